@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"file-store/internal/merkle"
+	"file-store/internal/p2p"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tombstoneEntryPrefix starts the entries of tombstones in the Merkle tree of the files held, which no checksum starts with
+const tombstoneEntryPrefix = "deleted@"
+
+// runAntiEntropy syncs the files held with those of a random connected peer every AntiEntropyInterval. A replica that missed
+// a STORE, because it was partitioned off or the message was lost, is repaired by the next sync with a peer holding the file.
+func (s *Store) runAntiEntropy() {
+	s.indexLocalFiles()
+	ticker := time.NewTicker(s.StoreOpts.AntiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.antiEntropyRound()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// antiEntropyRound runs a single round of anti-entropy, with a random live member
+func (s *Store) antiEntropyRound() {
+	if s.MetadataDB == nil {
+		return
+	}
+	members := s.Members.Members()
+	if len(members) == 0 {
+		return
+	}
+	addr := members[rand.Intn(len(members))].Addr
+
+	ctx, cancel := context.WithTimeout(context.Background(), util.AntiEntropySyncTimeout)
+	defer cancel()
+	if err := s.syncWithPeer(ctx, addr); err != nil {
+		log.Printf("Error while syncing with %s: %v", addr, err)
+	}
+}
+
+// indexLocalFiles records the metadata of the files in storage that have none, e.g, the ones stored before it was recorded
+func (s *Store) indexLocalFiles() {
+	if s.MetadataDB == nil {
+		return
+	}
+	files, err := s.listFileMetadata()
+	if err != nil {
+		log.Println("Error while listing file metadata:", err)
+		return
+	}
+	keys, err := s.listLocalKeys()
+	if err != nil {
+		log.Println("Error while listing local files:", err)
+		return
+	}
+	for _, key := range keys {
+		if _, recorded := files[key]; recorded {
+			continue
+		}
+		if err := s.indexLocalFile(key); err != nil {
+			log.Printf("Error while indexing %s: %v", key, err)
+		}
+	}
+}
+
+// indexLocalFile records the metadata of the file of key in storage, as of when it was last written
+func (s *Store) indexLocalFile(key string) error {
+	fd, err := s.handleFileOpen(key)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, fd); err != nil {
+		return err
+	}
+	return s.recordFileMetadata(key, FileMetadata{Checksum: hex.EncodeToString(checksum.Sum(nil)), Size: info.Size(), ModifiedAt: info.ModTime()})
+}
+
+// syncWithPeer compares the Merkle tree of the files held with the one of the peer listening on addr, descending from the root
+// into the subtrees whose hashes differ, and then exchanges the entries of the leaves that differ. Every file either side is
+// missing, or holds an older version of, is pushed to it by the other side. Only the files that both sides own are compared.
+func (s *Store) syncWithPeer(ctx context.Context, addr string) error {
+	peer, err := s.connectToPeer(ctx, addr)
+	if err != nil {
+		return err
+	}
+	// Buckets are synced first, so that the files of the ones deleted meanwhile are dropped rather than synced
+	if err := s.exchangeBuckets(ctx, addr); err != nil {
+		log.Printf("Couldn't sync buckets with %s: %v", addr, err)
+	}
+	files, err := s.listFileMetadata()
+	if err != nil {
+		return err
+	}
+	files = s.sharedFiles(files, addr)
+	tree := merkle.Build(fileChecksums(files))
+
+	var leaves []int
+	for nodes := []int{merkle.Root}; len(nodes) > 0; {
+		var next []int
+		for start := 0; start < len(nodes); start += util.AntiEntropyNodesPerCall {
+			batch := nodes[start:min(start+util.AntiEntropyNodesPerCall, len(nodes))]
+			reply, err := s.callSync(ctx, peer, p2p.MESSAGE_SYNC_TREE_CONTROL_COMMAND, map[string]string{
+				"nodes":       merkle.EncodeNodes(batch),
+				"sender_addr": s.normalizedListenAddress(),
+			})
+			if err != nil {
+				return err
+			}
+			hashes, err := merkle.DecodeHashes(reply["hashes"], len(batch))
+			if err != nil {
+				return fmt.Errorf("invalid SYNC_RESPONSE: %w", err)
+			}
+			for i, node := range batch {
+				switch {
+				case tree.Hash(node) == hashes[i]:
+				case merkle.IsLeaf(node):
+					leaves = append(leaves, node)
+				default:
+					next = append(next, merkle.Children(node)...)
+				}
+			}
+		}
+		nodes = next
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+	log.Printf("%d leaves differ from those of %s", len(leaves), peer)
+
+	// The leaves are exchanged in batches, so that their entries fit in a message
+	for len(leaves) > 0 {
+		var (
+			batch   []int
+			entries = make(map[string]FileMetadata)
+		)
+		for len(leaves) > 0 && (len(batch) == 0 || len(entries) < util.AntiEntropyKeysPerCall) {
+			for key := range tree.Entries(leaves[0]) {
+				entries[key] = files[key]
+			}
+			batch, leaves = append(batch, leaves[0]), leaves[1:]
+		}
+		encoded, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		reply, err := s.callSync(ctx, peer, p2p.MESSAGE_SYNC_KEYS_CONTROL_COMMAND, map[string]string{
+			"leaves":      merkle.EncodeNodes(batch),
+			"entries":     string(encoded),
+			"sender_addr": s.normalizedListenAddress(),
+		})
+		if err != nil {
+			return err
+		}
+		var remote map[string]FileMetadata
+		if err := json.Unmarshal([]byte(reply["entries"]), &remote); err != nil {
+			return fmt.Errorf("invalid SYNC_RESPONSE: %w", err)
+		}
+		s.pushNewerFiles(entries, remote, peer)
+	}
+	return nil
+}
+
+// handleSyncTree answers a SYNC_TREE from fromPeer with the hashes of the requested nodes of the Merkle tree of the files held
+func (s *Store) handleSyncTree(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	nodes, err := merkle.DecodeNodes(payload.Args["nodes"])
+	if err != nil || len(nodes) == 0 {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid nodes for SYNC_TREE Control Message %s", fromPeer.String())
+	}
+	if s.MetadataDB == nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "no metadata DB on %s", s.StoreOpts.ListenAddress)
+	}
+	files, err := s.listFileMetadata()
+	if err != nil {
+		return err
+	}
+	tree := merkle.Build(fileChecksums(s.sharedFiles(files, senderAddr(payload, fromPeer))))
+	hashes := make([]string, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = tree.Hash(node)
+	}
+	return s.replyToPeer(payload, constructSyncResponse(map[string]string{"hashes": merkle.EncodeHashes(hashes)}), fromPeer)
+}
+
+// handleSyncKeys answers a SYNC_KEYS from fromPeer with the entries of the requested leaves of the Merkle tree of the files held,
+// and pushes to fromPeer the files of those leaves that it is missing, or holds an older version of, in the background
+func (s *Store) handleSyncKeys(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	leaves, err := merkle.DecodeNodes(payload.Args["leaves"])
+	if err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid leaves for SYNC_KEYS Control Message %s", fromPeer.String())
+	}
+	var remote map[string]FileMetadata
+	if err := json.Unmarshal([]byte(payload.Args["entries"]), &remote); err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid entries for SYNC_KEYS Control Message %s: %v", fromPeer.String(), err)
+	}
+	if s.MetadataDB == nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "no metadata DB on %s", s.StoreOpts.ListenAddress)
+	}
+	files, err := s.listFileMetadata()
+	if err != nil {
+		return err
+	}
+	files = s.sharedFiles(files, senderAddr(payload, fromPeer))
+	tree := merkle.Build(fileChecksums(files))
+	entries := make(map[string]FileMetadata)
+	for _, leaf := range leaves {
+		if !merkle.IsLeaf(leaf) {
+			return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid leaves for SYNC_KEYS Control Message %s", fromPeer.String())
+		}
+		for key := range tree.Entries(leaf) {
+			entries[key] = files[key]
+		}
+	}
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	go s.pushNewerFiles(entries, remote, fromPeer)
+	return s.replyToPeer(payload, constructSyncResponse(map[string]string{"entries": string(encoded)}), fromPeer)
+}
+
+// pushNewerFiles pushes to toPeer every version of the files of local that remote, the entries toPeer holds, is missing or holds
+// an older version of. Siblings are pushed along with the current versions, so that toPeer learns of the conflict too.
+func (s *Store) pushNewerFiles(local map[string]FileMetadata, remote map[string]FileMetadata, toPeer p2p.Peer) {
+	for key, metadata := range local {
+		var theirs *FileMetadata
+		if remoteMetadata, exists := remote[key]; exists {
+			theirs = &remoteMetadata
+		}
+		for _, version := range metadata.versions() {
+			if !version.newerThan(theirs) {
+				continue
+			}
+			log.Printf("Repairing the replica of %s on %s", key, toPeer)
+			if err := s.pushFileToPeer(key, version, toPeer); err != nil {
+				log.Printf("Error while repairing the replica of %s on %s: %v", key, toPeer, err)
+			}
+		}
+	}
+}
+
+// pushFileToPeer replicates the given version of the stored file of key to toPeer, like handleStoreFile does to every peer. A
+// tombstone is replicated as a DELETE, rather than the content it replaced.
+func (s *Store) pushFileToPeer(key string, version FileMetadata, toPeer p2p.Peer) error {
+	if version.deleted() {
+		return s.sendMessageToPeer(constructDeleteMessage(key, version), toPeer)
+	}
+	if version.Size > util.MaxAllowedDataPayloadSize {
+		return s.streamVersionToPeer(key, version.Checksum, upload.NewSessionID(), 0, toPeer)
+	}
+	fd, version, err := s.openVersion(key, version.Checksum)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return err
+	}
+	return s.sendMessageToPeer(withVersionArgs(p2p.ConstructDataMessage(key, data), version), toPeer)
+}
+
+// callSync sends a SYNC_TREE or SYNC_KEYS request with the given args to peer, and waits for the args of its SYNC_RESPONSE
+func (s *Store) callSync(ctx context.Context, peer p2p.Peer, command p2p.ControlMessage, args map[string]string) (map[string]string, error) {
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: command,
+			Args:    args,
+		},
+	}
+	reply, err := s.Transport.Call(ctx, peer, msg)
+	if err != nil {
+		return nil, err
+	}
+	payload, isControl := reply.Payload.(p2p.ControlPayload)
+	if !isControl || payload.Command != p2p.MESSAGE_SYNC_RESPONSE_CONTROL_COMMAND {
+		return nil, fmt.Errorf("unexpected %s reply to %s from %s", reply.Command(), command, peer)
+	}
+	return payload.Args, nil
+}
+
+// constructSyncResponse constructs and returns a MESSAGE_SYNC_RESPONSE_CONTROL_COMMAND message with the given args
+func constructSyncResponse(args map[string]string) p2p.Message {
+	return p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_SYNC_RESPONSE_CONTROL_COMMAND,
+			Args:    args,
+		},
+	}
+}
+
+// sharedFiles returns the entries of files that both this Store and the node listening on addr own, which are the ones the two
+// of them sync
+func (s *Store) sharedFiles(files map[string]FileMetadata, addr string) map[string]FileMetadata {
+	nodes := s.placementNodes(false)
+	shared := make(map[string]FileMetadata)
+	for key, metadata := range files {
+		if s.isOwnedBy(key, nodes, s.normalizedListenAddress(), addr) {
+			shared[key] = metadata
+		}
+	}
+	return shared
+}
+
+// senderAddr returns the listen address of fromPeer, which sent the given payload, falling back to its remote address
+func senderAddr(payload *p2p.ControlPayload, fromPeer p2p.Peer) string {
+	if addr, exists := payload.Args["sender_addr"]; exists {
+		return addr
+	}
+	return fromPeer.String()
+}
+
+// fileChecksums returns the key→checksum entries of files, which the Merkle tree of the files held is built over. The checksums
+// of the siblings of a file are part of its entry, so that replicas missing one of them differ. Tombstones have an entry too,
+// which tells when the file was deleted, so that the replicas that still hold the file differ.
+func fileChecksums(files map[string]FileMetadata) map[string]string {
+	checksums := make(map[string]string, len(files))
+	for key, metadata := range files {
+		if metadata.deleted() {
+			checksums[key] = tombstoneEntryPrefix + metadata.DeletedAt.UTC().Format(time.RFC3339Nano)
+			continue
+		}
+		entry := []string{metadata.Checksum}
+		for _, sibling := range metadata.Siblings {
+			entry = append(entry, sibling.Checksum)
+		}
+		sort.Strings(entry[1:])
+		checksums[key] = strings.Join(entry, ",")
+	}
+	return checksums
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"file-store/internal/vclock"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// syncNodes has node i run a round of anti-entropy with node j
+func (c *testCluster) syncNodes(i, j int) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(c.t, c.Nodes[i].syncWithPeer(ctx, clusterNodeAddr(j)))
+}
+
+func TestFileMetadataNewerThan(t *testing.T) {
+	now := time.Now()
+	older := FileMetadata{Checksum: "a", ModifiedAt: now}
+	newer := FileMetadata{Checksum: "b", ModifiedAt: now.Add(time.Second)}
+
+	assert.True(t, older.newerThan(nil))
+	assert.True(t, newer.newerThan(&older))
+	assert.False(t, older.newerThan(&newer))
+	// The same content is never newer, whenever it was written
+	assert.False(t, FileMetadata{Checksum: "a", ModifiedAt: now.Add(time.Hour)}.newerThan(&older))
+	// Writes at the same time are ordered the same way on every node
+	tied := FileMetadata{Checksum: "b", ModifiedAt: now}
+	assert.True(t, tied.newerThan(&older))
+	assert.False(t, older.newerThan(&tied))
+
+	// Versioned files are ordered by their clocks instead, and conflicting ones are pushed unless they are held as siblings
+	first := FileMetadata{Checksum: "a", ModifiedAt: now.Add(time.Hour), Clock: vclock.Clock{"x": 1}}
+	second := FileMetadata{Checksum: "b", ModifiedAt: now, Clock: vclock.Clock{"x": 2}}
+	conflicting := FileMetadata{Checksum: "c", ModifiedAt: now, Clock: vclock.Clock{"x": 1, "y": 1}}
+	assert.True(t, second.newerThan(&first))
+	assert.False(t, first.newerThan(&second))
+	assert.True(t, conflicting.newerThan(&second))
+	second.Siblings = []FileMetadata{conflicting}
+	assert.False(t, conflicting.newerThan(&second))
+}
+
+func TestAntiEntropyRepairsMissedReplicas(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4*1024)
+
+	// Files stored while node 2 is partitioned off never reach it
+	cluster.Isolate(2)
+	for i := 0; i < 5; i++ {
+		cluster.Store(0, fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("content of key %d", i)))
+	}
+	cluster.Store(0, "large", large)
+	cluster.WaitStored("large", 1)
+	// The writes held for it expired, so it isn't handed them off when it is back
+	assert.Nil(t, cluster.Nodes[0].Hints.RemoveOwner(clusterNodeAddr(2)))
+	cluster.Rejoin(2)
+	assert.False(t, cluster.Nodes[2].existsInStorage("key-0"))
+
+	// Syncing from either side repairs the replicas it missed, whatever their size
+	cluster.syncNodes(2, 0)
+	cluster.WaitStored("large", 2)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		cluster.WaitStored(key, 2)
+		data, err := cluster.Nodes[2].handleFileRead(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("content of key %d", i)), data)
+	}
+	stored, err := cluster.Nodes[2].handleFileRead("large")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(large, stored))
+
+	// A node that lost its replica gets it back from the next peer it syncs with
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("key-3"))
+	cluster.syncNodes(2, 1)
+	cluster.WaitStored("key-3", 1)
+}
+
+func TestAntiEntropyConvergesOnTheLastWrite(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster.Store(0, "key", []byte("first"))
+	cluster.WaitStored("key", 1)
+
+	// Both sides of a partition write the key, and the write made last is served by both once it heals, while the other one is
+	// kept as its sibling
+	cluster.Isolate(1)
+	cluster.Store(0, "key", []byte("second"))
+	cluster.Store(1, "key", []byte("third"))
+	assert.Nil(t, cluster.Nodes[0].Hints.RemoveOwner(clusterNodeAddr(1)))
+	assert.Nil(t, cluster.Nodes[1].Hints.RemoveOwner(clusterNodeAddr(0)))
+	cluster.Rejoin(1)
+	cluster.syncNodes(0, 1)
+	assert.Eventually(t, func() bool {
+		data, err := cluster.Nodes[0].handleFileRead("key")
+		return err == nil && bytes.Equal(data, []byte("third"))
+	}, 5*time.Second, 10*time.Millisecond)
+	data, err := cluster.Nodes[1].handleFileRead("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("third"), data)
+	cluster.waitVersions(0, "key", 2)
+	cluster.waitVersions(1, "key", 2)
+
+	// Once converged, the trees match, and syncing again transfers nothing
+	files0, err := cluster.Nodes[0].listFileMetadata()
+	assert.Nil(t, err)
+	files1, err := cluster.Nodes[1].listFileMetadata()
+	assert.Nil(t, err)
+	assert.Equal(t, fileChecksums(files0), fileChecksums(files1))
+	cluster.syncNodes(1, 0)
+	after, err := cluster.Nodes[0].listFileMetadata()
+	assert.Nil(t, err)
+	assert.Equal(t, files0["key"].ModifiedAt, after["key"].ModifiedAt)
+}
+
+func TestAntiEntropyReplicatesDeletes(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	cluster.Store(0, "key", []byte("content"))
+	cluster.WaitStored("key", 1, 2)
+
+	// The key is deleted on node 0 alone, and the tombstone it keeps is synced to the replicas, rather than the replicas pushing
+	// the file back to it
+	assert.Nil(t, cluster.Nodes[0].deleteFile("key"))
+	assert.ErrorIs(t, cluster.Nodes[0].deleteFile("key"), os.ErrNotExist)
+	cluster.syncNodes(1, 0)
+	cluster.WaitDeleted("key", 1)
+	cluster.syncNodes(0, 2)
+	cluster.WaitDeleted("key", 2)
+	cluster.syncNodes(2, 1)
+	assert.Never(t, func() bool {
+		return cluster.Nodes[0].existsInStorage("key") || cluster.Nodes[1].existsInStorage("key") || cluster.Nodes[2].existsInStorage("key")
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	for i := range cluster.Nodes {
+		_, err := cluster.Nodes[i].handleGetFile("key", true)
+		assert.ErrorIs(t, err, os.ErrNotExist, "node %d", i)
+	}
+
+	// A write made after the delete brings the key back everywhere
+	cluster.Store(1, "key", []byte("written again"))
+	cluster.WaitStored("key", 0, 2)
+	cluster.syncNodes(0, 2)
+	data, err := cluster.Nodes[0].handleFileRead("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("written again"), data)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"file-store/internal/audit"
+	"file-store/internal/bucket"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Actors that aren't principals, for the entries of the audit log
+const (
+	anonymousActor       = "anonymous"
+	unauthenticatedActor = "unauthenticated"
+	peerActorPrefix      = "peer:"
+	// Files that a node deletes on its own are recorded as deleted by the system, for the reason they were deleted for
+	expiryActor  = "system:ttl"
+	erasureActor = "system:erasure"
+)
+
+// recordAudit appends e to the audit log as an operation made on this node. The operation it records has already been made by
+// then, so an error appending is only logged.
+func (s *Store) recordAudit(e audit.Entry) {
+	e.Node = s.normalizedListenAddress()
+	if _, err := s.Audit.Append(e); err != nil {
+		log.Printf("Error while appending %s of %q to the audit log: %v", e.Operation, e.Key, err)
+	}
+}
+
+// auditResult returns the result of an operation that failed with err, or audit.ResultOK if it succeeded
+func auditResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return audit.ResultOK
+}
+
+// peerActor returns the actor that operations of fromPeer are recorded as
+func (s *Store) peerActor(fromPeer p2p.Peer) string {
+	return peerActorPrefix + s.peerListenAddr(fromPeer)
+}
+
+// auditPeer records an operation that fromPeer made on this node, which failed with err, if it did
+func (s *Store) auditPeer(op audit.Operation, key string, fromPeer p2p.Peer, size int64, err error) {
+	s.recordAudit(audit.Entry{
+		Actor:     s.peerActor(fromPeer),
+		Operation: op,
+		Key:       key,
+		Result:    auditResult(err),
+		Bytes:     size,
+	})
+}
+
+// deleteAudited deletes the file of key held here with del on behalf of actor, and records it in the audit log, unless there was
+// no file to delete
+func (s *Store) deleteAudited(key string, actor string, del func(key string) error) error {
+	err := del(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.recordAudit(audit.Entry{Actor: actor, Operation: audit.Delete, Key: key, Result: auditResult(err)})
+	return err
+}
+
+// requestedLength returns how many bytes a request for a part of a file asked for, or 0 if it didn't say
+func requestedLength(payload *p2p.ControlPayload) int64 {
+	length, _ := strconv.ParseInt(payload.Args["length"], 10, 64)
+	return length
+}
+
+// auditedResponseWriter keeps the status and the size of a response, for the audit log
+type auditedResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *auditedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// countingReadCloser counts the bytes read from a request body, for the audit log
+type countingReadCloser struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	return n, err
+}
+
+// requestActor returns who a request was made by: the principal its token was issued to, or anonymousActor if requests aren't
+// authenticated
+func (s *Store) requestActor(r *http.Request) string {
+	if !s.authEnabled() {
+		return anonymousActor
+	}
+	p, err := s.authenticate(r)
+	if err != nil {
+		return unauthenticatedActor
+	}
+	return p.Name
+}
+
+// audited wraps next so that every request it serves is recorded in the audit log as op over the qualified key that keyOf
+// returns, or over no key in particular if keyOf is nil. The bytes recorded are those received for stores, and those sent
+// otherwise. It wraps the handlers authorizing requests, so that requests turned down are recorded too.
+func (s *Store) audited(op audit.Operation, keyOf func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The key is looked up first, since upload sessions are gone once they complete
+		key := ""
+		if keyOf != nil {
+			key = keyOf(r)
+		}
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &auditedResponseWriter{ResponseWriter: w}
+		next(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		result := audit.ResultOK
+		if status >= http.StatusBadRequest {
+			result = fmt.Sprintf("%d %s", status, http.StatusText(status))
+		}
+		size := recorder.written
+		if op == audit.Store {
+			size = body.read
+		}
+		s.recordAudit(audit.Entry{Actor: s.requestActor(r), Operation: op, Key: key, Result: result, Bytes: size})
+	}
+}
+
+// handleQueryAudit serves the entries of the audit log of this node that the from, to, key and limit query parameters select,
+// oldest first. from and to are RFC 3339 times, and key is qualified with the bucket query parameter.
+func (s *Store) handleQueryAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := audit.Filter{Limit: util.DefaultAuditQueryLimit}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("key") {
+		filter.Key = bucket.Qualify(query.Get("bucket"), query.Get("key"))
+	}
+	entries, err := s.Audit.Query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleVerifyAudit serves whether the audit log of this node checks out, along with how many entries it holds
+func (s *Store) handleVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	count, err := s.Audit.Verify()
+	if err != nil && !errors.Is(err, audit.ErrTampered) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verification := struct {
+		Entries int    `json:"entries"`
+		Valid   bool   `json:"valid"`
+		Error   string `json:"error,omitempty"`
+	}{Entries: count, Valid: err == nil}
+	if err != nil {
+		verification.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, verification)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"file-store/internal/acl"
+	"file-store/internal/audit"
+	"file-store/internal/bucket"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRecordsClientAndPeerOperations(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	node := cluster.Nodes[0]
+	node.StoreOpts.AdminToken = "admin-token"
+	handler := node.newHTTPHandler()
+	serve := func(token string, r *http.Request) *httptest.ResponseRecorder {
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	since := time.Now().Add(-time.Second)
+
+	// Client requests are recorded along with who made them, whether they were let through or not
+	r := newTusRequest(http.MethodPost, "/uploads", nil)
+	r.Header.Set("Upload-Length", "4")
+	r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte("cat.png")))
+	w := serve("admin-token", r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	r = newTusRequest(http.MethodPatch, w.Header().Get("Location"), []byte("meow"))
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", "0")
+	assert.Equal(t, http.StatusNoContent, serve("admin-token", r).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("", httptest.NewRequest(http.MethodDelete, "/namespace/cat.png", nil)).Code)
+
+	// Replicas written by peers, and files fetched by them, are recorded as operations of the peer
+	cluster.WaitStored("cat.png", 1)
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("cat.png"))
+	data, err := cluster.Nodes[1].handleGetFile("cat.png", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "meow", string(data))
+
+	query := func(v url.Values) []audit.Entry {
+		w := serve("admin-token", httptest.NewRequest(http.MethodGet, "/audit?"+v.Encode(), nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var entries []audit.Entry
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&entries))
+		return entries
+	}
+	// Entries are only told apart by who made them and what they did, since peers may sync with node 0 meanwhile
+	type recorded struct {
+		Actor     string
+		Operation audit.Operation
+		Result    string
+		Bytes     int64
+	}
+	var client []recorded
+	assert.Eventually(t, func() bool {
+		client = nil
+		fetched := false
+		for _, e := range query(url.Values{"key": {"cat.png"}, "from": {since.Format(time.RFC3339)}}) {
+			assert.Equal(t, clusterNodeAddr(0), e.Node)
+			if strings.HasPrefix(e.Actor, peerActorPrefix) {
+				fetched = fetched || (e.Operation == audit.Get && e.Result == audit.ResultOK && e.Bytes == 4)
+			} else {
+				client = append(client, recorded{e.Actor, e.Operation, e.Result, e.Bytes})
+			}
+		}
+		return fetched
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []recorded{
+		{"root", audit.Store, audit.ResultOK, 0},
+		{"root", audit.Store, audit.ResultOK, 4},
+		{"unauthenticated", audit.Delete, "401 Unauthorized", int64(len(acl.ErrUnauthenticated.Error()) + 1)},
+	}, client)
+
+	replicated, err := cluster.Nodes[1].Audit.Query(audit.Filter{Key: "cat.png"})
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, replicated) {
+		assert.Equal(t, audit.Store, replicated[0].Operation)
+		assert.Equal(t, peerActorPrefix+clusterNodeAddr(0), replicated[0].Actor)
+	}
+
+	// Entries are queried by time too, and only by admins
+	assert.Empty(t, query(url.Values{"key": {"cat.png"}, "to": {since.Format(time.RFC3339)}}))
+	assert.Equal(t, http.StatusUnauthorized, serve("", httptest.NewRequest(http.MethodGet, "/audit", nil)).Code)
+
+	w = serve("admin-token", httptest.NewRequest(http.MethodGet, "/audit/verify", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"valid":true`)
+}
+
+func TestAuditLogRecordsStreamedTransfers(t *testing.T) {
+	// recorded waits until node holds an entry of op over key made by the peer listening on peerAddr, and returns it
+	recorded := func(node *Store, op audit.Operation, key string, peerAddr string) audit.Entry {
+		var found audit.Entry
+		assert.Eventually(t, func() bool {
+			entries, err := node.Audit.Query(audit.Filter{Key: key})
+			assert.Nil(t, err)
+			for _, e := range entries {
+				if e.Operation == op && e.Actor == peerActorPrefix+peerAddr {
+					found = e
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+		return found
+	}
+
+	// Files over a DataMessage are streamed to their replicas, and the chunks of swarm fetches are found through the manifest
+	cluster := startTestCluster(&testCluster{t: t, configure: func(opts *StoreOpts) {
+		opts.SwarmFetch = true
+	}}, 2)
+	data := []byte(strings.Repeat("meow", 1024))
+	cluster.Store(0, "cat.png", data)
+	cluster.WaitStored("cat.png", 1)
+	e := recorded(cluster.Nodes[1], audit.Store, "cat.png", clusterNodeAddr(0))
+	assert.Equal(t, audit.ResultOK, e.Result)
+	assert.Equal(t, int64(len(data)), e.Bytes)
+
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("cat.png"))
+	fetched, err := cluster.Nodes[1].handleGetFile("cat.png", true)
+	assert.Nil(t, err)
+	assert.Equal(t, data, fetched)
+	// The page of the manifest is recorded apart from the chunk, which is the only one of so small a file
+	var gets []int64
+	assert.Eventually(t, func() bool {
+		gets = nil
+		entries, err := cluster.Nodes[0].Audit.Query(audit.Filter{Key: "cat.png"})
+		assert.Nil(t, err)
+		for _, e := range entries {
+			if e.Operation == audit.Get && e.Actor == peerActorPrefix+clusterNodeAddr(1) && e.Result == audit.ResultOK {
+				gets = append(gets, e.Bytes)
+			}
+		}
+		return len(gets) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []int64{0, int64(len(data))}, gets)
+
+	// Shards are streamed to the nodes they are placed on
+	erasureCoded := newErasureCodedCluster(t, 3, 1, 1)
+	erasureCoded.Store(0, "archive", data)
+	for i, indexes := range erasureCoded.shardHolders("archive") {
+		if i != 0 {
+			assert.Len(t, indexes, 1)
+			e := recorded(erasureCoded.Nodes[i], audit.Store, "archive", clusterNodeAddr(0))
+			assert.Equal(t, audit.ResultOK, e.Result, fmt.Sprintf("node %d", i))
+			assert.Equal(t, int64(len(data)), e.Bytes, fmt.Sprintf("node %d", i))
+		}
+	}
+}
+
+func TestAuditLogRecordsDeletesNodesMake(t *testing.T) {
+	// deletes returns the actors that deleted key on node, as recorded there
+	deletes := func(node *Store, key string) []string {
+		entries, err := node.Audit.Query(audit.Filter{Key: key})
+		assert.Nil(t, err)
+		var actors []string
+		for _, e := range entries {
+			if e.Operation == audit.Delete && e.Result == audit.ResultOK {
+				actors = append(actors, e.Actor)
+			}
+		}
+		return actors
+	}
+
+	// Files expire on their own
+	store := setupUploadStore(t)
+	_, err := store.createBucket(bucket.Bucket{Name: "tmp", TTLSeconds: 60})
+	assert.Nil(t, err)
+	stale := bucket.Qualify("tmp", "stale")
+	assert.Nil(t, store.handleStoreFile(stale, bytes.NewReader([]byte("stale"))))
+	metadata, err := store.getFileMetadata(stale)
+	assert.Nil(t, err)
+	metadata.ModifiedAt = time.Now().Add(-2 * time.Minute)
+	assert.Nil(t, store.recordFileMetadata(stale, *metadata))
+	store.expireBucketFiles()
+	assert.Equal(t, []string{expiryActor}, deletes(store, stale))
+
+	// The files of a deleted bucket are deleted on behalf of whoever deleted it, and on the other nodes, on behalf of the peer
+	// they learned it from
+	cluster := newTestCluster(t, 2)
+	_, err = cluster.Nodes[0].createBucket(bucket.Bucket{Name: "team-a"})
+	assert.Nil(t, err)
+	key := bucket.Qualify("team-a", "cat.png")
+	cluster.Store(0, key, []byte("meow"))
+	cluster.WaitStored(key, 0, 1)
+	assert.Nil(t, cluster.Nodes[1].deleteBucket("team-a", "alice"))
+	assert.Equal(t, []string{"alice"}, deletes(cluster.Nodes[1], key))
+	assert.Eventually(t, func() bool {
+		actors := deletes(cluster.Nodes[0], key)
+		return len(actors) == 1 && actors[0] == peerActorPrefix+clusterNodeAddr(1)
+	}, 5*time.Second, 10*time.Millisecond)
+}
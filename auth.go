@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"file-store/internal/acl"
+	"file-store/internal/bucket"
+	"file-store/internal/util"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrACLDisabled = errors.New("principals need a metadata DB")
+	// ErrNoClusterSecret is returned for a node that authenticates requests to the HTTP API, but lets any peer connect to it. Peers
+	// store, fetch and list files without a token, so anyone could get around the tokens through the peer port.
+	ErrNoClusterSecret = errors.New("-admin-token needs -cluster-secret, or anyone can connect to the peer port as a peer")
+)
+
+// principalContextKey is the key that the principal a request was made as is kept under, in the context of the request
+type principalContextKey struct{}
+
+// authEnabled reports whether requests to the HTTP API have to be made with a token
+func (s *Store) authEnabled() bool {
+	return s.StoreOpts.AdminToken != ""
+}
+
+// checkPeerAuth returns ErrNoClusterSecret if args enable authentication without a cluster secret for peers to handshake with
+func checkPeerAuth(args util.CommandLineArgs) error {
+	if args.AdminToken != "" && args.ClusterSecret == "" {
+		return ErrNoClusterSecret
+	}
+	return nil
+}
+
+// authenticate returns the principal that the bearer token of r was issued to, or acl.Root for the admin token
+func (s *Store) authenticate(r *http.Request) (acl.Principal, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return acl.Principal{}, acl.ErrUnauthenticated
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.StoreOpts.AdminToken)) == 1 {
+		return acl.Root, nil
+	}
+	if s.ACL == nil {
+		return acl.Principal{}, acl.ErrUnauthenticated
+	}
+	return s.ACL.Authenticate(token)
+}
+
+// requestPrincipal returns the principal that r was made as, which is only known if authentication is enabled
+func requestPrincipal(r *http.Request) (acl.Principal, bool) {
+	p, ok := r.Context().Value(principalContextKey{}).(acl.Principal)
+	return p, ok
+}
+
+// authenticated wraps next so that it is only served to requests made with a valid token, which next can look the principal
+// of up with requestPrincipal
+func (s *Store) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() {
+			next(w, r)
+			return
+		}
+		p, err := s.authenticate(r)
+		if err != nil {
+			writeACLError(w, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p)))
+	}
+}
+
+// authorized wraps next so that it is only served to requests made as a principal with permission over the file whose qualified
+// key keyOf returns, or, if keyOf is nil, as an admin of the cluster
+func (s *Store) authorized(permission acl.Permission, keyOf func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return s.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := requestPrincipal(r); ok {
+			allowed := p.IsAdmin()
+			if keyOf != nil {
+				allowed = p.Can(permission, keyOf(r))
+			}
+			if !allowed {
+				writeACLError(w, fmt.Errorf("%w: %s may not %s this", acl.ErrForbidden, p.Name, permission))
+				return
+			}
+		}
+		next(w, r)
+	})
+}
+
+// bucketKey returns the qualified key that stands for the whole bucket a request is about, which a grant covers if it covers
+// every file of the bucket
+func bucketKey(r *http.Request) string {
+	return bucket.Qualify(r.PathValue("name"), "")
+}
+
+// createUploadKey returns the qualified key that a request starting an upload session is for, or "" if it names none
+func createUploadKey(r *http.Request) string {
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return ""
+	}
+	key, _ := uploadKey(metadata)
+	return key
+}
+
+// uploadSessionKey returns the qualified key of the upload session a request is about, or "" if there is no such session
+func (s *Store) uploadSessionKey(r *http.Request) string {
+	if s.Uploads == nil {
+		return ""
+	}
+	session, err := s.Uploads.Get(r.PathValue("id"))
+	if err != nil {
+		return ""
+	}
+	return session.Key
+}
+
+// writeACLError writes the HTTP status that err stands for, out of the errors of authentication, authorization and principal
+// management
+func writeACLError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, acl.ErrUnauthenticated):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="file-store"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, acl.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, acl.ErrInvalidPrincipal):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, acl.ErrNotFound), errors.Is(err, acl.ErrTokenNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, acl.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrACLDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleListPrincipals serves every principal, ordered by name
+func (s *Store) handleListPrincipals(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.ACL.Principals())
+}
+
+// handleCreatePrincipal creates the principal that the body describes, with its name, kind and grants
+func (s *Store) handleCreatePrincipal(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	var p acl.Principal
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, fmt.Sprintf("invalid principal: %v", err), http.StatusBadRequest)
+		return
+	}
+	created, err := s.ACL.CreatePrincipal(p)
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handleGetPrincipal serves a principal along with its grants
+func (s *Store) handleGetPrincipal(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	p, err := s.ACL.Principal(r.PathValue("name"))
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// handleDeletePrincipal deletes a principal, revoking every token of it
+func (s *Store) handleDeletePrincipal(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	if err := s.ACL.DeletePrincipal(r.PathValue("name")); err != nil {
+		writeACLError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListTokens serves the tokens of a principal, without their secrets
+func (s *Store) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	if _, err := s.ACL.Principal(r.PathValue("name")); err != nil {
+		writeACLError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.ACL.Tokens(r.PathValue("name")))
+}
+
+// issuedToken is a token as it is served once issued, which is the only time its secret is served
+type issuedToken struct {
+	acl.Token
+	Secret string `json:"token"`
+}
+
+// handleIssueToken issues a new token to a principal
+func (s *Store) handleIssueToken(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	secret, token, err := s.ACL.IssueToken(r.PathValue("name"))
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, issuedToken{Token: token, Secret: secret})
+}
+
+// handleRevokeToken revokes a token
+func (s *Store) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if s.ACL == nil {
+		writeACLError(w, ErrACLDisabled)
+		return
+	}
+	if err := s.ACL.RevokeToken(r.PathValue("id")); err != nil {
+		writeACLError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestsAreAuthorizedWithTokens(t *testing.T) {
+	store := setupUploadStore(t)
+	store.StoreOpts.AdminToken = "admin-token"
+	handler := store.newHTTPHandler()
+	serve := func(token string, method string, target string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	upload := func(token string, bucketName string, key string) *httptest.ResponseRecorder {
+		r := newTusRequest(http.MethodPost, "/uploads", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Upload-Length", "4")
+		r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte(key))+",bucket "+base64.StdEncoding.EncodeToString([]byte(bucketName)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Requests without a valid token are turned down, except for tus discovery
+	assert.Equal(t, http.StatusUnauthorized, serve("", http.MethodGet, "/buckets", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("guess", http.MethodGet, "/buckets", "").Code)
+	assert.Equal(t, http.StatusNoContent, serve("", http.MethodOptions, "/uploads", "").Code)
+
+	// The admin token sets up buckets and principals
+	for _, name := range []string{"photos", "logs"} {
+		assert.Equal(t, http.StatusCreated, serve("admin-token", http.MethodPost, "/buckets", `{"name": "`+name+`"}`).Code)
+	}
+	w := serve("admin-token", http.MethodPost, "/principals",
+		`{"name": "uploader", "kind": "service", "grants": [{"bucket": "photos", "prefix": "cats-", "permissions": ["read", "write"]}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusBadRequest, serve("admin-token", http.MethodPost, "/principals", `{"name": "nobody", "kind": "robot"}`).Code)
+	w = serve("admin-token", http.MethodPost, "/principals/uploader/tokens", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var issued issuedToken
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&issued))
+	assert.NotEmpty(t, issued.Secret)
+
+	// Principals may only do what they were granted, where they were granted it
+	w = upload(issued.Secret, "photos", "cats-tom.png")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	r := newTusRequest(http.MethodPatch, w.Header().Get("Location"), []byte("meow"))
+	r.Header.Set("Authorization", "Bearer "+issued.Secret)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, http.StatusForbidden, upload(issued.Secret, "photos", "dogs-rex.png").Code)
+	assert.Equal(t, http.StatusForbidden, upload(issued.Secret, "", "cats-tom.png").Code)
+	assert.Equal(t, http.StatusOK, serve(issued.Secret, http.MethodGet, "/siblings/cats-tom.png?bucket=photos", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(issued.Secret, http.MethodDelete, "/namespace/cats-tom.png?bucket=photos", "").Code)
+
+	// Buckets and cluster management are only shown to whom they concern
+	w = serve(issued.Secret, http.MethodGet, "/buckets", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"photos"`)
+	assert.NotContains(t, w.Body.String(), `"logs"`)
+	assert.Equal(t, http.StatusForbidden, serve(issued.Secret, http.MethodGet, "/buckets/logs", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(issued.Secret, http.MethodDelete, "/buckets/photos", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(issued.Secret, http.MethodPost, "/principals/uploader/tokens", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(issued.Secret, http.MethodGet, "/capacity", "").Code)
+
+	// Revoked tokens no longer authenticate
+	assert.Equal(t, http.StatusNoContent, serve("admin-token", http.MethodDelete, "/tokens/"+issued.ID, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(issued.Secret, http.MethodGet, "/buckets", "").Code)
+}
+
+func TestAuthNeedsAClusterSecret(t *testing.T) {
+	// Tokens only guard the HTTP API, so a node checking them has to keep peers that don't know the cluster secret out too
+	assert.ErrorIs(t, checkPeerAuth(util.CommandLineArgs{AdminToken: "admin-token"}), ErrNoClusterSecret)
+	assert.Nil(t, checkPeerAuth(util.CommandLineArgs{AdminToken: "admin-token", ClusterSecret: "secret"}))
+	assert.Nil(t, checkPeerAuth(util.CommandLineArgs{}))
+}
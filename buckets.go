@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"file-store/internal/acl"
+	"file-store/internal/bucket"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrBucketsDisabled is returned by bucket operations on a Store without a metadata DB
+var ErrBucketsDisabled = errors.New("buckets need a metadata DB")
+
+// bucketsArg is the arg of BUCKETS and BUCKETS_RESPONSE messages that holds the buckets of their sender, tombstones included
+const bucketsArg = "buckets"
+
+// bucketOf returns the bucket that the file of key is stored in, or nil for the default bucket. bucket.ErrNotFound is returned
+// if the bucket doesn't exist, or was deleted.
+func (s *Store) bucketOf(key string) (*bucket.Bucket, error) {
+	name, _ := bucket.Split(key)
+	if name == "" {
+		return nil, nil
+	}
+	if s.Buckets == nil {
+		return nil, fmt.Errorf("%w: %s: %v", bucket.ErrNotFound, name, ErrBucketsDisabled)
+	}
+	b, err := s.Buckets.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// replicationFactor returns how many nodes own the file of key, which is set by its bucket, if the bucket sets it and is known here
+func (s *Store) replicationFactor(key string) int {
+	if b, _ := s.bucketOf(key); b != nil && b.ReplicationFactor > 0 {
+		return b.ReplicationFactor
+	}
+	return s.StoreOpts.ReplicationFactor
+}
+
+// bucketPath returns the directory that the files of the bucket with the given name are stored under
+func (s *Store) bucketPath(name string) string {
+	return filepath.Join(s.StoreOpts.BaseStorageLocation, util.BucketsDirName, name)
+}
+
+// compresses reports whether the files of bucket b are compressed at rest
+func compresses(b *bucket.Bucket) bool {
+	return b != nil && b.Compression == bucket.GzipCompression
+}
+
+// compressContent returns a reader of the content read from r, gzip compressed. The reader has to be closed once done with, so
+// that the compression stops.
+func compressContent(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decodeContent returns the content of the file of key from data, as stored in its bucket, undoing the compression of the bucket
+func (s *Store) decodeContent(key string, data []byte) ([]byte, error) {
+	b, err := s.bucketOf(key)
+	if err != nil || !compresses(b) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress %s: %w", key, err)
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// decodeReader returns a reader of the content of the file of key read from r, as stored in its bucket, undoing the compression
+// of the bucket
+func (s *Store) decodeReader(key string, r io.Reader) (io.Reader, error) {
+	b, err := s.bucketOf(key)
+	if err != nil || !compresses(b) {
+		return r, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress %s: %w", key, err)
+	}
+	return zr, nil
+}
+
+// checkReplicaBucket returns a remote error for a replica of key, of the given version, that the bucket of key turns down, which
+// it does once the bucket was deleted, so that replicas in flight don't bring it back. Replicas that expired already are dropped
+// with errReplicaExpired.
+func (s *Store) checkReplicaBucket(key string, version *FileMetadata) error {
+	name, _ := bucket.Split(key)
+	if name == "" || s.Buckets == nil {
+		return nil
+	}
+	if s.Buckets.IsDeleted(name) {
+		return p2p.NewRemoteError(p2p.ErrorCodeNotFound, "bucket %s of %s was deleted", name, key)
+	}
+	if b, _ := s.bucketOf(key); b != nil && version != nil && b.TTL() > 0 && time.Since(version.ModifiedAt) > b.TTL() {
+		return errReplicaExpired
+	}
+	return nil
+}
+
+// errReplicaExpired is returned for replicas whose bucket expired them before they arrived
+var errReplicaExpired = errors.New("replica expired")
+
+// createBucket creates the bucket b, and lets every live member know of it
+func (s *Store) createBucket(b bucket.Bucket) (bucket.Bucket, error) {
+	if s.Buckets == nil {
+		return b, ErrBucketsDisabled
+	}
+	created, err := s.Buckets.Create(b)
+	if err != nil {
+		return created, err
+	}
+	log.Printf("Created bucket %s", created.Name)
+	s.broadcastBuckets()
+	return created, nil
+}
+
+// deleteBucket deletes the bucket with the given name along with the files of it held here, on behalf of actor, and lets every
+// live member know of it, so that they delete the files of it they hold as well
+func (s *Store) deleteBucket(name string, actor string) error {
+	if s.Buckets == nil {
+		return ErrBucketsDisabled
+	}
+	if _, err := s.Buckets.Delete(name); err != nil {
+		return err
+	}
+	log.Printf("Deleted bucket %s", name)
+	if err := s.purgeBucket(name, actor); err != nil {
+		log.Printf("Error while deleting the files of bucket %s: %v", name, err)
+	}
+	s.broadcastBuckets()
+	return nil
+}
+
+// purgeBucket deletes every file of the bucket with the given name held here, along with its metadata, on behalf of actor
+func (s *Store) purgeBucket(name string, actor string) error {
+	if s.MetadataDB != nil {
+		var keys []string
+		err := s.MetadataDB.ForEach(util.BucketMetadataBucketPrefix+name, func(key string, _ []byte) error {
+			keys = append(keys, bucket.Qualify(name, key))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := s.deleteAudited(key, actor, s.handleFileDelete); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Error while deleting %s: %v", key, err)
+			}
+		}
+		if err := s.MetadataDB.DeleteBucket(util.BucketMetadataBucketPrefix + name); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.bucketPath(name))
+}
+
+// mergeBuckets takes in the buckets that the peer known as actor encoded in the buckets arg of a message, and deletes the files
+// of the buckets that it learns were deleted on behalf of that peer
+func (s *Store) mergeBuckets(encoded string, actor string) error {
+	var buckets []bucket.Bucket
+	if err := json.Unmarshal([]byte(encoded), &buckets); err != nil {
+		return fmt.Errorf("invalid %s: %w", bucketsArg, err)
+	}
+	merged, err := s.Buckets.Merge(buckets)
+	for _, b := range merged {
+		if !b.Deleted() {
+			log.Printf("Learned of bucket %s", b.Name)
+			continue
+		}
+		log.Printf("Learned that bucket %s was deleted", b.Name)
+		if err := s.purgeBucket(b.Name, actor); err != nil {
+			log.Printf("Error while deleting the files of bucket %s: %v", b.Name, err)
+		}
+	}
+	return err
+}
+
+// encodeBuckets returns the buckets of this Store, tombstones included, as the buckets arg of a message
+func (s *Store) encodeBuckets() (string, error) {
+	encoded, err := json.Marshal(s.Buckets.All())
+	return string(encoded), err
+}
+
+// exchangeBuckets sends the buckets of this Store to the peer listening on addr, and merges the buckets it replies with
+func (s *Store) exchangeBuckets(ctx context.Context, addr string) error {
+	if s.Buckets == nil {
+		return nil
+	}
+	encoded, err := s.encodeBuckets()
+	if err != nil {
+		return err
+	}
+	reply, err := s.callPeer(ctx, addr, p2p.MESSAGE_BUCKETS_CONTROL_COMMAND, map[string]string{bucketsArg: encoded})
+	if err != nil {
+		return err
+	}
+	return s.mergeBuckets(reply[bucketsArg], peerActorPrefix+addr)
+}
+
+// broadcastBuckets exchanges buckets with every live member at once, and waits until every exchange is over. The members it
+// doesn't reach learn of the buckets with the next round of anti-entropy.
+func (s *Store) broadcastBuckets() {
+	var wg sync.WaitGroup
+	for _, member := range s.Members.Members() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), util.BucketExchangeTimeout)
+			defer cancel()
+			if err := s.exchangeBuckets(ctx, addr); err != nil {
+				log.Printf("Couldn't exchange buckets with %s: %v", addr, err)
+			}
+		}(member.Addr)
+	}
+	wg.Wait()
+}
+
+// handleBucketsRequest merges the buckets of fromPeer, and answers with the buckets of this Store in a BUCKETS_RESPONSE
+func (s *Store) handleBucketsRequest(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	if s.Buckets == nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "no metadata DB on %s", s.StoreOpts.ListenAddress)
+	}
+	if err := s.mergeBuckets(payload.Args[bucketsArg], s.peerActor(fromPeer)); err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid BUCKETS Control Message %s: %v", fromPeer.String(), err)
+	}
+	encoded, err := s.encodeBuckets()
+	if err != nil {
+		return err
+	}
+	return s.replyToPeer(payload, p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_BUCKETS_RESPONSE_CONTROL_COMMAND,
+			Args:    map[string]string{bucketsArg: encoded},
+		},
+	}, fromPeer)
+}
+
+// runBucketExpiry deletes the files held that the TTL of their bucket expired, every BucketExpiryInterval
+func (s *Store) runBucketExpiry() {
+	ticker := time.NewTicker(util.BucketExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expireBucketFiles()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// expireBucketFiles deletes the files held whose every version was written longer than the TTL of their bucket ago. Every replica
+// expires its copy on its own, which it does at the same time as the others, as the versions carry when they were written. The
+// tombstones of files deleted longer than the TTL ago are dropped, since any replica of those files is expired too.
+func (s *Store) expireBucketFiles() {
+	if s.Buckets == nil {
+		return
+	}
+	for _, b := range s.Buckets.List() {
+		if b.TTL() <= 0 {
+			continue
+		}
+		var expired, forgotten []string
+		err := s.MetadataDB.ForEach(util.BucketMetadataBucketPrefix+b.Name, func(key string, value []byte) error {
+			var metadata FileMetadata
+			if err := json.Unmarshal(value, &metadata); err != nil {
+				return err
+			}
+			for _, version := range metadata.versions() {
+				if time.Since(version.ModifiedAt) <= b.TTL() {
+					return nil
+				}
+			}
+			if metadata.deleted() {
+				forgotten = append(forgotten, bucket.Qualify(b.Name, key))
+			} else {
+				expired = append(expired, bucket.Qualify(b.Name, key))
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error while listing the files of bucket %s: %v", b.Name, err)
+		}
+		for _, key := range expired {
+			if err := s.deleteAudited(key, expiryActor, s.deleteFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Error while expiring %s: %v", key, err)
+				continue
+			}
+			log.Printf("Expired %s", key)
+		}
+		for _, key := range forgotten {
+			if err := s.forgetFileMetadata(key); err != nil {
+				log.Printf("Error while dropping the tombstone of %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// requestKey returns the qualified key that a request is about, from its key path value and its bucket query parameter, if any
+func requestKey(r *http.Request) string {
+	return bucket.Qualify(r.URL.Query().Get("bucket"), r.PathValue("key"))
+}
+
+// withValidKey rejects requests whose key, which keyOf returns, could name a file outside of the storage directory. The path
+// value of a key is decoded, so an escaped "/" doesn't keep its ".." segments from being caught.
+func withValidKey(keyOf func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := bucket.ValidateKey(keyOf(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeBucketError writes the HTTP status that err stands for, out of the errors of bucket operations
+func writeBucketError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, bucket.ErrInvalidName), errors.Is(err, bucket.ErrInvalidSettings):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, bucket.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, bucket.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrBucketsDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeJSON writes v as JSON with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error while writing response:", err)
+	}
+}
+
+// handleListBuckets serves the buckets that exist, ordered by name
+func (s *Store) handleListBuckets(w http.ResponseWriter, r *http.Request) {
+	if s.Buckets == nil {
+		writeBucketError(w, ErrBucketsDisabled)
+		return
+	}
+	buckets := s.Buckets.List()
+	// Principals are only shown the buckets they have files of
+	if p, ok := requestPrincipal(r); ok {
+		visible := make([]bucket.Bucket, 0, len(buckets))
+		for _, b := range buckets {
+			if p.CanSee(b.Name) {
+				visible = append(visible, b)
+			}
+		}
+		buckets = visible
+	}
+	writeJSON(w, http.StatusOK, buckets)
+}
+
+// handleCreateBucket creates the bucket that the body describes, with its name and settings
+func (s *Store) handleCreateBucket(w http.ResponseWriter, r *http.Request) {
+	var b bucket.Bucket
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, fmt.Sprintf("invalid bucket: %v", err), http.StatusBadRequest)
+		return
+	}
+	created, err := s.createBucket(b)
+	if err != nil {
+		writeBucketError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handleGetBucket serves a bucket along with its settings
+func (s *Store) handleGetBucket(w http.ResponseWriter, r *http.Request) {
+	if s.Buckets == nil {
+		writeBucketError(w, ErrBucketsDisabled)
+		return
+	}
+	if p, ok := requestPrincipal(r); ok && !p.CanSee(r.PathValue("name")) {
+		writeACLError(w, fmt.Errorf("%w: %s may not see bucket %s", acl.ErrForbidden, p.Name, r.PathValue("name")))
+		return
+	}
+	b, err := s.Buckets.Get(r.PathValue("name"))
+	if err != nil {
+		writeBucketError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+// handleDeleteBucket deletes a bucket along with every file in it
+func (s *Store) handleDeleteBucket(w http.ResponseWriter, r *http.Request) {
+	if err := s.deleteBucket(r.PathValue("name"), s.requestActor(r)); err != nil {
+		writeBucketError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
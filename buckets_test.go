@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"file-store/internal/bucket"
+	"file-store/internal/rebalance"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketsIsolateKeys(t *testing.T) {
+	store := setupUploadStore(t)
+	for _, name := range []string{"team-a", "team-b"} {
+		_, err := store.createBucket(bucket.Bucket{Name: name})
+		assert.Nil(t, err)
+	}
+
+	// The same key holds different files in every bucket
+	keys := []string{"report", bucket.Qualify("team-a", "report"), bucket.Qualify("team-b", "report")}
+	for _, key := range keys {
+		assert.Nil(t, store.handleStoreFile(key, bytes.NewReader([]byte("content of "+key))))
+	}
+	for _, key := range keys {
+		data, err := store.handleGetFile(key, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "content of "+key, string(data))
+	}
+	local, err := store.listLocalKeys()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, keys, local)
+	files, err := store.listFileMetadata()
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+
+	// Files can't be stored in buckets that don't exist
+	err = store.handleStoreFile(bucket.Qualify("team-c", "report"), bytes.NewReader([]byte("content")))
+	assert.ErrorIs(t, err, bucket.ErrNotFound)
+
+	// Deleting a bucket deletes its files, and leaves the others be
+	assert.Nil(t, store.deleteBucket("team-a", anonymousActor))
+	assert.False(t, store.existsInStorage(keys[1]))
+	assert.True(t, store.existsInStorage(keys[0]))
+	assert.True(t, store.existsInStorage(keys[2]))
+	_, err = os.Stat(store.bucketPath("team-a"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCompressedBucketsStoreLessThanTheyServe(t *testing.T) {
+	store := setupUploadStore(t)
+	_, err := store.createBucket(bucket.Bucket{Name: "logs", Compression: bucket.GzipCompression})
+	assert.Nil(t, err)
+
+	key := bucket.Qualify("logs", "app.log")
+	content := strings.Repeat("GET /index.html 200\n", 1000)
+	assert.Nil(t, store.handleStoreFile(key, strings.NewReader(content)))
+
+	stat, err := os.Stat(store.filePath(key))
+	assert.Nil(t, err)
+	assert.Less(t, stat.Size(), int64(len(content)))
+	data, err := store.handleGetFile(key, false)
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestBucketFilesExpireAfterTheirTTL(t *testing.T) {
+	store := setupUploadStore(t)
+	_, err := store.createBucket(bucket.Bucket{Name: "tmp", TTLSeconds: 60})
+	assert.Nil(t, err)
+	stale, fresh := bucket.Qualify("tmp", "stale"), bucket.Qualify("tmp", "fresh")
+	for _, key := range []string{stale, fresh, "kept"} {
+		assert.Nil(t, store.handleStoreFile(key, bytes.NewReader([]byte(key))))
+	}
+
+	// Only the files written longer than the TTL ago expire
+	metadata, err := store.getFileMetadata(stale)
+	assert.Nil(t, err)
+	metadata.ModifiedAt = time.Now().Add(-2 * time.Minute)
+	assert.Nil(t, store.recordFileMetadata(stale, *metadata))
+	store.expireBucketFiles()
+	assert.False(t, store.existsInStorage(stale))
+	assert.True(t, store.existsInStorage(fresh))
+	assert.True(t, store.existsInStorage("kept"))
+
+	// Replicas that expired on their way here are dropped
+	assert.ErrorIs(t, store.checkReplicaBucket(stale, metadata), errReplicaExpired)
+}
+
+func TestBucketsPropagateAcrossTheCluster(t *testing.T) {
+	cluster := newTestClusterWithReplication(t, 3, 3)
+	_, err := cluster.Nodes[0].createBucket(bucket.Bucket{Name: "single", ReplicationFactor: 1})
+	assert.Nil(t, err)
+	for _, node := range cluster.Nodes {
+		_, err := node.Buckets.Get("single")
+		assert.Nil(t, err)
+	}
+	cluster.waitPlaced()
+
+	// Files of the bucket are only replicated to their one owner, while the others are replicated to every node
+	addrs := []string{clusterNodeAddr(0), clusterNodeAddr(1), clusterNodeAddr(2)}
+	var key string
+	for i := 0; key == ""; i++ {
+		if candidate := bucket.Qualify("single", fmt.Sprintf("key-%d", i)); rebalance.Owners(candidate, addrs, 1)[0] == clusterNodeAddr(0) {
+			key = candidate
+		}
+	}
+	cluster.Store(0, key, []byte("content of "+key))
+	cluster.Store(0, "shared", []byte("content of shared"))
+	cluster.WaitStored("shared", 0, 1, 2)
+	assert.True(t, cluster.Nodes[0].existsInStorage(key))
+	assert.Never(t, func() bool {
+		return cluster.Nodes[1].existsInStorage(key) || cluster.Nodes[2].existsInStorage(key)
+	}, 200*time.Millisecond, 10*time.Millisecond)
+
+	// A bucket deleted on any node is deleted, along with its files, on every node
+	assert.Nil(t, cluster.Nodes[2].deleteBucket("single", anonymousActor))
+	assert.Eventually(t, func() bool {
+		return cluster.Nodes[0].Buckets.IsDeleted("single") && !cluster.Nodes[0].existsInStorage(key)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Error(t, cluster.Nodes[0].checkReplicaBucket(key, nil))
+}
+
+func TestBucketsAPI(t *testing.T) {
+	store := setupUploadStore(t)
+	handler := store.newHTTPHandler()
+	serve := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := serve(http.MethodPost, "/buckets", `{"name": "photos", "replication_factor": 2, "compression": "gzip"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created bucket.Bucket
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, 2, created.ReplicationFactor)
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPost, "/buckets", `{"name": "photos"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/buckets", `{"name": "Photos"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/buckets", `{"name": "logs", "compression": "zip"}`).Code)
+
+	w = serve(http.MethodGet, "/buckets", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listed []bucket.Bucket
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&listed))
+	assert.Equal(t, []string{"photos"}, []string{listed[0].Name})
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/buckets/photos", "").Code)
+
+	// Uploads name their bucket in Upload-Metadata
+	upload := func(name string) *httptest.ResponseRecorder {
+		r := newTusRequest(http.MethodPost, "/uploads", nil)
+		r.Header.Set("Upload-Length", "4")
+		r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte("cat.png"))+",bucket "+base64.StdEncoding.EncodeToString([]byte(name)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	w = upload("photos")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	r := newTusRequest(http.MethodPatch, w.Header().Get("Location"), []byte("meow"))
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.True(t, store.existsInStorage(bucket.Qualify("photos", "cat.png")))
+	assert.False(t, store.existsInStorage("cat.png"))
+	assert.Equal(t, http.StatusNotFound, upload("videos").Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/siblings/cat.png?bucket=photos", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/siblings/cat.png", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/buckets/photos", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/buckets/photos", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/buckets/photos", "").Code)
+	assert.False(t, store.existsInStorage(bucket.Qualify("photos", "cat.png")))
+}
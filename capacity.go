@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"file-store/internal/capacity"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrInsufficientStorage is returned for writes that the node they are made on has no room for
+var ErrInsufficientStorage = capacity.ErrInsufficientStorage
+
+// roomArg is the arg of HEARTBEAT and HEARTBEAT_ACK messages that advertises how many more bytes of files their sender has room for
+const roomArg = "room"
+
+// runCapacityScans finds out how many bytes the files stored take up every CapacityScanInterval, which the bytes written in
+// between are added to until the next scan
+func (s *Store) runCapacityScans() {
+	ticker := time.NewTicker(util.CapacityScanInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Capacity.Scan(); err != nil {
+			log.Println("Error while scanning the files stored:", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// roomArgs returns the args that advertise the room for files of this Store to its peers
+func (s *Store) roomArgs() map[string]string {
+	return map[string]string{roomArg: strconv.FormatInt(s.Capacity.Usage().Available, 10)}
+}
+
+// observeRoom records the room for files that peer advertised in the roomArg arg of a message, if it advertised any
+func observeRoom(arg string, peer p2p.Peer) {
+	room, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return
+	}
+	peer.Stats().ObserveRoom(room)
+}
+
+// peerHasRoom reports whether peer has room for size more bytes of files, as of its last advertisement. Peers that haven't
+// advertised any room yet are taken to have room, so that writes aren't held back until the first heartbeat.
+func peerHasRoom(peer p2p.Peer, size int64) bool {
+	room, advertised := peer.Stats().Room()
+	return !advertised || capacity.Usage{Available: room}.HasRoom(size)
+}
+
+// readerSize returns how many bytes are left to read from r, if that can be told without reading them, or 0 otherwise
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *digestReader:
+		return readerSize(r.r)
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		return max(info.Size()-offset, 0)
+	}
+	return 0
+}
+
+// checkReplicaRoom returns a remote error for a replica of key of size bytes that this Store has no room for
+func (s *Store) checkReplicaRoom(key string, size int64) error {
+	if err := s.Capacity.Check(size); err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "no room for %s: %v", key, err)
+	}
+	return nil
+}
+
+// checkReplicasRoom returns ErrInsufficientStorage if the file of key, of size bytes, can't be replicated to as many nodes as it
+// is owned by, since too few of the nodes it would be placed on advertised room for it
+func (s *Store) checkReplicasRoom(key string, size int64) error {
+	if _, missing := s.placeReplicas(key, size); missing > 0 {
+		return fmt.Errorf("%w: no node with room for %d bytes was found for %d replicas of %s", ErrInsufficientStorage, size, missing, key)
+	}
+	return nil
+}
+
+// writeErrorStatus returns the HTTP status of a failed write, which is 507 Insufficient Storage if there was no room for it
+func writeErrorStatus(err error) int {
+	if errors.Is(err, ErrInsufficientStorage) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// handleGetCapacity reports how much room for files this Store has, along with the room its peers advertised
+func (s *Store) handleGetCapacity(w http.ResponseWriter, r *http.Request) {
+	peers := make(map[string]int64)
+	for _, peer := range s.connectedPeers() {
+		if room, advertised := peer.Stats().Room(); advertised {
+			peers[peer.String()] = room
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(struct {
+		capacity.Usage
+		Peers map[string]int64 `json:"peers"`
+	}{s.Capacity.Usage(), peers})
+	if err != nil {
+		log.Println("Error while writing capacity:", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"file-store/internal/bucket"
+	"file-store/internal/capacity"
+	"file-store/internal/rebalance"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWritesWithoutRoomAreRejectedEarly(t *testing.T) {
+	store := setupUploadStore(t)
+	store.Capacity.SetOpts(capacity.Opts{MaxBytes: 10})
+
+	// Nothing is written for a file that doesn't fit
+	err := store.handleStoreFile("key", bytes.NewReader([]byte("more than ten bytes")))
+	assert.ErrorIs(t, err, ErrInsufficientStorage)
+	assert.False(t, store.existsInStorage("key"))
+
+	// Files that fit count towards the capacity as soon as they are written
+	assert.Nil(t, store.handleStoreFile("key", bytes.NewReader([]byte("six by"))))
+	assert.ErrorIs(t, store.handleStoreFile("other", bytes.NewReader([]byte("five!"))), ErrInsufficientStorage)
+	// Even if they are compressed before they are written, which hides how large they are
+	_, err = store.createBucket(bucket.Bucket{Name: "logs", Compression: bucket.GzipCompression})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, store.handleStoreFile(bucket.Qualify("logs", "key"), bytes.NewReader([]byte("more than ten bytes"))), ErrInsufficientStorage)
+	assert.False(t, store.existsInStorage(bucket.Qualify("logs", "key")))
+
+	// Uploads are turned down before they start
+	r := newTusRequest(http.MethodPost, "/uploads", nil)
+	r.Header.Set("Upload-Length", "100")
+	r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte("upload")))
+	w := httptest.NewRecorder()
+	store.newHTTPHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+}
+
+func TestFullNodesAreSkippedByPlacement(t *testing.T) {
+	cluster := newTestClusterWithReplication(t, 3, 2)
+	cluster.waitPlaced()
+
+	// Pick a key that node 0 owns along with another node, which is then filled up
+	addrs := []string{clusterNodeAddr(0), clusterNodeAddr(1), clusterNodeAddr(2)}
+	var key string
+	var full, spare int
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("key-%d", i)
+		owners := rebalance.Owners(candidate, addrs, 2)
+		for j := 1; j < 3; j++ {
+			if (owners[0] == clusterNodeAddr(0) && owners[1] == clusterNodeAddr(j)) || (owners[1] == clusterNodeAddr(0) && owners[0] == clusterNodeAddr(j)) {
+				key, full, spare = candidate, j, 3-j
+			}
+		}
+	}
+	cluster.fillNode(full, 0)
+
+	// The next nearest node with room stands in for the full owner
+	cluster.Store(0, key, []byte("content of "+key))
+	cluster.WaitStored(key, 0, spare)
+	assert.False(t, cluster.Nodes[full].existsInStorage(key))
+
+	// A replica sent to the full node anyway is turned down
+	assert.Error(t, cluster.Nodes[full].checkReplicaRoom(key, 16))
+}
+
+// fillNode leaves node i of the cluster without room for files, and waits until node j learned of it
+func (c *testCluster) fillNode(i int, j int) {
+	c.t.Helper()
+	c.Nodes[i].Capacity.SetOpts(capacity.Opts{MaxBytes: 1})
+	c.Nodes[i].heartbeatPeers()
+	assert.Eventually(c.t, func() bool {
+		peer, connected := c.Nodes[j].peerForAddr(clusterNodeAddr(i))
+		if !connected {
+			return false
+		}
+		room, advertised := peer.Stats().Room()
+		return advertised && room <= 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWritesWithoutRoomOnTheReplicasAreRejected(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster.fillNode(1, 0)
+
+	// Every node owns every file, so there is no other node to stand in for the full one
+	err := cluster.Nodes[0].handleStoreFile("key", bytes.NewReader([]byte("content of key")))
+	assert.ErrorIs(t, err, ErrInsufficientStorage)
+	assert.False(t, cluster.Nodes[0].existsInStorage("key"))
+}
+
+func TestShardsAreNotPlacedOnFullNodes(t *testing.T) {
+	cluster := newErasureCodedCluster(t, 3, 2, 1)
+	cluster.fillNode(2, 0)
+
+	// The shard meant for the full node is turned down, which leaves enough shards to read the file from
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	assert.Nil(t, cluster.Nodes[0].handleStoreFile("archive", bytes.NewReader(data)))
+	indexes, err := cluster.Nodes[2].Shards.Indexes("archive")
+	assert.Nil(t, err)
+	assert.Empty(t, indexes)
+	read, err := cluster.Nodes[1].handleGetFile("archive", true)
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+}
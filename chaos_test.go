@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"file-store/internal/p2p"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// newChaosCluster starts a cluster in which node i runs on a p2p.FaultyTransport with the policy policies returns for it, if any
+func newChaosCluster(t *testing.T, n int, opts p2p.FaultyTransportOpts, policies map[int]p2p.FaultPolicy) *testCluster {
+	return newTestClusterWithTransports(t, n, func(i int, transport p2p.Transport) p2p.Transport {
+		policy, faulty := policies[i]
+		if !faulty {
+			return nil
+		}
+		opts := opts
+		opts.Policy = policy
+		return p2p.NewFaultyTransport(transport, opts)
+	})
+}
+
+func TestChaosReplicationSurvivesDuplicatedAndReorderedMessages(t *testing.T) {
+	// Every message either node receives, from membership to replicas, may arrive late, twice or out of order
+	lossless := map[p2p.Fault]float64{p2p.FaultDelay: 0.1, p2p.FaultDuplicate: 0.2, p2p.FaultReorder: 0.2}
+	cluster := newChaosCluster(t, 3, p2p.FaultyTransportOpts{Delay: 20 * time.Millisecond}, map[int]p2p.FaultPolicy{
+		1: p2p.NewRandomFaultPolicy(1, lossless),
+		2: p2p.NewRandomFaultPolicy(2, lossless),
+	})
+
+	for i := 0; i < 10; i++ {
+		cluster.Store(0, fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("content of key %d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		cluster.WaitStored(key, 1, 2)
+		for _, node := range []int{1, 2} {
+			data, err := cluster.Nodes[node].handleFileRead(key)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("content of key %d", i)), data)
+		}
+	}
+}
+
+func TestChaosFetchTimesOutOnLostRequests(t *testing.T) {
+	policy := p2p.NewScheduledFaultPolicy(p2p.FaultStep{Match: p2p.MatchCommand(p2p.MESSAGE_FETCH_CONTROL_COMMAND), Fault: p2p.FaultDrop})
+	cluster := newChaosCluster(t, 2, p2p.FaultyTransportOpts{}, map[int]p2p.FaultPolicy{1: policy})
+	cluster.Nodes[1].StoreOpts.FetchTimeout = 200 * time.Millisecond
+	cluster.Store(0, "key", []byte("content"))
+	cluster.WaitStored("key", 1)
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("key"))
+
+	// The only FETCH that could find the file is lost, so the fetch gives up once its time is up rather than hang
+	start := time.Now()
+	_, err := cluster.Nodes[1].handleGetFile("key", true)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.True(t, policy.Done())
+
+	data, err := cluster.Nodes[1].handleGetFile("key", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("content"), data)
+}
+
+func TestChaosCorruptedDataIsRejected(t *testing.T) {
+	// The replica node 0 is sent arrives corrupted, and so does the first reply to the FETCH it then makes
+	policy := p2p.NewScheduledFaultPolicy(
+		p2p.FaultStep{Match: p2p.MatchData, Fault: p2p.FaultCorrupt},
+		p2p.FaultStep{Match: p2p.MatchCommand(p2p.MESSAGE_FETCH_CONTROL_COMMAND), Fault: p2p.FaultCorrupt},
+	)
+	cluster := newChaosCluster(t, 3, p2p.FaultyTransportOpts{}, map[int]p2p.FaultPolicy{0: policy})
+	cluster.Store(2, "key", []byte("content"))
+	cluster.WaitStored("key", 1)
+	cluster.WaitProviders("key", 0, 2)
+	assert.False(t, cluster.Nodes[0].existsInStorage("key"))
+
+	data, err := cluster.Nodes[0].handleGetFile("key", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("content"), data)
+	assert.True(t, policy.Done())
+
+	// Replicas dropped on their own node leave no tombstone. A node whose replica was dropped still gets the file from the nodes
+	// holding it, and once the last replica is gone, every node agrees the file doesn't exist.
+	assert.Nil(t, cluster.Nodes[2].handleFileDelete("key"))
+	data, err = cluster.Nodes[2].handleGetFile("key", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("content"), data)
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("key"))
+	for i := range cluster.Nodes {
+		_, err := cluster.Nodes[i].handleGetFile("key", true)
+		assert.ErrorIs(t, err, os.ErrNotExist, "node %d", i)
+	}
+}
+
+func TestChaosDeletesSurviveLostAndDuplicatedMessages(t *testing.T) {
+	// The DELETE node 1 is sent is lost, while the one node 2 is sent arrives twice
+	lost := p2p.NewScheduledFaultPolicy(p2p.FaultStep{Match: p2p.MatchCommand(p2p.MESSAGE_DELETE_CONTROL_COMMAND), Fault: p2p.FaultDrop})
+	duplicated := p2p.NewScheduledFaultPolicy(p2p.FaultStep{Match: p2p.MatchCommand(p2p.MESSAGE_DELETE_CONTROL_COMMAND), Fault: p2p.FaultDuplicate})
+	cluster := newChaosCluster(t, 3, p2p.FaultyTransportOpts{}, map[int]p2p.FaultPolicy{1: lost, 2: duplicated})
+	cluster.Store(0, "key", []byte("content"))
+	cluster.WaitStored("key", 1, 2)
+
+	assert.Nil(t, cluster.Nodes[0].handleDeleteFile("key"))
+	cluster.WaitDeleted("key", 2)
+	assert.True(t, duplicated.Done())
+	assert.Eventually(t, lost.Done, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, cluster.Nodes[1].existsInStorage("key"))
+
+	// The node that missed the DELETE gets the tombstone from anti-entropy, rather than bringing the file back to the others
+	cluster.syncNodes(1, 2)
+	cluster.WaitDeleted("key", 1)
+	cluster.syncNodes(1, 0)
+	for i := range cluster.Nodes {
+		_, err := cluster.Nodes[i].handleGetFile("key", true)
+		assert.ErrorIs(t, err, os.ErrNotExist, "node %d", i)
+	}
+
+	// A file written again after its delete, and then deleted again, stays deleted however the DELETE arrives
+	cluster.Store(0, "key", []byte("written again"))
+	cluster.WaitStored("key", 1, 2)
+	assert.Nil(t, cluster.Nodes[0].handleDeleteFile("key"))
+	cluster.WaitDeleted("key", 1, 2)
+}
+
+func TestChaosTruncatedStoreStreamResumes(t *testing.T) {
+	policy := p2p.NewScheduledFaultPolicy(p2p.FaultStep{Match: p2p.MatchCommand(p2p.MESSAGE_STORE_CONTROL_COMMAND), Fault: p2p.FaultTruncate})
+	cluster := newChaosCluster(t, 2, p2p.FaultyTransportOpts{TruncateAfter: 64 * 1024}, map[int]p2p.FaultPolicy{1: policy})
+	data := bytes.Repeat([]byte("0123456789abcdef"), 32*1024)
+
+	// The stream is cut off, and nothing of the file is stored yet
+	assert.NotNil(t, cluster.Nodes[0].handleStoreFile("big", bytes.NewReader(data)))
+	assert.True(t, policy.Done())
+	assert.False(t, cluster.Nodes[1].existsInStorage("big"))
+
+	// Once the nodes reconnect, the upload resumes where it was cut off
+	cluster.Isolate(1)
+	cluster.Rejoin(1)
+	cluster.WaitStored("big", 1)
+	stored, err := cluster.Nodes[1].handleFileRead("big")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, stored))
+}
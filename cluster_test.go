@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"file-store/internal/db"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCluster is a set of Stores running in one process, connected over a virtual network rather than real ports
+type testCluster struct {
+	t       *testing.T
+	Network *p2p.MemoryNetwork
+	Nodes   []*Store
+	// replicationFactor is the ReplicationFactor of every node, or the default one if it is 0
+	replicationFactor int
+	wrap              func(i int, transport p2p.Transport) p2p.Transport
+	// configure, if set, adjusts the opts of every node before it starts
+	configure func(opts *StoreOpts)
+}
+
+// clusterNodeAddr returns the address node i of a testCluster listens on
+func clusterNodeAddr(i int) string {
+	return fmt.Sprintf("127.0.0.1:%d", 7001+i)
+}
+
+// newTestCluster starts n Stores, bootstrapped off the first one, and waits until every node is connected to every other
+func newTestCluster(t *testing.T, n int) *testCluster {
+	return startTestCluster(&testCluster{t: t}, n)
+}
+
+// newTestClusterWithTransports starts a cluster like newTestCluster, where node i runs on the Transport that wrap returns for
+// its transport over the virtual network, e.g, a p2p.FaultyTransport. Nodes that wrap returns nil for run on it unwrapped.
+func newTestClusterWithTransports(t *testing.T, n int, wrap func(i int, transport p2p.Transport) p2p.Transport) *testCluster {
+	return startTestCluster(&testCluster{t: t, wrap: wrap}, n)
+}
+
+// newTestClusterWithReplication starts a cluster like newTestCluster, where every file is owned by replicationFactor nodes
+func newTestClusterWithReplication(t *testing.T, n int, replicationFactor int) *testCluster {
+	return startTestCluster(&testCluster{t: t, replicationFactor: replicationFactor}, n)
+}
+
+// startTestCluster starts n nodes of c, and waits until every node is connected to every other
+func startTestCluster(c *testCluster, n int) *testCluster {
+	c.Network = p2p.NewMemoryNetwork()
+	c.t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for _, store := range c.Nodes {
+			_ = store.shutdown(ctx, false)
+		}
+	})
+	for i := 0; i < n; i++ {
+		c.startNode()
+	}
+	c.waitConnected()
+	return c
+}
+
+// startNode starts the next node of the cluster, bootstrapped off the first one, without waiting for it to connect
+func (c *testCluster) startNode() {
+	i := len(c.Nodes)
+	var bootstrapNodes []string
+	if i > 0 {
+		bootstrapNodes = []string{clusterNodeAddr(0)}
+	}
+	dir := c.t.TempDir()
+	store := createStoreOnTransport(clusterNodeAddr(i), bootstrapNodes, filepath.Join(dir, "storage"), func(opts p2p.TCPTransportOpts) p2p.Transport {
+		var transport p2p.Transport = p2p.NewMemoryTransport(c.Network, opts, util.MessageChanBufferSize)
+		if c.wrap != nil {
+			if wrapped := c.wrap(i, transport); wrapped != nil {
+				transport = wrapped
+			}
+		}
+		return transport
+	})
+	if c.replicationFactor != 0 {
+		store.StoreOpts.ReplicationFactor = c.replicationFactor
+	}
+	if c.configure != nil {
+		c.configure(&store.StoreOpts)
+	}
+	ddb, err := db.InitDB(filepath.Join(dir, "metadata.db"))
+	assert.Nil(c.t, err)
+	store.attachMetadataDB(&ddb)
+	go store.setupHyperStoreServer()
+	c.Nodes = append(c.Nodes, store)
+}
+
+// AddNode starts one more node, and waits until the cluster is fully connected again
+func (c *testCluster) AddNode() {
+	c.t.Helper()
+	c.startNode()
+	c.waitConnected()
+}
+
+// waitConnected waits until every node is connected to every other one
+func (c *testCluster) waitConnected() {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		for i, store := range c.Nodes {
+			for j := range c.Nodes {
+				if _, connected := store.peerForAddr(clusterNodeAddr(j)); i != j && !connected {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// Isolate partitions node i off from every other node, and waits until no node is connected to it anymore
+func (c *testCluster) Isolate(i int) {
+	c.t.Helper()
+	for j := range c.Nodes {
+		if j != i {
+			c.Network.Partition(clusterNodeAddr(i), clusterNodeAddr(j))
+		}
+	}
+	assert.Eventually(c.t, func() bool {
+		if len(c.Nodes[i].connectedPeers()) > 0 {
+			return false
+		}
+		for j, store := range c.Nodes {
+			if _, connected := store.peerForAddr(clusterNodeAddr(i)); j != i && connected {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// Rejoin links node i back to every other node, and waits until the cluster is fully connected again
+func (c *testCluster) Rejoin(i int) {
+	c.t.Helper()
+	for j := range c.Nodes {
+		if j != i {
+			c.Network.Link(clusterNodeAddr(i), clusterNodeAddr(j))
+		}
+	}
+	c.waitConnected()
+}
+
+// Store stores data under key on node i, which replicates it to the nodes connected to it
+func (c *testCluster) Store(i int, key string, data []byte) {
+	c.t.Helper()
+	assert.Nil(c.t, c.Nodes[i].handleStoreFile(key, bytes.NewReader(data)))
+}
+
+// WaitStored waits until every one of the given nodes holds key
+func (c *testCluster) WaitStored(key string, nodes ...int) {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		for _, i := range nodes {
+			if !c.Nodes[i].existsInStorage(key) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// WaitDeleted waits until none of the given nodes holds key
+func (c *testCluster) WaitDeleted(key string, nodes ...int) {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		for _, i := range nodes {
+			if c.Nodes[i].existsInStorage(key) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// WaitProviders waits until node i finds count providers of key in the DHT
+func (c *testCluster) WaitProviders(key string, i int, count int) {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		providers, err := c.Nodes[i].DHT.FindProviders(ctx, key)
+		return err == nil && len(providers) == count
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterReplicatesAndFetches(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	data := []byte(util.CommonStringContent)
+
+	cluster.Store(0, util.CommonFileKey, data)
+	cluster.WaitStored(util.CommonFileKey, 0, 1, 2)
+
+	// A node that lost its replica gets it back from the others
+	assert.Nil(t, cluster.Nodes[2].handleFileDelete(util.CommonFileKey))
+	assert.False(t, cluster.Nodes[2].existsInStorage(util.CommonFileKey))
+	fetched, err := cluster.Nodes[2].handleGetFile(util.CommonFileKey, true)
+	assert.Nil(t, err)
+	assert.Equal(t, data, fetched)
+
+	_, err = cluster.Nodes[1].handleGetFile("missing", true)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestClusterPartitionAndHeal(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	data := []byte(util.CommonStringContent)
+
+	// Files stored while a node is partitioned off don't reach it, and it can't fetch them
+	cluster.Isolate(2)
+	cluster.Store(0, util.CommonFileKey, data)
+	cluster.WaitStored(util.CommonFileKey, 0, 1)
+	assert.False(t, cluster.Nodes[2].existsInStorage(util.CommonFileKey))
+	_, err := cluster.Nodes[2].handleGetFile(util.CommonFileKey, true)
+	assert.NotNil(t, err)
+
+	// Once the partition heals, the node reconnects and fetches them
+	cluster.Rejoin(2)
+	fetched, err := cluster.Nodes[2].handleGetFile(util.CommonFileKey, true)
+	assert.Nil(t, err)
+	assert.Equal(t, data, fetched)
+}
+
+func TestClusterFetchesOverSlowLinks(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster.Store(0, util.CommonFileKey, []byte(util.CommonStringContent))
+	cluster.WaitStored(util.CommonFileKey, 0, 1)
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete(util.CommonFileKey))
+
+	cluster.Network.SetLatency(clusterNodeAddr(0), clusterNodeAddr(1), 100*time.Millisecond)
+	start := time.Now()
+	fetched, err := cluster.Nodes[1].handleGetFile(util.CommonFileKey, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(util.CommonStringContent), fetched)
+	// The FETCH and its reply each crossed the link
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestClusterSwarmFetchesLargeFiles(t *testing.T) {
+	cluster := startTestCluster(&testCluster{t: t, configure: func(opts *StoreOpts) {
+		opts.SwarmFetch = true
+	}}, 2)
+	// Over 1000 chunks, whose manifest alone would be more than a frame holds if it were sent whole
+	data := make([]byte, 17*1024*1024+1)
+	_, _ = rand.New(rand.NewSource(1)).Read(data)
+	cluster.Store(0, "large", data)
+	cluster.WaitStored("large", 0, 1)
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("large"))
+
+	fetched, err := cluster.Nodes[1].handleGetFile("large", true)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, fetched))
+}
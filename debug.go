@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"file-store/internal/p2p"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// renderCapture writes every message of capture to w, one per line, rendering control messages in format.
+// capture holds one direction of a connection as captured off the wire, or bare frames if raw is set, in which case codecName
+// must be given. Otherwise, codecName may be left empty to use the codec the connection negotiated.
+func renderCapture(w io.Writer, capture []byte, codecName string, format p2p.MessageFormat, raw bool) error {
+	var codec p2p.Codec
+	if codecName != "" {
+		var err error
+		if codec, err = p2p.NewCodec(codecName); err != nil {
+			return err
+		}
+	}
+	factory := p2p.NewMessageFormatFactory(p2p.MessageFormatOpts{MessageFormatter: format})
+
+	if raw {
+		if codec == nil {
+			return errors.New("a codec is needed to decode bare frames")
+		}
+		messages, err := p2p.DecodeFrames(bytes.NewReader(capture), codec)
+		for i := range messages {
+			fmt.Fprintln(w, renderMessage(factory, &messages[i]))
+		}
+		return err
+	}
+
+	captured, codec, err := p2p.DecodeCapture(capture, codec)
+	if codec != nil {
+		fmt.Fprintf(w, "# codec: %s\n", codec.Name())
+	}
+	for i := range captured {
+		line := fmt.Sprintf("stream %d: %s", captured[i].StreamID, renderMessage(factory, &captured[i].Message))
+		if captured[i].Trailing > 0 {
+			line += fmt.Sprintf(" (followed by %d bytes)", captured[i].Trailing)
+		}
+		fmt.Fprintln(w, line)
+	}
+	return err
+}
+
+// renderMessage renders a control message through factory, and summarizes a data message, whose bytes aren't worth printing
+func renderMessage(factory *p2p.MessageFormatFactory, msg *p2p.Message) string {
+	if payload, isData := msg.Payload.(p2p.DataPayload); isData {
+		return fmt.Sprintf("DATA key=%q bytes=%d metadata=%v", payload.Key, len(payload.Data), payload.Metadata)
+	}
+	rendered, err := factory.Render(msg)
+	if err != nil {
+		return fmt.Sprintf("unrenderable message: %v", err)
+	}
+	return rendered
+}
+
+// --------------------------------------------------------------  DEBUG ENDPOINTS --------------------------------------------------------------
+
+// messageFormatFromQuery returns the format named by the format query param, or the MessageFormat of the Store if there is none
+func (s *Store) messageFormatFromQuery(r *http.Request) (p2p.MessageFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return p2p.NewMessageFormat(name)
+	}
+	return s.StoreOpts.MessageFormat, nil
+}
+
+// handleDebugDecode renders the messages of the captured wire traffic in the request body, see renderCapture.
+// The codec, format and raw query params pick the codec, the format, and whether the body holds bare frames.
+func (s *Store) handleDebugDecode(w http.ResponseWriter, r *http.Request) {
+	format, err := s.messageFormatFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+	capture, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rendered bytes.Buffer
+	if err := renderCapture(&rendered, capture, r.URL.Query().Get("codec"), format, raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(rendered.Bytes())
+}
+
+// handleDebugEncode parses the control message rendered in the request body, and responds with it framed by the codec query param
+func (s *Store) handleDebugEncode(w http.ResponseWriter, r *http.Request) {
+	format, err := s.messageFormatFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	codecName := r.URL.Query().Get("codec")
+	if codecName == "" {
+		codecName = p2p.GobCodecName
+	}
+	codec, err := p2p.NewCodec(codecName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg, err := p2p.NewMessageFormatFactory(p2p.MessageFormatOpts{MessageFormatter: format}).Parse(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var frame bytes.Buffer
+	if err := codec.Encode(&frame, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(frame.Bytes())
+}
+
+// --------------------------------------------------------------  DECODE COMMAND --------------------------------------------------------------
+
+// runDecodeCommand implements `hyperstore decode`, which pretty-prints the captured wire traffic in a file, or in stdin
+func runDecodeCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: hyperstore decode [flags] [capture file]")
+		fmt.Fprintln(stdout, "Pretty-prints one direction of a connection as captured off the wire, read from stdin if no file is given.")
+		flags.PrintDefaults()
+	}
+	var (
+		codecName  = flags.String("codec", "", "The codec the messages are encoded with, either gob or protobuf. Detected from the capture when empty")
+		formatName = flags.String("format", p2p.JSONFormatName, "The format control messages are printed in, either json or proto")
+		raw        = flags.Bool("raw", false, "Setting this to true will decode bare frames of -codec, rather than a captured connection")
+	)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	format, err := p2p.NewMessageFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	input := stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	capture, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	return renderCapture(stdout, capture, *codecName, format, *raw)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEncodeThenDecode(t *testing.T) {
+	store := setupUploadStore(t)
+	handler := store.newHTTPHandler()
+
+	encoded := httptest.NewRecorder()
+	handler.ServeHTTP(encoded, httptest.NewRequest(http.MethodPost, "/debug/encode?format=json&codec=protobuf",
+		strings.NewReader(`{"@type":"FETCH","args":{"key":"some_key","request_id":"7"}}`)))
+	assert.Equal(t, http.StatusOK, encoded.Code)
+
+	decoded := httptest.NewRecorder()
+	handler.ServeHTTP(decoded, httptest.NewRequest(http.MethodPost, "/debug/decode?raw=true&codec=protobuf&format=proto", bytes.NewReader(encoded.Body.Bytes())))
+	assert.Equal(t, http.StatusOK, decoded.Code)
+	assert.Contains(t, decoded.Body.String(), "command: CONTROL_COMMAND_FETCH")
+	assert.Contains(t, decoded.Body.String(), `args { key: "key" value: "some_key" }`)
+
+	// Bare frames can't be decoded without knowing their codec, nor can a message be encoded from garbage
+	rejected := httptest.NewRecorder()
+	handler.ServeHTTP(rejected, httptest.NewRequest(http.MethodPost, "/debug/decode?raw=true", bytes.NewReader(encoded.Body.Bytes())))
+	assert.Equal(t, http.StatusBadRequest, rejected.Code)
+	rejected = httptest.NewRecorder()
+	handler.ServeHTTP(rejected, httptest.NewRequest(http.MethodPost, "/debug/encode?format=json", strings.NewReader(`{"@type":"NOPE"}`)))
+	assert.Equal(t, http.StatusBadRequest, rejected.Code)
+}
+
+func TestDecodeCommandPrintsFrames(t *testing.T) {
+	store := setupUploadStore(t)
+	encoded := httptest.NewRecorder()
+	store.newHTTPHandler().ServeHTTP(encoded, httptest.NewRequest(http.MethodPost, "/debug/encode?format=json",
+		strings.NewReader(`{"@type":"LIST","args":{"key":"some_key"}}`)))
+	assert.Equal(t, http.StatusOK, encoded.Code)
+
+	var out bytes.Buffer
+	assert.Nil(t, runDecodeCommand([]string{"-raw", "-codec", "gob"}, bytes.NewReader(encoded.Body.Bytes()), &out))
+	assert.Contains(t, out.String(), `"@type":"LIST"`)
+	assert.Contains(t, out.String(), `"key":"some_key"`)
+
+	assert.NotNil(t, runDecodeCommand([]string{"-format", "yaml"}, bytes.NewReader(nil), &out))
+}
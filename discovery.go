@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"file-store/internal/dht"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// storeDHTRPC implements dht.RPC over the control messages of the Store's Transport
+type storeDHTRPC struct {
+	store *Store
+}
+
+func (r *storeDHTRPC) FindNode(ctx context.Context, to dht.Contact, target dht.NodeID) ([]dht.Contact, error) {
+	resp, err := r.store.callPeer(ctx, to.Addr, p2p.MESSAGE_FIND_NODE_CONTROL_COMMAND, map[string]string{"target": target.String()})
+	if err != nil {
+		return nil, err
+	}
+	return dht.DecodeContacts(resp["contacts"])
+}
+
+func (r *storeDHTRPC) FindValue(ctx context.Context, to dht.Contact, key dht.NodeID) ([]dht.Contact, []dht.Contact, error) {
+	resp, err := r.store.callPeer(ctx, to.Addr, p2p.MESSAGE_FIND_VALUE_CONTROL_COMMAND, map[string]string{"target": key.String()})
+	if err != nil {
+		return nil, nil, err
+	}
+	providers, err := dht.DecodeContacts(resp["providers"])
+	if err != nil {
+		return nil, nil, err
+	}
+	closer, err := dht.DecodeContacts(resp["contacts"])
+	return providers, closer, err
+}
+
+func (r *storeDHTRPC) StoreProvider(ctx context.Context, to dht.Contact, key dht.NodeID, provider dht.Contact) error {
+	args := map[string]string{
+		"target":   key.String(),
+		"provider": provider.String(),
+	}
+	_, err := r.store.callPeer(ctx, to.Addr, p2p.MESSAGE_STORE_PROVIDER_CONTROL_COMMAND, args)
+	return err
+}
+
+// newStoreDHT creates the DHT of the Store, identified by the address it listens on
+func newStoreDHT(s *Store) *dht.DHT {
+	opts := dht.DHTOpts{
+		K:           util.DHTBucketSize,
+		Alpha:       util.DHTAlpha,
+		ProviderTTL: util.DHTProviderTTL,
+		RPCTimeout:  util.DHTRPCTimeout,
+	}
+	return dht.NewDHT(opts, dht.NewContact(s.normalizedListenAddress()), &storeDHTRPC{store: s})
+}
+
+// bootstrapDHT joins the DHT through the peers listening on seedAddrs
+func (s *Store) bootstrapDHT(seedAddrs []string) {
+	var seeds []dht.Contact
+	for _, addr := range seedAddrs {
+		seeds = append(seeds, dht.NewContact(addr))
+	}
+	if len(seeds) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), util.DHTLookupTimeout)
+	defer cancel()
+	if err := s.DHT.Bootstrap(ctx, seeds); err != nil {
+		log.Println("Error while bootstrapping DHT:", err)
+		return
+	}
+	log.Printf("Joined DHT with %d contacts", s.DHT.Table.Len())
+	// The files held were announced before there was anyone to announce them to, e.g, by a Store that just started
+	go s.reprovideKeys()
+}
+
+// announceKey records this node as a provider of key in the DHT, in the background
+func (s *Store) announceKey(key string) {
+	go s.provideKey(key)
+}
+
+// provideKey records this node as a provider of key in the DHT
+func (s *Store) provideKey(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), util.DHTLookupTimeout)
+	defer cancel()
+	if err := s.DHT.Provide(ctx, key); err != nil {
+		log.Printf("Error while announcing %s in DHT: %v", key, err)
+	}
+}
+
+// runReprovider announces the files held in the DHT again every DHTReprovideInterval, so that their provider records don't
+// expire while they are still held
+func (s *Store) runReprovider() {
+	ticker := time.NewTicker(util.DHTReprovideInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reprovideKeys()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// reprovideKeys announces every file held in the DHT, one at a time. Only one reprovide runs at a time.
+func (s *Store) reprovideKeys() {
+	if !s.reproviding.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.reproviding.Store(false)
+
+	files, err := s.listFileMetadata()
+	if err != nil {
+		log.Println("Error while listing file metadata:", err)
+		return
+	}
+	announced := 0
+	for key, metadata := range files {
+		if s.isShuttingDown() {
+			return
+		}
+		if metadata.deleted() {
+			continue
+		}
+		s.provideKey(key)
+		announced++
+	}
+	log.Printf("Announced %d files held in DHT", announced)
+}
+
+// fetchCandidates returns the peers to send a FETCH for key to, which are its providers found through the DHT, nearest first,
+// or every connected peer if there are none
+func (s *Store) fetchCandidates(key string) []p2p.Peer {
+	ctx, cancel := context.WithTimeout(context.Background(), util.DHTLookupTimeout)
+	defer cancel()
+
+	providers, err := s.DHT.FindProviders(ctx, key)
+	if err != nil {
+		log.Printf("Error while looking up providers of %s in DHT: %v", key, err)
+	}
+	var providerAddrs []string
+	for _, provider := range providers {
+		if provider.ID != s.DHT.Self.ID {
+			providerAddrs = append(providerAddrs, provider.Addr)
+		}
+	}
+	s.sortByRTT(providerAddrs)
+
+	var candidates []p2p.Peer
+	for _, addr := range providerAddrs {
+		peer, err := s.connectToPeer(ctx, addr)
+		if err != nil {
+			log.Printf("Couldn't connect to provider %s of %s: %v", addr, key, err)
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	if len(candidates) > 0 {
+		return candidates
+	}
+	log.Printf("No reachable providers of %s found in DHT, asking every peer", key)
+	for _, peer := range s.connectedPeers() {
+		candidates = append(candidates, peer)
+	}
+	return candidates
+}
+
+// callPeer sends a request to the peer listening on addr and waits for the args of its reply
+func (s *Store) callPeer(ctx context.Context, addr string, command p2p.ControlMessage, args map[string]string) (map[string]string, error) {
+	peer, err := s.connectToPeer(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	args["sender_addr"] = s.normalizedListenAddress()
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: command,
+			Args:    args,
+		},
+	}
+	reply, err := s.Transport.Call(ctx, peer, msg)
+	if err != nil {
+		return nil, err
+	}
+	payload, isControl := reply.Payload.(p2p.ControlPayload)
+	if !isControl {
+		return nil, fmt.Errorf("unexpected %s reply to %s from %s", reply.Type, command, addr)
+	}
+	return payload.Args, nil
+}
+
+// handleDHTRequest answers a FIND_NODE, FIND_VALUE or STORE_PROVIDER request from fromPeer with a DHT_RESPONSE
+func (s *Store) handleDHTRequest(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	var (
+		senderAddr, senderAddrExists = payload.Args["sender_addr"]
+		targetStr, targetExists      = payload.Args["target"]
+	)
+	if !senderAddrExists || !targetExists {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing sender_addr/target for %s Control Message %s", payload.Command, fromPeer.String())
+	}
+	target, err := dht.ParseNodeID(targetStr)
+	if err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid target for %s Control Message %s: %v", payload.Command, fromPeer.String(), err)
+	}
+	// The connection may be an inbound one, so remember which listen address it belongs to
+	s.addPeerAlias(senderAddr, fromPeer)
+	sender := dht.NewContact(senderAddr)
+
+	respArgs := make(map[string]string)
+	switch payload.Command {
+	case p2p.MESSAGE_FIND_NODE_CONTROL_COMMAND:
+		respArgs["contacts"] = dht.EncodeContacts(s.DHT.HandleFindNode(sender, target))
+	case p2p.MESSAGE_FIND_VALUE_CONTROL_COMMAND:
+		providers, closer := s.DHT.HandleFindValue(sender, target)
+		respArgs["providers"] = dht.EncodeContacts(providers)
+		respArgs["contacts"] = dht.EncodeContacts(closer)
+	case p2p.MESSAGE_STORE_PROVIDER_CONTROL_COMMAND:
+		providers, err := dht.DecodeContacts(payload.Args["provider"])
+		if err != nil || len(providers) != 1 {
+			return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid provider for STORE_PROVIDER Control Message %s", fromPeer.String())
+		}
+		s.DHT.HandleStoreProvider(sender, target, providers[0])
+	}
+
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_DHT_RESPONSE_CONTROL_COMMAND,
+			Args:    respArgs,
+		},
+	}
+	return s.replyToPeer(payload, msg, fromPeer)
+}
+
+// connectToPeer returns the peer listening on addr, dialing it and waiting for the connection if there is none yet
+func (s *Store) connectToPeer(ctx context.Context, addr string) (p2p.Peer, error) {
+	if peer, exists := s.peerForAddr(addr); exists {
+		return peer, nil
+	}
+	if err := s.dialPeer(addr); err != nil {
+		return nil, err
+	}
+	if peer, exists := s.peerForAddr(addr); exists {
+		return peer, nil
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if peer, exists := s.peerForAddr(addr); exists {
+				return peer, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connecting to %s: %w", addr, ctx.Err())
+		}
+	}
+}
+
+// dialPeer dials the peer listening on addr, unless it is already connected. Dials to the same address are serialized, so that
+// concurrent callers don't open a connection each.
+func (s *Store) dialPeer(addr string) error {
+	// The node may be connected to us already, which we only know once the alias it claimed checks out
+	s.waitAliasClaims(addr)
+	lock, _ := s.dialLocks.LoadOrStore(addr, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if _, exists := s.peerForAddr(addr); exists {
+		return nil
+	}
+	return s.Transport.Dial(addr)
+}
+
+// peerForAddr returns the connected peer listening on addr, either dialed directly or known through an alias
+func (s *Store) peerForAddr(addr string) (p2p.Peer, bool) {
+	s.PeerLock.Lock()
+	defer s.PeerLock.Unlock()
+
+	if peer, exists := s.PeerMap[addr]; exists {
+		return peer, true
+	}
+	if peerKey, aliased := s.PeerAliases[addr]; aliased {
+		peer, exists := s.PeerMap[peerKey]
+		return peer, exists
+	}
+	return nil, false
+}
+
+// addPeerAlias records that peer is the connection to the node listening on listenAddr, once the node there vouches for it.
+// The listen address is only what the peer claims, so it is dialed back first, lest any connection take the alias of another
+// node, and with it the uploads, hints and audit entries of that node.
+func (s *Store) addPeerAlias(listenAddr string, peer p2p.Peer) {
+	if listenAddr == peer.String() {
+		return
+	}
+	s.PeerLock.Lock()
+	known := s.PeerAliases[listenAddr] == peer.String()
+	s.PeerLock.Unlock()
+	if known {
+		s.Peers.Connected(listenAddr)
+		return
+	}
+
+	claim := aliasClaim{listenAddr: listenAddr, peerKey: peer.String()}
+	done := make(chan struct{})
+	if _, verifying := s.aliasClaims.LoadOrStore(claim, done); verifying {
+		return
+	}
+	go func() {
+		defer func() {
+			s.aliasClaims.Delete(claim)
+			close(done)
+		}()
+		if err := s.verifyPeerAlias(listenAddr, peer); err != nil {
+			log.Printf("Not taking %s for %s: %v", peer, listenAddr, err)
+			return
+		}
+		s.PeerLock.Lock()
+		// The connection may have ended meanwhile, and OnPeerDisconnect wouldn't drop an alias added after it
+		current, connected := s.PeerMap[peer.String()]
+		connected = connected && current == peer
+		if connected {
+			s.PeerAliases[listenAddr] = peer.String()
+		}
+		s.PeerLock.Unlock()
+		if !connected {
+			return
+		}
+
+		s.Peers.Connected(listenAddr)
+		go s.requestUploadResumption(peer, listenAddr)
+		go s.replayHints(listenAddr)
+	}()
+}
+
+// aliasClaim is the claim of the connection that is keyed peerKey in PeerMap to be the node listening on listenAddr
+type aliasClaim struct {
+	listenAddr string
+	peerKey    string
+}
+
+// waitAliasClaims waits until every alias claimed for addr is either taken or turned down
+func (s *Store) waitAliasClaims(addr string) {
+	s.aliasClaims.Range(func(claim, done any) bool {
+		if claim.(aliasClaim).listenAddr == addr {
+			<-done.(chan struct{})
+		}
+		return true
+	})
+}
+
+// verifyPeerAlias asks the node listening on listenAddr whether peer is a connection it dialed, over a connection to
+// listenAddr dialed by us
+func (s *Store) verifyPeerAlias(listenAddr string, peer p2p.Peer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), util.PeerAliasVerifyTimeout)
+	defer cancel()
+	node, err := s.dialDirect(ctx, listenAddr)
+	if err != nil {
+		return err
+	}
+	if _, probe := s.probePeers.Load(node); probe {
+		defer node.Close()
+	}
+
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_IDENTIFY_CONTROL_COMMAND,
+			Args:    map[string]string{"remote_addr": peer.String()},
+		},
+	}
+	reply, err := s.Transport.Call(ctx, node, msg)
+	if err != nil {
+		return err
+	}
+	payload, isControl := reply.Payload.(p2p.ControlPayload)
+	if !isControl || payload.Args["identified"] != "true" {
+		return fmt.Errorf("%s doesn't know the connection", listenAddr)
+	}
+	return nil
+}
+
+// dialDirect returns a connection to addr dialed by us, rather than one the node there dialed and that is only known by an
+// alias. If there is none, addr is dialed for a connection that is closed once the caller is done with it, and isn't taken
+// for a peer.
+func (s *Store) dialDirect(ctx context.Context, addr string) (p2p.Peer, error) {
+	lock, _ := s.dialLocks.LoadOrStore(addr, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	s.PeerLock.Lock()
+	peer, exists := s.PeerMap[addr]
+	s.PeerLock.Unlock()
+	if exists {
+		return peer, nil
+	}
+	probe := make(chan p2p.Peer, 1)
+	s.aliasProbes.Store(addr, probe)
+	defer s.aliasProbes.Delete(addr)
+	if err := s.Transport.Dial(addr); err != nil {
+		return nil, err
+	}
+	select {
+	case peer := <-probe:
+		return peer, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleIdentify answers an IDENTIFY from fromPeer with whether this Store dialed the connection whose remote address is
+// remote_addr, i.e, whether the connection that remote_addr is for belongs to this Store
+func (s *Store) handleIdentify(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	remoteAddr, exists := payload.Args["remote_addr"]
+	if !exists {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing remote_addr for IDENTIFY Control Message %s", fromPeer.String())
+	}
+	identified := false
+	s.PeerLock.Lock()
+	for _, peer := range s.PeerMap {
+		if peer.LocalAddr().String() == remoteAddr {
+			identified = true
+			break
+		}
+	}
+	s.PeerLock.Unlock()
+
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_IDENTIFY_RESPONSE_CONTROL_COMMAND,
+			Args:    map[string]string{"identified": strconv.FormatBool(identified)},
+		},
+	}
+	return s.replyToPeer(payload, msg, fromPeer)
+}
+
+// peerListenAddr returns the listen address of fromPeer, if it is known by an alias, or the address of its connection otherwise
+func (s *Store) peerListenAddr(fromPeer p2p.Peer) string {
+	s.PeerLock.Lock()
+	defer s.PeerLock.Unlock()
+	for listenAddr, peerKey := range s.PeerAliases {
+		if peerKey == fromPeer.String() {
+			return listenAddr
+		}
+	}
+	return fromPeer.String()
+}
+
+// isPeerAt reports whether fromPeer is a connection to the node listening on listenAddr, once the claims of that address being
+// verified are settled
+func (s *Store) isPeerAt(fromPeer p2p.Peer, listenAddr string) bool {
+	s.waitAliasClaims(listenAddr)
+	return s.peerListenAddr(fromPeer) == listenAddr
+}
+
+// normalizedListenAddress returns the address this Store listens on, in the same notation that remote addresses of peers use
+func (s *Store) normalizedListenAddress() string {
+	addr, err := util.SafeStringToAddr(s.StoreOpts.ListenAddress)
+	if err != nil {
+		return s.StoreOpts.ListenAddress
+	}
+	return addr.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"file-store/internal/dht"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPeersCannotTakeTheAliasOfAnotherNode(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	node := cluster.Nodes[0]
+	genuine, connected := node.peerForAddr(clusterNodeAddr(1))
+	assert.True(t, connected)
+
+	// Another connection claims to be node 1
+	peers := make(chan p2p.Peer, 1)
+	impostor := p2p.NewMemoryTransport(cluster.Network, p2p.TCPTransportOpts{
+		ListenAddress: "127.0.0.1:7099",
+		HandshakeFunc: p2p.NOHANDSHAKE,
+		OnPeer: func(peer p2p.Peer) error {
+			peers <- peer
+			return nil
+		},
+	}, util.MessageChanBufferSize)
+	assert.Nil(t, impostor.ListenAndAccept())
+	t.Cleanup(func() {
+		_ = impostor.Close()
+	})
+	assert.Nil(t, impostor.Dial(clusterNodeAddr(0)))
+	conn := <-peers
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, command := range []p2p.ControlMessage{p2p.MESSAGE_PING_CONTROL_COMMAND, p2p.MESSAGE_FIND_NODE_CONTROL_COMMAND} {
+		msg := p2p.Message{
+			Type: p2p.ControlMessageType,
+			Payload: p2p.ControlPayload{
+				Command: command,
+				Args:    map[string]string{"sender_addr": clusterNodeAddr(1), "target": node.DHT.Self.ID.String()},
+			},
+		}
+		_, err := impostor.Call(ctx, conn, msg)
+		assert.Nil(t, err)
+	}
+
+	// Node 1 doesn't vouch for the connection once node 0 dials it back, so node 1 keeps its alias, and the impostor isn't
+	// recorded as node 1
+	assert.Never(t, func() bool {
+		peer, connected := node.peerForAddr(clusterNodeAddr(1))
+		return !connected || peer != genuine
+	}, 500*time.Millisecond, 10*time.Millisecond)
+	node.PeerLock.Lock()
+	impostorPeer := node.PeerMap[conn.LocalAddr().String()]
+	node.PeerLock.Unlock()
+	if assert.NotNil(t, impostorPeer) {
+		assert.Equal(t, peerActorPrefix+conn.LocalAddr().String(), node.peerActor(impostorPeer))
+	}
+	assert.Equal(t, peerActorPrefix+clusterNodeAddr(1), node.peerActor(genuine))
+}
+
+func TestHeldFilesAreReprovidedBeforeTheirRecordsExpire(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	cluster.Store(0, util.CommonFileKey, []byte(util.CommonStringContent))
+	cluster.WaitStored(util.CommonFileKey, 0, 1, 2)
+	cluster.WaitProviders(util.CommonFileKey, 1, 3)
+
+	// Every provider record of the file expires
+	keyID := dht.KeyID(util.CommonFileKey)
+	for _, node := range cluster.Nodes {
+		for _, provider := range node.DHT.Providers.Get(keyID) {
+			node.DHT.Providers.Add(keyID, provider, time.Nanosecond)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	for _, node := range cluster.Nodes {
+		assert.Empty(t, node.DHT.Providers.Get(keyID))
+	}
+
+	// Until the nodes holding it announce it again
+	cluster.Nodes[0].reprovideKeys()
+	cluster.WaitProviders(util.CommonFileKey, 1, 1)
+	providers := cluster.Nodes[1].DHT.Providers.Get(keyID)
+	assert.Len(t, providers, 1)
+	assert.Equal(t, cluster.Nodes[0].DHT.Self.ID, providers[0].ID)
+}
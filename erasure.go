@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file-store/internal/erasure"
+	"file-store/internal/p2p"
+	"file-store/internal/rebalance"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTooFewNodes is returned when a file can't be erasure coded, since there are fewer nodes than shards to place on them
+var ErrTooFewNodes = errors.New("too few nodes to place every shard on a distinct one")
+
+// mayBeErasureCoded reports whether the file of key may be held as shards, which is the case if this Store erasure codes the
+// files it stores, or holds a shard of key
+func (s *Store) mayBeErasureCoded(key string) bool {
+	if s.StoreOpts.ErasureDataShards > 0 {
+		return true
+	}
+	indexes, err := s.Shards.Indexes(key)
+	return err == nil && len(indexes) > 0
+}
+
+// handleStoreErasureCoded splits the file of key read from r into ErasureDataShards data shards, computes ErasureParityShards
+// parity shards for them, and places every shard on a distinct node, the nearest nodes to key first. No node holds the whole
+// file, so that it takes (data + parity) / data times its size to store it. The write fails unless enough shards were placed
+// to reconstruct the file from, and the shards that weren't are rebuilt by the next repair.
+func (s *Store) handleStoreErasureCoded(key string, r io.Reader) error {
+	codec, err := erasure.NewCodec(s.StoreOpts.ErasureDataShards, s.StoreOpts.ErasureParityShards)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	shards := codec.Split(data)
+	if err := codec.Encode(shards); err != nil {
+		return err
+	}
+	manifest := erasure.NewManifest(key, int64(len(data)), codec, shards)
+	nodes := rebalance.Owners(key, s.placementNodes(false), codec.Shards())
+	if len(nodes) < codec.Shards() {
+		return fmt.Errorf("erasure coding %s into %d shards across %d nodes: %w", key, codec.Shards(), len(nodes), ErrTooFewNodes)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), util.ShardPlaceTimeout)
+	defer cancel()
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(shards))
+	)
+	for index, shard := range shards {
+		wg.Add(1)
+		go func(index int, shard []byte) {
+			defer wg.Done()
+			errs[index] = s.placeShard(ctx, manifest, index, shard, nodes[index])
+		}(index, shard)
+	}
+	wg.Wait()
+
+	placed := 0
+	for index, err := range errs {
+		if err != nil {
+			log.Printf("Couldn't place shard %d of %s on %s: %v", index, key, nodes[index], err)
+			continue
+		}
+		placed++
+	}
+	if placed < codec.DataShards {
+		return fmt.Errorf("placed %d of the %d shards needed to reconstruct %s: %w", placed, codec.DataShards, key, errors.Join(errs...))
+	}
+	log.Printf("Placed %d of %d shards of %s", placed, codec.Shards(), key)
+
+	// A whole copy held of an earlier version would be read instead of the shards
+	if s.existsInStorage(key) {
+		return s.deleteAudited(key, erasureActor, s.handleFileDelete)
+	}
+	return nil
+}
+
+// placeShard stores the shard at index of the file that manifest describes on the node listening on addr
+func (s *Store) placeShard(ctx context.Context, manifest erasure.Manifest, index int, shard []byte, addr string) error {
+	if addr == s.normalizedListenAddress() {
+		return s.Shards.Put(manifest, index, bytes.NewReader(shard))
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, util.ShardConnectTimeout)
+	defer cancel()
+	peer, err := s.connectToPeer(connectCtx, addr)
+	if err != nil {
+		return err
+	}
+	return s.streamShardToPeer(manifest, index, shard, peer)
+}
+
+// streamShardToPeer streams the shard at index of the file that manifest describes to toPeer, on a STORE_SHARD stream
+func (s *Store) streamShardToPeer(manifest erasure.Manifest, index int, shard []byte, toPeer p2p.Peer) error {
+	defer s.beginTransfer()()
+	stream, err := toPeer.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	message := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_STORE_SHARD_CONTROL_COMMAND,
+			Args: map[string]string{
+				"key":      manifest.Key,
+				"index":    strconv.Itoa(index),
+				"size":     strconv.Itoa(len(shard)),
+				"manifest": manifest.Encode(),
+			},
+		},
+	}
+	if err := s.encodeMessage(message, toPeer, stream); err != nil {
+		return err
+	}
+	if _, err := stream.Write(shard); err != nil {
+		return err
+	}
+
+	// The peer closes its end once it stored the shard, or resets it if it has no room for it, so wait for that before the
+	// transfer counts as over
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, stream)
+	return err
+}
+
+// handleStoreShardStream stores the shard that fromPeer streams along with a STORE_SHARD with the given args
+func (s *Store) handleStoreShardStream(args map[string]string, stream io.Reader, fromPeer p2p.Peer) error {
+	defer s.beginTransfer()()
+	index, indexErr := strconv.Atoi(args["index"])
+	size, sizeErr := strconv.ParseInt(args["size"], 10, 64)
+	manifest, manifestErr := erasure.DecodeManifest(args["manifest"])
+	if indexErr != nil || sizeErr != nil || manifestErr != nil {
+		return fmt.Errorf("invalid index/size/manifest for STORE_SHARD Control Message %s", fromPeer.String())
+	}
+	if err := validatePeerKey(manifest.Key, p2p.MESSAGE_STORE_SHARD_CONTROL_COMMAND, fromPeer); err != nil {
+		return err
+	}
+	if err := s.checkReplicaRoom(manifest.Key, size); err != nil {
+		return err
+	}
+	log.Printf("Storing shard %d of %s", index, manifest.Key)
+	return s.Shards.Put(manifest, index, io.LimitReader(stream, size))
+}
+
+// handleFetchShard answers a FETCH_SHARD from fromPeer. Without an index, the reply tells which shards of the key are held, along
+// with their manifest. With one, the reply holds the requested range of that shard.
+func (s *Store) handleFetchShard(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	key, keyExists := payload.Args["key"]
+	if !keyExists {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing key for FETCH_SHARD Control Message %s", fromPeer.String())
+	}
+	if err := validatePeerKey(key, payload.Command, fromPeer); err != nil {
+		return err
+	}
+	if _, hasIndex := payload.Args["index"]; !hasIndex {
+		manifest, err := s.Shards.Manifest(key)
+		indexes, indexesErr := s.Shards.Indexes(key)
+		if err != nil || indexesErr != nil || len(indexes) == 0 {
+			return p2p.NewRemoteError(p2p.ErrorCodeNotFound, "no shards of %s on %s", key, s.StoreOpts.ListenAddress)
+		}
+		msg := p2p.ConstructFetchResponseMessage(true)
+		args := msg.Payload.(p2p.ControlPayload).Args
+		args["manifest"] = manifest.Encode()
+		args["indexes"] = encodeIndexes(indexes)
+		return s.replyToPeer(payload, msg, fromPeer)
+	}
+
+	var (
+		index, indexErr   = strconv.Atoi(payload.Args["index"])
+		offset, offsetErr = strconv.ParseInt(payload.Args["offset"], 10, 64)
+		length, lengthErr = strconv.ParseInt(payload.Args["length"], 10, 64)
+	)
+	if indexErr != nil || offsetErr != nil || lengthErr != nil || length < 0 || length > util.ShardFetchChunkSize {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid index/offset/length for FETCH_SHARD Control Message %s", fromPeer.String())
+	}
+	data := make([]byte, length)
+	n, err := s.Shards.ReadAt(key, index, data, offset)
+	if err != nil && err != io.EOF {
+		return p2p.NewRemoteError(p2p.ErrorCodeNotFound, "shard %d of %s is unavailable: %v", index, key, err)
+	}
+	msg := p2p.Message{
+		Type: p2p.DataMessageType,
+		Payload: p2p.DataPayload{
+			Key:  key,
+			Data: data[:n],
+		},
+	}
+	return s.replyToPeer(payload, msg, fromPeer)
+}
+
+// shardLocations holds which nodes hold each shard of an erasure coded file
+type shardLocations struct {
+	manifest erasure.Manifest
+	// holders maps the index of every shard to the listen addresses of the nodes holding it
+	holders map[int][]string
+}
+
+// holds reports whether the node listening on addr holds any shard of the file
+func (l *shardLocations) holds(addr string) bool {
+	for _, holders := range l.holders {
+		for _, holder := range holders {
+			if holder == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// locateShards asks this Store and every live member which shards of key they hold. Holders may hold shards of different versions
+// of the file, so the version held by the most of them wins. If no node holds a shard of key, os.ErrNotExist is returned.
+func (s *Store) locateShards(key string) (*shardLocations, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), util.ShardLocateTimeout)
+	defer cancel()
+
+	type located struct {
+		addr     string
+		manifest erasure.Manifest
+		indexes  []int
+	}
+	nodes := s.placementNodes(false)
+	results := make(chan *located, len(nodes))
+	for _, addr := range nodes {
+		go func(addr string) {
+			if addr == s.normalizedListenAddress() {
+				manifest, err := s.Shards.Manifest(key)
+				indexes, _ := s.Shards.Indexes(key)
+				if err != nil || len(indexes) == 0 {
+					results <- nil
+					return
+				}
+				results <- &located{addr: addr, manifest: manifest, indexes: indexes}
+				return
+			}
+			reply, err := s.callPeer(ctx, addr, p2p.MESSAGE_FETCH_SHARD_CONTROL_COMMAND, map[string]string{"key": key})
+			if err != nil {
+				if !errors.Is(err, p2p.ErrNotFound) {
+					log.Printf("Couldn't locate shards of %s on %s: %v", key, addr, err)
+				}
+				results <- nil
+				return
+			}
+			manifest, err := erasure.DecodeManifest(reply["manifest"])
+			indexes, indexesErr := decodeIndexes(reply["indexes"], manifest.Shards())
+			if err != nil || indexesErr != nil {
+				log.Printf("Invalid shard locations of %s from %s", key, addr)
+				results <- nil
+				return
+			}
+			results <- &located{addr: addr, manifest: manifest, indexes: indexes}
+		}(addr)
+	}
+
+	versions := make(map[string]*shardLocations)
+	holdersOf := make(map[string]int)
+	for range nodes {
+		result := <-results
+		if result == nil {
+			continue
+		}
+		version := result.manifest.Encode()
+		if versions[version] == nil {
+			versions[version] = &shardLocations{manifest: result.manifest, holders: make(map[int][]string)}
+		}
+		for _, index := range result.indexes {
+			versions[version].holders[index] = append(versions[version].holders[index], result.addr)
+		}
+		holdersOf[version]++
+	}
+
+	var picked string
+	for version := range versions {
+		if picked == "" || holdersOf[version] > holdersOf[picked] {
+			picked = version
+		}
+	}
+	if picked == "" {
+		return nil, os.ErrNotExist
+	}
+	return versions[picked], nil
+}
+
+// fetchShards fetches DataShards of the shards of the file that locations describes from their holders, the data shards first
+// so that the file doesn't have to be decoded if they are all there. The shards that weren't fetched are nil.
+func (s *Store) fetchShards(locations *shardLocations) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), util.ShardFetchTimeout)
+	defer cancel()
+
+	manifest := locations.manifest
+	shards := make([][]byte, manifest.Shards())
+	fetched := 0
+	for index := 0; index < manifest.Shards() && fetched < manifest.DataShards; index++ {
+		for _, addr := range locations.holders[index] {
+			shard, err := s.fetchShard(ctx, manifest, index, addr)
+			if err != nil {
+				log.Printf("Couldn't fetch shard %d of %s from %s: %v", index, manifest.Key, addr, err)
+				continue
+			}
+			shards[index] = shard
+			fetched++
+			break
+		}
+	}
+	if fetched < manifest.DataShards {
+		return nil, fmt.Errorf("fetched %d of the %d shards needed to reconstruct %s: %w", fetched, manifest.DataShards, manifest.Key, erasure.ErrTooFewShards)
+	}
+	return shards, nil
+}
+
+// fetchShard fetches the shard at index of the file that manifest describes from the node listening on addr, a range at a time,
+// and checks it against manifest
+func (s *Store) fetchShard(ctx context.Context, manifest erasure.Manifest, index int, addr string) ([]byte, error) {
+	if addr == s.normalizedListenAddress() {
+		shard, err := s.Shards.Read(manifest.Key, index)
+		if err == nil && !manifest.Verify(index, shard) {
+			err = fmt.Errorf("shard %d of %s doesn't match its manifest", index, manifest.Key)
+		}
+		return shard, err
+	}
+	peer, err := s.connectToPeer(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	shard := make([]byte, 0, manifest.ShardSize)
+	for offset := int64(0); offset < manifest.ShardSize; {
+		msg := p2p.Message{
+			Type: p2p.ControlMessageType,
+			Payload: p2p.ControlPayload{
+				Command: p2p.MESSAGE_FETCH_SHARD_CONTROL_COMMAND,
+				Args: map[string]string{
+					"key":    manifest.Key,
+					"index":  strconv.Itoa(index),
+					"offset": strconv.FormatInt(offset, 10),
+					"length": strconv.FormatInt(min(util.ShardFetchChunkSize, manifest.ShardSize-offset), 10),
+				},
+			},
+		}
+		reply, err := s.Transport.Call(ctx, peer, msg)
+		if err != nil {
+			return nil, err
+		}
+		payload, isData := reply.Payload.(p2p.DataPayload)
+		if !isData || len(payload.Data) == 0 {
+			return nil, fmt.Errorf("unexpected %s reply to FETCH_SHARD from %s", reply.Type, addr)
+		}
+		shard = append(shard, payload.Data...)
+		offset += int64(len(payload.Data))
+	}
+	if !manifest.Verify(index, shard) {
+		return nil, fmt.Errorf("shard %d of %s from %s doesn't match its manifest", index, manifest.Key, addr)
+	}
+	return shard, nil
+}
+
+// handleGetErasureCoded reconstructs the file of key from the shards held across the cluster. If no node holds a shard of key,
+// os.ErrNotExist is returned.
+func (s *Store) handleGetErasureCoded(key string) ([]byte, error) {
+	locations, err := s.locateShards(key)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := s.fetchShards(locations)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := locations.manifest.Codec()
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	return codec.Join(shards, locations.manifest.Size)
+}
+
+// runShardRepair rebuilds the lost shards of the erasure coded files this Store holds shards of every ShardRepairInterval
+func (s *Store) runShardRepair() {
+	ticker := time.NewTicker(s.StoreOpts.ShardRepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.repairShards()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// repairShards rebuilds the lost shards of every erasure coded file this Store holds shards of
+func (s *Store) repairShards() {
+	keys, err := s.Shards.Keys()
+	if err != nil {
+		log.Println("Error while listing shards:", err)
+		return
+	}
+	for _, key := range keys {
+		if err := s.repairShardsOf(key); err != nil {
+			log.Printf("Error while repairing the shards of %s: %v", key, err)
+		}
+	}
+}
+
+// repairShardsOf rebuilds the shards of key that no live node holds from the others, and places each on a node holding none of
+// them yet. Only the holder nearest to key repairs it, so that its holders don't all rebuild the same shards.
+func (s *Store) repairShardsOf(key string) error {
+	locations, err := s.locateShards(key)
+	if err != nil {
+		return err
+	}
+	self := s.normalizedListenAddress()
+	nodes := rebalance.Owners(key, s.placementNodes(false), 0)
+	for _, node := range nodes {
+		if locations.holds(node) {
+			if node != self {
+				return nil
+			}
+			break
+		}
+	}
+
+	var missing []int
+	for index := 0; index < locations.manifest.Shards(); index++ {
+		if len(locations.holders[index]) == 0 {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	log.Printf("Rebuilding %d lost shards of %s", len(missing), key)
+	shards, err := s.fetchShards(locations)
+	if err != nil {
+		return err
+	}
+	codec, err := locations.manifest.Codec()
+	if err != nil {
+		return err
+	}
+	if err := codec.Reconstruct(shards); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), util.ShardPlaceTimeout)
+	defer cancel()
+	var targets []string
+	for _, node := range nodes {
+		if !locations.holds(node) {
+			targets = append(targets, node)
+		}
+	}
+	for _, index := range missing {
+		for len(targets) > 0 {
+			target := targets[0]
+			targets = targets[1:]
+			if err := s.placeShard(ctx, locations.manifest, index, shards[index], target); err != nil {
+				log.Printf("Couldn't place shard %d of %s on %s: %v", index, key, target, err)
+				continue
+			}
+			log.Printf("Rebuilt shard %d of %s on %s", index, key, target)
+			break
+		}
+	}
+	return nil
+}
+
+// encodeIndexes returns the comma separated notation of the shard indexes
+func encodeIndexes(indexes []int) string {
+	encoded := make([]string, len(indexes))
+	for i, index := range indexes {
+		encoded[i] = strconv.Itoa(index)
+	}
+	return strings.Join(encoded, ",")
+}
+
+// decodeIndexes parses the shard indexes encoded by encodeIndexes, each of which must be below count
+func decodeIndexes(s string, count int) ([]int, error) {
+	var indexes []int
+	for _, part := range strings.Split(s, ",") {
+		index, err := strconv.Atoi(part)
+		if err != nil || index < 0 || index >= count {
+			return nil, fmt.Errorf("invalid shard index %q", part)
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newErasureCodedCluster starts n nodes that erasure code the files they store into the given numbers of shards
+func newErasureCodedCluster(t *testing.T, n int, dataShards, parityShards int) *testCluster {
+	cluster := startTestCluster(&testCluster{t: t, configure: func(opts *StoreOpts) {
+		opts.ErasureDataShards = dataShards
+		opts.ErasureParityShards = parityShards
+	}}, n)
+	cluster.waitPlaced()
+	return cluster
+}
+
+// shardHolders returns the nodes that hold a shard of key, by index of the node
+func (c *testCluster) shardHolders(key string) map[int][]int {
+	holders := make(map[int][]int)
+	for i, store := range c.Nodes {
+		indexes, err := store.Shards.Indexes(key)
+		assert.Nil(c.t, err)
+		if len(indexes) > 0 {
+			holders[i] = indexes
+		}
+	}
+	return holders
+}
+
+func TestErasureCodedFileSurvivesLostShards(t *testing.T) {
+	cluster := newErasureCodedCluster(t, 4, 2, 1)
+	data := make([]byte, 100*1024)
+	_, _ = rand.Read(data)
+	cluster.Store(0, "archive", data)
+
+	// Every shard is on a node of its own, and no node holds the whole file
+	holders := cluster.shardHolders("archive")
+	assert.Len(t, holders, 3)
+	for i, indexes := range holders {
+		assert.Len(t, indexes, 1, "node %d", i)
+	}
+	for i := range cluster.Nodes {
+		assert.False(t, cluster.Nodes[i].existsInStorage("archive"))
+		read, err := cluster.Nodes[i].handleGetFile("archive", true)
+		assert.Nil(t, err)
+		assert.Equal(t, data, read, "read from node %d", i)
+	}
+
+	// Losing a holder leaves enough shards to read the file from
+	var lost, reader int
+	for i := range holders {
+		lost = i
+		break
+	}
+	for i := range cluster.Nodes {
+		if _, holds := holders[i]; !holds && i != lost {
+			reader = i
+		}
+	}
+	cluster.Isolate(lost)
+	read, err := cluster.Nodes[reader].handleGetFile("archive", true)
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+
+	// And the repair rebuilds the lost shard on the node that held none
+	for i, store := range cluster.Nodes {
+		if i != lost {
+			store.repairShards()
+		}
+	}
+	assert.Eventually(t, func() bool {
+		indexes, err := cluster.Nodes[reader].Shards.Indexes("archive")
+		return err == nil && len(indexes) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	held := make(map[int]bool)
+	for i, indexes := range cluster.shardHolders("archive") {
+		if i != lost {
+			held[indexes[0]] = true
+		}
+	}
+	assert.Len(t, held, 3)
+}
+
+func TestErasureCodingNeedsANodePerShard(t *testing.T) {
+	cluster := newErasureCodedCluster(t, 2, 2, 1)
+	err := cluster.Nodes[0].handleStoreFile("archive", strings.NewReader("too few nodes for three shards"))
+	assert.ErrorIs(t, err, ErrTooFewNodes)
+}
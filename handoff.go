@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"file-store/internal/hints"
+	"file-store/internal/p2p"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"io"
+	"log"
+)
+
+// hintUnreachableOwners holds a hint for every owner that the version of the stored file of key with the given checksum can't be
+// replicated to, since it isn't connected to us, so that the write is handed off to it once it is back rather than lost for it.
+// Failed members count as owners here, as they are likely to come back.
+func (s *Store) hintUnreachableOwners(key string, checksum string) {
+	if s.Hints == nil {
+		return
+	}
+	nodes := s.placementNodes(true)
+	for _, member := range append(s.Members.Members(), s.Members.Failed()...) {
+		if _, connected := s.peerForAddr(member.Addr); connected || !s.isOwnedBy(key, nodes, member.Addr) {
+			continue
+		}
+		if err := s.hintOwner(member.Addr, key, checksum); err != nil {
+			log.Printf("Couldn't hold a hint of %s for %s: %v", key, member.Addr, err)
+			continue
+		}
+		log.Printf("Holding a hint of %s for %s, which is unreachable", key, member.Addr)
+	}
+}
+
+// hintOwner holds a hint that the version of the stored file of key with the given checksum is meant for owner
+func (s *Store) hintOwner(owner string, key string, checksum string) error {
+	fd, version, err := s.openVersion(key, checksum)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.Hints.Add(owner, key, info.Size(), versionArgs(version), fd)
+	return err
+}
+
+// replayHints hands the writes held for owner off to it, oldest first, and forgets every hint that owner confirmed it stored.
+// Only one replay per owner runs at a time, and the hints that couldn't be handed off are kept for the next one.
+func (s *Store) replayHints(owner string) {
+	if s.Hints == nil {
+		return
+	}
+	if _, replaying := s.hintReplays.LoadOrStore(owner, struct{}{}); replaying {
+		return
+	}
+	defer s.hintReplays.Delete(owner)
+
+	hints, err := s.Hints.ForOwner(owner)
+	if err != nil {
+		log.Printf("Error while listing hints for %s: %v", owner, err)
+		return
+	}
+	if len(hints) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), util.HintReplayTimeout)
+	defer cancel()
+	peer, err := s.connectToPeer(ctx, owner)
+	if err != nil {
+		log.Printf("Couldn't hand %d hints off to %s: %v", len(hints), owner, err)
+		return
+	}
+
+	log.Printf("Handing %d hints off to %s", len(hints), owner)
+	for _, hint := range hints {
+		if err := s.handOffHint(ctx, hint, peer); err != nil {
+			log.Printf("Couldn't hand the hint of %s off to %s: %v", hint.Key, owner, err)
+			continue
+		}
+		if err := s.Hints.Remove(hint.ID); err != nil {
+			log.Printf("Error while removing the hint of %s for %s: %v", hint.Key, owner, err)
+		}
+	}
+}
+
+// handOffHint replicates the data held by hint to toPeer, as the version of the file of its key that was written, and returns
+// once toPeer stored it. Small files are acknowledged by toPeer, and large ones are stored once toPeer closed their stream.
+func (s *Store) handOffHint(ctx context.Context, hint *hints.Hint, toPeer p2p.Peer) error {
+	fd, err := s.Hints.Open(hint.ID)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if hint.Size > util.MaxAllowedDataPayloadSize {
+		return s.streamToPeer(hint.Key, fd, hint.Version, upload.NewSessionID(), 0, toPeer, nil)
+	}
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return err
+	}
+	msg := p2p.ConstructDataMessage(hint.Key, data)
+	for name, value := range hint.Version {
+		msg = msg.WithArg(name, value)
+	}
+	return s.storeOnPeer(ctx, msg, toPeer)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"file-store/internal/membership"
+	"file-store/internal/p2p"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHintedHandoffToUnreachableMember(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4*1024)
+
+	// Writes made while node 2 is down are held for it by the node they were made on
+	cluster.Isolate(2)
+	cluster.Store(0, "small", []byte("small content"))
+	cluster.Store(0, "large", large)
+	cluster.WaitStored("large", 1)
+	hints, err := cluster.Nodes[0].Hints.ForOwner(clusterNodeAddr(2))
+	assert.Nil(t, err)
+	assert.Len(t, hints, 2)
+	hints, err = cluster.Nodes[1].Hints.List()
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+
+	// Once it is back, they are handed off to it and forgotten
+	cluster.Rejoin(2)
+	cluster.WaitStored("small", 2)
+	cluster.WaitStored("large", 2)
+	stored, err := cluster.Nodes[2].handleFileRead("large")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(large, stored))
+	assert.Eventually(t, func() bool {
+		hints, err := cluster.Nodes[0].Hints.List()
+		return err == nil && len(hints) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHintsForLeftMemberAreDropped(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster.Isolate(1)
+	cluster.Store(0, "key", []byte("content"))
+	hints, err := cluster.Nodes[0].Hints.List()
+	assert.Nil(t, err)
+	assert.Len(t, hints, 1)
+
+	// A member that left for good isn't held writes for anymore
+	member, known := cluster.Nodes[0].Members.Member(clusterNodeAddr(1))
+	assert.True(t, known)
+	cluster.Nodes[0].onMembershipEvent(membership.Event{Type: membership.EventLeave, Member: member})
+	hints, err = cluster.Nodes[0].Hints.List()
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+}
+
+func TestHintsAreKeptUntilTheOwnerStoresThem(t *testing.T) {
+	// The owner fails to store the first hand-off of each hint, the small one as it arrives corrupted and the large one as its
+	// stream is cut off
+	policy := p2p.NewScheduledFaultPolicy(
+		p2p.FaultStep{Match: p2p.MatchData, Fault: p2p.FaultCorrupt},
+		p2p.FaultStep{Match: p2p.MatchCommand(p2p.MESSAGE_STORE_CONTROL_COMMAND), Fault: p2p.FaultTruncate},
+	)
+	cluster := newChaosCluster(t, 2, p2p.FaultyTransportOpts{TruncateAfter: 1024}, map[int]p2p.FaultPolicy{1: policy})
+	hinting, owner := cluster.Nodes[0], clusterNodeAddr(1)
+	// The replays run once the nodes connected are done before the hints are held, so that they are replayed here only
+	assert.Eventually(t, func() bool {
+		_, replaying := hinting.hintReplays.Load(owner)
+		return !replaying
+	}, 5*time.Second, 10*time.Millisecond)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4*1024)
+	_, err := hinting.Hints.Add(owner, "small", int64(len("small content")), nil, bytes.NewReader([]byte("small content")))
+	assert.Nil(t, err)
+	_, err = hinting.Hints.Add(owner, "large", int64(len(large)), nil, bytes.NewReader(large))
+	assert.Nil(t, err)
+
+	hinting.replayHints(owner)
+	assert.True(t, policy.Done())
+	hints, err := hinting.Hints.ForOwner(owner)
+	assert.Nil(t, err)
+	assert.Len(t, hints, 2)
+
+	hinting.replayHints(owner)
+	hints, err = hinting.Hints.ForOwner(owner)
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+	stored, err := cluster.Nodes[1].handleFileRead("large")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(large, stored))
+	cluster.WaitStored("small", 1)
+}
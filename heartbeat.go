@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"file-store/internal/p2p"
+	"log"
+	"sort"
+	"time"
+)
+
+// runHeartbeats sends a HEARTBEAT to every connected peer every HeartbeatInterval, and evicts the peers that stayed silent
+// for longer than HeartbeatTimeout. A half-open connection would otherwise look healthy until a write to it fails.
+func (s *Store) runHeartbeats() {
+	ticker := time.NewTicker(s.StoreOpts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.heartbeatPeers()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// heartbeatPeers runs a single round of heartbeats
+func (s *Store) heartbeatPeers() {
+	for _, peer := range s.connectedPeers() {
+		// Anything read from the peer counts, so a peer busy streaming to us isn't evicted for missing HEARTBEAT_ACKs
+		if silence := time.Since(peer.Stats().LastSeen()); silence > s.StoreOpts.HeartbeatTimeout {
+			log.Printf("Evicting peer %s, silent for %s", peer, silence.Round(time.Millisecond))
+			// OnPeerDisconnect takes care of forgetting it once the read loop ends
+			if err := peer.Close(); err != nil {
+				log.Printf("Error while closing connection to %s: %v", peer, err)
+			}
+			continue
+		}
+		// A heartbeat waits for its HEARTBEAT_ACK, so don't pile up heartbeats behind the one in flight
+		if _, inFlight := s.heartbeatsInFlight.LoadOrStore(peer, struct{}{}); inFlight {
+			continue
+		}
+		go func(peer p2p.Peer) {
+			defer s.heartbeatsInFlight.Delete(peer)
+			msg := p2p.Message{
+				Type: p2p.ControlMessageType,
+				Payload: p2p.ControlPayload{
+					Command: p2p.MESSAGE_HEARTBEAT_CONTROL_COMMAND,
+					Args:    s.roomArgs(),
+				},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), s.StoreOpts.HeartbeatTimeout)
+			defer cancel()
+			sentAt := time.Now()
+			reply, err := s.Transport.Call(ctx, peer, msg)
+			if err != nil {
+				log.Printf("No HEARTBEAT_ACK from %s: %v", peer, err)
+				return
+			}
+			peer.Stats().ObserveRTT(time.Since(sentAt))
+			room, _ := reply.Arg(roomArg)
+			observeRoom(room, peer)
+		}(peer)
+	}
+}
+
+// handleHeartbeat answers a HEARTBEAT from fromPeer with a HEARTBEAT_ACK. Both advertise the room for files of their sender.
+// The answer is sent off the worker, since it may have to wait for fromPeer to make room on the control stream.
+func (s *Store) handleHeartbeat(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	observeRoom(payload.Args[roomArg], fromPeer)
+	go func() {
+		msg := p2p.Message{
+			Type: p2p.ControlMessageType,
+			Payload: p2p.ControlPayload{
+				Command: p2p.MESSAGE_HEARTBEAT_ACK_CONTROL_COMMAND,
+				Args:    s.roomArgs(),
+			},
+		}
+		if err := s.replyToPeer(payload, msg, fromPeer); err != nil {
+			log.Printf("Couldn't send HEARTBEAT_ACK to %s: %v", fromPeer, err)
+		}
+	}()
+	return nil
+}
+
+// peerRTT returns the smoothed round trip time to the connected peer with the given address, and whether it has been measured
+func (s *Store) peerRTT(addr string) (time.Duration, bool) {
+	peer, exists := s.peerForAddr(addr)
+	if !exists {
+		return 0, false
+	}
+	return peer.Stats().RTT()
+}
+
+// sortByRTT orders peer addresses by their round trip time, nearest first, leaving the ones not measured yet at the end
+func (s *Store) sortByRTT(addrs []string) {
+	rtts := make(map[string]time.Duration, len(addrs))
+	for _, addr := range addrs {
+		if rtt, measured := s.peerRTT(addr); measured {
+			rtts[addr] = rtt
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		rttI, measuredI := rtts[addrs[i]]
+		rttJ, measuredJ := rtts[addrs[j]]
+		if measuredI != measuredJ {
+			return measuredI
+		}
+		return rttI < rttJ
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"file-store/internal/p2p"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// addPipePeer connects a peer over an in-memory pipe to store under addr, and returns the remote end of the pipe
+func addPipePeer(t *testing.T, store *Store, addr string) (p2p.Peer, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+	peer := p2p.NewTCPPeer(local, true, p2p.SendQueueOpts{})
+	store.PeerMap[addr] = peer
+	return peer, remote
+}
+
+func TestSortByRTT(t *testing.T) {
+	store := createStoreWithDefaultOptions(":5002", nil, t.TempDir())
+	near, _ := addPipePeer(t, store, "127.0.0.1:6001")
+	far, _ := addPipePeer(t, store, "127.0.0.1:6002")
+	addPipePeer(t, store, "127.0.0.1:6003")
+	near.Stats().ObserveRTT(time.Millisecond)
+	far.Stats().ObserveRTT(50 * time.Millisecond)
+
+	addrs := []string{"127.0.0.1:6003", "127.0.0.1:6004", "127.0.0.1:6002", "127.0.0.1:6001"}
+	store.sortByRTT(addrs)
+	assert.Equal(t, []string{"127.0.0.1:6001", "127.0.0.1:6002", "127.0.0.1:6003", "127.0.0.1:6004"}, addrs)
+}
+
+func TestHeartbeatEvictsSilentPeers(t *testing.T) {
+	store := createStoreWithDefaultOptions(":5002", nil, t.TempDir())
+	_, remote := addPipePeer(t, store, "127.0.0.1:6001")
+
+	store.StoreOpts.HeartbeatTimeout = 0
+	store.heartbeatPeers()
+
+	// The connection of the silent peer is closed, which the remote end sees as the peer going away
+	_, err := remote.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
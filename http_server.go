@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"file-store/internal/acl"
+	"file-store/internal/audit"
+	"file-store/internal/bucket"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setupHTTPServer starts the client facing HTTP API of the Store on listenAddress
+func (s *Store) setupHTTPServer(listenAddress string) {
+	log.Printf("Serving HTTP API on %s", listenAddress)
+	server := &http.Server{Addr: listenAddress, Handler: s.newHTTPHandler()}
+	s.httpServer.Store(server)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln("Error serving HTTP API:", err)
+	}
+}
+
+// newHTTPHandler builds the routes of the client facing HTTP API. Every route but the tus discovery one is authorized with the
+// ACL once the Store has an AdminToken, and the routes reading or writing files are recorded in the audit log.
+func (s *Store) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Resumable uploads, following the tus protocol (https://tus.io/protocols/resumable-upload)
+	uploads := http.NewServeMux()
+	uploads.HandleFunc("POST /uploads", s.audited(audit.Store, createUploadKey, s.authorized(acl.Write, createUploadKey, s.handleCreateUpload)))
+	uploads.HandleFunc("HEAD /uploads/{id}", s.authorized(acl.Write, s.uploadSessionKey, s.handleGetUploadOffset))
+	uploads.HandleFunc("PATCH /uploads/{id}", s.audited(audit.Store, s.uploadSessionKey, s.authorized(acl.Write, s.uploadSessionKey, s.handlePatchUpload)))
+	uploads.HandleFunc("DELETE /uploads/{id}", s.audited(audit.Delete, s.uploadSessionKey, s.authorized(acl.Write, s.uploadSessionKey, s.handleDeleteUpload)))
+	mux.HandleFunc("OPTIONS /uploads", s.handleUploadOptions)
+	mux.Handle("/uploads", withTusResumable(uploads))
+	mux.Handle("/uploads/", withTusResumable(uploads))
+
+	// Progress of the latest rebalance
+	mux.HandleFunc("GET /rebalance", s.authorized(acl.Admin, nil, s.handleGetRebalance))
+
+	// Version pointers of the keys, replicated with Raft
+	mux.HandleFunc("GET /namespace/{key}", s.audited(audit.Get, requestKey, s.authorized(acl.Read, requestKey, withValidKey(requestKey, s.handleGetKeyRecord))))
+	mux.HandleFunc("PUT /namespace/{key}", s.audited(audit.Store, requestKey, s.authorized(acl.Write, requestKey, withValidKey(requestKey, s.handlePutKeyRecord))))
+	mux.HandleFunc("DELETE /namespace/{key}", s.audited(audit.Delete, requestKey, s.authorized(acl.Delete, requestKey, withValidKey(requestKey, s.handleDeleteKeyRecord))))
+	mux.HandleFunc("GET /raft", s.authorized(acl.Admin, nil, s.handleGetRaft))
+
+	// Room for files of this node and its peers
+	mux.HandleFunc("GET /capacity", s.authorized(acl.Admin, nil, s.handleGetCapacity))
+
+	// Buckets, the isolated key spaces that files are stored in
+	mux.HandleFunc("GET /buckets", s.audited(audit.List, nil, s.authenticated(s.handleListBuckets)))
+	mux.HandleFunc("POST /buckets", s.authorized(acl.Admin, nil, s.handleCreateBucket))
+	mux.HandleFunc("GET /buckets/{name}", s.authenticated(s.handleGetBucket))
+	mux.HandleFunc("DELETE /buckets/{name}", s.audited(audit.Delete, bucketKey, s.authorized(acl.Admin, bucketKey, s.handleDeleteBucket)))
+
+	// Conflicting versions of the files, and their resolution
+	mux.HandleFunc("GET /siblings/{key}", s.audited(audit.List, requestKey, s.authorized(acl.Read, requestKey, withValidKey(requestKey, s.handleGetSiblings))))
+	mux.HandleFunc("GET /siblings/{key}/{checksum}", s.audited(audit.Get, requestKey, s.authorized(acl.Read, requestKey, withValidKey(requestKey, s.handleGetSibling))))
+	mux.HandleFunc("POST /siblings/{key}/resolve", s.audited(audit.Store, requestKey, s.authorized(acl.Write, requestKey, withValidKey(requestKey, s.handleResolveSiblings))))
+
+	// Principals that requests are made as, and their API tokens
+	mux.HandleFunc("GET /principals", s.authorized(acl.Admin, nil, s.handleListPrincipals))
+	mux.HandleFunc("POST /principals", s.authorized(acl.Admin, nil, s.handleCreatePrincipal))
+	mux.HandleFunc("GET /principals/{name}", s.authorized(acl.Admin, nil, s.handleGetPrincipal))
+	mux.HandleFunc("DELETE /principals/{name}", s.authorized(acl.Admin, nil, s.handleDeletePrincipal))
+	mux.HandleFunc("GET /principals/{name}/tokens", s.authorized(acl.Admin, nil, s.handleListTokens))
+	mux.HandleFunc("POST /principals/{name}/tokens", s.authorized(acl.Admin, nil, s.handleIssueToken))
+	mux.HandleFunc("DELETE /tokens/{id}", s.authorized(acl.Admin, nil, s.handleRevokeToken))
+
+	// Audit trail of the data operations made on this node
+	mux.HandleFunc("GET /audit", s.authorized(acl.Admin, nil, s.handleQueryAudit))
+	mux.HandleFunc("GET /audit/verify", s.authorized(acl.Admin, nil, s.handleVerifyAudit))
+
+	// Debugging tools for the wire protocol
+	mux.HandleFunc("POST /debug/decode", s.authorized(acl.Admin, nil, s.handleDebugDecode))
+	mux.HandleFunc("POST /debug/encode", s.authorized(acl.Admin, nil, s.handleDebugEncode))
+
+	return mux
+}
+
+// withTusResumable rejects requests of an unsupported tus version, and sets the tus version on every response
+func withTusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", util.TusResumableVersion)
+		if r.Header.Get("Tus-Resumable") != util.TusResumableVersion {
+			w.Header().Set("Tus-Version", util.TusResumableVersion)
+			http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleUploadOptions advertises the supported tus version and extensions
+func (s *Store) handleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", util.TusResumableVersion)
+	w.Header().Set("Tus-Version", util.TusResumableVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateUpload starts an upload session for the key given in Upload-Metadata, of Upload-Length bytes
+func (s *Store) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if s.Uploads == nil {
+		http.Error(w, "resumable uploads need a metadata DB", http.StatusServiceUnavailable)
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := uploadKey(metadata)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.bucketOf(key); err != nil {
+		writeBucketError(w, err)
+		return
+	}
+	// The upload is staged here before it is stored, so an upload there is no room for is turned down before it starts
+	if err := s.Capacity.Check(size); err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	session, err := s.Uploads.Create(upload.NewSessionID(), key, size, "", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// An empty upload is complete as soon as it is created
+	if session.IsComplete() {
+		if err := s.finalizeUpload(session, true); err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
+	}
+	w.Header().Set("Location", "/uploads/"+session.ID)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleGetUploadOffset returns the committed offset of an upload session, which is where the client should resume from
+func (s *Store) handleGetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.getUploadSession(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePatchUpload appends the request body to an upload session at Upload-Offset, and stores the file once it is complete
+func (s *Store) handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.getUploadSession(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	session, err = s.Uploads.Patch(session.ID, offset, r.Body)
+	switch {
+	case errors.Is(err, upload.ErrOffsetMismatch):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, upload.ErrSessionLocked):
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	case err != nil:
+		// Whatever made it to disk is committed, and the client can resume from there
+		log.Printf("Upload %s was interrupted: %v", r.PathValue("id"), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if session.IsComplete() {
+		if err := s.finalizeUpload(session, true); err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteUpload terminates an upload session, discarding whatever was uploaded so far
+func (s *Store) handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.getUploadSession(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Uploads.Remove(session.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUploadSession looks up the upload session in the request path, and writes an error response if there is none
+func (s *Store) getUploadSession(w http.ResponseWriter, r *http.Request) (*upload.Session, bool) {
+	if s.Uploads == nil {
+		http.Error(w, "resumable uploads need a metadata DB", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	session, err := s.Uploads.Get(r.PathValue("id"))
+	if errors.Is(err, upload.ErrSessionNotFound) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return session, true
+}
+
+// uploadKey returns the qualified key that the Upload-Metadata of a new upload session names, in the bucket it names if any
+func uploadKey(metadata map[string]string) (string, error) {
+	key, keyExists := metadata["key"]
+	if !keyExists || key == "" {
+		return "", errors.New("missing key in Upload-Metadata")
+	}
+	if strings.Contains(key, bucket.Separator) {
+		return "", errors.New("invalid key in Upload-Metadata")
+	}
+	// Files are uploaded to the default bucket, unless the bucket key of Upload-Metadata names another one
+	qualified := bucket.Qualify(metadata["bucket"], key)
+	if err := bucket.ValidateKey(qualified); err != nil {
+		return "", fmt.Errorf("invalid key in Upload-Metadata: %w", err)
+	}
+	return qualified, nil
+}
+
+// parseUploadMetadata parses a tus Upload-Metadata header, which is a comma separated list of keys and base64 encoded values
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Upload-Metadata value for %s", fields[0])
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("invalid Upload-Metadata pair %q", pair)
+		}
+	}
+	return metadata, nil
+}
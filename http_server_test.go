@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"file-store/internal/db"
+	"file-store/internal/p2p"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupUploadStore quickly sets up a Store with its own storage and metadata DB in a temp dir and returns it
+func setupUploadStore(t *testing.T) *Store {
+	dir := t.TempDir()
+	store := createStoreWithDefaultOptions(":5001", nil, filepath.Join(dir, "storage"))
+	ddb, err := db.InitDB(filepath.Join(dir, "metadata.db"))
+	assert.Nil(t, err)
+	store.attachMetadataDB(&ddb)
+
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	return store
+}
+
+// newTusRequest builds a request against the upload API with the tus version set
+func newTusRequest(method string, target string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", util.TusResumableVersion)
+	return r
+}
+
+func TestResumableUpload(t *testing.T) {
+	store := setupUploadStore(t)
+	handler := store.newHTTPHandler()
+	data := []byte(util.CommonStringContent)
+
+	// Create the upload
+	r := newTusRequest(http.MethodPost, "/uploads", nil)
+	r.Header.Set("Upload-Length", "14")
+	r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte(util.CommonFileKey)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	assert.NotEmpty(t, location)
+
+	// Send the first half
+	r = newTusRequest(http.MethodPatch, location, data[:7])
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "7", w.Header().Get("Upload-Offset"))
+
+	// Resuming from a stale offset conflicts
+	w = httptest.NewRecorder()
+	r = newTusRequest(http.MethodPatch, location, data)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", "0")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Ask where to resume from
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newTusRequest(http.MethodHead, location, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "7", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, "14", w.Header().Get("Upload-Length"))
+
+	// Send the rest, which stores the file
+	r = newTusRequest(http.MethodPatch, location, data[7:])
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", "7")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "14", w.Header().Get("Upload-Offset"))
+
+	content, err := store.handleFileRead(util.CommonFileKey)
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+
+	// The session is gone once the upload is complete
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newTusRequest(http.MethodHead, location, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUploadRejectsUnsupportedTusVersion(t *testing.T) {
+	store := setupUploadStore(t)
+	r := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	w := httptest.NewRecorder()
+	store.newHTTPHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
+
+func TestKeysCannotEscapeTheStorageDirectory(t *testing.T) {
+	escaping := []string{
+		strings.Repeat("../", 12) + "escaped.txt",
+		"photos/../../../../../../../../../../../../escaped.txt",
+		"/escaped.txt",
+	}
+	assertNotWritten := func(store *Store, key string) {
+		t.Helper()
+		_, err := os.Stat(store.filePath(key))
+		assert.ErrorIs(t, err, os.ErrNotExist, key)
+	}
+
+	// Clients are turned down before an upload session is even created
+	store := setupUploadStore(t)
+	handler := store.newHTTPHandler()
+	// Clients may not name buckets in the key itself either, which only Upload-Metadata does
+	for _, key := range append(escaping, "escaped\x00.txt") {
+		r := newTusRequest(http.MethodPost, "/uploads", nil)
+		r.Header.Set("Upload-Length", "4")
+		r.Header.Set("Upload-Metadata", "key "+base64.StdEncoding.EncodeToString([]byte(key)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, key)
+		assertNotWritten(store, key)
+	}
+
+	// So are peers, whether they send the file in a DataPayload or stream it
+	cluster := newTestCluster(t, 2)
+	sender, receiver := cluster.Nodes[0], cluster.Nodes[1]
+	peer, connected := sender.peerForAddr(clusterNodeAddr(1))
+	assert.True(t, connected)
+	content := filepath.Join(t.TempDir(), "content")
+	assert.Nil(t, os.WriteFile(content, []byte("meow"), 0644))
+	for _, key := range escaping {
+		assert.Nil(t, sender.sendMessageToPeer(p2p.ConstructDataMessage(key, []byte("meow")), peer))
+		for _, uploadID := range []string{"", upload.NewSessionID()} {
+			fd, err := os.Open(content)
+			assert.Nil(t, err)
+			_ = sender.streamToPeer(key, fd, nil, uploadID, 0, peer, nil)
+			_ = fd.Close()
+		}
+	}
+	// A valid key sent last is stored, so every message before it was handled by then
+	assert.Nil(t, sender.sendMessageToPeer(p2p.ConstructDataMessage("cat.png", []byte("meow")), peer))
+	cluster.WaitStored("cat.png", 1)
+	for _, key := range escaping {
+		assertNotWritten(receiver, key)
+	}
+
+	// Nor may they read files through such keys
+	for _, key := range escaping {
+		for _, command := range []p2p.ControlMessage{p2p.MESSAGE_FETCH_CONTROL_COMMAND, p2p.MESSAGE_FETCH_CHUNK_CONTROL_COMMAND, p2p.MESSAGE_FETCH_SHARD_CONTROL_COMMAND} {
+			_, err := sender.callPeer(context.Background(), clusterNodeAddr(1), command, map[string]string{"key": key, "offset": "0", "length": "4"})
+			assert.ErrorIs(t, err, p2p.ErrInvalidRequest, key)
+		}
+	}
+
+	// Keys in the path are decoded before they are checked, so escaping the "/" of their ".." segments doesn't help
+	for _, key := range escaping {
+		for _, route := range [][2]string{{http.MethodDelete, "/namespace/"}, {http.MethodGet, "/siblings/"}} {
+			r := httptest.NewRequest(route[0], route[1]+url.PathEscape(key), nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code, route[1]+key)
+		}
+	}
+}
+
+func TestUploadSessionsAreOnlyContinuedByTheirOrigin(t *testing.T) {
+	cluster := newTestCluster(t, 3)
+	receiver := cluster.Nodes[1]
+	origin, connected := receiver.peerForAddr(clusterNodeAddr(0))
+	assert.True(t, connected)
+	other, connected := receiver.peerForAddr(clusterNodeAddr(2))
+	assert.True(t, connected)
+
+	uploadID := upload.NewSessionID()
+	content := bytes.Repeat([]byte("m"), 20)
+	stream := func(key string, from p2p.Peer, offset int64) error {
+		args := map[string]string{
+			"key":       key,
+			"upload_id": uploadID,
+			"offset":    fmt.Sprint(offset),
+			"total":     fmt.Sprint(len(content)),
+			"origin":    clusterNodeAddr(0),
+		}
+		return receiver.handleResumableStoreStream(args, bytes.NewReader(content[offset:offset+10]), 10, from)
+	}
+	assert.Nil(t, stream("cat.png", origin, 0))
+
+	// Neither another key nor another node claiming to be the origin may write into the session
+	assert.Error(t, stream("dog.png", origin, 10))
+	assert.Error(t, stream("cat.png", other, 10))
+	session, err := receiver.Uploads.Get(uploadID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), session.Offset)
+
+	assert.Nil(t, stream("cat.png", origin, 10))
+	cluster.WaitStored("cat.png", 1)
+}
@@ -0,0 +1,371 @@
+package acl
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-store/internal/bucket"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidPrincipal = errors.New("invalid principal")
+	ErrNotFound         = errors.New("principal not found")
+	ErrExists           = errors.New("principal already exists")
+	ErrTokenNotFound    = errors.New("token not found")
+	ErrUnauthenticated  = errors.New("missing or invalid token")
+	ErrForbidden        = errors.New("permission denied")
+)
+
+// Permission is what a Grant lets a principal do with the files it covers
+type Permission string
+
+const (
+	Read   Permission = "read"
+	Write  Permission = "write"
+	Delete Permission = "delete"
+	// Admin lets a principal do anything with the files a Grant covers, and manage the buckets it covers. Admin over every file
+	// of every bucket lets it manage the cluster, and the principals and tokens of it, too.
+	Admin Permission = "admin"
+)
+
+// Kind is whether a principal is a person or a program
+type Kind string
+
+const (
+	User    Kind = "user"
+	Service Kind = "service"
+)
+
+// AnyBucket is the bucket of a Grant that covers the files of every bucket, the default one included
+const AnyBucket = "*"
+
+// Grant gives permissions over the files of a bucket whose keys start with a prefix
+type Grant struct {
+	// Bucket is the name of the bucket the Grant covers, which is the default bucket if it is empty, or every bucket if it is AnyBucket
+	Bucket      string       `json:"bucket,omitempty"`
+	Prefix      string       `json:"prefix,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// covers reports whether g covers the file of key, qualified with its bucket
+func (g Grant) covers(key string) bool {
+	name, localKey := bucket.Split(key)
+	return (g.Bucket == AnyBucket || g.Bucket == name) && strings.HasPrefix(localKey, g.Prefix)
+}
+
+// allows reports whether g gives permission, which Admin implies
+func (g Grant) allows(permission Permission) bool {
+	for _, granted := range g.Permissions {
+		if granted == permission || granted == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns ErrInvalidPrincipal if the bucket or the permissions of g are invalid
+func (g Grant) Validate() error {
+	if g.Bucket != "" && g.Bucket != AnyBucket {
+		if err := bucket.ValidateName(g.Bucket); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPrincipal, err)
+		}
+	}
+	if len(g.Permissions) == 0 {
+		return fmt.Errorf("%w: a grant needs permissions", ErrInvalidPrincipal)
+	}
+	for _, permission := range g.Permissions {
+		if permission != Read && permission != Write && permission != Delete && permission != Admin {
+			return fmt.Errorf("%w: unknown permission %q", ErrInvalidPrincipal, permission)
+		}
+	}
+	return nil
+}
+
+// Principal is a user or a service account that requests are made as, along with what it may do
+type Principal struct {
+	Name      string    `json:"name"`
+	Kind      Kind      `json:"kind"`
+	Grants    []Grant   `json:"grants"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Root is the principal that the admin token of a node authenticates as, which may do anything
+var Root = Principal{Name: "root", Kind: Service, Grants: []Grant{{Bucket: AnyBucket, Permissions: []Permission{Admin}}}}
+
+// Can reports whether p has permission over the file of key, qualified with its bucket
+func (p Principal) Can(permission Permission, key string) bool {
+	for _, grant := range p.Grants {
+		if grant.covers(key) && grant.allows(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether p is an admin of the whole cluster, which is the case if it has Admin over every file of every bucket
+func (p Principal) IsAdmin() bool {
+	for _, grant := range p.Grants {
+		if grant.Bucket == AnyBucket && grant.Prefix == "" && grant.allows(Admin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSee reports whether p has any permission over files of the bucket with the given name, which lets it look the bucket up
+func (p Principal) CanSee(name string) bool {
+	for _, grant := range p.Grants {
+		if grant.Bucket == AnyBucket || grant.Bucket == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns ErrInvalidPrincipal if the name, the kind or any of the grants of p are invalid
+func (p Principal) Validate() error {
+	if err := validateName(p.Name); err != nil {
+		return err
+	}
+	if p.Kind != User && p.Kind != Service {
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidPrincipal, p.Kind)
+	}
+	for _, grant := range p.Grants {
+		if err := grant.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateName returns ErrInvalidPrincipal unless name is 1 to 64 lowercase letters, digits, hyphens, underscores and dots
+func validateName(name string) error {
+	if len(name) == 0 || len(name) > 64 {
+		return fmt.Errorf("%w: the name %q must be 1 to 64 characters long", ErrInvalidPrincipal, name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return fmt.Errorf("%w: the name %q may only hold lowercase letters, digits, hyphens, underscores and dots", ErrInvalidPrincipal, name)
+		}
+	}
+	return nil
+}
+
+// Token is an API token of a principal. Only the hash of its secret is kept, so the secret is only known when it is issued.
+type Token struct {
+	// ID identifies the token, e.g, to revoke it, and is derived from its secret
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"`
+	Hash      string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// storedToken is how a Token is stored in the metadata DB, hash included
+type storedToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+// tokenSecretSize is how many random bytes the secret of every token is made of
+const tokenSecretSize = 32
+
+// tokenID returns the ID of the token with the given secret
+func tokenID(secret string) string {
+	sum := sha256.Sum256([]byte("id:" + secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tokenHash returns the hash of the given secret that the token with it is checked against
+func tokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Registry keeps the principals and their tokens in the metadata DB, and a copy of them in memory since every request looks its
+// token up. They are kept per node, so every node of a cluster is set up with the principals and tokens it accepts.
+type Registry struct {
+	ddb        *db.DDB
+	lock       sync.RWMutex
+	principals map[string]Principal
+	tokens     map[string]Token
+}
+
+// NewRegistry returns a Registry of the principals and tokens kept in ddb
+func NewRegistry(ddb *db.DDB) (*Registry, error) {
+	r := &Registry{ddb: ddb, principals: make(map[string]Principal), tokens: make(map[string]Token)}
+	err := ddb.ForEach(util.PrincipalsBucketName, func(name string, value []byte) error {
+		var p Principal
+		if err := json.Unmarshal(value, &p); err != nil {
+			return fmt.Errorf("invalid principal %s: %w", name, err)
+		}
+		r.principals[name] = p
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+	err = ddb.ForEach(util.APITokensBucketName, func(id string, value []byte) error {
+		var t storedToken
+		if err := json.Unmarshal(value, &t); err != nil {
+			return fmt.Errorf("invalid token %s: %w", id, err)
+		}
+		t.Token.Hash = t.Hash
+		r.tokens[id] = t.Token
+		return nil
+	})
+	return r, err
+}
+
+// CreatePrincipal creates the principal p, and returns it as created. ErrExists is returned if a principal with its name exists.
+func (r *Registry) CreatePrincipal(p Principal) (Principal, error) {
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.principals[p.Name]; exists {
+		return p, fmt.Errorf("%w: %s", ErrExists, p.Name)
+	}
+	p.CreatedAt = time.Now().UTC()
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return p, err
+	}
+	if err := r.ddb.Put(util.PrincipalsBucketName, p.Name, encoded); err != nil {
+		return p, err
+	}
+	r.principals[p.Name] = p
+	return p, nil
+}
+
+// Principal returns the principal with the given name, or ErrNotFound if there is none
+func (r *Registry) Principal(name string) (Principal, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	p, exists := r.principals[name]
+	if !exists {
+		return p, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return p, nil
+}
+
+// Principals returns every principal, ordered by name
+func (r *Registry) Principals() []Principal {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	principals := make([]Principal, 0, len(r.principals))
+	for _, p := range r.principals {
+		principals = append(principals, p)
+	}
+	sort.Slice(principals, func(i, j int) bool {
+		return principals[i].Name < principals[j].Name
+	})
+	return principals
+}
+
+// DeletePrincipal deletes the principal with the given name, revoking every token of it
+func (r *Registry) DeletePrincipal(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.principals[name]; !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	var revoked []string
+	for id, t := range r.tokens {
+		if t.Principal == name {
+			revoked = append(revoked, id)
+		}
+	}
+	if err := r.ddb.Batch(util.APITokensBucketName, nil, revoked); err != nil {
+		return err
+	}
+	for _, id := range revoked {
+		delete(r.tokens, id)
+	}
+	if err := r.ddb.Delete(util.PrincipalsBucketName, name); err != nil {
+		return err
+	}
+	delete(r.principals, name)
+	return nil
+}
+
+// IssueToken issues a new token to the principal with the given name, and returns its secret along with it. The secret can't be
+// had again later.
+func (r *Registry) IssueToken(name string) (string, Token, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.principals[name]; !exists {
+		return "", Token{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	random := make([]byte, tokenSecretSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", Token{}, err
+	}
+	secret := hex.EncodeToString(random)
+	t := Token{ID: tokenID(secret), Principal: name, Hash: tokenHash(secret), CreatedAt: time.Now().UTC()}
+	encoded, err := json.Marshal(storedToken{Token: t, Hash: t.Hash})
+	if err != nil {
+		return "", t, err
+	}
+	if err := r.ddb.Put(util.APITokensBucketName, t.ID, encoded); err != nil {
+		return "", t, err
+	}
+	r.tokens[t.ID] = t
+	return secret, t, nil
+}
+
+// Tokens returns the tokens of the principal with the given name, oldest first
+func (r *Registry) Tokens(name string) []Token {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	tokens := make([]Token, 0)
+	for _, t := range r.tokens {
+		if t.Principal == name {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// RevokeToken revokes the token with the given ID, which no longer authenticates from then on
+func (r *Registry) RevokeToken(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.tokens[id]; !exists {
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, id)
+	}
+	if err := r.ddb.Delete(util.APITokensBucketName, id); err != nil {
+		return err
+	}
+	delete(r.tokens, id)
+	return nil
+}
+
+// Authenticate returns the principal that the token with the given secret was issued to, or ErrUnauthenticated if there is no
+// such token
+func (r *Registry) Authenticate(secret string) (Principal, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	t, exists := r.tokens[tokenID(secret)]
+	if !exists || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(tokenHash(secret))) != 1 {
+		return Principal{}, ErrUnauthenticated
+	}
+	p, exists := r.principals[t.Principal]
+	if !exists {
+		return Principal{}, ErrUnauthenticated
+	}
+	return p, nil
+}
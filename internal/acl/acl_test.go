@@ -0,0 +1,101 @@
+package acl
+
+import (
+	"file-store/internal/bucket"
+	"file-store/internal/db"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T) (*Registry, *db.DDB) {
+	ddb, err := db.InitDB(filepath.Join(t.TempDir(), "metadata.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	registry, err := NewRegistry(&ddb)
+	assert.Nil(t, err)
+	return registry, &ddb
+}
+
+func TestGrantsCoverBucketsAndPrefixes(t *testing.T) {
+	p := Principal{Name: "uploader", Kind: Service, Grants: []Grant{
+		{Prefix: "public/", Permissions: []Permission{Read}},
+		{Bucket: "photos", Permissions: []Permission{Read, Write}},
+		{Bucket: "logs", Prefix: "app/", Permissions: []Permission{Admin}},
+	}}
+	assert.Nil(t, p.Validate())
+
+	assert.True(t, p.Can(Read, "public/index.html"))
+	assert.False(t, p.Can(Write, "public/index.html"))
+	assert.False(t, p.Can(Read, "private/index.html"))
+	assert.False(t, p.Can(Read, bucket.Qualify("other", "public/index.html")))
+
+	assert.True(t, p.Can(Write, bucket.Qualify("photos", "cat.png")))
+	assert.False(t, p.Can(Delete, bucket.Qualify("photos", "cat.png")))
+
+	// Admin implies every other permission, within what its grant covers
+	assert.True(t, p.Can(Delete, bucket.Qualify("logs", "app/today.log")))
+	assert.False(t, p.Can(Read, bucket.Qualify("logs", "db/today.log")))
+	assert.False(t, p.IsAdmin())
+	assert.True(t, Root.IsAdmin())
+	assert.True(t, Root.Can(Delete, bucket.Qualify("logs", "db/today.log")))
+
+	assert.True(t, p.CanSee("photos"))
+	assert.False(t, p.CanSee("videos"))
+
+	for _, invalid := range []Principal{
+		{Name: "Uploader", Kind: Service},
+		{Name: "uploader", Kind: "robot"},
+		{Name: "uploader", Kind: User, Grants: []Grant{{Permissions: []Permission{"list"}}}},
+		{Name: "uploader", Kind: User, Grants: []Grant{{Bucket: "photos"}}},
+		{Name: "uploader", Kind: User, Grants: []Grant{{Bucket: "No", Permissions: []Permission{Read}}}},
+	} {
+		assert.ErrorIs(t, invalid.Validate(), ErrInvalidPrincipal)
+	}
+}
+
+func TestRegistryIssuesAndRevokesTokens(t *testing.T) {
+	registry, ddb := newTestRegistry(t)
+
+	alice, err := registry.CreatePrincipal(Principal{Name: "alice", Kind: User, Grants: []Grant{{Bucket: AnyBucket, Permissions: []Permission{Read}}}})
+	assert.Nil(t, err)
+	_, err = registry.CreatePrincipal(Principal{Name: "alice", Kind: User})
+	assert.ErrorIs(t, err, ErrExists)
+	_, _, err = registry.IssueToken("bob")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	secret, token, err := registry.IssueToken("alice")
+	assert.Nil(t, err)
+	authenticated, err := registry.Authenticate(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, alice, authenticated)
+	_, err = registry.Authenticate(secret + "0")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+	assert.Equal(t, []Token{token}, registry.Tokens("alice"))
+
+	// Principals and tokens survive a restart, without the secrets of the tokens being kept
+	reloaded, err := NewRegistry(ddb)
+	assert.Nil(t, err)
+	assert.Equal(t, registry.Principals(), reloaded.Principals())
+	_, err = reloaded.Authenticate(secret)
+	assert.Nil(t, err)
+	value, err := ddb.Get("apiTokens", token.ID)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(value), secret)
+
+	// Revoked tokens, and the tokens of deleted principals, no longer authenticate
+	assert.Nil(t, registry.RevokeToken(token.ID))
+	assert.ErrorIs(t, registry.RevokeToken(token.ID), ErrTokenNotFound)
+	_, err = registry.Authenticate(secret)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+
+	secret, _, err = registry.IssueToken("alice")
+	assert.Nil(t, err)
+	assert.Nil(t, registry.DeletePrincipal("alice"))
+	_, err = registry.Authenticate(secret)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+	assert.Empty(t, registry.Tokens("alice"))
+	assert.ErrorIs(t, registry.DeletePrincipal("alice"), ErrNotFound)
+}
@@ -0,0 +1,461 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTampered = errors.New("audit log was tampered with")
+	ErrClosed   = errors.New("audit log is closed")
+)
+
+// Operation is the kind of data operation an Entry records
+type Operation string
+
+const (
+	Store  Operation = "store"
+	Get    Operation = "get"
+	Delete Operation = "delete"
+	List   Operation = "list"
+)
+
+// ResultOK is the result of the operations that succeeded
+const ResultOK = "ok"
+
+// Entry records a data operation made on a node. Every Entry holds the hash of the one before it, so that changing, dropping or
+// reordering entries breaks the chain from there on.
+type Entry struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Actor is who made the operation, e.g, the principal of a client request, or the peer that replicated a file
+	Actor     string    `json:"actor"`
+	Operation Operation `json:"operation"`
+	Key       string    `json:"key"`
+	Node      string    `json:"node"`
+	// Result is ResultOK if the operation succeeded, or why it failed otherwise
+	Result   string `json:"result"`
+	Bytes    int64  `json:"bytes"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// computeHash returns the hash of e, which covers every field of it but Hash itself
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Filter selects entries of the log. Its zero value selects every entry.
+type Filter struct {
+	// From and To bound the time of the entries selected, From included and To excluded, unless they are zero
+	From time.Time
+	To   time.Time
+	// Key selects the entries of the given key only, unless it is empty
+	Key string
+	// Limit is how many of the latest entries selected are returned, without a limit if it is 0
+	Limit int
+}
+
+// matches reports whether f selects e
+func (f Filter) matches(e Entry) bool {
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	return f.Key == "" || e.Key == f.Key
+}
+
+// head is where the chain of a Log stands. It is kept in the metadata DB, apart from the segments, so that entries can't be
+// dropped off either end of the log without it showing, which the chain alone can't tell from rotation.
+type head struct {
+	// FirstSeq is the number of the first entry kept, and FirstPrevHash is the hash of the entry before it, if rotation deleted it
+	FirstSeq      uint64 `json:"first_seq"`
+	FirstPrevHash string `json:"first_prev_hash"`
+	// Seq and Hash are those of the last entry appended
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// errStopReading stops forEach and readSegment early
+var errStopReading = errors.New("stop reading")
+
+// headKey is the key that the head of the log is kept under in util.AuditBucketName
+const headKey = "head"
+
+// segmentPrefix and segmentSuffix surround the sequence number of the first entry of every segment of the log in its file name
+const (
+	segmentPrefix = "audit-"
+	segmentSuffix = ".log"
+)
+
+// Log is an append-only log of data operations, kept as a JSON line per Entry in segment files of dir. A new segment is started
+// once the current one holds MaxFileBytes, and the oldest ones are deleted so that at most MaxFiles are kept. The chain of
+// hashes carries on across segments. Once a metadata DB is attached, the head of the chain is kept in it too.
+type Log struct {
+	// MaxFileBytes is how many bytes a segment may hold, without a limit if it is 0
+	MaxFileBytes int64
+	// MaxFiles is how many segments are kept, without a limit if it is 0
+	MaxFiles int
+
+	dir      string
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+	closed   bool
+	ddb      *db.DDB
+	// head is the head of the chain kept in ddb, or nil without a metadata DB, or until the log is opened for the first time
+	head *head
+}
+
+// NewLog returns a Log kept in dir. Nothing is read or written until the first Entry is appended.
+func NewLog(dir string, maxFileBytes int64, maxFiles int) *Log {
+	return &Log{MaxFileBytes: maxFileBytes, MaxFiles: maxFiles, dir: dir}
+}
+
+// AttachDB keeps the head of the chain in ddb, which Verify checks the ends of the log against from then on
+func (l *Log) AttachDB(ddb *db.DDB) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.ddb = ddb
+	encoded, err := ddb.Get(util.AuditBucketName, headKey)
+	if err != nil {
+		return err
+	}
+	if encoded != nil {
+		var h head
+		if err := json.Unmarshal(encoded, &h); err != nil {
+			return err
+		}
+		l.head = &h
+	}
+	if l.file == nil {
+		return nil
+	}
+	return l.syncHead()
+}
+
+// Append appends e to the log, numbered and chained to the entry before it, and returns it as appended
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.open(); err != nil {
+		return e, err
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq, e.PrevHash = l.seq+1, l.lastHash
+	hash, err := e.computeHash()
+	if err != nil {
+		return e, err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	line = append(line, '\n')
+	if l.MaxFileBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.MaxFileBytes {
+		if err := l.rotate(e.Seq); err != nil {
+			return e, err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return e, err
+	}
+	l.seq, l.lastHash = e.Seq, e.Hash
+	if l.head == nil {
+		return e, nil
+	}
+	l.head.Seq, l.head.Hash = e.Seq, e.Hash
+	return e, l.saveHead()
+}
+
+// Query returns the entries that f selects, oldest first
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries := make([]Entry, 0)
+	err := l.forEach(func(e Entry) error {
+		if f.matches(e) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, err
+}
+
+// Verify checks the hash of every entry of the log, and that it is chained to the entry before it, and returns how many entries
+// there are. ErrTampered is returned for the first entry that doesn't check out. With a metadata DB, the log has to start and end
+// where its head says, too. Without one, the first entry kept can't be checked against the entries of the segments deleted by
+// rotation, so it is taken as the start of the chain, and entries dropped off the end of the log go unnoticed.
+func (l *Log) Verify() (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count := 0
+	var prev *Entry
+	err := l.forEach(func(e Entry) error {
+		if prev == nil && l.head != nil && (e.Seq != l.head.FirstSeq || e.PrevHash != l.head.FirstPrevHash) {
+			return fmt.Errorf("%w: the log starts at entry %d rather than %d", ErrTampered, e.Seq, l.head.FirstSeq)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("%w: entry %d doesn't match its hash", ErrTampered, e.Seq)
+		}
+		if prev == nil && e.Seq == 1 && e.PrevHash != "" {
+			return fmt.Errorf("%w: entry 1 follows another entry", ErrTampered)
+		}
+		if prev != nil && (e.Seq != prev.Seq+1 || e.PrevHash != prev.Hash) {
+			return fmt.Errorf("%w: entry %d doesn't follow entry %d", ErrTampered, e.Seq, prev.Seq)
+		}
+		prev = &e
+		count++
+		return nil
+	})
+	if err != nil || l.head == nil {
+		return count, err
+	}
+	if prev == nil && l.head.Seq >= l.head.FirstSeq {
+		return count, fmt.Errorf("%w: entries %d to %d are missing", ErrTampered, l.head.FirstSeq, l.head.Seq)
+	}
+	if prev != nil && (prev.Seq != l.head.Seq || prev.Hash != l.head.Hash) {
+		return count, fmt.Errorf("%w: the log ends at entry %d rather than %d", ErrTampered, prev.Seq, l.head.Seq)
+	}
+	return count, nil
+}
+
+// Close closes the log, after which nothing more is appended to it
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the latest segment for appending, picking up the chain where it left off, unless it is open already. The caller
+// holds the lock.
+func (l *Log) open() error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(l.dir, os.ModePerm); err != nil {
+		return err
+	}
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		err = readSegment(segments[len(segments)-1], func(e Entry) error {
+			l.seq, l.lastHash = e.Seq, e.Hash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := l.syncHead(); err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return l.rotate(l.seq + 1)
+	}
+	latest := segments[len(segments)-1]
+	f, err := os.OpenFile(latest, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// rotate starts a new segment, whose first entry is numbered seq, and deletes the oldest segments beyond MaxFiles. The caller
+// holds the lock.
+func (l *Log) rotate(seq uint64) error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+	name := filepath.Join(l.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = f, 0
+	if l.MaxFiles <= 0 {
+		return nil
+	}
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	pruned := false
+	for len(segments) > l.MaxFiles {
+		if err := os.Remove(segments[0]); err != nil {
+			return err
+		}
+		segments, pruned = segments[1:], true
+	}
+	if !pruned || l.head == nil {
+		return nil
+	}
+	// The log now starts with the first entry of the oldest segment left, or with the entry about to be appended if that is
+	// the new one
+	l.head.FirstSeq, l.head.FirstPrevHash = seq, l.lastHash
+	err = readSegment(segments[0], func(e Entry) error {
+		l.head.FirstSeq, l.head.FirstPrevHash = e.Seq, e.PrevHash
+		return errStopReading
+	})
+	if err != nil && !errors.Is(err, errStopReading) {
+		return err
+	}
+	return l.saveHead()
+}
+
+// syncHead reconciles the chain picked up from the segments with the head kept in the metadata DB, if there is one. The
+// head is adopted from the segments the first time. The caller holds the lock.
+func (l *Log) syncHead() error {
+	if l.ddb == nil {
+		return nil
+	}
+	if l.head == nil {
+		h := head{FirstSeq: l.seq + 1, FirstPrevHash: l.lastHash, Seq: l.seq, Hash: l.lastHash}
+		err := l.forEach(func(e Entry) error {
+			h.FirstSeq, h.FirstPrevHash = e.Seq, e.PrevHash
+			return errStopReading
+		})
+		if err != nil && !errors.Is(err, errStopReading) {
+			return err
+		}
+		l.head = &h
+		return l.saveHead()
+	}
+	if l.seq > l.head.Seq {
+		// The node stopped between appending an entry and saving the head, so the entries that follow the head are kept
+		followsHead := false
+		_ = l.forEach(func(e Entry) error {
+			if e.Seq == l.head.Seq && e.Hash == l.head.Hash {
+				followsHead = true
+				return errStopReading
+			}
+			return nil
+		})
+		if followsHead {
+			l.head.Seq, l.head.Hash = l.seq, l.lastHash
+			return l.saveHead()
+		}
+	}
+	// New entries carry on from the head rather than from wherever the segments end, so entries dropped off the end keep showing
+	l.seq, l.lastHash = l.head.Seq, l.head.Hash
+	return nil
+}
+
+// saveHead saves the head of the chain in the metadata DB. The caller holds the lock.
+func (l *Log) saveHead() error {
+	encoded, err := json.Marshal(l.head)
+	if err != nil {
+		return err
+	}
+	return l.ddb.Put(util.AuditBucketName, headKey, encoded)
+}
+
+// segments returns the paths of the segments of the log, oldest first
+func (l *Log) segments() ([]string, error) {
+	dirEntries, err := os.ReadDir(l.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, dirEntry := range dirEntries {
+		if name := dirEntry.Name(); strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix) {
+			segments = append(segments, filepath.Join(l.dir, name))
+		}
+	}
+	// The sequence numbers in the names are zero padded, so their order is the order of the names
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// forEach calls fn for every entry of the log, oldest first. The caller holds the lock.
+func (l *Log) forEach(fn func(Entry) error) error {
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := readSegment(segment, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn for every entry of the segment at path, in order
+func readSegment(path string, fn func(Entry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%w: unreadable entry in %s: %v", ErrTampered, filepath.Base(path), err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"file-store/internal/db"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogIsChainedAcrossRotationsAndRestarts(t *testing.T) {
+	dir := t.TempDir()
+	log := NewLog(dir, 512, 0)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		key := "cat.png"
+		if i%2 == 1 {
+			key = "dog.png"
+		}
+		e, err := log.Append(Entry{Time: start.Add(time.Duration(i) * time.Minute), Actor: "alice", Operation: Store, Key: key, Result: ResultOK, Bytes: 4})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), e.Seq)
+	}
+	segments, err := log.segments()
+	assert.Nil(t, err)
+	assert.Greater(t, len(segments), 1)
+
+	// The chain picks up where it left off once the log is reopened
+	assert.Nil(t, log.Close())
+	_, err = log.Append(Entry{})
+	assert.ErrorIs(t, err, ErrClosed)
+	log = NewLog(dir, 512, 0)
+	e, err := log.Append(Entry{Time: start.Add(time.Hour), Actor: "peer:127.0.0.1:7002", Operation: Get, Key: "cat.png", Result: ResultOK})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(11), e.Seq)
+	count, err := log.Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, 11, count)
+
+	entries, err := log.Query(Filter{Key: "cat.png", From: start.Add(2 * time.Minute), To: start.Add(time.Hour)})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	for _, e := range entries {
+		assert.Equal(t, "cat.png", e.Key)
+	}
+	entries, err = log.Query(Filter{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{10, 11}, []uint64{entries[0].Seq, entries[1].Seq})
+
+	// Only MaxFiles segments are kept, and what is left still checks out
+	log.MaxFiles = 2
+	_, err = log.Append(Entry{Operation: List, Result: ResultOK, Bytes: 1 << 10})
+	assert.Nil(t, err)
+	segments, err = log.segments()
+	assert.Nil(t, err)
+	assert.Len(t, segments, 2)
+	_, err = log.Verify()
+	assert.Nil(t, err)
+}
+
+func TestLogDetectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	log := NewLog(dir, 0, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := log.Append(Entry{Actor: "alice", Operation: Delete, Key: key, Result: ResultOK})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, log.Close())
+	segments, err := NewLog(dir, 0, 0).segments()
+	assert.Nil(t, err)
+	original, err := os.ReadFile(segments[0])
+	assert.Nil(t, err)
+	lines := strings.SplitAfter(string(original), "\n")
+
+	for name, tampered := range map[string]string{
+		"edited":  strings.Replace(string(original), `"actor":"alice"`, `"actor":"bob"`, 1),
+		"dropped": lines[0] + lines[2],
+		"swapped": lines[1] + lines[0] + lines[2],
+	} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, filepath.Base(segments[0])), []byte(tampered), 0644))
+		_, err := NewLog(dir, 0, 0).Verify()
+		assert.ErrorIs(t, err, ErrTampered, name)
+	}
+}
+
+func TestLogWithAHeadDetectsTruncation(t *testing.T) {
+	dir := t.TempDir()
+	ddb, err := db.InitDB(filepath.Join(t.TempDir(), "metadata.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	// Entries written before the metadata DB was attached are taken as they are
+	log := NewLog(dir, 256, 3)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(Entry{Actor: "alice", Operation: Store, Key: "cat.png", Result: ResultOK})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, log.AttachDB(&ddb))
+	for i := 0; i < 12; i++ {
+		_, err := log.Append(Entry{Actor: "alice", Operation: Store, Key: "cat.png", Result: ResultOK})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, log.Close())
+
+	// Rotation deleting the oldest segments isn't mistaken for tampering
+	reopen := func() *Log {
+		log := NewLog(dir, 256, 3)
+		assert.Nil(t, log.AttachDB(&ddb))
+		return log
+	}
+	segments, err := reopen().segments()
+	assert.Nil(t, err)
+	assert.Len(t, segments, 3)
+	_, err = reopen().Verify()
+	assert.Nil(t, err)
+
+	// Neither is the oldest segment deleted, nor are entries dropped off the end, even if entries are appended afterwards
+	first, err := os.ReadFile(segments[0])
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(segments[0]))
+	_, err = reopen().Verify()
+	assert.ErrorIs(t, err, ErrTampered)
+	assert.Nil(t, os.WriteFile(segments[0], first, 0644))
+	_, err = reopen().Verify()
+	assert.Nil(t, err)
+
+	last, err := os.ReadFile(segments[2])
+	assert.Nil(t, err)
+	lines := strings.SplitAfter(string(last), "\n")
+	assert.Nil(t, os.WriteFile(segments[2], []byte(strings.Join(lines[:len(lines)-2], "")), 0644))
+	_, err = reopen().Verify()
+	assert.ErrorIs(t, err, ErrTampered)
+	log = reopen()
+	_, err = log.Append(Entry{Actor: "alice", Operation: Get, Key: "cat.png", Result: ResultOK})
+	assert.Nil(t, err)
+	_, err = log.Verify()
+	assert.ErrorIs(t, err, ErrTampered)
+	assert.Nil(t, log.Close())
+}
@@ -0,0 +1,282 @@
+package bucket
+
+import (
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidName     = errors.New("invalid bucket name")
+	ErrInvalidKey      = errors.New("invalid key")
+	ErrInvalidSettings = errors.New("invalid bucket settings")
+	ErrNotFound        = errors.New("bucket not found")
+	ErrExists          = errors.New("bucket already exists")
+)
+
+// Separator separates the name of a bucket from the key of a file in it, in the qualified keys that files are known by across
+// the cluster. No bucket name contains it, and the keys of the default bucket are left unqualified, so they read as they always did.
+const Separator = "\x00"
+
+// Compression is how the files of a bucket are compressed at rest
+type Compression string
+
+const (
+	NoCompression   Compression = ""
+	GzipCompression Compression = "gzip"
+)
+
+// Bucket is an isolated key space, along with the settings of the files stored in it
+type Bucket struct {
+	Name string `json:"name"`
+	// ReplicationFactor is how many nodes own every file of the bucket, which is the one of the Store if it is 0
+	ReplicationFactor int `json:"replication_factor,omitempty"`
+	// TTLSeconds is how long the files of the bucket are kept after they were last written, forever if it is 0
+	TTLSeconds  int64       `json:"ttl_seconds,omitempty"`
+	Compression Compression `json:"compression,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	// DeletedAt is set once the bucket is deleted. The bucket is kept as a tombstone, so that the nodes that learn of it later
+	// delete it too, rather than bring it back.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// TTL returns how long the files of b are kept after they were last written, or 0 if they are kept forever
+func (b Bucket) TTL() time.Duration {
+	return time.Duration(b.TTLSeconds) * time.Second
+}
+
+// Deleted reports whether b is a tombstone
+func (b Bucket) Deleted() bool {
+	return b.DeletedAt != nil
+}
+
+// updatedAt returns when b was last created or deleted
+func (b Bucket) updatedAt() time.Time {
+	if b.DeletedAt != nil {
+		return *b.DeletedAt
+	}
+	return b.CreatedAt
+}
+
+// newerThan reports whether b supersedes other, which is the case if it was created or deleted later. A deletion made at the
+// same time as a creation wins, so that every node settles on the same state.
+func (b Bucket) newerThan(other Bucket) bool {
+	if !b.updatedAt().Equal(other.updatedAt()) {
+		return b.updatedAt().After(other.updatedAt())
+	}
+	return b.Deleted() && !other.Deleted()
+}
+
+// Validate returns an error if the name or any of the settings of b are invalid
+func (b Bucket) Validate() error {
+	if err := ValidateName(b.Name); err != nil {
+		return err
+	}
+	if b.ReplicationFactor < 0 || b.TTLSeconds < 0 {
+		return fmt.Errorf("%w: the replication factor and TTL can't be negative", ErrInvalidSettings)
+	}
+	if b.Compression != NoCompression && b.Compression != GzipCompression {
+		return fmt.Errorf("%w: unknown compression %q", ErrInvalidSettings, b.Compression)
+	}
+	return nil
+}
+
+// ValidateName returns ErrInvalidName unless name is 3 to 63 lowercase letters, digits and hyphens, starting and ending with a
+// letter or digit
+func ValidateName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("%w: %q must be 3 to 63 characters long", ErrInvalidName, name)
+	}
+	for i, c := range name {
+		alphanumeric := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+		if !alphanumeric && (c != '-' || i == 0 || i == len(name)-1) {
+			return fmt.Errorf("%w: %q may only hold lowercase letters, digits and inner hyphens", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// ValidateKey returns ErrInvalidKey unless the key of qualified within its bucket could only name a file inside the directory of
+// the bucket, which it is stored under: it may not be empty, nor hold NUL, nor start with "/", nor have ".." segments.
+// The name of the bucket, if any, has to be valid too.
+func ValidateKey(qualified string) error {
+	name, key := Split(qualified)
+	if name != "" {
+		if err := ValidateName(name); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+	}
+	if key == "" || strings.Contains(key, "\x00") || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return fmt.Errorf("%w: %q may not have .. segments", ErrInvalidKey, key)
+		}
+	}
+	// Whatever is left, e.g, a key that filepath cleans into something else, still has to stay within the directory of the bucket
+	if !filepath.IsLocal(key) {
+		return fmt.Errorf("%w: %q leaves the storage directory", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// Qualify returns the qualified key of the file of key in the bucket with the given name, or key itself in the default bucket
+func Qualify(name string, key string) string {
+	if name == "" {
+		return key
+	}
+	return name + Separator + key
+}
+
+// Split returns the name of the bucket and the key within it of a qualified key, where the name of the default bucket is empty
+func Split(qualified string) (string, string) {
+	name, key, found := strings.Cut(qualified, Separator)
+	if !found {
+		return "", qualified
+	}
+	return name, key
+}
+
+// Registry keeps the buckets, along with the tombstones of the deleted ones, in the metadata DB, and a copy of them in memory
+// since they are looked up for every file placed
+type Registry struct {
+	ddb     *db.DDB
+	lock    sync.RWMutex
+	buckets map[string]Bucket
+}
+
+// NewRegistry returns a Registry of the buckets kept in ddb
+func NewRegistry(ddb *db.DDB) (*Registry, error) {
+	r := &Registry{ddb: ddb, buckets: make(map[string]Bucket)}
+	err := ddb.ForEach(util.BucketsBucketName, func(name string, value []byte) error {
+		var b Bucket
+		if err := json.Unmarshal(value, &b); err != nil {
+			return fmt.Errorf("invalid bucket %s: %w", name, err)
+		}
+		r.buckets[name] = b
+		return nil
+	})
+	return r, err
+}
+
+// Create creates the bucket b, and returns it as created. ErrExists is returned if a bucket with its name already exists.
+func (r *Registry) Create(b Bucket) (Bucket, error) {
+	if err := b.Validate(); err != nil {
+		return b, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	b.CreatedAt, b.DeletedAt = time.Now().UTC(), nil
+	if current, exists := r.buckets[b.Name]; exists {
+		if !current.Deleted() {
+			return current, fmt.Errorf("%w: %s", ErrExists, b.Name)
+		}
+		// The bucket has to supersede the tombstone of the one it replaces, wherever their clocks are at
+		if !b.newerThan(current) {
+			b.CreatedAt = current.DeletedAt.Add(time.Nanosecond)
+		}
+	}
+	return b, r.save(b)
+}
+
+// Delete deletes the bucket with the given name, leaving a tombstone of it, and returns the tombstone
+func (r *Registry) Delete(name string) (Bucket, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	b, exists := r.buckets[name]
+	if !exists || b.Deleted() {
+		return b, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	deletedAt := time.Now().UTC()
+	if !deletedAt.After(b.CreatedAt) {
+		deletedAt = b.CreatedAt.Add(time.Nanosecond)
+	}
+	b.DeletedAt = &deletedAt
+	return b, r.save(b)
+}
+
+// Get returns the bucket with the given name, or ErrNotFound if there is none or it was deleted
+func (r *Registry) Get(name string) (Bucket, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	b, exists := r.buckets[name]
+	if !exists || b.Deleted() {
+		return b, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return b, nil
+}
+
+// IsDeleted reports whether the bucket with the given name was deleted, and wasn't created again since
+func (r *Registry) IsDeleted(name string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.buckets[name].Deleted()
+}
+
+// List returns the buckets that exist, ordered by name
+func (r *Registry) List() []Bucket {
+	return r.list(false)
+}
+
+// All returns the buckets along with the tombstones of the deleted ones, ordered by name, for them to be merged into the
+// Registry of another node
+func (r *Registry) All() []Bucket {
+	return r.list(true)
+}
+
+func (r *Registry) list(withDeleted bool) []Bucket {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	buckets := make([]Bucket, 0, len(r.buckets))
+	for _, b := range r.buckets {
+		if withDeleted || !b.Deleted() {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return buckets
+}
+
+// Merge takes in the buckets of another node, as returned by its All, keeping whichever of every bucket was created or deleted
+// last. The buckets that superseded the ones held are returned, so that the caller can act on their deletion.
+func (r *Registry) Merge(buckets []Bucket) ([]Bucket, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var merged []Bucket
+	for _, b := range buckets {
+		if err := b.Validate(); err != nil {
+			return merged, err
+		}
+		if current, exists := r.buckets[b.Name]; exists && !b.newerThan(current) {
+			continue
+		}
+		if err := r.save(b); err != nil {
+			return merged, err
+		}
+		merged = append(merged, b)
+	}
+	return merged, nil
+}
+
+// save stores b in the metadata DB and in memory. The caller holds the lock.
+func (r *Registry) save(b Bucket) error {
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if err := r.ddb.Put(util.BucketsBucketName, b.Name, encoded); err != nil {
+		return err
+	}
+	r.buckets[b.Name] = b
+	return nil
+}
@@ -0,0 +1,121 @@
+package bucket
+
+import (
+	"file-store/internal/db"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T) (*Registry, *db.DDB) {
+	ddb, err := db.InitDB(filepath.Join(t.TempDir(), "metadata.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	registry, err := NewRegistry(&ddb)
+	assert.Nil(t, err)
+	return registry, &ddb
+}
+
+func TestNamesAndQualifiedKeys(t *testing.T) {
+	assert.Nil(t, ValidateName("team-a"))
+	assert.Nil(t, ValidateName("123"))
+	for _, name := range []string{"", "ab", "Team", "-team", "team-", "team_a", "team/a", string(make([]byte, 64))} {
+		assert.ErrorIs(t, ValidateName(name), ErrInvalidName, name)
+	}
+	assert.ErrorIs(t, Bucket{Name: "logs", Compression: "zip"}.Validate(), ErrInvalidSettings)
+	assert.ErrorIs(t, Bucket{Name: "logs", ReplicationFactor: -1}.Validate(), ErrInvalidSettings)
+
+	// Keys of the default bucket are left as they are, even if they look qualified
+	assert.Equal(t, "photos/cat.png", Qualify("", "photos/cat.png"))
+	name, key := Split("photos/cat.png")
+	assert.Equal(t, "", name)
+	assert.Equal(t, "photos/cat.png", key)
+
+	name, key = Split(Qualify("team-a", "photos/cat.png"))
+	assert.Equal(t, "team-a", name)
+	assert.Equal(t, "photos/cat.png", key)
+	assert.NotEqual(t, Qualify("team-a", "key"), Qualify("team-b", "key"))
+
+	// Keys may only name files within the directory of their bucket
+	for _, key := range []string{"cat.png", "photos/cat.png", "a..b", Qualify("team-a", "photos/cat.png")} {
+		assert.Nil(t, ValidateKey(key), key)
+	}
+	for _, key := range []string{"", "../cat.png", "photos/../../cat.png", "/cat.png", "photos/..", Qualify("team-a", "cat\x00.png"), Qualify("Team", "cat.png"), Qualify("team-a", "../cat.png")} {
+		assert.ErrorIs(t, ValidateKey(key), ErrInvalidKey, key)
+	}
+}
+
+func TestRegistryCreatesAndDeletesBuckets(t *testing.T) {
+	registry, ddb := newTestRegistry(t)
+
+	created, err := registry.Create(Bucket{Name: "logs", ReplicationFactor: 2, TTLSeconds: 60, Compression: GzipCompression})
+	assert.Nil(t, err)
+	assert.False(t, created.CreatedAt.IsZero())
+	assert.Equal(t, time.Minute, created.TTL())
+	_, err = registry.Create(Bucket{Name: "logs"})
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = registry.Create(Bucket{Name: "photos"})
+	assert.Nil(t, err)
+
+	found, err := registry.Get("logs")
+	assert.Nil(t, err)
+	assert.Equal(t, created, found)
+	assert.Len(t, registry.List(), 2)
+
+	// Deleted buckets are kept as tombstones, which aren't listed
+	tombstone, err := registry.Delete("logs")
+	assert.Nil(t, err)
+	assert.True(t, tombstone.Deleted())
+	assert.True(t, registry.IsDeleted("logs"))
+	_, err = registry.Get("logs")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = registry.Delete("logs")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Len(t, registry.List(), 1)
+	assert.Len(t, registry.All(), 2)
+
+	// A bucket created again supersedes its tombstone
+	recreated, err := registry.Create(Bucket{Name: "logs"})
+	assert.Nil(t, err)
+	assert.True(t, recreated.newerThan(tombstone))
+	assert.False(t, registry.IsDeleted("logs"))
+
+	// Buckets survive a restart
+	reloaded, err := NewRegistry(ddb)
+	assert.Nil(t, err)
+	assert.Equal(t, registry.All(), reloaded.All())
+}
+
+func TestRegistryMergeKeepsTheLastChange(t *testing.T) {
+	local, _ := newTestRegistry(t)
+	remote, _ := newTestRegistry(t)
+
+	_, err := remote.Create(Bucket{Name: "logs"})
+	assert.Nil(t, err)
+	merged, err := local.Merge(remote.All())
+	assert.Nil(t, err)
+	assert.Len(t, merged, 1)
+	_, err = local.Get("logs")
+	assert.Nil(t, err)
+
+	// Merging the same buckets again changes nothing
+	merged, err = local.Merge(remote.All())
+	assert.Nil(t, err)
+	assert.Empty(t, merged)
+
+	// A deletion is merged as a tombstone, and an older creation doesn't bring the bucket back
+	older := remote.All()
+	_, err = remote.Delete("logs")
+	assert.Nil(t, err)
+	merged, err = local.Merge(remote.All())
+	assert.Nil(t, err)
+	assert.Len(t, merged, 1)
+	assert.True(t, merged[0].Deleted())
+	merged, err = local.Merge(older)
+	assert.Nil(t, err)
+	assert.Empty(t, merged)
+	assert.True(t, local.IsDeleted("logs"))
+}
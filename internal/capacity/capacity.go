@@ -0,0 +1,131 @@
+package capacity
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// Unlimited is the room of a node without a capacity limit, whose free disk space can't be told either
+const Unlimited = -1
+
+type Opts struct {
+	// MaxBytes is how many bytes the files stored may take up in total, without a limit if it is 0
+	MaxBytes int64
+	// MinFreeDiskBytes is how many bytes of the disk the files are stored on are left free. Writes that would take the free disk
+	// space below it are rejected, rather than failing halfway once the disk is full.
+	MinFreeDiskBytes int64
+}
+
+// Usage is how much room a node has for files, as advertised to its peers
+type Usage struct {
+	// MaxBytes is the capacity limit of the node, which is 0 if it has none
+	MaxBytes int64 `json:"max_bytes"`
+	// UsedBytes is how many bytes the files stored take up
+	UsedBytes int64 `json:"used_bytes"`
+	// FreeDiskBytes is how many bytes of the disk are free, which is Unlimited if it can't be told
+	FreeDiskBytes int64 `json:"free_disk_bytes"`
+	// Available is how many more bytes may be stored, within both the capacity limit and the free disk watermark, or Unlimited
+	Available int64 `json:"available"`
+}
+
+// HasRoom reports whether size more bytes may be stored
+func (u Usage) HasRoom(size int64) bool {
+	return u.Available == Unlimited || size <= u.Available
+}
+
+// Tracker tracks how many bytes the files stored under a path take up, and how many more fit within its Opts. Walking the path is
+// costly, so it is only scanned now and then, and the bytes written in between are added up as they are written. Overwrites count
+// twice until the next scan, which errs on the side of rejecting writes.
+type Tracker struct {
+	path string
+	lock sync.Mutex
+	opts Opts
+	// scanned is how many bytes the last scan found, and written how many bytes were written since
+	scanned int64
+	written int64
+}
+
+func NewTracker(path string, opts Opts) *Tracker {
+	return &Tracker{
+		path: path,
+		opts: opts,
+	}
+}
+
+// SetOpts changes the limits the room for files is measured against
+func (t *Tracker) SetOpts(opts Opts) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.opts = opts
+}
+
+// Scan walks the path to find out how many bytes the files stored take up
+func (t *Tracker) Scan() error {
+	var used int64
+	err := filepath.WalkDir(t.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		used += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.scanned, t.written = used, 0
+	return nil
+}
+
+// Add records that n more bytes were written since the last scan
+func (t *Tracker) Add(n int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.written += n
+}
+
+// Usage returns how much room there is for files
+func (t *Tracker) Usage() Usage {
+	t.lock.Lock()
+	used, opts := t.scanned+t.written, t.opts
+	t.lock.Unlock()
+
+	usage := Usage{MaxBytes: opts.MaxBytes, UsedBytes: used, FreeDiskBytes: Unlimited, Available: Unlimited}
+	if opts.MaxBytes > 0 {
+		usage.Available = max(opts.MaxBytes-used, 0)
+	}
+	if free, known := diskFree(t.path); known {
+		usage.FreeDiskBytes = free
+		if room := max(free-opts.MinFreeDiskBytes, 0); usage.Available == Unlimited || room < usage.Available {
+			usage.Available = room
+		}
+	}
+	return usage
+}
+
+// Check returns ErrInsufficientStorage if there is no room for size more bytes
+func (t *Tracker) Check(size int64) error {
+	if usage := t.Usage(); !usage.HasRoom(size) {
+		return fmt.Errorf("%w: %d bytes don't fit in the %d bytes available", ErrInsufficientStorage, size, usage.Available)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package capacity
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrackerCountsStoredBytes(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "nested"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a"), make([]byte, 300), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "nested", "b"), make([]byte, 200), 0644))
+
+	tracker := NewTracker(dir, Opts{MaxBytes: 1000})
+	assert.Nil(t, tracker.Scan())
+	usage := tracker.Usage()
+	assert.Equal(t, int64(500), usage.UsedBytes)
+	assert.Equal(t, int64(500), usage.Available)
+	assert.Nil(t, tracker.Check(500))
+	assert.ErrorIs(t, tracker.Check(501), ErrInsufficientStorage)
+
+	// Writes count as soon as they are made, and the next scan finds out what they really take up
+	tracker.Add(400)
+	assert.ErrorIs(t, tracker.Check(101), ErrInsufficientStorage)
+	assert.Nil(t, tracker.Scan())
+	assert.Equal(t, int64(500), tracker.Usage().UsedBytes)
+}
+
+func TestTrackerKeepsFreeDiskWatermark(t *testing.T) {
+	dir := t.TempDir()
+	unlimited := NewTracker(filepath.Join(dir, "missing"), Opts{})
+	assert.Nil(t, unlimited.Scan())
+	free := unlimited.Usage().FreeDiskBytes
+	if free == Unlimited {
+		t.Skip("free disk space can't be told on this platform")
+	}
+	assert.Equal(t, free, unlimited.Usage().Available)
+
+	// A watermark above the free disk space leaves no room at all
+	full := NewTracker(dir, Opts{MinFreeDiskBytes: free + 1<<40})
+	assert.Equal(t, int64(0), full.Usage().Available)
+	assert.ErrorIs(t, full.Check(1), ErrInsufficientStorage)
+	assert.True(t, Usage{Available: Unlimited}.HasRoom(1<<40))
+}
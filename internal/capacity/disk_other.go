@@ -0,0 +1,8 @@
+//go:build !unix
+
+package capacity
+
+// diskFree can't tell how many bytes of the disk are free on this platform, so only the capacity limit applies
+func diskFree(path string) (int64, bool) {
+	return 0, false
+}
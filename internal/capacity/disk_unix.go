@@ -0,0 +1,26 @@
+//go:build unix
+
+package capacity
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// diskFree returns how many bytes of the disk holding path are free for unprivileged writes, and whether it could be told.
+// The path may not exist yet, in which case the disk of its nearest existing parent is measured.
+func diskFree(path string) (int64, bool) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), true
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, false
+		}
+		path = parent
+	}
+}
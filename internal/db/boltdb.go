@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -40,9 +41,11 @@ func InitDB(dbPath string) (DDB, error) {
 
 	// Create required buckets
 	err = _db.Update(func(tx *bbolt.Tx) error {
-		b := getBucketInstance(tx, util.MetadataBucketName)
-		if b == nil {
-			return fmt.Errorf("could not create bucket with name: %s", util.MetadataBucketName)
+		for _, bucketName := range util.RequiredBucketNames {
+			b := getBucketInstance(tx, bucketName)
+			if b == nil {
+				return fmt.Errorf("could not create bucket with name: %s", bucketName)
+			}
 		}
 		return nil
 	})
@@ -93,6 +96,15 @@ func CloseDB() {
 	}
 }
 
+// Close closes the db connection held by this DDB instance
+func (ddb *DDB) Close() error {
+	if !ddb.IsInit || !ddb.IsReady {
+		return nil
+	}
+	ddb.IsReady = false
+	return ddb.db.Close()
+}
+
 // -------------------------------------------------------------- END OF DB MANAGEMENT --------------------------------------------------------------
 
 // --------------------------------------------------------------  DB CRUD --------------------------------------------------------------
@@ -127,6 +139,122 @@ func (ddb *DDB) setValue(key string, value string) {
 	}
 }
 
+// Get returns a copy of the value stored against key in the given bucket, or nil if the key or the bucket doesn't exist
+func (ddb *DDB) Get(bucketName string, key string) ([]byte, error) {
+	var value []byte
+	err := ddb.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Put stores the given key-value pair in the given bucket, overwriting any existing value
+func (ddb *DDB) Put(bucketName string, key string, value []byte) error {
+	return ddb.db.Update(func(tx *bbolt.Tx) error {
+		b := getBucketInstance(tx, bucketName)
+		if b == nil {
+			return fmt.Errorf("could not create bucket with name: %s", bucketName)
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete removes the key from the given bucket. Deleting a key that doesn't exist is not an error.
+func (ddb *DDB) Delete(bucketName string, key string) error {
+	return ddb.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn for every key-value pair in the given bucket, in key order. The value is only valid inside fn.
+func (ddb *DDB) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	return ddb.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// Batch puts the given key-value pairs in the given bucket and deletes the given keys from it, in one transaction
+func (ddb *DDB) Batch(bucketName string, puts map[string][]byte, deletes []string) error {
+	return ddb.db.Update(func(tx *bbolt.Tx) error {
+		b := getBucketInstance(tx, bucketName)
+		if b == nil {
+			return fmt.Errorf("could not create bucket with name: %s", bucketName)
+		}
+		for _, key := range deletes {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		for key, value := range puts {
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Replace replaces every key-value pair in the given bucket with the given ones, in one transaction
+func (ddb *DDB) Replace(bucketName string, entries map[string][]byte) error {
+	return ddb.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(bucketName)) != nil {
+			if err := tx.DeleteBucket([]byte(bucketName)); err != nil {
+				return err
+			}
+		}
+		b := getBucketInstance(tx, bucketName)
+		if b == nil {
+			return fmt.Errorf("could not create bucket with name: %s", bucketName)
+		}
+		for key, value := range entries {
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BucketNames returns the names of the buckets that start with prefix, in order
+func (ddb *DDB) BucketNames(prefix string) ([]string, error) {
+	var names []string
+	err := ddb.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Cursor()
+		for name, _ := cursor.Seek([]byte(prefix)); name != nil && strings.HasPrefix(string(name), prefix); name, _ = cursor.Next() {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// DeleteBucket removes the given bucket along with every key-value pair in it. Deleting a bucket that doesn't exist is not an error.
+func (ddb *DDB) DeleteBucket(bucketName string) error {
+	return ddb.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(bucketName)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(bucketName))
+	})
+}
+
 // getBucketInstance returns an existing bucket or creates a new one if it doesn't exist.
 func getBucketInstance(tx *bbolt.Tx, bucketName string) *bbolt.Bucket {
 	bName := []byte(bucketName)
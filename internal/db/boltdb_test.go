@@ -123,4 +123,84 @@ func TestSetGetValue(t *testing.T) {
 	})
 }
 
+func TestPutGetDeleteForEach(t *testing.T) {
+	ddb := setupDB(t, util.DbPath)
+	assert.NotNil(t, ddb.db)
+
+	sampleKeyValuePairs := getSampleKeyValuePairs()
+	for k, v := range sampleKeyValuePairs {
+		assert.Nil(t, ddb.Put(util.UploadSessionsBucketName, k, []byte(v)))
+	}
+
+	for k, v := range sampleKeyValuePairs {
+		value, err := ddb.Get(util.UploadSessionsBucketName, k)
+		assert.Nil(t, err)
+		assert.Equal(t, v, string(value))
+	}
+
+	seen := make(map[string]string)
+	err := ddb.ForEach(util.UploadSessionsBucketName, func(key string, value []byte) error {
+		seen[key] = string(value)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, sampleKeyValuePairs, seen)
+
+	assert.Nil(t, ddb.Delete(util.UploadSessionsBucketName, "key0"))
+	value, err := ddb.Get(util.UploadSessionsBucketName, "key0")
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	t.Cleanup(func() {
+		teardownDB(t, true)
+	})
+}
+
+func TestBatchAndReplace(t *testing.T) {
+	ddb := setupDB(t, util.DbPath)
+	assert.NotNil(t, ddb.db)
+
+	assert.Nil(t, ddb.Put(util.RaftLogBucketName, "stale", []byte("value")))
+	assert.Nil(t, ddb.Batch(util.RaftLogBucketName, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}, []string{"stale"}))
+	seen := make(map[string]string)
+	assert.Nil(t, ddb.ForEach(util.RaftLogBucketName, func(key string, value []byte) error {
+		seen[key] = string(value)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"key1": "value1", "key2": "value2"}, seen)
+
+	assert.Nil(t, ddb.Replace(util.RaftLogBucketName, map[string][]byte{"key3": []byte("value3")}))
+	seen = make(map[string]string)
+	assert.Nil(t, ddb.ForEach(util.RaftLogBucketName, func(key string, value []byte) error {
+		seen[key] = string(value)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"key3": "value3"}, seen)
+
+	t.Cleanup(func() {
+		teardownDB(t, true)
+	})
+}
+
+func TestBucketNamesAndDeleteBucket(t *testing.T) {
+	ddb := setupDB(t, util.DbPath)
+	assert.NotNil(t, ddb.db)
+
+	assert.Nil(t, ddb.Put(util.BucketMetadataBucketPrefix+"photos", "key", []byte("value")))
+	assert.Nil(t, ddb.Put(util.BucketMetadataBucketPrefix+"logs", "key", []byte("value")))
+	names, err := ddb.BucketNames(util.BucketMetadataBucketPrefix)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{util.BucketMetadataBucketPrefix + "logs", util.BucketMetadataBucketPrefix + "photos"}, names)
+
+	assert.Nil(t, ddb.DeleteBucket(util.BucketMetadataBucketPrefix+"logs"))
+	assert.Nil(t, ddb.DeleteBucket(util.BucketMetadataBucketPrefix+"missing"))
+	names, err = ddb.BucketNames(util.BucketMetadataBucketPrefix)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{util.BucketMetadataBucketPrefix + "photos"}, names)
+
+	t.Cleanup(func() {
+		teardownDB(t, true)
+	})
+}
+
 // --------------------------------------------------------------  DB CRUD TESTS --------------------------------------------------------------
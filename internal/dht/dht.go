@@ -0,0 +1,288 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrNoContacts = errors.New("routing table has no contacts")
+
+// RPC sends the DHT requests to other nodes, over whatever transport the node uses
+type RPC interface {
+	// FindNode asks the contact for the contacts it knows closest to target
+	FindNode(ctx context.Context, to Contact, target NodeID) ([]Contact, error)
+	// FindValue asks the contact for the providers of key, along with the contacts it knows closest to key
+	FindValue(ctx context.Context, to Contact, key NodeID) ([]Contact, []Contact, error)
+	// StoreProvider asks the contact to record provider as holding key
+	StoreProvider(ctx context.Context, to Contact, key NodeID, provider Contact) error
+}
+
+type DHTOpts struct {
+	// K is the size of each k-bucket, as well as the number of nodes a provider record is stored on
+	K int
+	// Alpha is the number of requests a lookup keeps in flight at once
+	Alpha int
+	// ProviderTTL is how long a provider record lives without being refreshed
+	ProviderTTL time.Duration
+	// RPCTimeout bounds every single request
+	RPCTimeout time.Duration
+}
+
+// DHT is a Kademlia distributed hash table, which finds the nodes holding a key in O(log n) hops
+type DHT struct {
+	DHTOpts
+	Self      Contact
+	Table     *RoutingTable
+	Providers *ProviderStore
+	rpc       RPC
+}
+
+func NewDHT(opts DHTOpts, self Contact, rpc RPC) *DHT {
+	return &DHT{
+		DHTOpts:   opts,
+		Self:      self,
+		Table:     NewRoutingTable(self.ID, opts.K),
+		Providers: NewProviderStore(),
+		rpc:       rpc,
+	}
+}
+
+// --------------------------------------------------------------  CLIENT --------------------------------------------------------------
+
+// Bootstrap joins the DHT through seeds, by looking up our own id so that the nodes around us learn about us and vice versa
+func (d *DHT) Bootstrap(ctx context.Context, seeds []Contact) error {
+	for _, seed := range seeds {
+		if seed.ID == d.Self.ID {
+			continue
+		}
+		contacts, err := d.call(ctx, func(ctx context.Context) ([]Contact, error) {
+			return d.rpc.FindNode(ctx, seed, d.Self.ID)
+		})
+		if err != nil {
+			log.Printf("DHT: Couldn't reach seed %s: %v", seed.Addr, err)
+			continue
+		}
+		d.Observe(seed)
+		for _, contact := range contacts {
+			d.Observe(contact)
+		}
+	}
+	if d.Table.Len() == 0 {
+		return ErrNoContacts
+	}
+	_, _, err := d.lookup(ctx, d.Self.ID, false)
+	return err
+}
+
+// FindNode returns the K nodes closest to target in the whole DHT
+func (d *DHT) FindNode(ctx context.Context, target NodeID) ([]Contact, error) {
+	closest, _, err := d.lookup(ctx, target, false)
+	return closest, err
+}
+
+// FindProviders returns the nodes holding key, or none if no provider record could be found
+func (d *DHT) FindProviders(ctx context.Context, key string) ([]Contact, error) {
+	keyID := KeyID(key)
+	if providers := d.Providers.Get(keyID); len(providers) > 0 {
+		return providers, nil
+	}
+	_, providers, err := d.lookup(ctx, keyID, true)
+	return providers, err
+}
+
+// Provide announces that this node holds key, by storing a provider record on the K nodes closest to key
+func (d *DHT) Provide(ctx context.Context, key string) error {
+	keyID := KeyID(key)
+	closest, _, err := d.lookup(ctx, keyID, false)
+	if err != nil && !errors.Is(err, ErrNoContacts) {
+		return err
+	}
+	// Keep a record of our own, so that we can answer for the key without a lookup
+	d.Providers.Add(keyID, d.Self, d.ProviderTTL)
+
+	var wg sync.WaitGroup
+	for _, contact := range closest {
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			_, err := d.call(ctx, func(ctx context.Context) ([]Contact, error) {
+				return nil, d.rpc.StoreProvider(ctx, contact, keyID, d.Self)
+			})
+			if err != nil {
+				log.Printf("DHT: Couldn't store provider record of %s on %s: %v", key, contact.Addr, err)
+			}
+		}(contact)
+	}
+	wg.Wait()
+	return nil
+}
+
+// lookup iteratively queries the nodes closest to target, Alpha at a time, until the K closest nodes have all responded.
+// If findValue is set, the lookup stops as soon as a node returns providers for target.
+func (d *DHT) lookup(ctx context.Context, target NodeID, findValue bool) ([]Contact, []Contact, error) {
+	shortlist := d.Table.Closest(target, d.K)
+	if len(shortlist) == 0 {
+		return nil, nil, ErrNoContacts
+	}
+	var (
+		seen    = map[NodeID]bool{d.Self.ID: true}
+		queried = make(map[NodeID]bool)
+	)
+	for _, contact := range shortlist {
+		seen[contact.ID] = true
+	}
+
+	type lookupResult struct {
+		contact   Contact
+		providers []Contact
+		closer    []Contact
+		err       error
+	}
+	for {
+		// Query the Alpha closest contacts that haven't been queried yet
+		var batch []Contact
+		for _, contact := range shortlist {
+			if len(batch) == d.Alpha {
+				break
+			}
+			if !queried[contact.ID] {
+				batch = append(batch, contact)
+				queried[contact.ID] = true
+			}
+		}
+		if len(batch) == 0 {
+			return shortlist, nil, nil
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, contact := range batch {
+			go func(contact Contact) {
+				result := lookupResult{contact: contact}
+				if findValue {
+					rpcCtx, cancel := context.WithTimeout(ctx, d.RPCTimeout)
+					result.providers, result.closer, result.err = d.rpc.FindValue(rpcCtx, contact, target)
+					cancel()
+				} else {
+					result.closer, result.err = d.call(ctx, func(ctx context.Context) ([]Contact, error) {
+						return d.rpc.FindNode(ctx, contact, target)
+					})
+				}
+				results <- result
+			}(contact)
+		}
+
+		var providers []Contact
+		for range batch {
+			result := <-results
+			if result.err != nil {
+				// Unresponsive contacts are dropped from the lookup as well as the routing table
+				log.Printf("DHT: Dropping unresponsive contact %s: %v", result.contact.Addr, result.err)
+				d.Table.Remove(result.contact.ID)
+				shortlist = removeContact(shortlist, result.contact.ID)
+				continue
+			}
+			d.Observe(result.contact)
+			providers = append(providers, result.providers...)
+			for _, contact := range result.closer {
+				if !seen[contact.ID] {
+					seen[contact.ID] = true
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+		if findValue && len(providers) > 0 {
+			return shortlist, dedupeContacts(providers), nil
+		}
+
+		sortByDistance(shortlist, target)
+		if len(shortlist) > d.K {
+			shortlist = shortlist[:d.K]
+		}
+	}
+}
+
+// call runs a single request bounded by RPCTimeout
+func (d *DHT) call(ctx context.Context, fn func(ctx context.Context) ([]Contact, error)) ([]Contact, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.RPCTimeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// --------------------------------------------------------------  END OF CLIENT --------------------------------------------------------------
+
+// --------------------------------------------------------------  SERVER --------------------------------------------------------------
+
+// Observe records that contact is alive. If its bucket is full, the least recently seen contact is pinged in the background,
+// and replaced by contact only if it doesn't respond, since long-lived nodes are likely to stay around.
+func (d *DHT) Observe(contact Contact) {
+	stale, added := d.Table.Update(contact)
+	if added {
+		return
+	}
+	go func() {
+		_, err := d.call(context.Background(), func(ctx context.Context) ([]Contact, error) {
+			return d.rpc.FindNode(ctx, stale, d.Self.ID)
+		})
+		if err != nil {
+			d.Table.Replace(stale, contact)
+		} else {
+			d.Table.Update(stale)
+		}
+	}()
+}
+
+// HandleFindNode answers a FIND_NODE request from sender
+func (d *DHT) HandleFindNode(sender Contact, target NodeID) []Contact {
+	d.Observe(sender)
+	return d.closestExcept(target, sender.ID)
+}
+
+// HandleFindValue answers a FIND_VALUE request from sender with the providers of key it knows, and the contacts closest to key
+func (d *DHT) HandleFindValue(sender Contact, key NodeID) ([]Contact, []Contact) {
+	d.Observe(sender)
+	return d.Providers.Get(key), d.closestExcept(key, sender.ID)
+}
+
+// HandleStoreProvider answers a STORE_PROVIDER request from sender
+func (d *DHT) HandleStoreProvider(sender Contact, key NodeID, provider Contact) {
+	d.Observe(sender)
+	d.Providers.Add(key, provider, d.ProviderTTL)
+}
+
+// closestExcept returns the K contacts closest to target, leaving out the one with the given id
+func (d *DHT) closestExcept(target NodeID, id NodeID) []Contact {
+	closest := removeContact(d.Table.Closest(target, d.K+1), id)
+	if len(closest) > d.K {
+		closest = closest[:d.K]
+	}
+	return closest
+}
+
+// --------------------------------------------------------------  END OF SERVER --------------------------------------------------------------
+
+// removeContact returns contacts without the one with the given id
+func removeContact(contacts []Contact, id NodeID) []Contact {
+	filtered := contacts[:0:0]
+	for _, contact := range contacts {
+		if contact.ID != id {
+			filtered = append(filtered, contact)
+		}
+	}
+	return filtered
+}
+
+// dedupeContacts returns contacts with duplicate ids removed
+func dedupeContacts(contacts []Contact) []Contact {
+	seen := make(map[NodeID]bool)
+	var deduped []Contact
+	for _, contact := range contacts {
+		if !seen[contact.ID] {
+			seen[contact.ID] = true
+			deduped = append(deduped, contact)
+		}
+	}
+	return deduped
+}
@@ -0,0 +1,122 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryNetwork routes RPCs straight to the handlers of the target DHT, and counts them
+type memoryNetwork struct {
+	lock  sync.RWMutex
+	nodes map[string]*DHT
+	calls atomic.Int64
+}
+
+// memoryRPC is the RPC of a single node on a memoryNetwork
+type memoryRPC struct {
+	network *memoryNetwork
+	self    Contact
+}
+
+func (r *memoryRPC) target(to Contact) (*DHT, error) {
+	r.network.calls.Add(1)
+	r.network.lock.RLock()
+	node, exists := r.network.nodes[to.Addr]
+	r.network.lock.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%s is unreachable", to.Addr)
+	}
+	return node, nil
+}
+
+func (r *memoryRPC) FindNode(ctx context.Context, to Contact, target NodeID) ([]Contact, error) {
+	node, err := r.target(to)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleFindNode(r.self, target), nil
+}
+
+func (r *memoryRPC) FindValue(ctx context.Context, to Contact, key NodeID) ([]Contact, []Contact, error) {
+	node, err := r.target(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	providers, closer := node.HandleFindValue(r.self, key)
+	return providers, closer, nil
+}
+
+func (r *memoryRPC) StoreProvider(ctx context.Context, to Contact, key NodeID, provider Contact) error {
+	node, err := r.target(to)
+	if err != nil {
+		return err
+	}
+	node.HandleStoreProvider(r.self, key, provider)
+	return nil
+}
+
+// setupNetwork builds a network of n nodes, each bootstrapped through the first one
+func setupNetwork(t *testing.T, n int) (*memoryNetwork, []*DHT) {
+	network := &memoryNetwork{nodes: make(map[string]*DHT)}
+	opts := DHTOpts{K: 8, Alpha: 3, ProviderTTL: time.Hour, RPCTimeout: time.Second}
+
+	var nodes []*DHT
+	for i := 0; i < n; i++ {
+		self := NewContact(fmt.Sprintf("127.0.0.1:%d", 5000+i))
+		node := NewDHT(opts, self, &memoryRPC{network: network, self: self})
+		network.nodes[self.Addr] = node
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes[1:] {
+		assert.Nil(t, node.Bootstrap(context.Background(), []Contact{nodes[0].Self}))
+	}
+	return network, nodes
+}
+
+func TestFindProviders(t *testing.T) {
+	network, nodes := setupNetwork(t, 64)
+
+	provider := nodes[17]
+	assert.Nil(t, provider.Provide(context.Background(), "testfilename"))
+
+	// Every other node can find the provider, in far fewer requests than there are nodes
+	for _, node := range nodes {
+		before := network.calls.Load()
+		providers, err := node.FindProviders(context.Background(), "testfilename")
+		assert.Nil(t, err)
+		assert.Contains(t, providers, provider.Self)
+		assert.Less(t, network.calls.Load()-before, int64(len(nodes)/2))
+	}
+
+	providers, err := nodes[3].FindProviders(context.Background(), "missing")
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+}
+
+func TestFindNodeSkipsUnreachableNodes(t *testing.T) {
+	network, nodes := setupNetwork(t, 16)
+
+	// Take a node offline, lookups route around it and forget it
+	gone := nodes[5]
+	network.lock.Lock()
+	delete(network.nodes, gone.Self.Addr)
+	network.lock.Unlock()
+
+	closest, err := nodes[0].FindNode(context.Background(), gone.Self.ID)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, closest)
+	for _, contact := range closest {
+		assert.NotEqual(t, gone.Self.ID, contact.ID)
+	}
+}
+
+func TestBootstrapWithoutSeeds(t *testing.T) {
+	self := NewContact("127.0.0.1:5000")
+	node := NewDHT(DHTOpts{K: 8, Alpha: 3, RPCTimeout: time.Second}, self, &memoryRPC{network: &memoryNetwork{}, self: self})
+	assert.ErrorIs(t, node.Bootstrap(context.Background(), nil), ErrNoContacts)
+}
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// ID_LENGTH denotes the number of bytes in a NodeID, which matches the size of a sha1 hash
+const ID_LENGTH = sha1.Size
+
+// NodeID identifies both nodes and keys in the same 160 bit space, so that distances can be measured between them
+type NodeID [ID_LENGTH]byte
+
+// NewNodeID derives the NodeID of the node listening on addr
+func NewNodeID(addr string) NodeID {
+	return NodeID(sha1.Sum([]byte(addr)))
+}
+
+// KeyID derives the NodeID that a file key maps to
+func KeyID(key string) NodeID {
+	return NodeID(sha1.Sum([]byte(key)))
+}
+
+// ParseNodeID parses the hex encoding of a NodeID, as returned by String
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != ID_LENGTH {
+		return id, fmt.Errorf("invalid node id %q", s)
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between id and other
+func (id NodeID) Distance(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// Less reports whether the distance id is smaller than other
+func (id NodeID) Less(other NodeID) bool {
+	return bytes.Compare(id[:], other[:]) < 0
+}
+
+// CommonPrefixLen returns the number of leading bits id and other share, which picks the k-bucket other belongs to
+func (id NodeID) CommonPrefixLen(other NodeID) int {
+	distance := id.Distance(other)
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return ID_LENGTH * 8
+}
+
+// Contact is a node in the DHT, along with the address it can be reached on
+type Contact struct {
+	ID       NodeID
+	Addr     string
+	LastSeen time.Time
+}
+
+func NewContact(addr string) Contact {
+	return Contact{ID: NewNodeID(addr), Addr: addr}
+}
+
+func (c Contact) String() string {
+	return c.ID.String() + "@" + c.Addr
+}
+
+// EncodeContacts encodes contacts into a single control message arg
+func EncodeContacts(contacts []Contact) string {
+	encoded := make([]string, len(contacts))
+	for i, contact := range contacts {
+		encoded[i] = contact.String()
+	}
+	return strings.Join(encoded, ",")
+}
+
+// DecodeContacts decodes contacts from a control message arg, as encoded by EncodeContacts
+func DecodeContacts(s string) ([]Contact, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var contacts []Contact
+	for _, encoded := range strings.Split(s, ",") {
+		idStr, addr, found := strings.Cut(encoded, "@")
+		if !found || addr == "" {
+			return nil, fmt.Errorf("invalid contact %q", encoded)
+		}
+		id, err := ParseNodeID(idStr)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, Contact{ID: id, Addr: addr})
+	}
+	return contacts, nil
+}
@@ -0,0 +1,38 @@
+package dht
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNodeIDDistance(t *testing.T) {
+	a := NewNodeID("127.0.0.1:5000")
+	b := NewNodeID("127.0.0.1:6000")
+
+	assert.Equal(t, NodeID{}, a.Distance(a))
+	assert.Equal(t, a.Distance(b), b.Distance(a))
+	assert.Equal(t, ID_LENGTH*8, a.CommonPrefixLen(a))
+	assert.Less(t, a.CommonPrefixLen(b), ID_LENGTH*8)
+
+	parsed, err := ParseNodeID(a.String())
+	assert.Nil(t, err)
+	assert.Equal(t, a, parsed)
+
+	_, err = ParseNodeID("not hex")
+	assert.NotNil(t, err)
+}
+
+func TestContactsRoundTrip(t *testing.T) {
+	contacts := []Contact{NewContact("127.0.0.1:5000"), NewContact("127.0.0.1:6000")}
+
+	decoded, err := DecodeContacts(EncodeContacts(contacts))
+	assert.Nil(t, err)
+	assert.Equal(t, contacts, decoded)
+
+	decoded, err = DecodeContacts("")
+	assert.Nil(t, err)
+	assert.Empty(t, decoded)
+
+	_, err = DecodeContacts("missing-addr")
+	assert.NotNil(t, err)
+}
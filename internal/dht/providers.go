@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// providerRecord tracks a node holding a key, until it expires
+type providerRecord struct {
+	contact   Contact
+	expiresAt time.Time
+}
+
+// ProviderStore maps keys to the nodes holding them, for the keys this node is among the closest to
+type ProviderStore struct {
+	lock    sync.RWMutex
+	records map[NodeID]map[NodeID]providerRecord
+}
+
+func NewProviderStore() *ProviderStore {
+	return &ProviderStore{
+		records: make(map[NodeID]map[NodeID]providerRecord),
+	}
+}
+
+// Add records provider as holding key for ttl, refreshing the record if it already exists
+func (ps *ProviderStore) Add(key NodeID, provider Contact, ttl time.Duration) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.records[key] == nil {
+		ps.records[key] = make(map[NodeID]providerRecord)
+	}
+	ps.records[key][provider.ID] = providerRecord{contact: provider, expiresAt: time.Now().Add(ttl)}
+}
+
+// Get returns the unexpired providers of key
+func (ps *ProviderStore) Get(key NodeID) []Contact {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	var providers []Contact
+	now := time.Now()
+	for id, record := range ps.records[key] {
+		if now.After(record.expiresAt) {
+			delete(ps.records[key], id)
+			continue
+		}
+		providers = append(providers, record.contact)
+	}
+	if len(ps.records[key]) == 0 {
+		delete(ps.records, key)
+	}
+	return providers
+}
+
+// Remove drops the record of provider holding key
+func (ps *ProviderStore) Remove(key NodeID, provider NodeID) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	delete(ps.records[key], provider)
+	if len(ps.records[key]) == 0 {
+		delete(ps.records, key)
+	}
+}
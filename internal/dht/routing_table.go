@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RoutingTable keeps up to K contacts in each k-bucket, where bucket i holds the contacts sharing i leading bits with self
+type RoutingTable struct {
+	self    NodeID
+	k       int
+	lock    sync.RWMutex
+	buckets [ID_LENGTH * 8][]Contact
+}
+
+func NewRoutingTable(self NodeID, k int) *RoutingTable {
+	return &RoutingTable{
+		self: self,
+		k:    k,
+	}
+}
+
+// Update records that contact was just seen. A known contact is moved to the tail of its bucket, and a new one is appended if
+// there is room. If the bucket is full, the least recently seen contact is returned so that the caller can check if it is alive.
+func (rt *RoutingTable) Update(contact Contact) (Contact, bool) {
+	if contact.ID == rt.self {
+		return Contact{}, true
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	contact.LastSeen = time.Now()
+	index := rt.bucketIndex(contact.ID)
+	bucket := rt.buckets[index]
+	for i, existing := range bucket {
+		if existing.ID == contact.ID {
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), contact)
+			return Contact{}, true
+		}
+	}
+	if len(bucket) < rt.k {
+		rt.buckets[index] = append(bucket, contact)
+		return Contact{}, true
+	}
+	return bucket[0], false
+}
+
+// Replace evicts stale from its bucket in favour of contact, provided stale is still the least recently seen contact
+func (rt *RoutingTable) Replace(stale Contact, contact Contact) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	index := rt.bucketIndex(stale.ID)
+	bucket := rt.buckets[index]
+	if len(bucket) == 0 || bucket[0].ID != stale.ID || rt.bucketIndex(contact.ID) != index {
+		return
+	}
+	contact.LastSeen = time.Now()
+	rt.buckets[index] = append(bucket[1:len(bucket):len(bucket)], contact)
+}
+
+// Remove drops the contact with the given id
+func (rt *RoutingTable) Remove(id NodeID) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	index := rt.bucketIndex(id)
+	bucket := rt.buckets[index]
+	for i, existing := range bucket {
+		if existing.ID == id {
+			rt.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to n known contacts closest to target, nearest first
+func (rt *RoutingTable) Closest(target NodeID, n int) []Contact {
+	rt.lock.RLock()
+	var contacts []Contact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	rt.lock.RUnlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Len returns the number of known contacts
+func (rt *RoutingTable) Len() int {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	total := 0
+	for _, bucket := range rt.buckets {
+		total += len(bucket)
+	}
+	return total
+}
+
+// bucketIndex returns the index of the bucket id belongs to. Must be called with the lock held.
+func (rt *RoutingTable) bucketIndex(id NodeID) int {
+	index := rt.self.CommonPrefixLen(id)
+	if index >= len(rt.buckets) {
+		index = len(rt.buckets) - 1
+	}
+	return index
+}
+
+// sortByDistance sorts contacts by their distance to target, nearest first
+func sortByDistance(contacts []Contact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID.Distance(target).Less(contacts[j].ID.Distance(target))
+	})
+}
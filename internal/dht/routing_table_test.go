@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRoutingTableClosest(t *testing.T) {
+	self := NewContact("127.0.0.1:5000")
+	rt := NewRoutingTable(self.ID, 20)
+	for i := 0; i < 50; i++ {
+		rt.Update(NewContact(fmt.Sprintf("127.0.0.1:%d", 6000+i)))
+	}
+	// Self is never part of its own routing table
+	rt.Update(self)
+
+	target := KeyID("testfilename")
+	closest := rt.Closest(target, 5)
+	assert.Len(t, closest, 5)
+	for i := 1; i < len(closest); i++ {
+		assert.True(t, closest[i-1].ID.Distance(target).Less(closest[i].ID.Distance(target)))
+	}
+	for _, contact := range closest {
+		assert.NotEqual(t, self.ID, contact.ID)
+	}
+}
+
+func TestRoutingTableFullBucket(t *testing.T) {
+	self := NewContact("127.0.0.1:5000")
+	rt := NewRoutingTable(self.ID, 1)
+
+	// Find two contacts that land in the same bucket
+	var first, second Contact
+	buckets := make(map[int]Contact)
+	for i := 0; ; i++ {
+		contact := NewContact(fmt.Sprintf("127.0.0.1:%d", 6000+i))
+		index := self.ID.CommonPrefixLen(contact.ID)
+		if existing, found := buckets[index]; found {
+			first, second = existing, contact
+			break
+		}
+		buckets[index] = contact
+	}
+
+	_, added := rt.Update(first)
+	assert.True(t, added)
+	stale, added := rt.Update(second)
+	assert.False(t, added)
+	assert.Equal(t, first.ID, stale.ID)
+
+	rt.Replace(stale, second)
+	closest := rt.Closest(second.ID, 1)
+	assert.Equal(t, second.ID, closest[0].ID)
+
+	rt.Remove(second.ID)
+	assert.Zero(t, rt.Len())
+}
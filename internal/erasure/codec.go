@@ -0,0 +1,152 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTooFewShards is returned when fewer shards than there are data shards are left to reconstruct a file from
+	ErrTooFewShards = errors.New("too few shards to reconstruct from")
+	// ErrShardSize is returned when the shards handed to a Codec don't all have the same size
+	ErrShardSize = errors.New("shards differ in size")
+)
+
+// Codec splits files into data shards and computes parity shards for them with Reed-Solomon coding, so that a file can be
+// reconstructed from any DataShards of its DataShards+ParityShards shards
+type Codec struct {
+	DataShards   int
+	ParityShards int
+	// matrix turns the data shards into every shard. Its top rows are the identity, so the data shards are kept as is.
+	matrix matrix
+}
+
+// NewCodec returns a Codec for the given number of data and parity shards, which there may be at most 256 of in total
+func NewCodec(dataShards, parityShards int) (*Codec, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid erasure coding of %d data and %d parity shards", dataShards, parityShards)
+	}
+	total := dataShards + parityShards
+	all := vandermonde(total, dataShards)
+	top, err := all.subMatrix(0, dataShards).invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Codec{DataShards: dataShards, ParityShards: parityShards, matrix: all.multiply(top)}, nil
+}
+
+// Shards returns the total number of shards of a file
+func (c *Codec) Shards() int {
+	return c.DataShards + c.ParityShards
+}
+
+// Split splits data into DataShards data shards of equal size, padding the last with zeroes, followed by ParityShards empty
+// parity shards of the same size for Encode to fill
+func (c *Codec) Split(data []byte) [][]byte {
+	shardSize := (len(data) + c.DataShards - 1) / c.DataShards
+	if shardSize == 0 {
+		shardSize = 1
+	}
+	padded := make([]byte, shardSize*c.Shards())
+	copy(padded, data)
+	shards := make([][]byte, c.Shards())
+	for i := range shards {
+		shards[i] = padded[i*shardSize : (i+1)*shardSize : (i+1)*shardSize]
+	}
+	return shards
+}
+
+// Encode computes the parity shards of shards from its data shards
+func (c *Codec) Encode(shards [][]byte) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+	}
+	shardSize := len(shards[0])
+	for _, shard := range shards {
+		if len(shard) != shardSize {
+			return ErrShardSize
+		}
+	}
+	for p := c.DataShards; p < c.Shards(); p++ {
+		clear(shards[p])
+		for d := 0; d < c.DataShards; d++ {
+			mulAddSlice(c.matrix[p][d], shards[d], shards[p])
+		}
+	}
+	return nil
+}
+
+// Reconstruct fills in the shards of shards that are nil, from any DataShards of the others
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+	}
+	var (
+		present   []int
+		shardSize = -1
+	)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if shardSize >= 0 && len(shard) != shardSize {
+			return ErrShardSize
+		}
+		shardSize = len(shard)
+		present = append(present, i)
+	}
+	if len(present) < c.DataShards {
+		return ErrTooFewShards
+	}
+	if len(present) == c.Shards() {
+		return nil
+	}
+
+	// The data shards are recovered by inverting the rows of the matrix that produced the first DataShards shards present
+	present = present[:c.DataShards]
+	rows := newMatrix(c.DataShards, c.DataShards)
+	for r, i := range present {
+		copy(rows[r], c.matrix[i])
+	}
+	decode, err := rows.invert()
+	if err != nil {
+		return err
+	}
+	for d := 0; d < c.DataShards; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		shards[d] = make([]byte, shardSize)
+		for r, i := range present {
+			mulAddSlice(decode[d][r], shards[i], shards[d])
+		}
+	}
+	for p := c.DataShards; p < c.Shards(); p++ {
+		if shards[p] != nil {
+			continue
+		}
+		shards[p] = make([]byte, shardSize)
+		for d := 0; d < c.DataShards; d++ {
+			mulAddSlice(c.matrix[p][d], shards[d], shards[p])
+		}
+	}
+	return nil
+}
+
+// Join returns the first size bytes of the data shards of shards, which is the file they were split from
+func (c *Codec) Join(shards [][]byte, size int64) ([]byte, error) {
+	if len(shards) < c.DataShards {
+		return nil, ErrTooFewShards
+	}
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:c.DataShards] {
+		if shard == nil {
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shard...)
+	}
+	if int64(len(data)) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
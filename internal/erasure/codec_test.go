@@ -0,0 +1,53 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReconstructFromAnyDataShards(t *testing.T) {
+	codec, err := NewCodec(4, 2)
+	assert.Nil(t, err)
+	data := make([]byte, 10_000)
+	_, _ = rand.Read(data)
+
+	shards := codec.Split(data)
+	assert.Len(t, shards, 6)
+	assert.Nil(t, codec.Encode(shards))
+	original := make([][]byte, len(shards))
+	for i, shard := range shards {
+		original[i] = bytes.Clone(shard)
+	}
+
+	// Whichever two shards are lost, the others rebuild them
+	for lost1 := 0; lost1 < 6; lost1++ {
+		for lost2 := lost1 + 1; lost2 < 6; lost2++ {
+			damaged := make([][]byte, len(original))
+			for i, shard := range original {
+				damaged[i] = bytes.Clone(shard)
+			}
+			damaged[lost1], damaged[lost2] = nil, nil
+			assert.Nil(t, codec.Reconstruct(damaged))
+			assert.Equal(t, original, damaged)
+			joined, err := codec.Join(damaged, int64(len(data)))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, joined))
+		}
+	}
+
+	// But a third lost shard is one too many
+	original[0], original[1], original[5] = nil, nil, nil
+	assert.ErrorIs(t, codec.Reconstruct(original), ErrTooFewShards)
+}
+
+func TestNewCodecRejectsInvalidCodings(t *testing.T) {
+	for _, coding := range [][2]int{{0, 2}, {4, -1}, {200, 57}} {
+		_, err := NewCodec(coding[0], coding[1])
+		assert.NotNil(t, err, "%d+%d", coding[0], coding[1])
+	}
+	codec, err := NewCodec(3, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, codec.Encode(codec.Split([]byte("no parity at all"))))
+}
@@ -0,0 +1,67 @@
+package erasure
+
+// Arithmetic over GF(2^8), the field Reed-Solomon shards are computed in, with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+// Addition and subtraction are XOR, multiplication and division go through log and exp tables.
+
+const fieldPolynomial = 0x11d
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= fieldPolynomial
+		}
+	}
+}
+
+// gfMul returns a*b in GF(2^8)
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// gfDiv returns a/b in GF(2^8), b must not be 0
+func gfDiv(a, b byte) byte {
+	if b == 0 {
+		panic("erasure: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// gfExp returns a^n in GF(2^8)
+func gfExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulAddSlice adds c*in to out, byte by byte
+func mulAddSlice(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(logTable[c])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= expTable[logC+int(logTable[b])]
+		}
+	}
+}
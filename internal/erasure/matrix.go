@@ -0,0 +1,100 @@
+package erasure
+
+import "errors"
+
+var errSingularMatrix = errors.New("erasure: matrix is singular")
+
+// matrix is a matrix over GF(2^8), by rows
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func identityMatrix(n int) matrix {
+	m := newMatrix(n, n)
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// vandermonde returns the rows×cols matrix whose entry (r, c) is r^c. Any cols of its rows are linearly independent.
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = gfExp(byte(r), c)
+		}
+	}
+	return m
+}
+
+// multiply returns m×other
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for r := range result {
+		for c := range result[r] {
+			var value byte
+			for i := range other {
+				value ^= gfMul(m[r][i], other[i][c])
+			}
+			result[r][c] = value
+		}
+	}
+	return result
+}
+
+// subMatrix returns the rows [rmin, rmax) of m
+func (m matrix) subMatrix(rmin, rmax int) matrix {
+	result := newMatrix(rmax-rmin, len(m[0]))
+	for r := rmin; r < rmax; r++ {
+		copy(result[r-rmin], m[r])
+	}
+	return result
+}
+
+// invert returns the inverse of the square matrix m, by Gauss-Jordan elimination over m next to the identity
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		if scale := work[c][c]; scale != 1 {
+			for i := range work[c] {
+				work[c][i] = gfDiv(work[c][i], scale)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				factor := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= gfMul(factor, work[c][i])
+				}
+			}
+		}
+	}
+
+	inverse := newMatrix(n, n)
+	for r := range inverse {
+		copy(inverse[r], work[r][n:])
+	}
+	return inverse, nil
+}
@@ -0,0 +1,232 @@
+package erasure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrShardNotFound is returned when a shard isn't held
+var ErrShardNotFound = errors.New("shard not found")
+
+// manifestFileName is the name the Manifest of a key is saved under, next to the shards of it
+const manifestFileName = "manifest.json"
+
+// Manifest describes how the file of Key was erasure coded, so that it can be reconstructed from its shards
+type Manifest struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	ShardSize    int64  `json:"shard_size"`
+	// Checksums holds the hex encoded sha256 of every shard, by index
+	Checksums []string `json:"checksums"`
+}
+
+// NewManifest returns the Manifest of the file of key, of the given size, that was erasure coded by codec into shards
+func NewManifest(key string, size int64, codec *Codec, shards [][]byte) Manifest {
+	manifest := Manifest{
+		Key:          key,
+		Size:         size,
+		DataShards:   codec.DataShards,
+		ParityShards: codec.ParityShards,
+		ShardSize:    int64(len(shards[0])),
+	}
+	for _, shard := range shards {
+		manifest.Checksums = append(manifest.Checksums, checksum(shard))
+	}
+	return manifest
+}
+
+// Shards returns the total number of shards of the file
+func (m Manifest) Shards() int {
+	return m.DataShards + m.ParityShards
+}
+
+// Codec returns the Codec the file was erasure coded with
+func (m Manifest) Codec() (*Codec, error) {
+	return NewCodec(m.DataShards, m.ParityShards)
+}
+
+// Validate checks that the manifest is consistent
+func (m Manifest) Validate() error {
+	if m.Key == "" || m.Size < 0 || m.ShardSize <= 0 || len(m.Checksums) != m.Shards() {
+		return fmt.Errorf("invalid manifest of %q", m.Key)
+	}
+	if _, err := m.Codec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Verify reports whether data is the shard at index
+func (m Manifest) Verify(index int, data []byte) bool {
+	return index >= 0 && index < len(m.Checksums) && int64(len(data)) == m.ShardSize && checksum(data) == m.Checksums[index]
+}
+
+// Encode returns the JSON encoding of the manifest
+func (m Manifest) Encode() string {
+	encoded, _ := json.Marshal(m)
+	return string(encoded)
+}
+
+// DecodeManifest decodes and validates a manifest encoded by Encode
+func DecodeManifest(encoded string) (Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal([]byte(encoded), &manifest); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, manifest.Validate()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ShardStore keeps the shards held by this node on disk, each key in a directory of its own along with its Manifest
+type ShardStore struct {
+	dir string
+}
+
+// NewShardStore returns a ShardStore keeping its shards under dir
+func NewShardStore(dir string) *ShardStore {
+	return &ShardStore{dir: dir}
+}
+
+func (s *ShardStore) keyDir(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *ShardStore) shardPath(key string, index int) string {
+	return filepath.Join(s.keyDir(key), "shard-"+strconv.Itoa(index))
+}
+
+// Put saves the shard at index of the file that manifest describes, read from r, once its checksum matches the manifest.
+// A shard of an older version of the file is replaced, along with its manifest.
+func (s *ShardStore) Put(manifest Manifest, index int, r io.Reader) error {
+	if err := manifest.Validate(); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, manifest.ShardSize+1))
+	if err != nil {
+		return err
+	}
+	if !manifest.Verify(index, data) {
+		return fmt.Errorf("shard %d of %s doesn't match its manifest", index, manifest.Key)
+	}
+
+	dir := s.keyDir(manifest.Key)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if current, err := s.Manifest(manifest.Key); err == nil && current.Encode() != manifest.Encode() {
+		// The shards held of another version of the file can't be combined with this one
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(dir, manifestFileName), []byte(manifest.Encode())); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.shardPath(manifest.Key, index), data)
+}
+
+// Manifest returns the Manifest of the shards held of key
+func (s *ShardStore) Manifest(key string) (Manifest, error) {
+	encoded, err := os.ReadFile(filepath.Join(s.keyDir(key), manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Manifest{}, ErrShardNotFound
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	return DecodeManifest(string(encoded))
+}
+
+// Indexes returns the indexes of the shards held of key, in increasing order
+func (s *ShardStore) Indexes(key string) ([]int, error) {
+	entries, err := os.ReadDir(s.keyDir(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for _, entry := range entries {
+		if index, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "shard-")); err == nil && strings.HasPrefix(entry.Name(), "shard-") {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// ReadAt reads the part of the shard at index of key that starts at offset into p, like io.ReaderAt
+func (s *ShardStore) ReadAt(key string, index int, p []byte, offset int64) (int, error) {
+	fd, err := os.Open(s.shardPath(key, index))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrShardNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	return fd.ReadAt(p, offset)
+}
+
+// Read returns the shard at index of key
+func (s *ShardStore) Read(key string, index int) ([]byte, error) {
+	data, err := os.ReadFile(s.shardPath(key, index))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrShardNotFound
+	}
+	return data, err
+}
+
+// Keys returns the keys that shards are held of
+func (s *ShardStore) Keys() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		encoded, err := os.ReadFile(filepath.Join(s.dir, entry.Name(), manifestFileName))
+		if err != nil {
+			continue
+		}
+		if manifest, err := DecodeManifest(string(encoded)); err == nil {
+			keys = append(keys, manifest.Key)
+		}
+	}
+	return keys, nil
+}
+
+// Remove forgets every shard held of key
+func (s *ShardStore) Remove(key string) error {
+	return os.RemoveAll(s.keyDir(key))
+}
+
+// writeFileAtomic writes data to path through a temporary file, so that a crash never leaves a partial file at path
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,46 @@
+package erasure
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShardStoreKeepsShardsOfOneVersion(t *testing.T) {
+	store := NewShardStore(t.TempDir())
+	codec, err := NewCodec(2, 1)
+	assert.Nil(t, err)
+
+	shards := codec.Split([]byte("first version of the file"))
+	assert.Nil(t, codec.Encode(shards))
+	manifest := NewManifest("key", 25, codec, shards)
+	assert.Nil(t, store.Put(manifest, 0, bytes.NewReader(shards[0])))
+	assert.Nil(t, store.Put(manifest, 2, bytes.NewReader(shards[2])))
+	// A shard that doesn't match the manifest is refused
+	assert.NotNil(t, store.Put(manifest, 1, bytes.NewReader(shards[0])))
+
+	indexes, err := store.Indexes("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 2}, indexes)
+	held, err := store.Manifest("key")
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, held)
+	data, err := store.Read("key", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, shards[2], data)
+
+	// A shard of another version replaces the ones held of the previous one
+	shards = codec.Split([]byte("second version"))
+	assert.Nil(t, codec.Encode(shards))
+	assert.Nil(t, store.Put(NewManifest("key", 14, codec, shards), 1, bytes.NewReader(shards[1])))
+	indexes, err = store.Indexes("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, indexes)
+
+	keys, err := store.Keys()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key"}, keys)
+	assert.Nil(t, store.Remove("key"))
+	_, err = store.Manifest("key")
+	assert.ErrorIs(t, err, ErrShardNotFound)
+}
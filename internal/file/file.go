@@ -2,11 +2,14 @@ package file
 
 import (
 	"bufio"
+	"errors"
+	"file-store/internal/util"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 type File struct {
@@ -49,6 +52,40 @@ func (f *File) WriteStream(r io.Reader) error {
 	return fd.Close()
 }
 
+// WriteStreamAt writes into the File f from io.Reader r starting at offset, keeping the bytes before offset intact.
+// The number of bytes written is returned even when r fails midway, so that callers can commit a partial write.
+func (f *File) WriteStreamAt(r io.Reader, offset int64) (int64, error) {
+	// Open the file without truncating it and create a fd
+	fd, err := f.openFileForAppending()
+	if err != nil {
+		log.Printf("File Error: Couldn't create file descriptor for writing: %+v", err)
+		return 0, err
+	}
+	defer fd.Close()
+
+	// Drop anything beyond offset, since those bytes were never committed
+	if err := fd.Truncate(offset); err != nil {
+		log.Printf("File Error: Error truncating file to offset %d: %+v", offset, err)
+		return 0, err
+	}
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("File Error: Error seeking to offset %d: %+v", offset, err)
+		return 0, err
+	}
+
+	// Copy straight into the fd, so that every byte read from r is accounted for even if r fails midway
+	n, copyErr := io.Copy(fd, r)
+	// Sync changes to disk
+	if err := fd.Sync(); err != nil {
+		log.Printf("File Error: Error syncing file: %+v", err)
+		return 0, err
+	}
+	f.FileSize = offset + n
+
+	log.Printf("Written %d bytes at offset %d to %s/%s", n, offset, f.BasePath, f.KeyPath)
+	return n, copyErr
+}
+
 // ReadFile reads the File f and returns byte array of content
 func (f *File) ReadFile() ([]byte, error) {
 	if f.Exists() {
@@ -59,6 +96,16 @@ func (f *File) ReadFile() ([]byte, error) {
 	}
 }
 
+// OpenFile opens the File f for reading, so that its content can be streamed
+func (f *File) OpenFile() (*os.File, error) {
+	if f.Exists() {
+		fullPath := fmt.Sprintf("%s/%s", f.BasePath, f.KeyPath)
+		return os.Open(fullPath)
+	} else {
+		return nil, os.ErrNotExist
+	}
+}
+
 // DeleteFile deletes the File f
 func (f *File) DeleteFile() error {
 	if f.Exists() {
@@ -83,6 +130,16 @@ func (f *File) openFileForWriting() (*os.File, error) {
 	return os.Create(fullPath)
 }
 
+// openFileForAppending creates the necessary subdirectories and opens a file descriptor to the File f without truncating it
+func (f *File) openFileForAppending() (*os.File, error) {
+	if err := os.MkdirAll(f.BasePath, f.FileMode); err != nil {
+		fmt.Println("File Error: Couldn't create subdirs for writing", err)
+		return nil, err
+	}
+	fullPath := filepath.Join(f.BasePath, f.KeyPath)
+	return os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, util.ReadWrite)
+}
+
 // deleteParentFolders recursively removes parent directories if they become empty
 func (f *File) deleteParentFolders() error {
 	dir := filepath.Dir(f.BasePath + "/")
@@ -91,7 +148,7 @@ func (f *File) deleteParentFolders() error {
 		err := os.Remove(dir)
 		if err != nil {
 			// Stop if the directory is not empty
-			if os.IsNotExist(err) || os.IsPermission(err) {
+			if os.IsNotExist(err) || os.IsPermission(err) || errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
 				break
 			}
 			return fmt.Errorf("failed to remove directory %s: %v", dir, err)
@@ -54,3 +54,47 @@ func TestFileExistsBadInput(t *testing.T) {
 	file := File{KeyPath: util.DefaultFileKeyPath, BasePath: util.DefaultFileBasePath}
 	assert.False(t, file.Exists())
 }
+
+func TestFileWriteStreamAt(t *testing.T) {
+	file := setupFile(t, util.DefaultFileKeyPath, util.DefaultFileBasePath, util.Default)
+	t.Cleanup(func() {
+		teardownFile(t, file, true)
+	})
+
+	// Overwrite everything after the first 4 bytes, and leave the prefix intact
+	n, err := file.WriteStreamAt(bytes.NewReader([]byte(" jpg bytes")), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.Equal(t, int64(14), file.FileSize)
+
+	content, err := file.ReadFile()
+	assert.Nil(t, err)
+	assert.Equal(t, "some jpg bytes", string(content))
+}
+
+func TestFileWriteStreamAtTruncatesUncommittedBytes(t *testing.T) {
+	file := setupFile(t, util.DefaultFileKeyPath, util.DefaultFileBasePath, util.Default)
+	t.Cleanup(func() {
+		teardownFile(t, file, true)
+	})
+
+	n, err := file.WriteStreamAt(bytes.NewReader(nil), 4)
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+
+	content, err := file.ReadFile()
+	assert.Nil(t, err)
+	assert.Equal(t, "some", string(content))
+}
+
+func TestFileDeleteKeepsNonEmptyParents(t *testing.T) {
+	dir := t.TempDir()
+	sibling := setupFile(t, "sibling", filepath.Join(dir, "a"), util.Default)
+	file := setupFile(t, util.DefaultFileKeyPath, filepath.Join(dir, "a", "b", "c"), util.Default)
+
+	// The folders left empty are removed, up to the first one still holding something
+	assert.Nil(t, file.DeleteFile())
+	assert.False(t, file.Exists())
+	assert.NoDirExists(t, filepath.Join(dir, "a", "b"))
+	assert.True(t, sibling.Exists())
+}
@@ -0,0 +1,226 @@
+package hints
+
+import (
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/file"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrHintStoreFull = errors.New("hint store is full")
+
+// Hint records a write that couldn't reach Owner, the node it was meant for, so that it is handed off once Owner is back
+type Hint struct {
+	ID string `json:"id"`
+	// Owner is the listen address of the node the write was meant for
+	Owner     string    `json:"owner"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	// Version holds the args describing the version of the file that was written, which it is handed off with
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type ManagerOpts struct {
+	// MaxBytes is how many bytes of data every hint held may take up in total
+	MaxBytes int64
+	// MaxAge is how long a hint is held before it is given up on
+	MaxAge time.Duration
+}
+
+// Manager persists hints in the metadata DB and keeps a copy of the data of each on disk, until it is handed off to its owner
+type Manager struct {
+	ManagerOpts
+	ddb      *db.DDB
+	dataPath string
+	lock     sync.Mutex
+}
+
+func NewManager(ddb *db.DDB, dataPath string, opts ManagerOpts) *Manager {
+	return &Manager{
+		ManagerOpts: opts,
+		ddb:         ddb,
+		dataPath:    dataPath,
+	}
+}
+
+// Add stores a hint that the size bytes of key read from r, the given version of it, are meant for owner, replacing any older
+// hint for the same key.
+// Expired hints are given up on first, and if the data still doesn't fit in MaxBytes, ErrHintStoreFull is returned.
+func (m *Manager) Add(owner string, key string, size int64, version map[string]string, r io.Reader) (*Hint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.expire(); err != nil {
+		return nil, err
+	}
+	hints, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	var used int64
+	for _, hint := range hints {
+		if hint.Owner == owner && hint.Key == key {
+			if err := m.remove(hint.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		used += hint.Size
+	}
+	if used+size > m.MaxBytes {
+		return nil, fmt.Errorf("%w: %d of %d bytes used, %d more needed", ErrHintStoreFull, used, m.MaxBytes, size)
+	}
+
+	hint := &Hint{ID: upload.NewSessionID(), Owner: owner, Key: key, Size: size, CreatedAt: time.Now(), Version: version}
+	f := file.File{
+		KeyPath:  hint.ID,
+		BasePath: m.dataPath,
+		FileMode: util.Default,
+	}
+	if err := f.WriteStream(io.LimitReader(r, size)); err != nil {
+		return nil, err
+	}
+	if f.FileSize != size {
+		_ = os.Remove(m.dataFilePath(hint.ID))
+		return nil, fmt.Errorf("hint data of %s ended after %d of %d bytes", key, f.FileSize, size)
+	}
+	if err := m.save(hint); err != nil {
+		_ = os.Remove(m.dataFilePath(hint.ID))
+		return nil, err
+	}
+	return hint, nil
+}
+
+// ForOwner returns the hints held for owner, oldest first. Expired hints are given up on first.
+func (m *Manager) ForOwner(owner string) ([]*Hint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.expire(); err != nil {
+		return nil, err
+	}
+	hints, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	var owned []*Hint
+	for _, hint := range hints {
+		if hint.Owner == owner {
+			owned = append(owned, hint)
+		}
+	}
+	return owned, nil
+}
+
+// List returns every hint held, oldest first
+func (m *Manager) List() ([]*Hint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.list()
+}
+
+// Open opens the data of the hint with the given id for reading
+func (m *Manager) Open(id string) (*os.File, error) {
+	return os.Open(m.dataFilePath(id))
+}
+
+// Remove deletes the hint with the given id along with its data
+func (m *Manager) Remove(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.remove(id)
+}
+
+// RemoveOwner deletes every hint held for owner, e.g, once it left the cluster for good
+func (m *Manager) RemoveOwner(owner string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hints, err := m.list()
+	if err != nil {
+		return err
+	}
+	for _, hint := range hints {
+		if hint.Owner == owner {
+			if err := m.remove(hint.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Expire gives up on the hints held for longer than MaxAge, and returns how many there were
+func (m *Manager) Expire() (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.expire()
+}
+
+// expire implements Expire. Must be called with the lock held.
+func (m *Manager) expire() (int, error) {
+	hints, err := m.list()
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, hint := range hints {
+		if time.Since(hint.CreatedAt) <= m.MaxAge {
+			continue
+		}
+		if err := m.remove(hint.ID); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// list returns every hint held, oldest first. Must be called with the lock held.
+func (m *Manager) list() ([]*Hint, error) {
+	var hints []*Hint
+	err := m.ddb.ForEach(util.HintsBucketName, func(key string, value []byte) error {
+		var hint Hint
+		if err := json.Unmarshal(value, &hint); err != nil {
+			return fmt.Errorf("corrupt hint %s: %w", key, err)
+		}
+		hints = append(hints, &hint)
+		return nil
+	})
+	sort.SliceStable(hints, func(i, j int) bool {
+		return hints[i].CreatedAt.Before(hints[j].CreatedAt)
+	})
+	return hints, err
+}
+
+// remove implements Remove. Must be called with the lock held.
+func (m *Manager) remove(id string) error {
+	if err := os.Remove(m.dataFilePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return m.ddb.Delete(util.HintsBucketName, id)
+}
+
+// save persists the given hint in the metadata DB
+func (m *Manager) save(hint *Hint) error {
+	value, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	return m.ddb.Put(util.HintsBucketName, hint.ID, value)
+}
+
+// dataFilePath returns the path where the data of the hint with the given id is kept
+func (m *Manager) dataFilePath(id string) string {
+	return filepath.Join(m.dataPath, id)
+}
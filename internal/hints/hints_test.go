@@ -0,0 +1,102 @@
+package hints
+
+import (
+	"bytes"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupManager quickly sets up a Manager backed by a fresh DDB in a temp dir and returns it
+func setupManager(t *testing.T, opts ManagerOpts) *Manager {
+	dir := t.TempDir()
+	ddb, err := db.InitDB(filepath.Join(dir, "metadata.db"))
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	return NewManager(&ddb, filepath.Join(dir, "hints"), opts)
+}
+
+func addHint(t *testing.T, manager *Manager, owner string, key string, data string) *Hint {
+	hint, err := manager.Add(owner, key, int64(len(data)), nil, bytes.NewReader([]byte(data)))
+	assert.Nil(t, err)
+	return hint
+}
+
+func TestAddAndOpenHints(t *testing.T) {
+	manager := setupManager(t, ManagerOpts{MaxBytes: 1024, MaxAge: time.Hour})
+	first := addHint(t, manager, "owner-a", util.CommonFileKey, util.CommonStringContent)
+	addHint(t, manager, "owner-b", util.CommonFileKey, util.CommonStringContent)
+	second := addHint(t, manager, "owner-a", "other", "other content")
+
+	hints, err := manager.ForOwner("owner-a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first.ID, second.ID}, []string{hints[0].ID, hints[1].ID})
+
+	fd, err := manager.Open(first.ID)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(fd)
+	assert.Nil(t, fd.Close())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(util.CommonStringContent), data)
+
+	assert.Nil(t, manager.Remove(first.ID))
+	_, err = manager.Open(first.ID)
+	assert.NotNil(t, err)
+	assert.Nil(t, manager.RemoveOwner("owner-a"))
+	hints, err = manager.List()
+	assert.Nil(t, err)
+	assert.Len(t, hints, 1)
+	assert.Equal(t, "owner-b", hints[0].Owner)
+}
+
+func TestNewerHintReplacesOlderOne(t *testing.T) {
+	manager := setupManager(t, ManagerOpts{MaxBytes: 1024, MaxAge: time.Hour})
+	addHint(t, manager, "owner", util.CommonFileKey, "first")
+	latest := addHint(t, manager, "owner", util.CommonFileKey, "second")
+
+	hints, err := manager.ForOwner("owner")
+	assert.Nil(t, err)
+	assert.Len(t, hints, 1)
+	assert.Equal(t, latest.ID, hints[0].ID)
+}
+
+func TestHintsAreLimitedInSize(t *testing.T) {
+	manager := setupManager(t, ManagerOpts{MaxBytes: 10, MaxAge: time.Hour})
+	addHint(t, manager, "owner", "first", "123456")
+
+	_, err := manager.Add("owner", "second", 5, nil, bytes.NewReader([]byte("12345")))
+	assert.ErrorIs(t, err, ErrHintStoreFull)
+	addHint(t, manager, "owner", "second", "1234")
+
+	// Data that ends before the size it was announced with isn't held
+	_, err = manager.Add("other", "third", 5, nil, bytes.NewReader([]byte("1")))
+	assert.NotNil(t, err)
+	hints, err := manager.List()
+	assert.Nil(t, err)
+	assert.Len(t, hints, 2)
+}
+
+func TestHintsAreLimitedInAge(t *testing.T) {
+	manager := setupManager(t, ManagerOpts{MaxBytes: 10, MaxAge: 50 * time.Millisecond})
+	addHint(t, manager, "owner", "first", "1234567890")
+	time.Sleep(100 * time.Millisecond)
+
+	// Expired hints make room for new ones, and aren't handed off anymore
+	second := addHint(t, manager, "owner", "second", "1234567890")
+	hints, err := manager.ForOwner("owner")
+	assert.Nil(t, err)
+	assert.Len(t, hints, 1)
+	assert.Equal(t, second.ID, hints[0].ID)
+
+	time.Sleep(100 * time.Millisecond)
+	expired, err := manager.Expire()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, expired)
+}
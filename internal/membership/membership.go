@@ -0,0 +1,465 @@
+package membership
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Transport sends the probes of the failure detector to other members, over whatever transport the node uses.
+// Both calls carry piggybacked updates to the member contacted, and return the ones it piggybacked on its ack.
+type Transport interface {
+	// Ping probes addr directly
+	Ping(ctx context.Context, addr string, updates []Update) ([]Update, error)
+	// PingReq asks via to probe target on our behalf, and only succeeds if target acked via
+	PingReq(ctx context.Context, via string, target string, updates []Update) ([]Update, error)
+}
+
+// EventType denotes the kind of change in the member list an Event reports
+type EventType int
+
+const (
+	EventJoin EventType = iota
+	EventLeave
+	EventFail
+)
+
+func (e EventType) String() string {
+	return [...]string{"JOIN", "LEAVE", "FAIL"}[e]
+}
+
+// Event reports that a member joined, left or was declared dead
+type Event struct {
+	Type   EventType
+	Member Member
+}
+
+// Member is a node of the cluster, as the local node currently sees it
+type Member struct {
+	Addr           string
+	State          MemberState
+	Incarnation    uint64
+	StateChangedAt time.Time
+}
+
+type MemberlistOpts struct {
+	// ProbeInterval is how often a member is probed
+	ProbeInterval time.Duration
+	// ProbeTimeout bounds a direct probe, as well as the indirect probes that follow if it fails
+	ProbeTimeout time.Duration
+	// IndirectChecks is the number of members asked to probe a member that didn't ack a direct probe
+	IndirectChecks int
+	// SuspicionTimeout is how long a member stays suspected before it is declared dead
+	SuspicionTimeout time.Duration
+	// RetransmitMult scales the number of times an update is piggybacked, which is RetransmitMult * log(n+1)
+	RetransmitMult int
+	// OnEvent is called for every join, leave or failure, outside of any lock
+	OnEvent func(Event)
+}
+
+// broadcast is an update waiting to be piggybacked on outgoing probes and acks
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// Memberlist is a SWIM-style failure detector and membership list. Every ProbeInterval, one member is pinged, directly and then
+// through IndirectChecks other members. A member that acks neither is suspected, and declared dead if it doesn't refute the
+// suspicion within SuspicionTimeout. Changes to the list are spread by piggybacking them on the probes and their acks.
+type Memberlist struct {
+	MemberlistOpts
+	Self        string
+	transport   Transport
+	lock        sync.Mutex
+	incarnation uint64
+	members     map[string]*Member
+	broadcasts  []*broadcast
+	probeOrder  []string
+	probeIndex  int
+	left        bool
+	stopCh      chan struct{}
+	stopOnce    sync.Once
+}
+
+func NewMemberlist(opts MemberlistOpts, self string, transport Transport) *Memberlist {
+	return &Memberlist{
+		MemberlistOpts: opts,
+		Self:           self,
+		transport:      transport,
+		members:        make(map[string]*Member),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// --------------------------------------------------------------  CLIENT --------------------------------------------------------------
+
+// Join contacts seeds to announce ourselves, returning the number of seeds that could be reached
+func (m *Memberlist) Join(ctx context.Context, seeds []string) int {
+	joined := 0
+	for _, seed := range seeds {
+		if seed == m.Self {
+			continue
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+		updates, err := m.transport.Ping(probeCtx, seed, m.outgoingUpdates())
+		cancel()
+		if err != nil {
+			log.Printf("Membership: Couldn't reach seed %s: %v", seed, err)
+			continue
+		}
+		m.Merge(append(updates, Update{Addr: seed, State: StateAlive}))
+		joined++
+	}
+	return joined
+}
+
+// Start runs the probe loop in the background, until Stop is called
+func (m *Memberlist) Start() {
+	go func() {
+		ticker := time.NewTicker(m.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.Probe(context.Background())
+				m.ReapSuspects()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the probe loop
+func (m *Memberlist) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+// Leave announces to every live member that we are leaving the cluster, and stops probing
+func (m *Memberlist) Leave(ctx context.Context) {
+	m.lock.Lock()
+	m.left = true
+	leaving := []Update{{Addr: m.Self, State: StateLeft, Incarnation: m.incarnation}}
+	m.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, member := range m.Members() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+			defer cancel()
+			if _, err := m.transport.Ping(probeCtx, addr, leaving); err != nil {
+				log.Printf("Membership: Couldn't announce leave to %s: %v", addr, err)
+			}
+		}(member.Addr)
+	}
+	wg.Wait()
+	m.Stop()
+}
+
+// Probe runs one round of the failure detector against the next member in the probe order
+func (m *Memberlist) Probe(ctx context.Context) {
+	target, ok := m.nextProbeTarget()
+	if !ok {
+		return
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+	updates, err := m.transport.Ping(probeCtx, target.Addr, m.outgoingUpdates())
+	cancel()
+	if err == nil {
+		m.Merge(updates)
+		return
+	}
+
+	// The direct probe failed, so ask other members to probe the target, in case only our path to it is broken
+	helpers := m.randomMembers(m.IndirectChecks, target.Addr)
+	acks := make(chan []Update, len(helpers))
+	var wg sync.WaitGroup
+	for _, helper := range helpers {
+		wg.Add(1)
+		go func(via string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+			defer cancel()
+			updates, err := m.transport.PingReq(probeCtx, via, target.Addr, m.outgoingUpdates())
+			if err == nil {
+				acks <- updates
+			}
+		}(helper.Addr)
+	}
+	wg.Wait()
+	close(acks)
+
+	acked := false
+	for updates := range acks {
+		acked = true
+		m.Merge(updates)
+	}
+	if !acked {
+		log.Printf("Membership: %s didn't ack any probe, suspecting it", target.Addr)
+		m.Merge([]Update{{Addr: target.Addr, State: StateSuspect, Incarnation: target.Incarnation}})
+	}
+}
+
+// ReapSuspects declares dead the members that have been suspected for longer than SuspicionTimeout
+func (m *Memberlist) ReapSuspects() {
+	m.lock.Lock()
+	var expired []Update
+	for _, member := range m.members {
+		if member.State == StateSuspect && time.Since(member.StateChangedAt) >= m.SuspicionTimeout {
+			expired = append(expired, Update{Addr: member.Addr, State: StateDead, Incarnation: member.Incarnation})
+		}
+	}
+	m.lock.Unlock()
+
+	if len(expired) > 0 {
+		m.Merge(expired)
+	}
+}
+
+// --------------------------------------------------------------  END OF CLIENT --------------------------------------------------------------
+
+// --------------------------------------------------------------  SERVER --------------------------------------------------------------
+
+// HandlePing answers a probe from the member listening on from. A member we didn't know as live is sent the whole member list, so
+// that a node joining through us converges right away instead of waiting for gossip.
+func (m *Memberlist) HandlePing(from string, updates []Update) []Update {
+	m.lock.Lock()
+	member, known := m.members[from]
+	live := known && (member.State == StateAlive || member.State == StateSuspect)
+	m.lock.Unlock()
+
+	m.Merge(append(updates, Update{Addr: from, State: StateAlive}))
+	if !live {
+		return m.fullState()
+	}
+	return m.outgoingUpdates()
+}
+
+// HandlePingReq probes target on behalf of the member listening on from, and returns the updates to piggyback on our ack
+func (m *Memberlist) HandlePingReq(ctx context.Context, from string, target string, updates []Update) ([]Update, error) {
+	m.Merge(append(updates, Update{Addr: from, State: StateAlive}))
+
+	probeCtx, cancel := context.WithTimeout(ctx, m.ProbeTimeout)
+	defer cancel()
+	targetUpdates, err := m.transport.Ping(probeCtx, target, m.outgoingUpdates())
+	if err != nil {
+		return nil, err
+	}
+	m.Merge(targetUpdates)
+	return m.outgoingUpdates(), nil
+}
+
+// Merge applies gossiped updates to the member list, following the SWIM precedence rules:
+// Alive overrides a state of a lower incarnation, Suspect overrides Alive of the same or a lower incarnation,
+// and Dead or Left override any state of the same or a lower incarnation.
+func (m *Memberlist) Merge(updates []Update) {
+	var events []Event
+	m.lock.Lock()
+	for _, update := range updates {
+		if event, ok := m.apply(update); ok {
+			events = append(events, event)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, event := range events {
+		log.Printf("Membership: %s %s", event.Member.Addr, event.Type)
+		if m.OnEvent != nil {
+			m.OnEvent(event)
+		}
+	}
+}
+
+// apply applies a single update, returning the event it caused if any. Must be called with the lock held.
+func (m *Memberlist) apply(update Update) (Event, bool) {
+	if update.Addr == m.Self {
+		// Refute suspicions about us by outgrowing their incarnation. This is also how a node that restarts after being
+		// declared dead or gone comes back, since it learns about its old state from the full state sent on join.
+		if !m.left && update.State != StateAlive && update.Incarnation >= m.incarnation {
+			m.incarnation = update.Incarnation + 1
+			m.enqueue(Update{Addr: m.Self, State: StateAlive, Incarnation: m.incarnation})
+		}
+		return Event{}, false
+	}
+
+	member, known := m.members[update.Addr]
+	if !known {
+		member = &Member{Addr: update.Addr, State: update.State, Incarnation: update.Incarnation, StateChangedAt: time.Now()}
+		m.members[update.Addr] = member
+		m.enqueue(update)
+		if update.State == StateAlive || update.State == StateSuspect {
+			return Event{Type: EventJoin, Member: *member}, true
+		}
+		// Remember the members we learn are gone, so that older gossip can't bring them back
+		return Event{}, false
+	}
+
+	wasGone := member.State == StateDead || member.State == StateLeft
+	switch update.State {
+	case StateAlive:
+		if update.Incarnation <= member.Incarnation {
+			return Event{}, false
+		}
+	case StateSuspect:
+		if wasGone || update.Incarnation < member.Incarnation ||
+			(update.Incarnation == member.Incarnation && member.State != StateAlive) {
+			return Event{}, false
+		}
+	case StateDead, StateLeft:
+		if wasGone || update.Incarnation < member.Incarnation {
+			return Event{}, false
+		}
+	}
+
+	member.State = update.State
+	member.Incarnation = update.Incarnation
+	member.StateChangedAt = time.Now()
+	m.enqueue(update)
+
+	switch {
+	case update.State == StateAlive && wasGone:
+		return Event{Type: EventJoin, Member: *member}, true
+	case update.State == StateDead:
+		return Event{Type: EventFail, Member: *member}, true
+	case update.State == StateLeft:
+		return Event{Type: EventLeave, Member: *member}, true
+	}
+	return Event{}, false
+}
+
+// --------------------------------------------------------------  END OF SERVER --------------------------------------------------------------
+
+// Members returns the members currently believed to be alive or suspected, excluding ourselves
+func (m *Memberlist) Members() []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var members []Member
+	for _, member := range m.members {
+		if member.State == StateAlive || member.State == StateSuspect {
+			members = append(members, *member)
+		}
+	}
+	return members
+}
+
+// Failed returns the members currently believed to be dead, which may still come back unlike the ones that left
+func (m *Memberlist) Failed() []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var members []Member
+	for _, member := range m.members {
+		if member.State == StateDead {
+			members = append(members, *member)
+		}
+	}
+	return members
+}
+
+// Member returns the member listening on addr, whatever its state
+func (m *Memberlist) Member(addr string) (Member, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	member, exists := m.members[addr]
+	if !exists {
+		return Member{}, false
+	}
+	return *member, true
+}
+
+// nextProbeTarget returns the next live member in a round-robin over a shuffled member list, reshuffled on every pass
+func (m *Memberlist) nextProbeTarget() (Member, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for m.probeIndex < len(m.probeOrder) {
+			member, exists := m.members[m.probeOrder[m.probeIndex]]
+			m.probeIndex++
+			if exists && (member.State == StateAlive || member.State == StateSuspect) {
+				return *member, true
+			}
+		}
+		m.probeOrder = m.probeOrder[:0]
+		for addr := range m.members {
+			m.probeOrder = append(m.probeOrder, addr)
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+		m.probeIndex = 0
+	}
+	return Member{}, false
+}
+
+// randomMembers returns up to n random live members, leaving out the one listening on except
+func (m *Memberlist) randomMembers(n int, except string) []Member {
+	var candidates []Member
+	for _, member := range m.Members() {
+		if member.Addr != except && member.State == StateAlive {
+			candidates = append(candidates, member)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// enqueue queues update for piggybacking, superseding any queued update about the same member. Must be called with the lock held.
+func (m *Memberlist) enqueue(update Update) {
+	for i, queued := range m.broadcasts {
+		if queued.update.Addr == update.Addr {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{update: update})
+}
+
+// outgoingUpdates returns the updates to piggyback on a message, always including our own liveness.
+// Every queued update is sent RetransmitMult * log(n+1) times before being dropped.
+func (m *Memberlist) outgoingUpdates() []Update {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	limit := m.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+2))))
+	updates := []Update{{Addr: m.Self, State: StateAlive, Incarnation: m.incarnation}}
+	remaining := m.broadcasts[:0]
+	for _, queued := range m.broadcasts {
+		if queued.update.Addr != m.Self {
+			updates = append(updates, queued.update)
+		}
+		queued.transmits++
+		if queued.transmits < limit {
+			remaining = append(remaining, queued)
+		}
+	}
+	m.broadcasts = remaining
+	return updates
+}
+
+// fullState returns an update for every member we know, ourselves included
+func (m *Memberlist) fullState() []Update {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	updates := []Update{{Addr: m.Self, State: StateAlive, Incarnation: m.incarnation}}
+	for _, member := range m.members {
+		updates = append(updates, Update{Addr: member.Addr, State: member.State, Incarnation: member.Incarnation})
+	}
+	return updates
+}
@@ -0,0 +1,223 @@
+package membership
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryNetwork routes probes straight to the handlers of the target Memberlist, and can cut nodes or single links off
+type memoryNetwork struct {
+	lock   sync.RWMutex
+	nodes  map[string]*Memberlist
+	broken map[[2]string]bool
+}
+
+// memoryTransport is the Transport of a single node on a memoryNetwork
+type memoryTransport struct {
+	network *memoryNetwork
+	self    string
+}
+
+func (n *memoryNetwork) target(from string, to string) (*Memberlist, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	node, exists := n.nodes[to]
+	if !exists || n.broken[[2]string{from, to}] {
+		return nil, fmt.Errorf("%s is unreachable from %s", to, from)
+	}
+	return node, nil
+}
+
+func (tr *memoryTransport) Ping(ctx context.Context, addr string, updates []Update) ([]Update, error) {
+	node, err := tr.network.target(tr.self, addr)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandlePing(tr.self, updates), nil
+}
+
+func (tr *memoryTransport) PingReq(ctx context.Context, via string, target string, updates []Update) ([]Update, error) {
+	node, err := tr.network.target(tr.self, via)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandlePingReq(ctx, tr.self, target, updates)
+}
+
+// eventLog records the events of every node
+type eventLog struct {
+	lock   sync.Mutex
+	events map[string][]Event
+}
+
+func (l *eventLog) count(node string, eventType EventType, addr string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	total := 0
+	for _, event := range l.events[node] {
+		if event.Type == eventType && event.Member.Addr == addr {
+			total++
+		}
+	}
+	return total
+}
+
+// setupCluster builds a cluster of n nodes, each joined through the first one
+func setupCluster(t *testing.T, n int) (*memoryNetwork, []*Memberlist, *eventLog) {
+	network := &memoryNetwork{nodes: make(map[string]*Memberlist), broken: make(map[[2]string]bool)}
+	events := &eventLog{events: make(map[string][]Event)}
+
+	var nodes []*Memberlist
+	for i := 0; i < n; i++ {
+		self := fmt.Sprintf("127.0.0.1:%d", 5000+i)
+		opts := MemberlistOpts{
+			ProbeInterval:    10 * time.Millisecond,
+			ProbeTimeout:     time.Second,
+			IndirectChecks:   3,
+			SuspicionTimeout: 0,
+			RetransmitMult:   4,
+			OnEvent: func(event Event) {
+				events.lock.Lock()
+				defer events.lock.Unlock()
+				events.events[self] = append(events.events[self], event)
+			},
+		}
+		node := NewMemberlist(opts, self, &memoryTransport{network: network, self: self})
+		network.nodes[self] = node
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes[1:] {
+		assert.Equal(t, 1, node.Join(context.Background(), []string{nodes[0].Self}))
+	}
+	return network, nodes, events
+}
+
+// probeRounds runs rounds of the failure detector on every node
+func probeRounds(nodes []*Memberlist, rounds int) {
+	for i := 0; i < rounds; i++ {
+		for _, node := range nodes {
+			node.Probe(context.Background())
+			node.ReapSuspects()
+		}
+	}
+}
+
+func TestUpdateEncoding(t *testing.T) {
+	updates := []Update{
+		{Addr: "127.0.0.1:5000", State: StateAlive, Incarnation: 3},
+		{Addr: "127.0.0.1:5001", State: StateDead, Incarnation: 0},
+	}
+	decoded, err := DecodeUpdates(EncodeUpdates(updates))
+	assert.Nil(t, err)
+	assert.Equal(t, updates, decoded)
+
+	decoded, err = DecodeUpdates("")
+	assert.Nil(t, err)
+	assert.Empty(t, decoded)
+
+	_, err = DecodeUpdates("127.0.0.1:5000|9|0")
+	assert.NotNil(t, err)
+}
+
+func TestClusterConvergesOnMemberList(t *testing.T) {
+	_, nodes, events := setupCluster(t, 6)
+	probeRounds(nodes, 10)
+
+	for _, node := range nodes {
+		assert.Len(t, node.Members(), len(nodes)-1, "node %s", node.Self)
+		for _, other := range nodes {
+			if other != node {
+				assert.Equal(t, 1, events.count(node.Self, EventJoin, other.Self), "node %s", node.Self)
+			}
+		}
+	}
+}
+
+func TestFailedMemberIsDetected(t *testing.T) {
+	network, nodes, events := setupCluster(t, 5)
+	probeRounds(nodes, 10)
+
+	failed := nodes[len(nodes)-1]
+	network.lock.Lock()
+	delete(network.nodes, failed.Self)
+	network.lock.Unlock()
+
+	probeRounds(nodes[:len(nodes)-1], 20)
+	for _, node := range nodes[:len(nodes)-1] {
+		member, exists := node.Member(failed.Self)
+		assert.True(t, exists)
+		assert.Equal(t, StateDead, member.State, "node %s", node.Self)
+		assert.Equal(t, 1, events.count(node.Self, EventFail, failed.Self), "node %s", node.Self)
+		assert.Len(t, node.Members(), len(nodes)-2)
+		assert.Equal(t, []Member{member}, node.Failed())
+	}
+}
+
+func TestIndirectProbeAvoidsFalseSuspicion(t *testing.T) {
+	network, nodes, events := setupCluster(t, 4)
+	probeRounds(nodes, 10)
+
+	// Only the link from the first node to the second is broken, so the others can still vouch for it
+	network.lock.Lock()
+	network.broken[[2]string{nodes[0].Self, nodes[1].Self}] = true
+	network.lock.Unlock()
+
+	probeRounds(nodes, 20)
+	member, exists := nodes[0].Member(nodes[1].Self)
+	assert.True(t, exists)
+	assert.Equal(t, StateAlive, member.State)
+	assert.Equal(t, 0, events.count(nodes[0].Self, EventFail, nodes[1].Self))
+}
+
+func TestSuspicionIsRefuted(t *testing.T) {
+	_, nodes, _ := setupCluster(t, 3)
+	probeRounds(nodes, 10)
+
+	suspected := nodes[1]
+	nodes[0].Merge([]Update{{Addr: suspected.Self, State: StateSuspect, Incarnation: 0}})
+	member, _ := nodes[0].Member(suspected.Self)
+	assert.Equal(t, StateSuspect, member.State)
+
+	// The suspicion reaches the suspect through gossip, which refutes it with a higher incarnation
+	suspected.Merge([]Update{{Addr: suspected.Self, State: StateSuspect, Incarnation: 0}})
+	nodes[0].Merge(suspected.outgoingUpdates())
+	member, _ = nodes[0].Member(suspected.Self)
+	assert.Equal(t, StateAlive, member.State)
+	assert.Equal(t, uint64(1), member.Incarnation)
+
+	// Stale gossip of the old suspicion can't override the refutation
+	nodes[0].Merge([]Update{{Addr: suspected.Self, State: StateSuspect, Incarnation: 0}})
+	member, _ = nodes[0].Member(suspected.Self)
+	assert.Equal(t, StateAlive, member.State)
+}
+
+func TestLeaveAndRejoin(t *testing.T) {
+	network, nodes, events := setupCluster(t, 3)
+	probeRounds(nodes, 10)
+
+	leaving := nodes[2]
+	leaving.Leave(context.Background())
+	for _, node := range nodes[:2] {
+		member, _ := node.Member(leaving.Self)
+		assert.Equal(t, StateLeft, member.State)
+		assert.Equal(t, 1, events.count(node.Self, EventLeave, leaving.Self))
+	}
+
+	// A restarted node begins at incarnation 0 again, and outgrows the record of its departure on join
+	rejoined := NewMemberlist(leaving.MemberlistOpts, leaving.Self, &memoryTransport{network: network, self: leaving.Self})
+	network.lock.Lock()
+	network.nodes[rejoined.Self] = rejoined
+	network.lock.Unlock()
+	assert.Equal(t, 1, rejoined.Join(context.Background(), []string{nodes[0].Self}))
+
+	probeRounds([]*Memberlist{nodes[0], nodes[1], rejoined}, 10)
+	for _, node := range nodes[:2] {
+		member, _ := node.Member(rejoined.Self)
+		assert.Equal(t, StateAlive, member.State)
+		assert.Equal(t, 2, events.count(node.Self, EventJoin, rejoined.Self))
+	}
+}
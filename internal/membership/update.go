@@ -0,0 +1,66 @@
+package membership
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MemberState denotes what the cluster believes about a member
+type MemberState int
+
+const (
+	StateAlive MemberState = iota
+	StateSuspect
+	StateDead
+	StateLeft
+)
+
+func (s MemberState) String() string {
+	return [...]string{"ALIVE", "SUSPECT", "DEAD", "LEFT"}[s]
+}
+
+// Update is a piece of membership gossip, stating that a member is in a state as of an incarnation.
+// Only the member itself bumps its incarnation, which is how it refutes stale suspicions about it.
+type Update struct {
+	Addr        string
+	State       MemberState
+	Incarnation uint64
+}
+
+func (u Update) String() string {
+	return fmt.Sprintf("%s|%d|%d", u.Addr, u.State, u.Incarnation)
+}
+
+// EncodeUpdates encodes updates into a single control message arg
+func EncodeUpdates(updates []Update) string {
+	encoded := make([]string, len(updates))
+	for i, update := range updates {
+		encoded[i] = update.String()
+	}
+	return strings.Join(encoded, ";")
+}
+
+// DecodeUpdates decodes updates from a control message arg, as encoded by EncodeUpdates
+func DecodeUpdates(s string) ([]Update, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var updates []Update
+	for _, encoded := range strings.Split(s, ";") {
+		fields := strings.Split(encoded, "|")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid membership update %q", encoded)
+		}
+		state, err := strconv.Atoi(fields[1])
+		if err != nil || state < int(StateAlive) || state > int(StateLeft) {
+			return nil, fmt.Errorf("invalid state in membership update %q", encoded)
+		}
+		incarnation, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid incarnation in membership update %q", encoded)
+		}
+		updates = append(updates, Update{Addr: fields[0], State: MemberState(state), Incarnation: incarnation})
+	}
+	return updates, nil
+}
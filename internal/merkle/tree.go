@@ -0,0 +1,157 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Depth is the number of levels below the root of every Tree. It is fixed, so that the trees built by different nodes line up
+// node for node, and only the subtrees whose hashes differ have to be compared.
+const Depth = 10
+
+// Root is the index of the root node of a Tree. The children of node i are 2i and 2i+1, which makes the leaves the nodes
+// from 1<<Depth up to 2<<Depth.
+const Root = 1
+
+// Tree is a Merkle tree over a set of key→checksum entries. Every key belongs to the leaf its hash falls in, the hash of a leaf
+// covers its entries, and the hash of every other node covers the hashes of its children. Empty subtrees hash to "".
+type Tree struct {
+	hashes []string
+	leaves []map[string]string
+}
+
+// Build builds the Tree of the given key→checksum entries
+func Build(entries map[string]string) *Tree {
+	t := &Tree{
+		hashes: make([]string, 2<<Depth),
+		leaves: make([]map[string]string, 1<<Depth),
+	}
+	for key, checksum := range entries {
+		i := LeafOf(key) - 1<<Depth
+		if t.leaves[i] == nil {
+			t.leaves[i] = make(map[string]string)
+		}
+		t.leaves[i][key] = checksum
+	}
+	for i, entries := range t.leaves {
+		t.hashes[1<<Depth+i] = hashLeaf(entries)
+	}
+	for node := 1<<Depth - 1; node >= Root; node-- {
+		left, right := t.hashes[2*node], t.hashes[2*node+1]
+		if left != "" || right != "" {
+			t.hashes[node] = hashStrings(left, right)
+		}
+	}
+	return t
+}
+
+// LeafOf returns the leaf the given key belongs to
+func LeafOf(key string) int {
+	hash := sha256.Sum256([]byte(key))
+	bucket := (int(hash[0])<<8 | int(hash[1])) >> (16 - Depth)
+	return 1<<Depth + bucket
+}
+
+// IsNode reports whether node is the index of a node of a Tree
+func IsNode(node int) bool {
+	return node >= Root && node < 2<<Depth
+}
+
+// IsLeaf reports whether node is the index of a leaf of a Tree
+func IsLeaf(node int) bool {
+	return node >= 1<<Depth && node < 2<<Depth
+}
+
+// Children returns the children of node, which mustn't be a leaf
+func Children(node int) []int {
+	return []int{2 * node, 2*node + 1}
+}
+
+// Hash returns the hash of node, or "" if node isn't a node of the Tree
+func (t *Tree) Hash(node int) string {
+	if !IsNode(node) {
+		return ""
+	}
+	return t.hashes[node]
+}
+
+// Entries returns a copy of the entries of leaf, which are empty if leaf isn't a leaf of the Tree
+func (t *Tree) Entries(leaf int) map[string]string {
+	entries := make(map[string]string)
+	if IsLeaf(leaf) {
+		for key, checksum := range t.leaves[leaf-1<<Depth] {
+			entries[key] = checksum
+		}
+	}
+	return entries
+}
+
+// EncodeNodes encodes a list of node indices into a control message arg
+func EncodeNodes(nodes []int) string {
+	encoded := make([]string, len(nodes))
+	for i, node := range nodes {
+		encoded[i] = strconv.Itoa(node)
+	}
+	return strings.Join(encoded, ",")
+}
+
+// DecodeNodes decodes a list of node indices encoded by EncodeNodes, rejecting indices that aren't nodes of a Tree
+func DecodeNodes(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var nodes []int
+	for _, encoded := range strings.Split(s, ",") {
+		node, err := strconv.Atoi(encoded)
+		if err != nil || !IsNode(node) {
+			return nil, fmt.Errorf("invalid node %q", encoded)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// EncodeHashes encodes a list of node hashes into a control message arg
+func EncodeHashes(hashes []string) string {
+	return strings.Join(hashes, ",")
+}
+
+// DecodeHashes decodes a list of count node hashes encoded by EncodeHashes
+func DecodeHashes(s string, count int) ([]string, error) {
+	hashes := strings.Split(s, ",")
+	if len(hashes) != count {
+		return nil, fmt.Errorf("got %d hashes, expected %d", len(hashes), count)
+	}
+	return hashes, nil
+}
+
+// hashLeaf returns the hash of the entries of a leaf, in key order, or "" if there are none
+func hashLeaf(entries map[string]string) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		parts = append(parts, key, entries[key])
+	}
+	return hashStrings(parts...)
+}
+
+// hashStrings returns the hex encoded sha256 hash of the given strings, each prefixed with its length so that no two lists of
+// strings hash alike
+func hashStrings(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(strconv.Itoa(len(part)) + ":" + part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
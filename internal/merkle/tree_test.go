@@ -0,0 +1,93 @@
+package merkle
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// differingLeaves descends both trees from the root like two peers do, and returns the leaves whose hashes differ
+func differingLeaves(a, b *Tree) []int {
+	var leaves []int
+	nodes := []int{Root}
+	for len(nodes) > 0 {
+		var next []int
+		for _, node := range nodes {
+			if a.Hash(node) == b.Hash(node) {
+				continue
+			}
+			if IsLeaf(node) {
+				leaves = append(leaves, node)
+			} else {
+				next = append(next, Children(node)...)
+			}
+		}
+		nodes = next
+	}
+	return leaves
+}
+
+func TestTreeHashesDependOnEntriesOnly(t *testing.T) {
+	entries := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		entries[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("checksum-%d", i)
+	}
+	assert.Equal(t, Build(entries).Hash(Root), Build(entries).Hash(Root))
+	assert.Equal(t, "", Build(nil).Hash(Root))
+
+	entries["key-0"] = "changed"
+	assert.NotEqual(t, Build(nil).Hash(Root), Build(entries).Hash(Root))
+}
+
+func TestTreesDifferOnlyInTheLeavesOfDifferingKeys(t *testing.T) {
+	local, remote := make(map[string]string), make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		local[fmt.Sprintf("key-%d", i)] = "checksum"
+		remote[fmt.Sprintf("key-%d", i)] = "checksum"
+	}
+	remote["key-7"] = "changed"
+	delete(remote, "key-42")
+	remote["only-remote"] = "checksum"
+
+	a, b := Build(local), Build(remote)
+	leaves := differingLeaves(a, b)
+	assert.ElementsMatch(t, uniqueLeaves("key-7", "key-42", "only-remote"), leaves)
+	for _, leaf := range leaves {
+		assert.True(t, IsLeaf(leaf))
+	}
+	assert.Equal(t, "checksum", a.Entries(LeafOf("key-42"))["key-42"])
+	assert.NotContains(t, b.Entries(LeafOf("key-42")), "key-42")
+	assert.Empty(t, differingLeaves(a, Build(local)))
+}
+
+func TestNodesAndHashesRoundTrip(t *testing.T) {
+	nodes := []int{Root, 2, 3, 1 << Depth, 2<<Depth - 1}
+	decoded, err := DecodeNodes(EncodeNodes(nodes))
+	assert.Nil(t, err)
+	assert.Equal(t, nodes, decoded)
+
+	for _, invalid := range []string{"0", "x", fmt.Sprint(2 << Depth), "1,,2"} {
+		_, err := DecodeNodes(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+
+	hashes := []string{"", "abc", ""}
+	decodedHashes, err := DecodeHashes(EncodeHashes(hashes), len(hashes))
+	assert.Nil(t, err)
+	assert.Equal(t, hashes, decodedHashes)
+	_, err = DecodeHashes("abc", 2)
+	assert.NotNil(t, err)
+}
+
+// uniqueLeaves returns the leaves the given keys belong to, without repeats
+func uniqueLeaves(keys ...string) []int {
+	seen := make(map[int]bool)
+	var leaves []int
+	for _, key := range keys {
+		if leaf := LeafOf(key); !seen[leaf] {
+			seen[leaf] = true
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves
+}
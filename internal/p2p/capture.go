@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CapturedMessage is a message decoded from captured wire traffic
+type CapturedMessage struct {
+	StreamID uint32
+	Message  Message
+	// Trailing is the number of bytes that follow the message on its stream, e.g, those of the file a STORE streams
+	Trailing int
+}
+
+// DecodeCapture decodes the messages sent in one direction of a connection, as captured off the wire, i.e, the mux frames
+// of the session with the codec negotiation at the start of the control stream. The messages of the control stream come first,
+// followed by the message opening every other stream. If codec is nil, the codec agreed on during the negotiation is used.
+// A capture cut short decodes up to its last whole message.
+func DecodeCapture(capture []byte, codec Codec) ([]CapturedMessage, Codec, error) {
+	// Put the data of every stream back together, in the order the streams were seen in
+	var (
+		streams   = make(map[uint32]*bytes.Buffer)
+		streamIDs []uint32
+	)
+	for len(capture) >= MUX_HEADER_SIZE {
+		var (
+			frameType = muxFrameType(capture[0])
+			streamID  = binary.BigEndian.Uint32(capture[2:6])
+			length    = binary.BigEndian.Uint32(capture[6:10])
+		)
+		capture = capture[MUX_HEADER_SIZE:]
+		if frameType != muxFrameData {
+			continue
+		}
+		if length > MUX_MAX_FRAME_SIZE {
+			return nil, codec, fmt.Errorf("frame of %d bytes on stream %d exceeds the max of %d bytes", length, streamID, MUX_MAX_FRAME_SIZE)
+		}
+		if _, seen := streams[streamID]; !seen {
+			streams[streamID] = new(bytes.Buffer)
+			streamIDs = append(streamIDs, streamID)
+		}
+		streams[streamID].Write(capture[:min(int(length), len(capture))])
+		capture = capture[min(int(length), len(capture)):]
+	}
+
+	var captured []CapturedMessage
+	if control, exists := streams[MUX_CONTROL_STREAM_ID]; exists {
+		name, err := readCodecName(control)
+		if err != nil {
+			return nil, codec, err
+		}
+		if codec == nil {
+			if codec, err = NewCodec(name); err != nil {
+				return nil, codec, err
+			}
+		}
+		for control.Len() > 0 {
+			msg := Message{}
+			if err := codec.Decode(control, &msg); err != nil {
+				return captured, codec, ignoreTruncation(err)
+			}
+			captured = append(captured, CapturedMessage{StreamID: MUX_CONTROL_STREAM_ID, Message: msg})
+		}
+	}
+	if codec == nil {
+		return nil, codec, errors.New("no codec negotiation in capture")
+	}
+	for _, streamID := range streamIDs {
+		if streamID == MUX_CONTROL_STREAM_ID {
+			continue
+		}
+		msg := Message{}
+		if err := codec.Decode(streams[streamID], &msg); err != nil {
+			return captured, codec, ignoreTruncation(err)
+		}
+		captured = append(captured, CapturedMessage{StreamID: streamID, Message: msg, Trailing: streams[streamID].Len()})
+	}
+	return captured, codec, nil
+}
+
+// DecodeFrames decodes the messages of r, framed by codec one after the other without any mux framing around them
+func DecodeFrames(r io.Reader, codec Codec) ([]Message, error) {
+	var messages []Message
+	for {
+		msg := Message{}
+		if err := codec.Decode(r, &msg); err != nil {
+			if err == io.EOF {
+				return messages, nil
+			}
+			return messages, ignoreTruncation(err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// ignoreTruncation drops the error of a message cut short at the end of a capture
+func ignoreTruncation(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordingConn keeps a copy of every byte written to the connection, as a capture off the wire would
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) capture() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+func TestDecodeCaptureOfASession(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	recorded := &recordingConn{Conn: clientConn}
+	client, server := NewSession(recorded, true), NewSession(serverConn, false)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	codec := &ProtobufCodec{}
+	fetch := ConstructErrorMessage(NewRemoteError(ErrorCodeNotFound, "key not found"))
+	store := Message{Type: ControlMessageType, Payload: ControlPayload{Command: MESSAGE_STORE_CONTROL_COMMAND, Args: map[string]string{"key": "key"}}}
+
+	// The codec negotiation and a message on the control stream, then a stream opened by a message followed by a file
+	var control bytes.Buffer
+	assert.Nil(t, writeCodecName(&control, codec.Name()))
+	assert.Nil(t, codec.Encode(&control, &fetch))
+	_, err := client.Control().Write(control.Bytes())
+	assert.Nil(t, err)
+	var streamed bytes.Buffer
+	assert.Nil(t, codec.Encode(&streamed, &store))
+	streamed.WriteString("file bytes")
+	stream, err := client.Open()
+	assert.Nil(t, err)
+	_, err = stream.Write(streamed.Bytes())
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close())
+
+	// Once the other end has read it all, the capture holds every frame
+	received, err := io.ReadFull(server.Control(), make([]byte, control.Len()))
+	assert.Nil(t, err)
+	assert.Equal(t, control.Len(), received)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	_, err = io.ReadAll(accepted)
+	assert.Nil(t, err)
+
+	captured, detected, err := DecodeCapture(recorded.capture(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ProtobufCodecName, detected.Name())
+	assert.Equal(t, []CapturedMessage{
+		{StreamID: MUX_CONTROL_STREAM_ID, Message: Message{Type: fetch.Type, Payload: fetch.Payload}},
+		{StreamID: stream.ID(), Message: store, Trailing: len("file bytes")},
+	}, captured)
+
+	// Frames cut short decode up to their last whole message
+	messages, err := DecodeFrames(bytes.NewReader(control.Bytes()[len(codec.Name())+1:control.Len()-3]), codec)
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+	messages, err = DecodeFrames(bytes.NewReader(streamed.Bytes()[:streamed.Len()-len("file bytes")]), codec)
+	assert.Nil(t, err)
+	assert.Equal(t, []Message{store}, messages)
+
+	_, _, err = DecodeCapture(nil, nil)
+	assert.NotNil(t, err)
+}
@@ -2,40 +2,56 @@ package p2p
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"log"
 )
 
-// MAX_DECODER_BUFFER_SIZE denotes the max size of the decoder buffer, and its value must be in sync with util.MaxAllowedDataPayloadSize
-const MAX_DECODER_BUFFER_SIZE = 1024
+// MAX_DECODER_BUFFER_SIZE denotes the max size of an encoded payload, and its value must be well above util.MaxAllowedDataPayloadSize
+// and util.DefaultSwarmChunkSize, since DataPayloads of those sizes have to fit in it along with their encoding overhead
+const MAX_DECODER_BUFFER_SIZE = 64 * 1024
+
+// FRAME_HEADER_SIZE denotes the size of the header written before each payload, i.e, 1 byte of MessageType and 4 bytes of payload length
+const FRAME_HEADER_SIZE = 5
+
+// Names of the codecs a connection may use, as agreed on during the handshake
+const (
+	GobCodecName      = "gob"
+	ProtobufCodecName = "protobuf"
+)
 
 type Codec interface {
+	// Name identifies the codec to the peer during the handshake
+	Name() string
 	Encode(io.Writer, *Message) error
 	Decode(io.Reader, *Message) error
 }
 
-type DefaultCodec struct{}
-
-func (c *DefaultCodec) Encode(w io.Writer, msg *Message) error {
-	// Helper lambda to write bytes into w
-	var writeIntoW = func(b []byte) (int, error) {
-		if size, err := w.Write(b); err != nil {
-			return 0, fmt.Errorf("failed to write: %w", err)
-		} else {
-			return size, nil
-		}
+// NewCodec returns the codec with the given name
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case GobCodecName:
+		return &DefaultCodec{}, nil
+	case ProtobufCodecName:
+		return &ProtobufCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec: %s", name)
 	}
+}
 
-	// Encode and write message type
-	msgTypeBuf := []byte{byte(msg.Type)}
-	if _, err := writeIntoW(msgTypeBuf); err != nil {
-		return err
-	}
+// DefaultCodec frames every message as its MessageType, followed by the length of its gob encoded payload and the payload itself
+type DefaultCodec struct{}
 
-	// Buffer to hold payload bytes
+func (c *DefaultCodec) Name() string {
+	return GobCodecName
+}
+
+func (c *DefaultCodec) Encode(w io.Writer, msg *Message) error {
+	// Buffer to hold payload bytes, after room for the frame header
 	var payloadBuf bytes.Buffer
+	payloadBuf.Write(make([]byte, FRAME_HEADER_SIZE))
 
 	// Encode payload based on MessageType
 	switch msg.Type {
@@ -61,36 +77,42 @@ func (c *DefaultCodec) Encode(w io.Writer, msg *Message) error {
 		return fmt.Errorf("unsupported message type: %v", msg.Type)
 	}
 
-	// Write payload bytes to writer
-	if _, err := writeIntoW(payloadBuf.Bytes()); err != nil {
-		return err
+	// Fill in the frame header
+	frame := payloadBuf.Bytes()
+	payloadSize := len(frame) - FRAME_HEADER_SIZE
+	if payloadSize > MAX_DECODER_BUFFER_SIZE {
+		return fmt.Errorf("payload of %d bytes exceeds the max of %d bytes", payloadSize, MAX_DECODER_BUFFER_SIZE)
+	}
+	frame[0] = byte(msg.Type)
+	binary.BigEndian.PutUint32(frame[1:FRAME_HEADER_SIZE], uint32(payloadSize))
+
+	// Write the whole frame at once, so that frames written concurrently to the same conn don't interleave
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
 	}
 
 	return nil
 }
 
 func (c *DefaultCodec) Decode(r io.Reader, msg *Message) error {
-	// Helper lambda to read bytes from r
-	var readFromR = func(buf []byte) (int, error) {
-		if size, err := r.Read(buf); err != nil {
-			return 0, fmt.Errorf("failed to read: %w", err)
-		} else {
-			return size, nil
+	// Decode frame header, a clean EOF here means that the peer is done sending
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return err
 		}
+		return fmt.Errorf("failed to read: %w", err)
 	}
-
-	// Decode message type
-	typeBuf := make([]byte, 1)
-	if _, err := readFromR(typeBuf); err != nil {
-		return err
+	msg.Type = MessageType(header[0])
+	n := int(binary.BigEndian.Uint32(header[1:]))
+	if n > MAX_DECODER_BUFFER_SIZE {
+		return fmt.Errorf("payload of %d bytes exceeds the max of %d bytes", n, MAX_DECODER_BUFFER_SIZE)
 	}
-	msg.Type = MessageType(typeBuf[0])
 
-	// Buffer for payload
-	buf := make([]byte, MAX_DECODER_BUFFER_SIZE)
-	n, err := readFromR(buf)
-	if err != nil {
-		return err
+	// Read exactly the payload, so that whatever follows it on r is left for the next read
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("failed to read: %w", err)
 	}
 
 	// Decode payload based on MessageType
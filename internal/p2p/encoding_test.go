@@ -0,0 +1,44 @@
+package p2p
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDefaultCodecRoundTrip(t *testing.T) {
+	codec := &DefaultCodec{}
+	var wire bytes.Buffer
+
+	dataMsg := Message{
+		Type:    DataMessageType,
+		Payload: DataPayload{Key: "key", Data: bytes.Repeat([]byte("a"), 16*1024), Metadata: map[string]string{"fetch_id": "id"}},
+	}
+	controlMsg := ConstructFetchResponseMessage(true)
+
+	// Frames written back to back, followed by raw stream bytes, must come apart cleanly
+	assert.Nil(t, codec.Encode(&wire, &dataMsg))
+	assert.Nil(t, codec.Encode(&wire, &controlMsg))
+	wire.WriteString("raw stream bytes")
+
+	var decoded Message
+	assert.Nil(t, codec.Decode(&wire, &decoded))
+	assert.Equal(t, dataMsg.Payload, decoded.Payload)
+
+	assert.Nil(t, codec.Decode(&wire, &decoded))
+	assert.Equal(t, controlMsg.Payload, decoded.Payload)
+
+	assert.Equal(t, "raw stream bytes", wire.String())
+}
+
+func TestDefaultCodecRejectsOversizedPayload(t *testing.T) {
+	codec := &DefaultCodec{}
+	var wire bytes.Buffer
+
+	msg := Message{
+		Type:    DataMessageType,
+		Payload: DataPayload{Key: "key", Data: make([]byte, MAX_DECODER_BUFFER_SIZE+1)},
+	}
+	assert.NotNil(t, codec.Encode(&wire, &msg))
+	assert.Zero(t, wire.Len())
+}
@@ -0,0 +1,342 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fault denotes what a FaultyTransport does to a message going through it
+type Fault int
+
+const (
+	// FaultNone lets the message through untouched
+	FaultNone Fault = iota
+	// FaultDrop loses the message
+	FaultDrop
+	// FaultDelay lets the message through after FaultyTransportOpts.Delay, behind the messages that came after it
+	FaultDelay
+	// FaultDuplicate lets the message through twice
+	FaultDuplicate
+	// FaultReorder holds the message back until the next one went through, or until FaultyTransportOpts.Delay passed
+	FaultReorder
+	// FaultCorrupt flips bits of the data or of an arg of the message
+	FaultCorrupt
+	// FaultTruncate cuts the stream a message opens off after FaultyTransportOpts.TruncateAfter bytes, by resetting it
+	FaultTruncate
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FaultNone:
+		return "NONE"
+	case FaultDrop:
+		return "DROP"
+	case FaultDelay:
+		return "DELAY"
+	case FaultDuplicate:
+		return "DUPLICATE"
+	case FaultReorder:
+		return "REORDER"
+	case FaultCorrupt:
+		return "CORRUPT"
+	case FaultTruncate:
+		return "TRUNCATE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// FaultPolicy decides which fault is injected into each message going through a FaultyTransport
+type FaultPolicy interface {
+	Next(msg *Message) Fault
+}
+
+// RandomFaultPolicy injects every fault with its own probability, drawn from a seeded source so that a run can be replayed
+type RandomFaultPolicy struct {
+	lock          sync.Mutex
+	rand          *rand.Rand
+	probabilities map[Fault]float64
+	faults        []Fault
+}
+
+func NewRandomFaultPolicy(seed int64, probabilities map[Fault]float64) *RandomFaultPolicy {
+	faults := make([]Fault, 0, len(probabilities))
+	for fault := range probabilities {
+		faults = append(faults, fault)
+	}
+	// Walk the faults in a fixed order, so that the same seed always picks the same faults
+	sort.Slice(faults, func(i, j int) bool {
+		return faults[i] < faults[j]
+	})
+	return &RandomFaultPolicy{
+		rand:          rand.New(rand.NewSource(seed)),
+		probabilities: probabilities,
+		faults:        faults,
+	}
+}
+
+// Next implements the FaultPolicy interface, and picks at most one fault for msg
+func (p *RandomFaultPolicy) Next(msg *Message) Fault {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	roll := p.rand.Float64()
+	for _, fault := range p.faults {
+		if roll < p.probabilities[fault] {
+			return fault
+		}
+		roll -= p.probabilities[fault]
+	}
+	return FaultNone
+}
+
+// FaultStep is a step of a ScheduledFaultPolicy, which injects Fault into the next message that Match accepts
+type FaultStep struct {
+	// Match selects the message the step applies to, any message if nil
+	Match func(msg *Message) bool
+	Fault Fault
+}
+
+// MatchCommand returns a FaultStep.Match accepting the control messages with the given command
+func MatchCommand(command ControlMessage) func(msg *Message) bool {
+	return func(msg *Message) bool {
+		return msg.Command() == command
+	}
+}
+
+// MatchData is a FaultStep.Match accepting the data messages
+func MatchData(msg *Message) bool {
+	return msg.Type == DataMessageType
+}
+
+// ScheduledFaultPolicy injects faults as scripted. Messages are matched against the first step left, which is done
+// once it matched a message, and the messages that don't match it go through untouched.
+type ScheduledFaultPolicy struct {
+	lock  sync.Mutex
+	steps []FaultStep
+}
+
+func NewScheduledFaultPolicy(steps ...FaultStep) *ScheduledFaultPolicy {
+	return &ScheduledFaultPolicy{steps: steps}
+}
+
+// Next implements the FaultPolicy interface
+func (p *ScheduledFaultPolicy) Next(msg *Message) Fault {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.steps) == 0 {
+		return FaultNone
+	}
+	if step := p.steps[0]; step.Match == nil || step.Match(msg) {
+		p.steps = p.steps[1:]
+		return step.Fault
+	}
+	return FaultNone
+}
+
+// Done reports whether every step of the schedule was applied
+func (p *ScheduledFaultPolicy) Done() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.steps) == 0
+}
+
+type FaultyTransportOpts struct {
+	Policy FaultPolicy
+	// Delay is how long FaultDelay holds a message back, and how long FaultReorder does at most
+	Delay time.Duration
+	// TruncateAfter is how many bytes of a stream FaultTruncate lets through, past the message opening it
+	TruncateAfter int64
+}
+
+// FaultyTransport decorates a Transport, injecting the faults its policy picks into the messages it receives, and into the
+// requests it makes through Call along with their replies. It is meant for chaos testing, and never for production use.
+type FaultyTransport struct {
+	Transport
+	FaultyTransportOpts
+	messageChan chan Message
+	closedCh    chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewFaultyTransport(transport Transport, opts FaultyTransportOpts) *FaultyTransport {
+	t := &FaultyTransport{
+		Transport:           transport,
+		FaultyTransportOpts: opts,
+		messageChan:         make(chan Message),
+		closedCh:            make(chan struct{}),
+	}
+	go t.forward()
+	return t
+}
+
+// Consume implements the Transport interface, and returns the messages received, with faults injected
+func (t *FaultyTransport) Consume() <-chan Message {
+	return t.messageChan
+}
+
+// Close implements the Transport interface, and closes the decorated Transport
+func (t *FaultyTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closedCh)
+	})
+	return t.Transport.Close()
+}
+
+// Call implements the Transport interface. A dropped request is lost, and fails once ctx is done. Delayed and reordered requests
+// are sent late, duplicated ones are sent twice, and corrupted ones have their reply corrupted. Streams aren't involved in calls,
+// so they can't be truncated.
+func (t *FaultyTransport) Call(ctx context.Context, peer Peer, msg Message) (Message, error) {
+	fault := t.Policy.Next(&msg)
+	if fault != FaultNone {
+		fmt.Printf("Injecting %s into %s request to %s\n", fault, msg.Command(), peer)
+	}
+	switch fault {
+	case FaultDrop:
+		<-ctx.Done()
+		return Message{}, ctx.Err()
+	case FaultDelay, FaultReorder:
+		select {
+		case <-time.After(t.Delay):
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	case FaultDuplicate:
+		go func() {
+			_, _ = t.Transport.Call(ctx, peer, msg)
+		}()
+	case FaultCorrupt:
+		reply, err := t.Transport.Call(ctx, peer, msg)
+		if err != nil {
+			return reply, err
+		}
+		return corruptMessage(reply), nil
+	}
+	return t.Transport.Call(ctx, peer, msg)
+}
+
+// forward injects faults into the messages of the decorated Transport, and hands them on to Consume
+func (t *FaultyTransport) forward() {
+	var (
+		held      *Message
+		heldTimer <-chan time.Time
+	)
+	releaseHeld := func() {
+		if held != nil {
+			t.emit(*held)
+			held, heldTimer = nil, nil
+		}
+	}
+
+	for {
+		var msg Message
+		select {
+		case msg = <-t.Transport.Consume():
+		case <-heldTimer:
+			releaseHeld()
+			continue
+		case <-t.closedCh:
+			return
+		}
+
+		fault := t.Policy.Next(&msg)
+		if fault != FaultNone {
+			fmt.Printf("Injecting %s into %s message from %s\n", fault, msg.Command(), msg.From)
+		}
+		switch fault {
+		case FaultDrop:
+			// The sender of a stream waits on it, so it is reset rather than left open
+			if msg.Stream != nil {
+				_ = msg.Stream.Reset()
+			}
+		case FaultDelay:
+			go func(msg Message) {
+				select {
+				case <-time.After(t.Delay):
+					t.emit(msg)
+				case <-t.closedCh:
+				}
+			}(msg)
+		case FaultDuplicate:
+			t.emit(msg)
+			// Only one handler may read a stream
+			if msg.Stream == nil {
+				t.emit(msg)
+			}
+		case FaultReorder:
+			releaseHeld()
+			held, heldTimer = &msg, time.After(t.Delay)
+			continue
+		case FaultCorrupt:
+			t.emit(corruptMessage(msg))
+		case FaultTruncate:
+			if msg.Stream != nil {
+				msg.Stream.truncateAt(t.TruncateAfter)
+			}
+			t.emit(msg)
+		default:
+			t.emit(msg)
+		}
+		releaseHeld()
+	}
+}
+
+// emit hands msg on to Consume, waiting for room like the decorated Transport does
+func (t *FaultyTransport) emit(msg Message) {
+	select {
+	case t.messageChan <- msg:
+	case <-t.closedCh:
+		if msg.Stream != nil {
+			_ = msg.Stream.Reset()
+		}
+	}
+}
+
+// corruptMessage returns a copy of msg with the bits of a byte flipped, in its data if it has any, or else in the value of the
+// first of its args, by name, that doesn't correlate a request with its reply
+func corruptMessage(msg Message) Message {
+	flip := func(b []byte) []byte {
+		b = bytes.Clone(b)
+		if len(b) == 0 {
+			return []byte{0xff}
+		}
+		b[len(b)/2] ^= 0xff
+		return b
+	}
+	corruptArgs := func(args map[string]string) map[string]string {
+		var names []string
+		for name := range args {
+			if name != RequestIDArg && name != ReplyToArg {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return args
+		}
+		sort.Strings(names)
+		corrupted := make(map[string]string, len(args))
+		for name, value := range args {
+			corrupted[name] = value
+		}
+		corrupted[names[0]] = string(flip([]byte(args[names[0]])))
+		return corrupted
+	}
+
+	switch payload := msg.Payload.(type) {
+	case DataPayload:
+		if len(payload.Data) > 0 {
+			payload.Data = flip(payload.Data)
+		} else {
+			payload.Metadata = corruptArgs(payload.Metadata)
+		}
+		msg.Payload = payload
+	case ControlPayload:
+		payload.Args = corruptArgs(payload.Args)
+		msg.Payload = payload
+	}
+	return msg
+}
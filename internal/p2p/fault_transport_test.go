@@ -0,0 +1,139 @@
+package p2p
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+// stubTransport hands out the messages pushed to it, and replies to every Call with the key of the request as data
+type stubTransport struct {
+	messageChan chan Message
+}
+
+func (t *stubTransport) Dial(string) error       { return nil }
+func (t *stubTransport) ListenAndAccept() error  { return nil }
+func (t *stubTransport) Consume() <-chan Message { return t.messageChan }
+func (t *stubTransport) Close() error            { return nil }
+func (t *stubTransport) Call(ctx context.Context, peer Peer, msg Message) (Message, error) {
+	key, _ := msg.Arg("key")
+	return Message{Type: DataMessageType, Payload: DataPayload{Key: key, Data: []byte(key)}}, nil
+}
+
+func keyedMessage(key string) Message {
+	return Message{Type: ControlMessageType, Payload: ControlPayload{Command: MESSAGE_FETCH_CONTROL_COMMAND, Args: map[string]string{"key": key}}}
+}
+
+func TestRandomFaultPolicyIsReproducible(t *testing.T) {
+	probabilities := map[Fault]float64{FaultDrop: 0.2, FaultDuplicate: 0.3}
+	first, second := NewRandomFaultPolicy(42, probabilities), NewRandomFaultPolicy(42, probabilities)
+
+	counts := make(map[Fault]int)
+	for i := 0; i < 1000; i++ {
+		msg := keyedMessage("key")
+		fault := first.Next(&msg)
+		assert.Equal(t, fault, second.Next(&msg))
+		counts[fault]++
+	}
+	assert.InDelta(t, 200, counts[FaultDrop], 50)
+	assert.InDelta(t, 300, counts[FaultDuplicate], 50)
+	assert.InDelta(t, 500, counts[FaultNone], 50)
+}
+
+func TestScheduledFaultPolicyFollowsSchedule(t *testing.T) {
+	policy := NewScheduledFaultPolicy(FaultStep{Match: MatchData, Fault: FaultCorrupt}, FaultStep{Fault: FaultDrop})
+	fetch, data := keyedMessage("key"), Message{Type: DataMessageType, Payload: DataPayload{Key: "key"}}
+
+	// Messages that don't match the next step go through untouched
+	assert.Equal(t, FaultNone, policy.Next(&fetch))
+	assert.Equal(t, FaultCorrupt, policy.Next(&data))
+	assert.False(t, policy.Done())
+	assert.Equal(t, FaultDrop, policy.Next(&fetch))
+	assert.True(t, policy.Done())
+	assert.Equal(t, FaultNone, policy.Next(&data))
+}
+
+func TestFaultyTransportInjectsFaultsIntoMessages(t *testing.T) {
+	inner := &stubTransport{messageChan: make(chan Message, 8)}
+	transport := NewFaultyTransport(inner, FaultyTransportOpts{
+		Policy: NewScheduledFaultPolicy(
+			FaultStep{Fault: FaultDrop},
+			FaultStep{Fault: FaultDuplicate},
+			FaultStep{Fault: FaultReorder},
+			FaultStep{Fault: FaultNone},
+			FaultStep{Fault: FaultCorrupt},
+		),
+		Delay: time.Minute,
+	})
+	defer transport.Close()
+
+	for _, key := range []string{"1", "2", "3", "4", "5", "6"} {
+		inner.messageChan <- keyedMessage(key)
+	}
+	var keys []string
+	for i := 0; i < 6; i++ {
+		msg := <-transport.Consume()
+		key, _ := msg.Arg("key")
+		keys = append(keys, key)
+	}
+	// 1 is dropped, 2 duplicated, 3 overtaken by 4, and 5 corrupted
+	assert.Equal(t, []string{"2", "2", "4", "3", string([]byte{'5' ^ 0xff}), "6"}, keys)
+}
+
+func TestFaultyTransportTruncatesStreams(t *testing.T) {
+	client, server := newSessionPair(t)
+	inner := &stubTransport{messageChan: make(chan Message, 1)}
+	transport := NewFaultyTransport(inner, FaultyTransportOpts{
+		Policy:        NewScheduledFaultPolicy(FaultStep{Fault: FaultTruncate}),
+		TruncateAfter: 10,
+	})
+	defer transport.Close()
+
+	sent, err := client.Open()
+	assert.Nil(t, err)
+	written := make(chan error, 1)
+	go func() {
+		_, err := sent.Write(make([]byte, 3*MUX_INITIAL_WINDOW_SIZE))
+		written <- err
+	}()
+	received, err := server.Accept()
+	assert.Nil(t, err)
+
+	inner.messageChan <- Message{Type: ControlMessageType, Payload: ControlPayload{Command: MESSAGE_STORE_CONTROL_COMMAND}, Stream: received}
+	msg := <-transport.Consume()
+	read, err := io.ReadAll(msg.Stream)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	assert.Len(t, read, 10)
+	// The sender sees the transfer cut off
+	assert.ErrorIs(t, <-written, ErrStreamReset)
+}
+
+func TestFaultyTransportInjectsFaultsIntoCalls(t *testing.T) {
+	transport := NewFaultyTransport(&stubTransport{messageChan: make(chan Message)}, FaultyTransportOpts{
+		Policy: NewScheduledFaultPolicy(FaultStep{Fault: FaultDrop}, FaultStep{Fault: FaultDelay}, FaultStep{Fault: FaultCorrupt}),
+		Delay:  20 * time.Millisecond,
+	})
+	defer transport.Close()
+
+	// A dropped request never gets a reply
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := transport.Call(ctx, nil, keyedMessage("dropped"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	start := time.Now()
+	reply, err := transport.Call(context.Background(), nil, keyedMessage("delayed"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("delayed"), reply.Payload.(DataPayload).Data)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	reply, err = transport.Call(context.Background(), nil, keyedMessage("ab"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'a', 'b' ^ 0xff}, reply.Payload.(DataPayload).Data)
+
+	reply, err = transport.Call(context.Background(), nil, keyedMessage("untouched"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("untouched"), reply.Payload.(DataPayload).Data)
+}
@@ -1,11 +1,148 @@
 package p2p
 
-import "errors"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
 
 var ErrInvalidHandshake = errors.New("invalid handshake, couldn't verify peer")
 
+// CODEC_NEGOTIATION_TIMEOUT denotes how long the peers on a new connection may take to agree on a codec
+const CODEC_NEGOTIATION_TIMEOUT = 10 * time.Second
+
 type doHandshake func(Peer) error
 
 func NOHANDSHAKE(Peer) error {
 	return nil
 }
+
+// handshakeNonceSize is the size of the nonce every side of a SharedSecretHandshake sends
+const handshakeNonceSize = 32
+
+// SharedSecretHandshake returns a handshake that only lets peers knowing secret connect, which makes them the members of the
+// cluster. Every side sends a fresh nonce, and then proves it knows secret with an HMAC of its own nonce followed by the nonce
+// of the other side, so that neither an eavesdropper nor a peer replaying the proof of the other side gets in. The secret
+// itself never goes over the wire.
+func SharedSecretHandshake(secret []byte) doHandshake {
+	return func(peer Peer) error {
+		if err := peer.SetDeadline(time.Now().Add(CODEC_NEGOTIATION_TIMEOUT)); err != nil {
+			return err
+		}
+		defer func() {
+			_ = peer.SetDeadline(time.Time{})
+		}()
+
+		nonce := make([]byte, handshakeNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		peerNonce, err := exchange(peer, nonce)
+		if err != nil {
+			return err
+		}
+		if hmac.Equal(nonce, peerNonce) {
+			return fmt.Errorf("%w: %s echoed the nonce sent to it", ErrInvalidHandshake, peer.RemoteAddr())
+		}
+		peerProof, err := exchange(peer, handshakeProof(secret, nonce, peerNonce))
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(peerProof, handshakeProof(secret, peerNonce, nonce)) {
+			return fmt.Errorf("%w: %s doesn't know the cluster secret", ErrInvalidHandshake, peer.RemoteAddr())
+		}
+		return nil
+	}
+}
+
+// handshakeProof returns the proof that the side that sent nonce knows secret, to the side that sent peerNonce
+func handshakeProof(secret []byte, nonce []byte, peerNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(peerNonce)
+	return mac.Sum(nil)
+}
+
+// exchange writes b to conn while reading as many bytes from it, which the other side writes at the same time, and returns them
+func exchange(conn net.Conn, b []byte) ([]byte, error) {
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(b)
+		written <- err
+	}()
+	read := make([]byte, len(b))
+	_, err := io.ReadFull(conn, read)
+	if writeErr := <-written; err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+	}
+	return read, nil
+}
+
+// negotiateCodec agrees with the peer on the codec the messages of the connection are encoded with, before any message is sent.
+// The dialing side proposes its preferred codec, and the accepting side takes it if it knows it, or answers with preferred otherwise.
+// Each name is written to the control stream as a byte of length followed by the name.
+func negotiateCodec(peer *TCPPeer, preferred Codec) (Codec, error) {
+	// A peer that never answers must not hold the connection up forever
+	if err := peer.Conn.SetDeadline(time.Now().Add(CODEC_NEGOTIATION_TIMEOUT)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = peer.Conn.SetDeadline(time.Time{})
+	}()
+
+	if peer.isOutbound {
+		if err := writeCodecName(peer, preferred.Name()); err != nil {
+			return nil, err
+		}
+		name, err := readCodecName(peer)
+		if err != nil {
+			return nil, err
+		}
+		codec, err := NewCodec(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+		}
+		return codec, nil
+	}
+
+	name, err := readCodecName(peer)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := NewCodec(name)
+	if err != nil {
+		codec = preferred
+	}
+	if err := writeCodecName(peer, codec.Name()); err != nil {
+		return nil, err
+	}
+	return codec, nil
+}
+
+func writeCodecName(w io.Writer, name string) error {
+	if len(name) > 255 {
+		return fmt.Errorf("codec name %s is too long", name)
+	}
+	_, err := w.Write(append([]byte{byte(len(name))}, name...))
+	return err
+}
+
+func readCodecName(r io.Reader) (string, error) {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return "", fmt.Errorf("failed to read codec name: %w", err)
+	}
+	name := make([]byte, size[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", fmt.Errorf("failed to read codec name: %w", err)
+	}
+	return string(name), nil
+}
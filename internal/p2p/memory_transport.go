@@ -0,0 +1,267 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrMemoryConnRefused is returned when dialing a node that isn't listening on the MemoryNetwork, or is partitioned from us
+var ErrMemoryConnRefused = errors.New("memory network: connection refused")
+
+// MEMORY_ACCEPT_BACKLOG denotes how many dialed connections may wait for a MemoryTransport to accept them
+const MEMORY_ACCEPT_BACKLOG = 16
+
+// MEMORY_FIRST_EPHEMERAL_PORT denotes the port of the first connection dialed on a MemoryNetwork, as seen by the node accepting it
+const MEMORY_FIRST_EPHEMERAL_PORT = 49152
+
+// MemoryNetwork is a virtual network connecting the MemoryTransports of one process, without binding any port.
+// Nodes are known by their listen address. Every node is linked to every other node until they are partitioned,
+// and the link between two nodes may be given latency.
+type MemoryNetwork struct {
+	mu          sync.Mutex
+	listeners   map[string]*memoryListener
+	partitioned map[memoryLink]bool
+	latency     map[memoryLink]time.Duration
+	conns       map[*memoryConn]struct{}
+	nextPort    int
+}
+
+// memoryLink is the link between two nodes, in either direction
+type memoryLink struct {
+	a, b string
+}
+
+func newMemoryLink(a, b string) memoryLink {
+	if a > b {
+		a, b = b, a
+	}
+	return memoryLink{a: a, b: b}
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners:   make(map[string]*memoryListener),
+		partitioned: make(map[memoryLink]bool),
+		latency:     make(map[memoryLink]time.Duration),
+		conns:       make(map[*memoryConn]struct{}),
+		nextPort:    MEMORY_FIRST_EPHEMERAL_PORT,
+	}
+}
+
+// Partition cuts the link between the nodes a and b. The connections between them are closed, and they can't dial each other
+// until they are linked again.
+func (n *MemoryNetwork) Partition(a, b string) {
+	n.mu.Lock()
+	link := newMemoryLink(a, b)
+	n.partitioned[link] = true
+	var cut []*memoryConn
+	for conn := range n.conns {
+		if newMemoryLink(conn.localNode, conn.remoteNode) == link {
+			cut = append(cut, conn)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, conn := range cut {
+		_ = conn.Close()
+	}
+}
+
+// Link restores the link between the nodes a and b, so that they can dial each other again
+func (n *MemoryNetwork) Link(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitioned, newMemoryLink(a, b))
+}
+
+// SetLatency delays every write between the nodes a and b, in either direction, by latency
+func (n *MemoryNetwork) SetLatency(a, b string, latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if latency <= 0 {
+		delete(n.latency, newMemoryLink(a, b))
+		return
+	}
+	n.latency[newMemoryLink(a, b)] = latency
+}
+
+func (n *MemoryNetwork) latencyBetween(a, b string) time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency[newMemoryLink(a, b)]
+}
+
+// listen makes addr reachable on the network, until the returned listener is closed
+func (n *MemoryNetwork) listen(addr string) (*memoryListener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, exists := n.listeners[addr]; exists {
+		return nil, fmt.Errorf("memory network: %s is already in use", addr)
+	}
+	listener := &memoryListener{
+		network:  n,
+		addr:     memoryAddr(addr),
+		acceptCh: make(chan net.Conn, MEMORY_ACCEPT_BACKLOG),
+		closedCh: make(chan struct{}),
+	}
+	n.listeners[addr] = listener
+	return listener, nil
+}
+
+// dial connects the node listening on from to the node listening on to, and returns the end of the connection of from.
+// Like a TCP connection, the node accepting it sees it coming from an ephemeral port on the host of from.
+func (n *MemoryNetwork) dial(from, to string) (net.Conn, error) {
+	n.mu.Lock()
+	listener, listening := n.listeners[to]
+	if !listening || n.partitioned[newMemoryLink(from, to)] {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("dialing %s: %w", to, ErrMemoryConnRefused)
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil || host == "" {
+		host = "127.0.0.1"
+	}
+	ephemeralAddr := memoryAddr(net.JoinHostPort(host, strconv.Itoa(n.nextPort)))
+	n.nextPort++
+
+	dialerEnd, acceptorEnd := net.Pipe()
+	dialerConn := &memoryConn{Conn: dialerEnd, network: n, localNode: from, remoteNode: to, localAddr: ephemeralAddr, remoteAddr: memoryAddr(to)}
+	acceptorConn := &memoryConn{Conn: acceptorEnd, network: n, localNode: to, remoteNode: from, localAddr: memoryAddr(to), remoteAddr: ephemeralAddr}
+	n.conns[dialerConn] = struct{}{}
+	n.conns[acceptorConn] = struct{}{}
+	n.mu.Unlock()
+
+	select {
+	case listener.acceptCh <- acceptorConn:
+		return dialerConn, nil
+	case <-listener.closedCh:
+		_ = dialerConn.Close()
+		_ = acceptorConn.Close()
+		return nil, fmt.Errorf("dialing %s: %w", to, ErrMemoryConnRefused)
+	}
+}
+
+func (n *MemoryNetwork) forget(conn *memoryConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, conn)
+}
+
+func (n *MemoryNetwork) unlisten(listener *memoryListener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners[listener.addr.String()] == listener {
+		delete(n.listeners, listener.addr.String())
+	}
+}
+
+// memoryAddr is the address of a node, or of one end of a connection, on a MemoryNetwork
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+// memoryListener implements net.Listener, and accepts the connections dialed to its address on a MemoryNetwork
+type memoryListener struct {
+	network   *MemoryNetwork
+	addr      memoryAddr
+	acceptCh  chan net.Conn
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.closedCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.unlisten(l)
+		close(l.closedCh)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryConn is one end of a connection on a MemoryNetwork, whose writes are delayed by the latency of its link
+type memoryConn struct {
+	net.Conn
+	network    *MemoryNetwork
+	localNode  string
+	remoteNode string
+	localAddr  memoryAddr
+	remoteAddr memoryAddr
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	if latency := c.network.latencyBetween(c.localNode, c.remoteNode); latency > 0 {
+		time.Sleep(latency)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *memoryConn) Close() error {
+	c.network.forget(c)
+	return c.Conn.Close()
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// MemoryTransport implements the Transport interface over a MemoryNetwork. Only how connections are made differs from
+// TCPTransport, and the peers on them are set up and read from exactly as over TCP.
+type MemoryTransport struct {
+	*TCPTransport
+	network *MemoryNetwork
+}
+
+func NewMemoryTransport(network *MemoryNetwork, opts TCPTransportOpts, messageChanBufferSize uint8) *MemoryTransport {
+	return &MemoryTransport{
+		TCPTransport: NewTCPTransport(opts, messageChanBufferSize),
+		network:      network,
+	}
+}
+
+// ListenAndAccept implements the Transport interface, makes t.ListenAddress reachable on the network and accepts connections to it
+func (t *MemoryTransport) ListenAndAccept() error {
+	listener, err := t.network.listen(t.ListenAddress)
+	if err != nil {
+		return err
+	}
+	t.listener = listener
+
+	go t.accept()
+	return nil
+}
+
+// Dial implements the Transport interface, and connects to the node listening on nodeAddr on the network.
+// As over TCP, the peer is handshaked and handed to OnPeer before Dial returns.
+func (t *MemoryTransport) Dial(nodeAddr string) error {
+	conn, err := t.network.dial(t.ListenAddress, nodeAddr)
+	if err != nil {
+		return err
+	}
+	return t.handleDialedConn(conn)
+}
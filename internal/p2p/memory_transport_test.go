@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newMemoryNode starts a MemoryTransport listening on addr, and returns it along with the peers handed to its OnPeer
+func newMemoryNode(t *testing.T, network *MemoryNetwork, addr string) (*MemoryTransport, chan Peer) {
+	peers := make(chan Peer, 4)
+	transport := NewMemoryTransport(network, TCPTransportOpts{
+		ListenAddress: addr,
+		HandshakeFunc: NOHANDSHAKE,
+		Codec:         &ProtobufCodec{},
+		OnPeer: func(peer Peer) error {
+			peers <- peer
+			return nil
+		},
+	}, 8)
+	assert.Nil(t, transport.ListenAndAccept())
+	t.Cleanup(func() {
+		_ = transport.Close()
+	})
+	return transport, peers
+}
+
+func TestMemoryTransportConnectsNodes(t *testing.T) {
+	network := NewMemoryNetwork()
+	a, aPeers := newMemoryNode(t, network, "127.0.0.1:7001")
+	b, bPeers := newMemoryNode(t, network, "127.0.0.1:7002")
+
+	// Peers are set up as over TCP, and are seen under the listen address dialed and an ephemeral address of the dialer
+	assert.Nil(t, a.Dial("127.0.0.1:7002"))
+	aPeer, bPeer := <-aPeers, <-bPeers
+	assert.Equal(t, "127.0.0.1:7002", aPeer.String())
+	assert.Equal(t, "127.0.0.1:49152", bPeer.String())
+	assert.Equal(t, ProtobufCodecName, bPeer.Codec().Name())
+
+	msg := Message{Type: ControlMessageType, Payload: ControlPayload{Command: MESSAGE_LIST_CONTROL_COMMAND, Args: map[string]string{"key": "value"}}}
+	var frame bytes.Buffer
+	assert.Nil(t, aPeer.Codec().Encode(&frame, &msg))
+	assert.Nil(t, aPeer.Send(frame.Bytes(), msg.Priority()))
+	received := <-b.Consume()
+	assert.Equal(t, msg.Payload, received.Payload)
+	assert.Equal(t, "127.0.0.1:49152", received.From.String())
+
+	// Nothing is listening on other addresses, not even on a real port
+	assert.ErrorIs(t, a.Dial("127.0.0.1:7003"), ErrMemoryConnRefused)
+	assert.NotNil(t, b.ListenAndAccept())
+}
+
+func TestMemoryNetworkPartitionsAndLinks(t *testing.T) {
+	network := NewMemoryNetwork()
+	a, aPeers := newMemoryNode(t, network, "127.0.0.1:7001")
+	_, bPeers := newMemoryNode(t, network, "127.0.0.1:7002")
+	assert.Nil(t, a.Dial("127.0.0.1:7002"))
+	aPeer, bPeer := <-aPeers, <-bPeers
+
+	// A partition cuts the connections across it, and keeps new ones from being made
+	network.Partition("127.0.0.1:7002", "127.0.0.1:7001")
+	_, err := bPeer.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.NotNil(t, aPeer.Send([]byte("lost"), ControlPriority))
+	assert.ErrorIs(t, a.Dial("127.0.0.1:7002"), ErrMemoryConnRefused)
+
+	network.Link("127.0.0.1:7001", "127.0.0.1:7002")
+	assert.Nil(t, a.Dial("127.0.0.1:7002"))
+	<-aPeers
+	<-bPeers
+
+	// Every write across a link with latency is delayed by it
+	network.SetLatency("127.0.0.1:7001", "127.0.0.1:7002", 20*time.Millisecond)
+	assert.Nil(t, a.Dial("127.0.0.1:7002"))
+	aPeer = <-aPeers
+	<-bPeers
+	start := time.Now()
+	_, err = aPeer.Write([]byte("slow"))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
@@ -1,6 +1,10 @@
 package p2p
 
 import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -12,6 +16,8 @@ type FetchResult struct {
 	Data       []byte
 	PeerAddr   string
 	Error      error
+	// Metadata holds the args of the FETCH_RESPONSE that produced this result, if any
+	Metadata map[string]string
 }
 
 type ControlMessage int
@@ -22,11 +28,54 @@ const (
 	MESSAGE_FETCH_RESPONSE_CONTROL_COMMAND
 	MESSAGE_LIST_CONTROL_COMMAND
 	MESSAGE_EXIT_CONTROL_COMMAND
+	MESSAGE_UPLOAD_OFFSET_CONTROL_COMMAND
+	MESSAGE_FETCH_CHUNK_CONTROL_COMMAND
+	MESSAGE_FIND_NODE_CONTROL_COMMAND
+	MESSAGE_FIND_VALUE_CONTROL_COMMAND
+	MESSAGE_STORE_PROVIDER_CONTROL_COMMAND
+	MESSAGE_DHT_RESPONSE_CONTROL_COMMAND
+	MESSAGE_PING_CONTROL_COMMAND
+	MESSAGE_PING_REQ_CONTROL_COMMAND
+	MESSAGE_ACK_CONTROL_COMMAND
+	MESSAGE_HEARTBEAT_CONTROL_COMMAND
+	MESSAGE_HEARTBEAT_ACK_CONTROL_COMMAND
+	MESSAGE_ERROR_CONTROL_COMMAND
+	MESSAGE_SYNC_TREE_CONTROL_COMMAND
+	MESSAGE_SYNC_KEYS_CONTROL_COMMAND
+	MESSAGE_SYNC_RESPONSE_CONTROL_COMMAND
+	MESSAGE_STORE_SHARD_CONTROL_COMMAND
+	MESSAGE_FETCH_SHARD_CONTROL_COMMAND
+	MESSAGE_RAFT_REQUEST_VOTE_CONTROL_COMMAND
+	MESSAGE_RAFT_APPEND_ENTRIES_CONTROL_COMMAND
+	MESSAGE_RAFT_INSTALL_SNAPSHOT_CONTROL_COMMAND
+	MESSAGE_RAFT_PROPOSE_CONTROL_COMMAND
+	MESSAGE_RAFT_READ_CONTROL_COMMAND
+	MESSAGE_RAFT_RESPONSE_CONTROL_COMMAND
+	MESSAGE_BUCKETS_CONTROL_COMMAND
+	MESSAGE_BUCKETS_RESPONSE_CONTROL_COMMAND
+	MESSAGE_IDENTIFY_CONTROL_COMMAND
+	MESSAGE_IDENTIFY_RESPONSE_CONTROL_COMMAND
+	MESSAGE_DELETE_CONTROL_COMMAND
 	MESSAGE_UNKNOWN_CONTROL_COMMAND
 )
 
 func (m ControlMessage) String() string {
-	return [...]string{"STORE", "FETCH", "FETCH_RESPONSE", "LIST", "EXIT"}[m]
+	return [...]string{"STORE", "FETCH", "FETCH_RESPONSE", "LIST", "EXIT", "UPLOAD_OFFSET", "FETCH_CHUNK", "FIND_NODE", "FIND_VALUE",
+		"STORE_PROVIDER", "DHT_RESPONSE", "PING", "PING_REQ", "ACK",
+		"HEARTBEAT", "HEARTBEAT_ACK", "ERROR", "SYNC_TREE", "SYNC_KEYS", "SYNC_RESPONSE",
+		"STORE_SHARD", "FETCH_SHARD", "RAFT_REQUEST_VOTE", "RAFT_APPEND_ENTRIES", "RAFT_INSTALL_SNAPSHOT",
+		"RAFT_PROPOSE", "RAFT_READ", "RAFT_RESPONSE", "BUCKETS", "BUCKETS_RESPONSE", "IDENTIFY",
+		"IDENTIFY_RESPONSE", "DELETE", "UNKNOWN"}[m]
+}
+
+// ParseControlMessage returns the ControlMessage with the given name, as returned by its String
+func ParseControlMessage(name string) (ControlMessage, error) {
+	for m := MESSAGE_STORE_CONTROL_COMMAND; m <= MESSAGE_UNKNOWN_CONTROL_COMMAND; m++ {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return MESSAGE_UNKNOWN_CONTROL_COMMAND, fmt.Errorf("unknown control message: %s", name)
 }
 
 // MessageType denotes the type of message received from an enum list
@@ -66,12 +115,68 @@ type Message struct {
 	Type    MessageType
 	From    net.Addr
 	Payload interface{}
+	// Stream is set on the messages that open a stream of their own, and carries the bytes that follow them, e.g, STORE
+	Stream *Stream
 }
 
 func (m *Message) String() string {
 	return fmt.Sprintf("Message containing Type=%s, From=%s and Payload=%+v", m.Type, m.From, m.Payload)
 }
 
+// Arg returns the arg with the given name, held in the Args of a ControlPayload or in the Metadata of a DataPayload
+func (m *Message) Arg(name string) (string, bool) {
+	var args map[string]string
+	switch payload := m.Payload.(type) {
+	case ControlPayload:
+		args = payload.Args
+	case DataPayload:
+		args = payload.Metadata
+	}
+	value, exists := args[name]
+	return value, exists
+}
+
+// WithArg returns a copy of m with the arg with the given name set to value, leaving the args of m untouched
+func (m Message) WithArg(name string, value string) Message {
+	var (
+		args   map[string]string
+		cloned = make(map[string]string)
+	)
+	switch payload := m.Payload.(type) {
+	case ControlPayload:
+		args = payload.Args
+		payload.Args = cloned
+		m.Payload = payload
+	case DataPayload:
+		args = payload.Metadata
+		payload.Metadata = cloned
+		m.Payload = payload
+	default:
+		return m
+	}
+	for k, v := range args {
+		cloned[k] = v
+	}
+	cloned[name] = value
+	return m
+}
+
+// Command returns the Command of a ControlPayload, or MESSAGE_UNKNOWN_CONTROL_COMMAND for any other payload
+func (m *Message) Command() ControlMessage {
+	if payload, isControl := m.Payload.(ControlPayload); isControl {
+		return payload.Command
+	}
+	return MESSAGE_UNKNOWN_CONTROL_COMMAND
+}
+
+// Priority returns the priority m is sent with, so that control messages aren't held up behind bulky data messages
+func (m *Message) Priority() SendPriority {
+	if m.Type == DataMessageType {
+		return DataPriority
+	}
+	return ControlPriority
+}
+
 // ConstructFetchResponseMessage constructs and return MESSAGE_FETCH_RESPONSE_CONTROL_COMMAND message based on whether the file was found or not
 func ConstructFetchResponseMessage(fileExists bool) Message {
 	return Message{
@@ -85,11 +190,60 @@ func ConstructFetchResponseMessage(fileExists bool) Message {
 	}
 }
 
+// ChecksumArg is the metadata of a DataPayload holding the checksum of its data, see ConstructDataMessage
+const ChecksumArg = "checksum"
+
+var ErrChecksumMismatch = errors.New("data doesn't match its checksum")
+
+// ConstructDataMessage constructs and returns a DataMessage holding data of key, along with the checksum of data,
+// so that the receiver can tell whether it arrived intact
+func ConstructDataMessage(key string, data []byte) Message {
+	return Message{
+		Type: DataMessageType,
+		Payload: DataPayload{
+			Key:      key,
+			Data:     data,
+			Metadata: map[string]string{ChecksumArg: dataChecksum(data)},
+		},
+	}
+}
+
+// Verify returns ErrChecksumMismatch if the data of p doesn't match the checksum it carries. Payloads without a checksum pass.
+func (p DataPayload) Verify() error {
+	if checksum, exists := p.Metadata[ChecksumArg]; exists && checksum != dataChecksum(p.Data) {
+		return fmt.Errorf("%w for %s", ErrChecksumMismatch, p.Key)
+	}
+	return nil
+}
+
+func dataChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ConstructUploadOffsetMessage constructs and returns MESSAGE_UPLOAD_OFFSET_CONTROL_COMMAND message, which tells the
+// sender of a resumable STORE stream the offset that it should continue streaming key from
+func ConstructUploadOffsetMessage(uploadID string, key string, offset int64, total int64) Message {
+	return Message{
+		Type: ControlMessageType,
+		Payload: ControlPayload{
+			Command: MESSAGE_UPLOAD_OFFSET_CONTROL_COMMAND,
+			Args: map[string]string{
+				"upload_id": uploadID,
+				"key":       key,
+				"offset":    strconv.FormatInt(offset, 10),
+				"total":     strconv.FormatInt(total, 10),
+			},
+		},
+	}
+}
+
 // ParseMessage decodes a message received from the network
 func ParseMessage(msg Message) *Message {
 	var decodedMsg Message
 	decodedMsg.From = msg.From
 	decodedMsg.Type = msg.Type
+	decodedMsg.Stream = msg.Stream
 
 	switch msg.Type {
 	case DataMessageType:
@@ -113,3 +267,12 @@ func ParseMessage(msg Message) *Message {
 
 	return &decodedMsg
 }
+
+// RegisterGobTypes registers the message types with gob, so that they can be sent over the wire
+func RegisterGobTypes() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(Message{})
+	gob.Register(DataPayload{})
+	gob.Register(ControlPayload{})
+	gob.Register(map[string]string{})
+}
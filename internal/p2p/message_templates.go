@@ -3,27 +3,46 @@ package p2p
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"file-store/internal/file"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
 )
 
+// Names of the formats control messages may be rendered in
+const (
+	JSONFormatName  = "json"
+	ProtoFormatName = "proto"
+)
+
+var ErrInvalidMessageFormat = errors.New("invalid rendered message")
+
+// MessageWrapper holds a control message as rendered by a MessageFormat
 type MessageWrapper struct {
 	ControlMessage ControlMessage
-	File           file.File
+	// File is the file the message refers to, if any. It is only ever rendered, since it isn't carried on the wire.
+	File file.File
+	Args map[string]string
 }
 
+// MessageFormat renders control messages for humans and debugging tools, and parses them back
 type MessageFormat interface {
-	generateMessage(messageWrapper *MessageWrapper) string
-	parseMessage(messageString string) *MessageWrapper
+	generateMessage(messageWrapper *MessageWrapper) (string, error)
+	parseMessage(messageString string) (*MessageWrapper, error)
 }
 
 type MessageFormatOpts struct {
 	MessageFormatter MessageFormat
 }
 
+// JSONFormat renders a control message as a JSON object
 type JSONFormat struct{}
 
+// ProtoFormat renders a control message as the ControlPayload of message.proto in the protobuf text format
 type ProtoFormat struct{}
 
 type MessageFormatFactory struct {
@@ -36,53 +55,339 @@ func NewMessageFormatFactory(opts MessageFormatOpts) *MessageFormatFactory {
 	}
 }
 
-func (msgFormat JSONFormat) parseMessage(messageString string) *MessageWrapper {
-	return &MessageWrapper{}
+// NewMessageFormat returns the format with the given name
+func NewMessageFormat(name string) (MessageFormat, error) {
+	switch name {
+	case JSONFormatName:
+		return JSONFormat{}, nil
+	case ProtoFormatName:
+		return ProtoFormat{}, nil
+	default:
+		return nil, fmt.Errorf("unknown message format: %s", name)
+	}
 }
 
-func (msgFormat ProtoFormat) parseMessage(messageString string) *MessageWrapper {
-	return &MessageWrapper{}
+// Render renders the control message msg
+func (f *MessageFormatFactory) Render(msg *Message) (string, error) {
+	payload, isControl := msg.Payload.(ControlPayload)
+	if !isControl {
+		return "", fmt.Errorf("only control messages can be rendered, got a %s message", msg.Type)
+	}
+	return f.MessageFormatter.generateMessage(&MessageWrapper{ControlMessage: payload.Command, Args: payload.Args})
+}
+
+// Parse parses a control message rendered by Render
+func (f *MessageFormatFactory) Parse(messageString string) (Message, error) {
+	wrapper, err := f.MessageFormatter.parseMessage(messageString)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type: ControlMessageType,
+		Payload: ControlPayload{
+			Command: wrapper.ControlMessage,
+			Args:    wrapper.Args,
+		},
+	}, nil
+}
+
+// --------------------------------------------------------------  JSON --------------------------------------------------------------
+
+type jsonMessageTemplate struct {
+	ControlMessageType string            `json:"@type"`
+	File               *file.File        `json:"file,omitempty"`
+	Args               map[string]string `json:"args,omitempty"`
+}
+
+func (msgFormat JSONFormat) parseMessage(messageString string) (*MessageWrapper, error) {
+	var jsonMessage jsonMessageTemplate
+	decoder := json.NewDecoder(strings.NewReader(messageString))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&jsonMessage); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessageFormat, err)
+	}
+	controlMessage, err := ParseControlMessage(jsonMessage.ControlMessageType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessageFormat, err)
+	}
+	wrapper := &MessageWrapper{ControlMessage: controlMessage, Args: jsonMessage.Args}
+	if jsonMessage.File != nil {
+		wrapper.File = *jsonMessage.File
+	}
+	return wrapper, nil
 }
 
-func (msgFormat JSONFormat) generateMessage(messageWrapper *MessageWrapper) string {
+func (msgFormat JSONFormat) generateMessage(messageWrapper *MessageWrapper) (string, error) {
 	jsonMessage := jsonMessageTemplate{
 		ControlMessageType: messageWrapper.ControlMessage.String(),
-		File:               messageWrapper.File,
+		Args:               messageWrapper.Args,
+	}
+	if messageWrapper.File != (file.File{}) {
+		jsonMessage.File = &messageWrapper.File
 	}
 	marshal, err := json.Marshal(jsonMessage)
 	if err != nil {
-		fmt.Println("Error: ", err)
-		return ""
+		return "", err
 	}
-	return string(marshal)
+	return string(marshal), nil
 }
 
-func (msgFormat ProtoFormat) generateMessage(messageWrapper *MessageWrapper) string {
-	tmpl, err := template.New("controlMessage").Parse(protoMessageTemplate)
-	if err != nil {
-		panic(err)
+// --------------------------------------------------------------  PROTOBUF TEXT --------------------------------------------------------------
+
+// PROTO_COMMAND_PREFIX denotes the prefix of the values of the ControlCommand enum of message.proto
+const PROTO_COMMAND_PREFIX = "CONTROL_COMMAND_"
+
+// protoMessageTemplate renders the fields of a ControlPayload, and of the file it refers to, one per line
+const protoMessageTemplate = `command: {{ .Command }}
+{{- range .Args }}
+args { key: {{ quote .Key }} value: {{ quote .Value }} }
+{{- end }}
+{{- with .File }}
+file { base_path: {{ quote .BasePath }} key_path: {{ quote .KeyPath }} file_mode: {{ printf "%d" .FileMode }} file_size: {{ .FileSize }} }
+{{- end }}
+`
+
+var protoTemplate = template.Must(template.New("controlMessage").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(protoMessageTemplate))
+
+type protoTemplateArg struct {
+	Key   string
+	Value string
+}
+
+type protoTemplateData struct {
+	Command string
+	Args    []protoTemplateArg
+	File    *file.File
+}
+
+func (msgFormat ProtoFormat) generateMessage(messageWrapper *MessageWrapper) (string, error) {
+	data := protoTemplateData{Command: PROTO_COMMAND_PREFIX + messageWrapper.ControlMessage.String()}
+	for k, v := range messageWrapper.Args {
+		data.Args = append(data.Args, protoTemplateArg{Key: k, Value: v})
 	}
+	// Args are rendered in a stable order, so that renders of the same message can be compared
+	sort.Slice(data.Args, func(i, j int) bool {
+		return data.Args[i].Key < data.Args[j].Key
+	})
+	if messageWrapper.File != (file.File{}) {
+		data.File = &messageWrapper.File
+	}
+
 	buf := new(bytes.Buffer)
-	err = tmpl.Execute(buf, tmpl)
+	if err := protoTemplate.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (msgFormat ProtoFormat) parseMessage(messageString string) (*MessageWrapper, error) {
+	tokens, err := tokenizeProtoText(messageString)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		p       = &protoTextParser{tokens: tokens}
+		wrapper = &MessageWrapper{}
+	)
+	err = p.parseFields(false, func(name string) error {
+		switch name {
+		case "command":
+			value, err := p.scalar(protoTokenIdent)
+			if err != nil {
+				return err
+			}
+			wrapper.ControlMessage, err = ParseControlMessage(strings.TrimPrefix(value, PROTO_COMMAND_PREFIX))
+			return err
+		case "args":
+			var key, value string
+			err := p.message(map[string]func() error{
+				"key":   p.scalarInto(protoTokenString, &key),
+				"value": p.scalarInto(protoTokenString, &value),
+			})
+			if wrapper.Args == nil {
+				wrapper.Args = make(map[string]string)
+			}
+			wrapper.Args[key] = value
+			return err
+		case "file":
+			var fileMode, fileSize string
+			err := p.message(map[string]func() error{
+				"base_path": p.scalarInto(protoTokenString, &wrapper.File.BasePath),
+				"key_path":  p.scalarInto(protoTokenString, &wrapper.File.KeyPath),
+				"file_mode": p.scalarInto(protoTokenNumber, &fileMode),
+				"file_size": p.scalarInto(protoTokenNumber, &fileSize),
+			})
+			if err != nil {
+				return err
+			}
+			mode, _ := strconv.ParseUint(fileMode, 10, 32)
+			wrapper.File.FileMode = os.FileMode(mode)
+			wrapper.File.FileSize, _ = strconv.ParseInt(fileSize, 10, 64)
+			return nil
+		default:
+			return fmt.Errorf("unknown field %s", name)
+		}
+	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessageFormat, err)
 	}
+	return wrapper, nil
+}
+
+type protoTokenKind int
 
-	return buf.String()
+const (
+	protoTokenIdent protoTokenKind = iota
+	protoTokenNumber
+	protoTokenString
+	protoTokenPunct
+)
+
+type protoToken struct {
+	kind  protoTokenKind
+	value string
 }
 
-const protoMessageTemplate = `{
-{{ @type: .ControlMessage }},
-{{ if .File }}
-  file:  {
-	  {{ .File.KeyPath }},
-	  {{ .FileKey.BasePath }},
-  }
-{{ end }}
+// tokenizeProtoText splits s into the identifiers, numbers, quoted strings and punctuation of the protobuf text format
+func tokenizeProtoText(s string) ([]protoToken, error) {
+	var tokens []protoToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' || c == ';':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == ':' || c == '{' || c == '}':
+			tokens = append(tokens, protoToken{kind: protoTokenPunct, value: string(c)})
+			i++
+		case c == '"':
+			// Find the closing quote, skipping the escaped characters
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidMessageFormat)
+			}
+			value, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid string %s", ErrInvalidMessageFormat, s[i:j+1])
+			}
+			tokens = append(tokens, protoToken{kind: protoTokenString, value: value})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, protoToken{kind: protoTokenNumber, value: s[i:j]})
+			i = j
+		case isProtoIdentChar(c) && !(c >= '0' && c <= '9'):
+			j := i
+			for j < len(s) && isProtoIdentChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, protoToken{kind: protoTokenIdent, value: s[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("%w: unexpected character %q", ErrInvalidMessageFormat, c)
+		}
+	}
+	return tokens, nil
 }
-`
 
-type jsonMessageTemplate struct {
-	ControlMessageType string    `json:"@type"`
-	File               file.File `json:"file,omitempty"`
+func isProtoIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// protoTextParser parses the tokens of a message in the protobuf text format
+type protoTextParser struct {
+	tokens []protoToken
+	pos    int
+}
+
+func (p *protoTextParser) next() (protoToken, error) {
+	if p.pos >= len(p.tokens) {
+		return protoToken{}, errors.New("unexpected end of message")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *protoTextParser) peek(kind protoTokenKind, value string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos] == protoToken{kind: kind, value: value}
+}
+
+// parseFields calls onField with the name of every field until the closing brace of a nested message, or the end of the message.
+// onField consumes the value of the field.
+func (p *protoTextParser) parseFields(nested bool, onField func(name string) error) error {
+	for {
+		if !nested && p.pos == len(p.tokens) {
+			return nil
+		}
+		if nested && p.peek(protoTokenPunct, "}") {
+			p.pos++
+			return nil
+		}
+		name, err := p.next()
+		if err != nil {
+			return err
+		}
+		if name.kind != protoTokenIdent {
+			return fmt.Errorf("expected a field name, got %q", name.value)
+		}
+		if err := onField(name.value); err != nil {
+			return err
+		}
+	}
+}
+
+// scalar consumes the value of a scalar field, which must be of the given kind
+func (p *protoTextParser) scalar(kind protoTokenKind) (string, error) {
+	if !p.peek(protoTokenPunct, ":") {
+		return "", errors.New("expected ':'")
+	}
+	p.pos++
+	value, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if value.kind != kind {
+		return "", fmt.Errorf("unexpected value %q", value.value)
+	}
+	return value.value, nil
+}
+
+// scalarInto returns a func consuming the value of a scalar field of the given kind into dst
+func (p *protoTextParser) scalarInto(kind protoTokenKind, dst *string) func() error {
+	return func() error {
+		value, err := p.scalar(kind)
+		*dst = value
+		return err
+	}
+}
+
+// message consumes the value of a message field, whose fields are consumed by the func of their name
+func (p *protoTextParser) message(fields map[string]func() error) error {
+	// The colon before a message value is optional
+	if p.peek(protoTokenPunct, ":") {
+		p.pos++
+	}
+	if !p.peek(protoTokenPunct, "{") {
+		return errors.New("expected '{'")
+	}
+	p.pos++
+	return p.parseFields(true, func(name string) error {
+		consume, known := fields[name]
+		if !known {
+			return fmt.Errorf("unknown field %s", name)
+		}
+		return consume()
+	})
 }
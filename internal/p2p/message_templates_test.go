@@ -2,9 +2,9 @@ package p2p
 
 import (
 	"file-store/internal/file"
-	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"unicode/utf8"
 )
 
 func getEmptyMessageWrapper() MessageWrapper {
@@ -19,9 +19,8 @@ func TestGenerateJSON(t *testing.T) {
 		MessageFormatter: JSONFormat{},
 	})
 	msg := getEmptyMessageWrapper()
-	str := messageFormatFactory.MessageFormatter.generateMessage(&msg)
-
-	fmt.Println(str)
+	str, err := messageFormatFactory.MessageFormatter.generateMessage(&msg)
+	assert.Nil(t, err)
 
 	assert.NotNil(t, str)
 	assert.NotEmpty(t, str)
@@ -32,5 +31,90 @@ func TestGenerateJSON(t *testing.T) {
 }
 
 func TestGenerateProto(t *testing.T) {
-	assert.True(t, true)
+	messageFormatFactory := NewMessageFormatFactory(MessageFormatOpts{
+		MessageFormatter: ProtoFormat{},
+	})
+	msg := getEmptyMessageWrapper()
+	str, err := messageFormatFactory.MessageFormatter.generateMessage(&msg)
+	assert.Nil(t, err)
+	// A message without args or a file renders as its command alone
+	assert.Equal(t, "command: CONTROL_COMMAND_LIST\n", str)
+
+	msg.Args = map[string]string{"key": "some \"quoted\" key"}
+	msg.File = file.File{KeyPath: "key", BasePath: "base", FileMode: 0644, FileSize: 42}
+	str, err = messageFormatFactory.MessageFormatter.generateMessage(&msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "command: CONTROL_COMMAND_LIST\nargs { key: \"key\" value: \"some \\\"quoted\\\" key\" }\nfile { base_path: \"base\" key_path: \"key\" file_mode: 420 file_size: 42 }\n", str)
+}
+
+func TestFormatsRoundTripEveryControlMessage(t *testing.T) {
+	args := map[string]string{"key": "some \"quoted\" key", "value": "line\nbreak\ttab \\ ünïcode", "empty": ""}
+	for _, format := range []MessageFormat{JSONFormat{}, ProtoFormat{}} {
+		factory := NewMessageFormatFactory(MessageFormatOpts{MessageFormatter: format})
+		for command := MESSAGE_STORE_CONTROL_COMMAND; command <= MESSAGE_UNKNOWN_CONTROL_COMMAND; command++ {
+			msg := Message{Type: ControlMessageType, Payload: ControlPayload{Command: command, Args: args}}
+			rendered, err := factory.Render(&msg)
+			assert.Nil(t, err)
+			parsed, err := factory.Parse(rendered)
+			assert.Nil(t, err, rendered)
+			assert.Equal(t, msg, parsed)
+		}
+
+		// The file a message refers to survives the round trip as well
+		wrapper := MessageWrapper{ControlMessage: MESSAGE_LIST_CONTROL_COMMAND, File: file.File{KeyPath: "key", BasePath: "base", FileMode: 0644, FileSize: 42}}
+		rendered, err := format.generateMessage(&wrapper)
+		assert.Nil(t, err)
+		parsed, err := format.parseMessage(rendered)
+		assert.Nil(t, err, rendered)
+		assert.Equal(t, &wrapper, parsed)
+	}
+}
+
+func TestProtoFormatParsesHandWrittenMessages(t *testing.T) {
+	wrapper, err := ProtoFormat{}.parseMessage(`
+		# A FETCH, the way someone would type it
+		command: CONTROL_COMMAND_FETCH
+		args: { key: "key" value: "some_key" };
+		args { key: "swarm", value: "true" }
+	`)
+	assert.Nil(t, err)
+	assert.Equal(t, &MessageWrapper{ControlMessage: MESSAGE_FETCH_CONTROL_COMMAND, Args: map[string]string{"key": "some_key", "swarm": "true"}}, wrapper)
+
+	for _, invalid := range []string{`command: CONTROL_COMMAND_NOPE`, `command CONTROL_COMMAND_FETCH`, `args { key: "key"`, `args { key: 1 }`, `bogus: 1`, `args { key: "unterminated }`} {
+		_, err := ProtoFormat{}.parseMessage(invalid)
+		assert.ErrorIs(t, err, ErrInvalidMessageFormat, invalid)
+	}
+	_, err = JSONFormat{}.parseMessage(`{"@type":"FETCH","bogus":1}`)
+	assert.ErrorIs(t, err, ErrInvalidMessageFormat)
+}
+
+func FuzzMessageFormatsRoundTrip(f *testing.F) {
+	f.Add(uint8(MESSAGE_FETCH_CONTROL_COMMAND), "key", "value", "reply_to", "1")
+	f.Add(uint8(MESSAGE_ERROR_CONTROL_COMMAND), "message", "not \"found\"", "", "\x00\xff")
+	f.Add(uint8(MESSAGE_PING_CONTROL_COMMAND), "updates", "a,b;c\n# not a comment", "{", "}")
+	f.Fuzz(func(t *testing.T, command uint8, k1 string, v1 string, k2 string, v2 string) {
+		msg := Message{
+			Type: ControlMessageType,
+			Payload: ControlPayload{
+				Command: ControlMessage(command % uint8(MESSAGE_UNKNOWN_CONTROL_COMMAND+1)),
+				Args:    map[string]string{k1: v1, k2: v2},
+			},
+		}
+		for _, format := range []MessageFormat{JSONFormat{}, ProtoFormat{}} {
+			// JSON strings can't carry bytes that aren't valid UTF-8
+			if _, isJSON := format.(JSONFormat); isJSON && !(utf8.ValidString(k1) && utf8.ValidString(v1) && utf8.ValidString(k2) && utf8.ValidString(v2)) {
+				continue
+			}
+			factory := NewMessageFormatFactory(MessageFormatOpts{MessageFormatter: format})
+			rendered, err := factory.Render(&msg)
+			if err != nil {
+				t.Fatalf("rendering %+v: %v", msg, err)
+			}
+			parsed, err := factory.Parse(rendered)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", rendered, err)
+			}
+			assert.Equal(t, msg, parsed)
+		}
+	})
 }
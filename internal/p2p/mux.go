@@ -0,0 +1,511 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// MUX_HEADER_SIZE denotes the size of the header written before each frame, i.e, 1 byte of frame type, 1 byte of flags,
+// 4 bytes of stream ID and 4 bytes of length
+const MUX_HEADER_SIZE = 10
+
+// MUX_MAX_FRAME_SIZE denotes the max number of data bytes in a frame, so that the frames of several streams interleave finely
+const MUX_MAX_FRAME_SIZE = 32 * 1024
+
+// MUX_INITIAL_WINDOW_SIZE denotes how many bytes may be sent on a stream before the receiver has read any of them
+const MUX_INITIAL_WINDOW_SIZE = 256 * 1024
+
+// MUX_ACCEPT_BACKLOG denotes how many streams opened by the remote may wait to be accepted, further ones are reset
+const MUX_ACCEPT_BACKLOG = 64
+
+// MUX_CONTROL_STREAM_ID denotes the stream that exists from the start of every session, and carries the framed messages
+const MUX_CONTROL_STREAM_ID = 0
+
+var (
+	ErrSessionClosed = errors.New("mux session closed")
+	ErrStreamClosed  = errors.New("mux stream closed for writing")
+	ErrStreamReset   = errors.New("mux stream reset")
+)
+
+type muxFrameType byte
+
+const (
+	// muxFrameData carries length bytes of stream data
+	muxFrameData muxFrameType = iota
+	// muxFrameWindowUpdate lets the sender of a stream send length more bytes on it
+	muxFrameWindowUpdate
+)
+
+type muxFlags byte
+
+const (
+	// muxFlagSYN opens a stream
+	muxFlagSYN muxFlags = 1 << iota
+	// muxFlagFIN tells that the sender won't write to the stream anymore
+	muxFlagFIN
+	// muxFlagRST aborts the stream in both directions
+	muxFlagRST
+)
+
+// Session multiplexes independent, flow controlled streams over a single connection. Both ends start with the control stream,
+// and either end may open more. The dialing end opens odd stream IDs and the accepting end even ones, so that they never clash.
+type Session struct {
+	conn         net.Conn
+	nextStreamID uint32
+	control      *Stream
+
+	streamsLock sync.Mutex
+	streams     map[uint32]*Stream
+	acceptCh    chan *Stream
+
+	// writeLock serializes frames, so that a frame never lands in the middle of another one
+	writeLock sync.Mutex
+
+	closeOnce sync.Once
+	closedCh  chan struct{}
+	closeErr  error
+}
+
+// NewSession starts multiplexing conn. isClient must be set on the dialing end and unset on the accepting end.
+func NewSession(conn net.Conn, isClient bool) *Session {
+	s := &Session{
+		conn:         conn,
+		nextStreamID: 2,
+		streams:      make(map[uint32]*Stream),
+		acceptCh:     make(chan *Stream, MUX_ACCEPT_BACKLOG),
+		closedCh:     make(chan struct{}),
+	}
+	if isClient {
+		s.nextStreamID = 1
+	}
+	s.control = newStream(s, MUX_CONTROL_STREAM_ID)
+	s.streams[MUX_CONTROL_STREAM_ID] = s.control
+	go s.recvLoop()
+	return s
+}
+
+// Control returns the control stream of the session
+func (s *Session) Control() *Stream {
+	return s.control
+}
+
+// Open opens a new stream to the remote end, which gets it from Accept
+func (s *Session) Open() (*Stream, error) {
+	s.streamsLock.Lock()
+	if s.isClosed() {
+		s.streamsLock.Unlock()
+		return nil, ErrSessionClosed
+	}
+	stream := newStream(s, s.nextStreamID)
+	s.nextStreamID += 2
+	s.streams[stream.id] = stream
+	s.streamsLock.Unlock()
+
+	if err := s.writeFrame(muxFrameData, muxFlagSYN, stream.id, nil); err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the remote end
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closedCh:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Close closes the connection, which ends every stream of the session
+func (s *Session) Close() error {
+	return s.closeWithErr(ErrSessionClosed)
+}
+
+// Err returns why the session was closed, or nil if it is still open
+func (s *Session) Err() error {
+	if !s.isClosed() {
+		return nil
+	}
+	return s.closeErr
+}
+
+func (s *Session) closeWithErr(err error) error {
+	closeErr := ErrSessionClosed
+	s.closeOnce.Do(func() {
+		s.closeErr = err
+		close(s.closedCh)
+		closeErr = s.conn.Close()
+	})
+	return closeErr
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeFrame writes a single frame to the connection
+func (s *Session) writeFrame(frameType muxFrameType, flags muxFlags, streamID uint32, data []byte) error {
+	return s.writeFrameWithLength(frameType, flags, streamID, uint32(len(data)), data)
+}
+
+func (s *Session) writeFrameWithLength(frameType muxFrameType, flags muxFlags, streamID uint32, length uint32, data []byte) error {
+	frame := make([]byte, MUX_HEADER_SIZE+len(data))
+	frame[0] = byte(frameType)
+	frame[1] = byte(flags)
+	binary.BigEndian.PutUint32(frame[2:6], streamID)
+	binary.BigEndian.PutUint32(frame[6:10], length)
+	copy(frame[MUX_HEADER_SIZE:], data)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		_ = s.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads frames from the connection and dispatches them to their streams, until the connection ends
+func (s *Session) recvLoop() {
+	header := make([]byte, MUX_HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			_ = s.closeWithErr(err)
+			return
+		}
+		var (
+			frameType = muxFrameType(header[0])
+			flags     = muxFlags(header[1])
+			streamID  = binary.BigEndian.Uint32(header[2:6])
+			length    = binary.BigEndian.Uint32(header[6:10])
+		)
+		if err := s.handleFrame(frameType, flags, streamID, length); err != nil {
+			_ = s.closeWithErr(err)
+			return
+		}
+	}
+}
+
+// handleFrame handles a frame whose header was just read, consuming its data from the connection
+func (s *Session) handleFrame(frameType muxFrameType, flags muxFlags, streamID uint32, length uint32) error {
+	stream := s.getStream(streamID)
+	if stream == nil && flags&muxFlagSYN != 0 {
+		stream = s.acceptStream(streamID)
+	}
+
+	switch frameType {
+	case muxFrameData:
+		if length > MUX_MAX_FRAME_SIZE {
+			return fmt.Errorf("mux frame of %d bytes exceeds the max of %d bytes", length, MUX_MAX_FRAME_SIZE)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return err
+		}
+		if stream == nil {
+			// The stream is gone on our end, so whatever is still in flight on it has nowhere to go
+			return nil
+		}
+		if err := stream.pushData(data); err != nil {
+			return err
+		}
+	case muxFrameWindowUpdate:
+		if stream != nil {
+			stream.growSendWindow(length)
+		}
+	default:
+		return fmt.Errorf("unknown mux frame type %d", frameType)
+	}
+
+	if stream != nil {
+		if flags&muxFlagRST != 0 {
+			stream.remoteReset()
+		} else if flags&muxFlagFIN != 0 {
+			stream.remoteFinished()
+		}
+	}
+	return nil
+}
+
+// acceptStream registers a stream opened by the remote end and queues it for Accept, or resets it if the backlog is full
+func (s *Session) acceptStream(streamID uint32) *Stream {
+	stream := newStream(s, streamID)
+	s.streamsLock.Lock()
+	s.streams[streamID] = stream
+	s.streamsLock.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+		return stream
+	default:
+		s.removeStream(streamID)
+		// Resetting writes to the connection, which must not hold up reading from it
+		go func() {
+			_ = s.writeFrame(muxFrameData, muxFlagRST, streamID, nil)
+		}()
+		return nil
+	}
+}
+
+func (s *Session) getStream(streamID uint32) *Stream {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return s.streams[streamID]
+}
+
+func (s *Session) removeStream(streamID uint32) {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	delete(s.streams, streamID)
+}
+
+// Stream is a single flow controlled, bidirectional byte stream within a Session. A Write is never interleaved with other
+// Writes to the same stream, so that a framed message written at once arrives in one piece.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	lock sync.Mutex
+	// recvBuf holds the bytes received and not read yet, of which there are at most recvWindow more to come
+	recvBuf    bytes.Buffer
+	recvWindow uint32
+	// unacked counts the bytes read since the remote was last told to send more
+	unacked    uint32
+	sendWindow uint32
+	// finSent and finReceived tell which ends are done writing
+	finSent     bool
+	finReceived bool
+	reset       bool
+	// truncated streams are reset once readLeft more bytes were read, see truncateAt
+	truncated bool
+	readLeft  int64
+
+	readReady chan struct{}
+	sendReady chan struct{}
+	writeLock sync.Mutex
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: MUX_INITIAL_WINDOW_SIZE,
+		sendWindow: MUX_INITIAL_WINDOW_SIZE,
+		readReady:  make(chan struct{}, 1),
+		sendReady:  make(chan struct{}, 1),
+	}
+}
+
+// ID returns the ID of the stream within its session
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads the bytes received on the stream, and returns io.EOF once the remote is done writing and every byte was read
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.lock.Lock()
+		if st.truncated && st.readLeft == 0 {
+			st.lock.Unlock()
+			_ = st.Reset()
+			return 0, ErrStreamReset
+		}
+		if st.recvBuf.Len() > 0 {
+			if st.truncated && int64(len(b)) > st.readLeft {
+				b = b[:st.readLeft]
+			}
+			n, _ := st.recvBuf.Read(b)
+			if st.truncated {
+				st.readLeft -= int64(n)
+			}
+			st.unacked += uint32(n)
+			// Let the remote send more once half of the window was read, rather than after every read
+			var increment uint32
+			if st.unacked >= MUX_INITIAL_WINDOW_SIZE/2 && !st.finReceived {
+				increment = st.unacked
+				st.recvWindow += increment
+				st.unacked = 0
+			}
+			st.lock.Unlock()
+			if increment > 0 {
+				_ = st.session.writeFrameWithLength(muxFrameWindowUpdate, 0, st.id, increment, nil)
+			}
+			return n, nil
+		}
+		reset, finReceived := st.reset, st.finReceived
+		st.lock.Unlock()
+
+		switch {
+		case reset:
+			return 0, ErrStreamReset
+		case finReceived:
+			return 0, io.EOF
+		}
+		select {
+		case <-st.readReady:
+		case <-st.session.closedCh:
+			// Whatever arrived before the connection ended can still be read
+			if st.hasBufferedData() {
+				continue
+			}
+			return 0, st.session.closeErr
+		}
+	}
+}
+
+// Write writes b to the stream as a whole, waiting whenever the remote has no room for more
+func (st *Stream) Write(b []byte) (int, error) {
+	st.writeLock.Lock()
+	defer st.writeLock.Unlock()
+
+	written := 0
+	for written < len(b) {
+		st.lock.Lock()
+		if st.reset {
+			st.lock.Unlock()
+			return written, ErrStreamReset
+		}
+		if st.finSent {
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := min(uint32(len(b)-written), st.sendWindow, MUX_MAX_FRAME_SIZE)
+		st.sendWindow -= n
+		st.lock.Unlock()
+
+		if n == 0 {
+			select {
+			case <-st.sendReady:
+				continue
+			case <-st.session.closedCh:
+				return written, ErrSessionClosed
+			}
+		}
+		if err := st.session.writeFrame(muxFrameData, 0, st.id, b[written:written+int(n)]); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// Close tells the remote that nothing more will be written to the stream, which can still be read until the remote does the same
+func (st *Stream) Close() error {
+	st.writeLock.Lock()
+	defer st.writeLock.Unlock()
+
+	st.lock.Lock()
+	if st.finSent || st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finReceived
+	st.lock.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return st.session.writeFrame(muxFrameData, muxFlagFIN, st.id, nil)
+}
+
+// truncateAt has the stream reset once n more bytes were read from it, as if the transfer was cut off there
+func (st *Stream) truncateAt(n int64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.truncated = true
+	st.readLeft = max(n, 0)
+}
+
+// Reset aborts the stream in both directions, discarding whatever wasn't read yet
+func (st *Stream) Reset() error {
+	st.lock.Lock()
+	if st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.lock.Unlock()
+
+	st.notify()
+	st.session.removeStream(st.id)
+	return st.session.writeFrame(muxFrameData, muxFlagRST, st.id, nil)
+}
+
+// pushData buffers data received on the stream, which the remote may only send within the window it was given
+func (st *Stream) pushData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if uint32(len(data)) > st.recvWindow {
+		return fmt.Errorf("mux stream %d received %d bytes beyond its window of %d bytes", st.id, len(data), st.recvWindow)
+	}
+	st.recvWindow -= uint32(len(data))
+	st.recvBuf.Write(data)
+	signal(st.readReady)
+	return nil
+}
+
+func (st *Stream) growSendWindow(increment uint32) {
+	st.lock.Lock()
+	st.sendWindow += increment
+	st.lock.Unlock()
+	signal(st.sendReady)
+}
+
+func (st *Stream) remoteFinished() {
+	st.lock.Lock()
+	st.finReceived = true
+	done := st.finSent
+	st.lock.Unlock()
+
+	signal(st.readReady)
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.lock.Lock()
+	st.reset = true
+	st.lock.Unlock()
+
+	st.notify()
+	st.session.removeStream(st.id)
+}
+
+func (st *Stream) notify() {
+	signal(st.readReady)
+	signal(st.sendReady)
+}
+
+func (st *Stream) hasBufferedData() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.recvBuf.Len() > 0
+}
+
+// signal wakes up whoever waits on ch, without blocking if it was already woken up
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
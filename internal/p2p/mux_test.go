@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSessionPair connects a dialing and an accepting Session over an in-memory connection
+func newSessionPair(t *testing.T) (*Session, *Session) {
+	clientConn, serverConn := net.Pipe()
+	client, server := NewSession(clientConn, true), NewSession(serverConn, false)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestMuxStreamCarriesBytesBeyondTheWindow(t *testing.T) {
+	client, server := newSessionPair(t)
+	data := make([]byte, 3*MUX_INITIAL_WINDOW_SIZE+123)
+	_, _ = rand.Read(data)
+
+	go func() {
+		stream, err := client.Open()
+		assert.Nil(t, err)
+		_, err = stream.Write(data)
+		assert.Nil(t, err)
+		assert.Nil(t, stream.Close())
+	}()
+
+	stream, err := server.Accept()
+	assert.Nil(t, err)
+	received, err := io.ReadAll(stream)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, received))
+	assert.Nil(t, stream.Close())
+
+	// Once both ends are done with it, the stream is forgotten
+	assert.Eventually(t, func() bool {
+		return client.getStream(stream.ID()) == nil && server.getStream(stream.ID()) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMuxStalledStreamDoesNotBlockOthers(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	// Fill the window of a stream that nobody reads
+	stalled, err := client.Open()
+	assert.Nil(t, err)
+	stalledWritten := make(chan struct{})
+	go func() {
+		_, _ = stalled.Write(make([]byte, 2*MUX_INITIAL_WINDOW_SIZE))
+		close(stalledWritten)
+	}()
+	_, err = server.Accept()
+	assert.Nil(t, err)
+
+	// The control stream and other streams keep flowing
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := client.Control().Write([]byte("control"))
+		assert.Nil(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		other, err := client.Open()
+		assert.Nil(t, err)
+		_, err = other.Write([]byte("other"))
+		assert.Nil(t, err)
+		assert.Nil(t, other.Close())
+	}()
+
+	buf := make([]byte, len("control"))
+	_, err = io.ReadFull(server.Control(), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "control", string(buf))
+
+	other, err := server.Accept()
+	assert.Nil(t, err)
+	received, err := io.ReadAll(other)
+	assert.Nil(t, err)
+	assert.Equal(t, "other", string(received))
+	wg.Wait()
+
+	select {
+	case <-stalledWritten:
+		t.Fatal("write beyond the window of an unread stream returned")
+	default:
+	}
+}
+
+func TestMuxResetAndCloseUnblockStreams(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err)
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	// A reset on one end fails writes waiting for room on the other
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, 2*MUX_INITIAL_WINDOW_SIZE))
+		writeErr <- err
+	}()
+	assert.Nil(t, accepted.Reset())
+	assert.ErrorIs(t, <-writeErr, ErrStreamReset)
+
+	// Closing the session ends reads on every stream
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := server.Control().Read(make([]byte, 1))
+		readErr <- err
+	}()
+	assert.Nil(t, client.Close())
+	assert.NotNil(t, <-readErr)
+	_, err = client.Open()
+	assert.ErrorIs(t, err, ErrSessionClosed)
+}
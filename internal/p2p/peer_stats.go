@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PeerStats tracks the liveness of a peer, as the time anything was last read from it and its smoothed round trip time, along
+// with the room for files it last advertised
+type PeerStats struct {
+	lastSeen atomic.Int64
+	rtt      atomic.Int64
+	// room holds the room advertised plus one, so that 0 stands for none advertised and -1 for unlimited room fits in
+	room atomic.Int64
+}
+
+// Touch records that something was just read from the peer
+func (ps *PeerStats) Touch() {
+	ps.lastSeen.Store(time.Now().UnixNano())
+}
+
+// LastSeen returns the time anything was last read from the peer
+func (ps *PeerStats) LastSeen() time.Time {
+	return time.Unix(0, ps.lastSeen.Load())
+}
+
+// ObserveRTT folds a round trip time sample into the smoothed RTT, weighting it by 1/8 like TCP does
+func (ps *PeerStats) ObserveRTT(sample time.Duration) {
+	if sample <= 0 {
+		sample = 1
+	}
+	for {
+		current := ps.rtt.Load()
+		smoothed := int64(sample)
+		if current != 0 {
+			smoothed = current + (int64(sample)-current)/8
+		}
+		if ps.rtt.CompareAndSwap(current, smoothed) {
+			return
+		}
+	}
+}
+
+// RTT returns the smoothed round trip time, and whether it has been measured at all
+func (ps *PeerStats) RTT() (time.Duration, bool) {
+	rtt := ps.rtt.Load()
+	return time.Duration(rtt), rtt != 0
+}
+
+// ObserveRoom records how many more bytes of files the peer advertised room for, where a negative count stands for unlimited room
+func (ps *PeerStats) ObserveRoom(bytes int64) {
+	ps.room.Store(max(bytes, -1) + 1)
+}
+
+// Room returns the room for files the peer last advertised, and whether it advertised any at all
+func (ps *PeerStats) Room() (int64, bool) {
+	room := ps.room.Load()
+	return room - 1, room != 0
+}
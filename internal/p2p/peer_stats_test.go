@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerStatsSmoothsRTT(t *testing.T) {
+	stats := PeerStats{}
+	_, measured := stats.RTT()
+	assert.False(t, measured)
+
+	stats.ObserveRTT(80 * time.Millisecond)
+	rtt, measured := stats.RTT()
+	assert.True(t, measured)
+	assert.Equal(t, 80*time.Millisecond, rtt)
+
+	// A single outlier only moves the smoothed RTT by an eighth of the difference
+	stats.ObserveRTT(160 * time.Millisecond)
+	rtt, _ = stats.RTT()
+	assert.Equal(t, 90*time.Millisecond, rtt)
+}
+
+func TestPeerStatsRecordsRoom(t *testing.T) {
+	stats := PeerStats{}
+	_, advertised := stats.Room()
+	assert.False(t, advertised)
+
+	stats.ObserveRoom(0)
+	room, advertised := stats.Room()
+	assert.True(t, advertised)
+	assert.Equal(t, int64(0), room)
+	stats.ObserveRoom(-1)
+	room, _ = stats.Room()
+	assert.Equal(t, int64(-1), room)
+}
+
+func TestTCPPeerReadTouchesLastSeen(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	peer := NewTCPPeer(local, false, SendQueueOpts{})
+	before := peer.Stats().LastSeen()
+	time.Sleep(time.Millisecond)
+
+	go func() {
+		_, _ = NewSession(remote, true).Control().Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	n, err := peer.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.True(t, peer.Stats().LastSeen().After(before))
+}
@@ -0,0 +1,271 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"log"
+)
+
+// PROTOBUF_FRAME_HEADER_SIZE denotes the size of the header written before each message by ProtobufCodec, i.e, 4 bytes of length
+const PROTOBUF_FRAME_HEADER_SIZE = 4
+
+// Field numbers of the messages in message.proto
+const (
+	protoMessageTypeField    protowire.Number = 1
+	protoMessageDataField    protowire.Number = 2
+	protoMessageControlField protowire.Number = 3
+	protoDataKeyField        protowire.Number = 1
+	protoDataDataField       protowire.Number = 2
+	protoDataMetadataField   protowire.Number = 3
+	protoControlCommandField protowire.Number = 1
+	protoControlArgsField    protowire.Number = 2
+	protoMapEntryKeyField    protowire.Number = 1
+	protoMapEntryValueField  protowire.Number = 2
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf encoding")
+
+// ProtobufCodec frames every message as its length, followed by the Message of message.proto encoded with protobuf,
+// so that peers and tools written in any language can speak the protocol
+type ProtobufCodec struct{}
+
+func (c *ProtobufCodec) Name() string {
+	return ProtobufCodecName
+}
+
+func (c *ProtobufCodec) Encode(w io.Writer, msg *Message) error {
+	frame := make([]byte, PROTOBUF_FRAME_HEADER_SIZE)
+	frame = protowire.AppendTag(frame, protoMessageTypeField, protowire.VarintType)
+	frame = protowire.AppendVarint(frame, uint64(msg.Type))
+
+	switch msg.Type {
+	case DataMessageType:
+		payload, ok := msg.Payload.(DataPayload)
+		if !ok {
+			return fmt.Errorf("invalid payload type for DataMessageType")
+		}
+		frame = protowire.AppendTag(frame, protoMessageDataField, protowire.BytesType)
+		frame = protowire.AppendBytes(frame, appendProtoDataPayload(nil, &payload))
+
+	case ControlMessageType:
+		payload, ok := msg.Payload.(ControlPayload)
+		if !ok {
+			return fmt.Errorf("invalid payload type for ControlMessageType")
+		}
+		frame = protowire.AppendTag(frame, protoMessageControlField, protowire.BytesType)
+		frame = protowire.AppendBytes(frame, appendProtoControlPayload(nil, &payload))
+
+	default:
+		return fmt.Errorf("unsupported message type: %v", msg.Type)
+	}
+
+	// Fill in the frame header
+	payloadSize := len(frame) - PROTOBUF_FRAME_HEADER_SIZE
+	if payloadSize > MAX_DECODER_BUFFER_SIZE {
+		return fmt.Errorf("payload of %d bytes exceeds the max of %d bytes", payloadSize, MAX_DECODER_BUFFER_SIZE)
+	}
+	binary.BigEndian.PutUint32(frame, uint32(payloadSize))
+
+	// Write the whole frame at once, so that frames written concurrently to the same conn don't interleave
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+func (c *ProtobufCodec) Decode(r io.Reader, msg *Message) error {
+	// Decode frame header, a clean EOF here means that the peer is done sending
+	header := make([]byte, PROTOBUF_FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	n := int(binary.BigEndian.Uint32(header))
+	if n > MAX_DECODER_BUFFER_SIZE {
+		return fmt.Errorf("payload of %d bytes exceeds the max of %d bytes", n, MAX_DECODER_BUFFER_SIZE)
+	}
+
+	// Read exactly the message, so that whatever follows it on r is left for the next read
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	if err := decodeProtoMessage(buf, msg); err != nil {
+		return fmt.Errorf("failed to decode Message: %w", err)
+	}
+	log.Printf("Received and decoded %s -> %+v", msg.Type, msg.Payload)
+	return nil
+}
+
+func appendProtoDataPayload(b []byte, payload *DataPayload) []byte {
+	if payload.Key != "" {
+		b = protowire.AppendTag(b, protoDataKeyField, protowire.BytesType)
+		b = protowire.AppendString(b, payload.Key)
+	}
+	if len(payload.Data) > 0 {
+		b = protowire.AppendTag(b, protoDataDataField, protowire.BytesType)
+		b = protowire.AppendBytes(b, payload.Data)
+	}
+	return appendProtoMap(b, protoDataMetadataField, payload.Metadata)
+}
+
+func appendProtoControlPayload(b []byte, payload *ControlPayload) []byte {
+	if payload.Command != 0 {
+		b = protowire.AppendTag(b, protoControlCommandField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(payload.Command))
+	}
+	return appendProtoMap(b, protoControlArgsField, payload.Args)
+}
+
+// appendProtoMap appends m as a map<string, string> field, i.e, a repeated field of key/value entries
+func appendProtoMap(b []byte, field protowire.Number, m map[string]string) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = protowire.AppendTag(entry, protoMapEntryKeyField, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, protoMapEntryValueField, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// consumeProtoFields calls onField with the number, type and value of every field of the message encoded in b.
+// Fields onField doesn't consume are skipped, so that fields added to the schema later don't break older peers.
+func consumeProtoFields(b []byte, onField func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errInvalidProtobuf
+		}
+		b = b[n:]
+		n, err := onField(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errInvalidProtobuf
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func decodeProtoMessage(b []byte, msg *Message) error {
+	var (
+		data    *DataPayload
+		control *ControlPayload
+	)
+	msg.Type = DataMessageType
+	err := consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == protoMessageTypeField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			msg.Type = MessageType(v)
+			return n, nil
+		case num == protoMessageDataField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			data, control = &DataPayload{}, nil
+			return n, decodeProtoDataPayload(v, data)
+		case num == protoMessageControlField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			data, control = nil, &ControlPayload{}
+			return n, decodeProtoControlPayload(v, control)
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case msg.Type == DataMessageType && data != nil:
+		msg.Payload = *data
+	case msg.Type == ControlMessageType && control != nil:
+		msg.Payload = *control
+	default:
+		return fmt.Errorf("missing payload for message type: %d", msg.Type)
+	}
+	return nil
+}
+
+func decodeProtoDataPayload(b []byte, payload *DataPayload) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return 0, nil
+		}
+		switch num {
+		case protoDataKeyField:
+			v, n := protowire.ConsumeString(b)
+			payload.Key = v
+			return n, nil
+		case protoDataDataField:
+			v, n := protowire.ConsumeBytes(b)
+			payload.Data = append([]byte(nil), v...)
+			return n, nil
+		case protoDataMetadataField:
+			if payload.Metadata == nil {
+				payload.Metadata = make(map[string]string)
+			}
+			return consumeProtoMapEntry(b, payload.Metadata)
+		}
+		return 0, nil
+	})
+}
+
+func decodeProtoControlPayload(b []byte, payload *ControlPayload) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == protoControlCommandField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			// Commands added after this peer was built are unknown to it
+			payload.Command = MESSAGE_UNKNOWN_CONTROL_COMMAND
+			if v < uint64(MESSAGE_UNKNOWN_CONTROL_COMMAND) {
+				payload.Command = ControlMessage(v)
+			}
+			return n, nil
+		case num == protoControlArgsField && typ == protowire.BytesType:
+			if payload.Args == nil {
+				payload.Args = make(map[string]string)
+			}
+			return consumeProtoMapEntry(b, payload.Args)
+		}
+		return 0, nil
+	})
+}
+
+// consumeProtoMapEntry decodes a key/value entry of a map<string, string> field into m, and returns the bytes it consumed
+func consumeProtoMapEntry(b []byte, m map[string]string) (int, error) {
+	entry, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	var key, value string
+	err := consumeProtoFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return 0, nil
+		}
+		switch num {
+		case protoMapEntryKeyField:
+			v, n := protowire.ConsumeString(b)
+			key = v
+			return n, nil
+		case protoMapEntryValueField:
+			v, n := protowire.ConsumeString(b)
+			value = v
+			return n, nil
+		}
+		return 0, nil
+	})
+	m[key] = value
+	return n, err
+}
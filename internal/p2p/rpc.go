@@ -0,0 +1,151 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// RequestIDArg is the arg carrying the ID of a request, which its reply carries back as ReplyToArg
+	RequestIDArg = "request_id"
+	ReplyToArg   = "reply_to"
+)
+
+// ErrorCode denotes the kind of failure an ERROR reply reports
+type ErrorCode string
+
+const (
+	ErrorCodeNotFound       ErrorCode = "not_found"
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request"
+	ErrorCodeUnavailable    ErrorCode = "unavailable"
+	ErrorCodeInternal       ErrorCode = "internal"
+)
+
+// RemoteError is the error a peer replied to a request with
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a RemoteError with the same Code, so that replies can be matched with errors.Is
+func (e *RemoteError) Is(target error) bool {
+	t, ok := target.(*RemoteError)
+	return ok && t.Code == e.Code
+}
+
+var (
+	ErrNotFound       = &RemoteError{Code: ErrorCodeNotFound, Message: "not found"}
+	ErrInvalidRequest = &RemoteError{Code: ErrorCodeInvalidRequest, Message: "invalid request"}
+	ErrUnavailable    = &RemoteError{Code: ErrorCodeUnavailable, Message: "unavailable"}
+)
+
+// NewRemoteError returns a RemoteError with the given code, and a message formatted according to format
+func NewRemoteError(code ErrorCode, format string, a ...any) *RemoteError {
+	return &RemoteError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// ConstructErrorMessage constructs and returns MESSAGE_ERROR_CONTROL_COMMAND message reporting err. Errors that aren't
+// a RemoteError are reported as internal ones.
+func ConstructErrorMessage(err error) Message {
+	remoteErr := &RemoteError{Code: ErrorCodeInternal, Message: err.Error()}
+	errors.As(err, &remoteErr)
+	return Message{
+		Type: ControlMessageType,
+		Payload: ControlPayload{
+			Command: MESSAGE_ERROR_CONTROL_COMMAND,
+			Args: map[string]string{
+				"code":    string(remoteErr.Code),
+				"message": remoteErr.Message,
+			},
+		},
+	}
+}
+
+// ConstructReplyMessage returns reply, correlated with the request whose payload is given
+func ConstructReplyMessage(request *ControlPayload, reply Message) Message {
+	return reply.WithArg(ReplyToArg, request.Args[RequestIDArg])
+}
+
+// pendingCall is a request sent by Call, waiting for its reply
+type pendingCall struct {
+	peer    Peer
+	replyCh chan Message
+}
+
+// pendingCalls keeps track of the requests waiting for their reply
+type pendingCalls struct {
+	lock    sync.Mutex
+	calls   map[string]*pendingCall
+	counter atomic.Uint64
+}
+
+func (p *pendingCalls) add(peer Peer) (string, *pendingCall) {
+	id := strconv.FormatUint(p.counter.Add(1), 10)
+	call := &pendingCall{peer: peer, replyCh: make(chan Message, 1)}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.calls == nil {
+		p.calls = make(map[string]*pendingCall)
+	}
+	p.calls[id] = call
+	return id, call
+}
+
+func (p *pendingCalls) remove(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.calls, id)
+}
+
+// deliver hands reply from peer to the call waiting for it, and reports whether there was one
+func (p *pendingCalls) deliver(id string, peer Peer, reply Message) bool {
+	p.lock.Lock()
+	call, exists := p.calls[id]
+	p.lock.Unlock()
+	// A reply only counts if it comes from the peer the request went to
+	if !exists || call.peer != peer {
+		return false
+	}
+	select {
+	case call.replyCh <- reply:
+		return true
+	default:
+		return false
+	}
+}
+
+// Call implements the Transport interface, sends the request msg to peer, and waits for the reply correlated with it or until
+// ctx is done. An ERROR reply is returned as a *RemoteError.
+func (t *TCPTransport) Call(ctx context.Context, peer Peer, msg Message) (Message, error) {
+	id, call := t.calls.add(peer)
+	defer t.calls.remove(id)
+
+	msg = msg.WithArg(RequestIDArg, id)
+	var frame bytes.Buffer
+	if err := peer.Codec().Encode(&frame, &msg); err != nil {
+		return Message{}, err
+	}
+	if err := peer.Send(frame.Bytes(), msg.Priority()); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case reply := <-call.replyCh:
+		if payload, isControl := reply.Payload.(ControlPayload); isControl && payload.Command == MESSAGE_ERROR_CONTROL_COMMAND {
+			return reply, &RemoteError{Code: ErrorCode(payload.Args["code"]), Message: payload.Args["message"]}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("%s to %s: %w", msg.Command(), peer, ctx.Err())
+	}
+}
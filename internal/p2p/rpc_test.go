@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCallReturnsCorrelatedReplies(t *testing.T) {
+	var (
+		codec        = &DefaultCodec{}
+		serverPeerCh = make(chan Peer, 1)
+		clientPeerCh = make(chan Peer, 1)
+	)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddress: ":5012",
+		HandshakeFunc: NOHANDSHAKE,
+		Codec:         codec,
+		OnPeer: func(peer Peer) error {
+			serverPeerCh <- peer
+			return nil
+		},
+	}, 8)
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOHANDSHAKE,
+		Codec:         codec,
+		OnPeer: func(peer Peer) error {
+			clientPeerCh <- peer
+			return nil
+		},
+	}, 8)
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+	assert.Nil(t, client.Dial(":5012"))
+	clientPeer := <-clientPeerCh
+	defer clientPeer.Close()
+	serverPeer := <-serverPeerCh
+
+	// The server replies to a FETCH with the key as data, with a not_found ERROR for "missing", and never for "silent"
+	go func() {
+		for msg := range server.Consume() {
+			payload := msg.Payload.(ControlPayload)
+			var reply Message
+			switch key := payload.Args["key"]; key {
+			case "silent":
+				continue
+			case "missing":
+				reply = ConstructErrorMessage(NewRemoteError(ErrorCodeNotFound, "%s not found", key))
+			default:
+				reply = Message{Type: DataMessageType, Payload: DataPayload{Key: key, Data: []byte(key)}}
+			}
+			reply = ConstructReplyMessage(&payload, reply)
+			var frame bytes.Buffer
+			assert.Nil(t, codec.Encode(&frame, &reply))
+			assert.Nil(t, serverPeer.Send(frame.Bytes(), reply.Priority()))
+		}
+	}()
+	fetch := func(key string) Message {
+		return Message{Type: ControlMessageType, Payload: ControlPayload{Command: MESSAGE_FETCH_CONTROL_COMMAND, Args: map[string]string{"key": key}}}
+	}
+
+	// Concurrent calls each get the reply to their own request
+	results := make(chan error, 10)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		go func(key string) {
+			reply, err := client.Call(context.Background(), clientPeer, fetch(key))
+			if err == nil && string(reply.Payload.(DataPayload).Data) != key {
+				err = assert.AnError
+			}
+			results <- err
+		}(key)
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, <-results)
+	}
+
+	// An ERROR reply comes back as a RemoteError
+	_, err := client.Call(context.Background(), clientPeer, fetch("missing"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, "not_found: missing not found", err.Error())
+
+	// A call that gets no reply gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Call(ctx, clientPeer, fetch("silent"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, client.calls.calls)
+}
@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrSendQueueFull   = errors.New("send queue full")
+	ErrSendQueueClosed = errors.New("send queue closed")
+)
+
+// SendPriority denotes which frames are written first, when frames of several priorities are waiting
+type SendPriority int
+
+const (
+	// ControlPriority frames are written ahead of every DataPriority frame waiting to be written
+	ControlPriority SendPriority = iota
+	DataPriority
+)
+
+// SendPolicy denotes what happens to a frame sent to a full SendQueue
+type SendPolicy int
+
+const (
+	// BlockWhenFull makes the sender wait for room in the queue, which pushes back on senders when the peer is slow
+	BlockWhenFull SendPolicy = iota
+	// DropWhenFull fails the send right away with ErrSendQueueFull
+	DropWhenFull
+)
+
+type SendQueueOpts struct {
+	// Capacity is the max number of frames of each priority waiting to be written
+	Capacity int
+	Policy   SendPolicy
+}
+
+type sendRequest struct {
+	frame  []byte
+	result chan error
+}
+
+// SendQueue writes the frames sent to it to w one at a time from a goroutine of its own, so that frames never interleave
+// and a slow w only holds up the senders of that queue
+type SendQueue struct {
+	SendQueueOpts
+	w io.Writer
+	// queues holds the frames waiting to be written, indexed by SendPriority
+	queues    [2]chan *sendRequest
+	closeOnce sync.Once
+	closedCh  chan struct{}
+}
+
+func NewSendQueue(w io.Writer, opts SendQueueOpts) *SendQueue {
+	q := &SendQueue{
+		SendQueueOpts: opts,
+		w:             w,
+		closedCh:      make(chan struct{}),
+	}
+	for i := range q.queues {
+		q.queues[i] = make(chan *sendRequest, opts.Capacity)
+	}
+	go q.writeLoop()
+	return q
+}
+
+// Send queues frame with the given priority, and waits until it was written
+func (q *SendQueue) Send(frame []byte, priority SendPriority) error {
+	req := &sendRequest{frame: frame, result: make(chan error, 1)}
+	queue := q.queues[priority]
+
+	if q.Policy == DropWhenFull {
+		select {
+		case queue <- req:
+		default:
+			return ErrSendQueueFull
+		}
+	} else {
+		select {
+		case queue <- req:
+		case <-q.closedCh:
+			return ErrSendQueueClosed
+		}
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-q.closedCh:
+		// The frame may have been written right before the queue was closed
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return ErrSendQueueClosed
+		}
+	}
+}
+
+// Close stops writing, and fails the sends still waiting
+func (q *SendQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.closedCh)
+	})
+}
+
+// writeLoop writes the queued frames until the queue is closed, control frames first
+func (q *SendQueue) writeLoop() {
+	for {
+		var req *sendRequest
+		select {
+		case req = <-q.queues[ControlPriority]:
+		default:
+			select {
+			case req = <-q.queues[ControlPriority]:
+			case req = <-q.queues[DataPriority]:
+			case <-q.closedCh:
+				return
+			}
+		}
+		_, err := q.w.Write(req.frame)
+		req.result <- err
+	}
+}
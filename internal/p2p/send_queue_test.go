@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedWriter records the frames written to it, and holds up every write until its gate is opened
+type gatedWriter struct {
+	lock    sync.Mutex
+	frames  []string
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{entered: make(chan struct{}, 16), gate: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(b []byte) (int, error) {
+	w.entered <- struct{}{}
+	<-w.gate
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.frames = append(w.frames, string(b))
+	return len(b), nil
+}
+
+func (w *gatedWriter) written() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.frames...)
+}
+
+// fillSendQueue sends the first frame and waits until the writer is held up with it, then queues the rest behind it
+func fillSendQueue(t *testing.T, q *SendQueue, w *gatedWriter, frames []string, priorities []SendPriority) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for i, frame := range frames {
+		wg.Add(1)
+		go func(frame string, priority SendPriority) {
+			defer wg.Done()
+			assert.Nil(t, q.Send([]byte(frame), priority))
+		}(frame, priorities[i])
+
+		if i == 0 {
+			<-w.entered
+			continue
+		}
+		queued := i
+		assert.Eventually(t, func() bool {
+			return len(q.queues[ControlPriority])+len(q.queues[DataPriority]) == queued
+		}, time.Second, time.Millisecond)
+	}
+	return &wg
+}
+
+func TestSendQueueWritesControlFramesFirst(t *testing.T) {
+	w := newGatedWriter()
+	q := NewSendQueue(w, SendQueueOpts{Capacity: 8, Policy: BlockWhenFull})
+	defer q.Close()
+
+	wg := fillSendQueue(t, q, w, []string{"data-1", "data-2", "control"}, []SendPriority{DataPriority, DataPriority, ControlPriority})
+	close(w.gate)
+	wg.Wait()
+	assert.Equal(t, []string{"data-1", "control", "data-2"}, w.written())
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	// With one frame held up in the writer and one waiting in the queue, a dropping queue fails the next send right away
+	w := newGatedWriter()
+	drop := NewSendQueue(w, SendQueueOpts{Capacity: 1, Policy: DropWhenFull})
+	defer drop.Close()
+	wg := fillSendQueue(t, drop, w, []string{"first", "second"}, []SendPriority{DataPriority, DataPriority})
+	assert.ErrorIs(t, drop.Send([]byte("third"), DataPriority), ErrSendQueueFull)
+	close(w.gate)
+	wg.Wait()
+	assert.Equal(t, []string{"first", "second"}, w.written())
+
+	// While a blocking queue holds the sender up, until there is room or the queue is closed
+	w = newGatedWriter()
+	block := NewSendQueue(w, SendQueueOpts{Capacity: 1, Policy: BlockWhenFull})
+	for _, frame := range []string{"first", "second"} {
+		go func(frame string) {
+			_ = block.Send([]byte(frame), DataPriority)
+		}(frame)
+		if frame == "first" {
+			<-w.entered
+		}
+	}
+	blocked := make(chan error)
+	go func() {
+		blocked <- block.Send([]byte("third"), DataPriority)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("send to a full blocking queue returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	block.Close()
+	assert.ErrorIs(t, <-blocked, ErrSendQueueClosed)
+	close(w.gate)
+}
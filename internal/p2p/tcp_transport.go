@@ -1,47 +1,106 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"sync"
 )
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener    net.Listener
 	messageChan chan Message
+	calls       pendingCalls
 }
 
 type TCPTransportOpts struct {
 	ListenAddress string
 	HandshakeFunc doHandshake
-	Codec         Codec
-	OnPeer        func(Peer) error
+	// Codec is the codec proposed to the peers dialed, and answered with to the peers proposing one that isn't known
+	Codec Codec
+	// SendQueue configures the queue that every peer is sent messages through
+	SendQueue SendQueueOpts
+	OnPeer    func(Peer) error
+	// OnPeerDisconnect is called once the connection to a peer accepted by OnPeer has ended
+	OnPeerDisconnect func(Peer)
 }
 
 type TCPPeer struct {
 	net.Conn
 	// for tcp-dial => true, for tcp-accept => false
 	isOutbound bool
-	Wg         *sync.WaitGroup
+	// session multiplexes the connection, so that messages travel on its control stream while transfers get streams of their own
+	session *Session
+	// sendQueue writes the messages sent to the peer onto the control stream
+	sendQueue *SendQueue
+	stats     *PeerStats
+	// codec encodes the messages of the connection, as agreed on with the peer
+	codec Codec
 }
 
-func NewTCPPeer(conn net.Conn, isOutbound bool) *TCPPeer {
+func NewTCPPeer(conn net.Conn, isOutbound bool, sendQueueOpts SendQueueOpts) *TCPPeer {
+	stats := &PeerStats{}
+	stats.Touch()
+	session := NewSession(&statsConn{Conn: conn, stats: stats}, isOutbound)
 	return &TCPPeer{
 		Conn:       conn,
 		isOutbound: isOutbound,
-		Wg:         &sync.WaitGroup{},
+		session:    session,
+		sendQueue:  NewSendQueue(session.Control(), sendQueueOpts),
+		stats:      stats,
+		codec:      &DefaultCodec{},
 	}
 }
 
-// Send implements the Peer interface, and send the given msg bytes to that peer
-func (p *TCPPeer) Send(msg []byte) error {
-	_, err := p.Conn.Write(msg)
-	if err != nil {
-		return err
+// statsConn records that the peer is alive whenever anything is read from its connection, on any stream
+type statsConn struct {
+	net.Conn
+	stats *PeerStats
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stats.Touch()
 	}
-	return nil
+	return n, err
+}
+
+// Read implements the Peer interface, and reads from the control stream of the peer
+func (p *TCPPeer) Read(b []byte) (int, error) {
+	return p.session.Control().Read(b)
+}
+
+// Write implements the Peer interface, and writes b to the control stream of the peer at once, bypassing the send queue
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	return p.session.Control().Write(b)
+}
+
+// Close implements the Peer interface, and closes the connection along with every stream on it
+func (p *TCPPeer) Close() error {
+	p.sendQueue.Close()
+	return p.session.Close()
+}
+
+// OpenStream implements the Peer interface, and opens a new stream to the peer, independent of the control stream
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	return p.session.Open()
+}
+
+// Stats implements the Peer interface, and returns the liveness stats of the peer
+func (p *TCPPeer) Stats() *PeerStats {
+	return p.stats
+}
+
+// Codec implements the Peer interface, and returns the codec the messages of the connection are encoded with
+func (p *TCPPeer) Codec() Codec {
+	return p.codec
+}
+
+// Send implements the Peer interface, and sends the given msg bytes to that peer through its send queue
+func (p *TCPPeer) Send(msg []byte, priority SendPriority) error {
+	return p.sendQueue.Send(msg, priority)
 }
 
 func (p *TCPPeer) String() string {
@@ -62,6 +121,9 @@ func (t *TCPTransport) Consume() <-chan Message {
 
 // Close implements the Transport interface, closes the transport channel and returns err
 func (t *TCPTransport) Close() error {
+	if t.listener == nil {
+		return nil
+	}
 	return t.listener.Close()
 }
 
@@ -77,63 +139,106 @@ func (t *TCPTransport) ListenAndAccept() error {
 	return nil
 }
 
-// Dial implements the Transport interface, dials out to bootstrap nodes and sets them up as part of the network
+// Dial implements the Transport interface, dials out to bootstrap nodes and sets them up as part of the network.
+// The peer is handshaked and handed to OnPeer before Dial returns, so that callers can use it right away.
 func (t *TCPTransport) Dial(nodeAddr string) error {
 	conn, err := net.Dial("tcp", nodeAddr)
 	if err != nil {
 		return err
 	}
-	go t.handleConn(conn, true)
+	return t.handleDialedConn(conn)
+}
+
+// handleDialedConn sets up a connection we dialed, and reads from it in the background until it ends
+func (t *TCPTransport) handleDialedConn(conn net.Conn) error {
+	peer, err := t.setupPeer(conn, true)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	go t.readLoop(peer)
 	return nil
 }
 
 func (t *TCPTransport) accept() {
 	for {
 		conn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			err := fmt.Errorf("TCP Error: Error while accepting connection: %s\n", err)
 			fmt.Println(err.Error())
+			continue
 		}
-		go t.handleConn(conn, false)
+		go t.handleConn(conn)
 	}
 }
 
-func (t *TCPTransport) handleConn(conn net.Conn, isOutbound bool) {
-	var err error
-	defer func() {
-		fmt.Println("Dropping peer connection, connection ending...")
-		err := conn.Close()
-		if err != nil {
-			fmt.Println(fmt.Errorf("Error while closing connection: %s\n", err))
-			return
-		}
-	}()
+// handleConn sets up an accepted connection and reads from it until it ends
+func (t *TCPTransport) handleConn(conn net.Conn) {
+	peer, err := t.setupPeer(conn, false)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	t.readLoop(peer)
+}
 
-	peer := NewTCPPeer(conn, isOutbound)
+// setupPeer handshakes with the peer on conn and hands it to OnPeer
+func (t *TCPTransport) setupPeer(conn net.Conn, isOutbound bool) (*TCPPeer, error) {
+	peer := NewTCPPeer(conn, isOutbound, t.SendQueue)
 	fmt.Println("New connection from peer: " + peer.RemoteAddr().String())
 
-	// Perform handshake and authenticate peer
-	if err = t.HandshakeFunc(peer); err != nil {
+	preferred := t.Codec
+	if preferred == nil {
+		preferred = &DefaultCodec{}
+	}
+	codec, err := negotiateCodec(peer, preferred)
+	if err != nil {
+		fmt.Println("TCP Error: Error while negotiating codec, closing connection to " + peer.RemoteAddr().String())
 		_ = peer.Close()
+		return nil, err
+	}
+	peer.codec = codec
+
+	// Perform handshake and authenticate peer
+	if err := t.HandshakeFunc(peer); err != nil {
 		fmt.Println("TCP Error: Error while handshaking, closing connection to " + peer.RemoteAddr().String())
-		return
+		return nil, err
 	}
 
 	// Call the onPeer on the peer ifc
 	if t.OnPeer != nil {
-		if err = t.OnPeer(peer); err != nil {
+		if err := t.OnPeer(peer); err != nil {
 			fmt.Println("Error while using onPeer, terminating connection")
-			_ = peer.Close()
+			return nil, err
+		}
+	}
+	return peer, nil
+}
+
+// readLoop decodes messages from the control stream of peer into the message channel until the connection ends
+func (t *TCPTransport) readLoop(peer *TCPPeer) {
+	defer func() {
+		fmt.Println("Dropping peer connection, connection ending...")
+		err := peer.Close()
+		if err != nil && !errors.Is(err, ErrSessionClosed) {
+			fmt.Println(fmt.Errorf("Error while closing connection: %s\n", err))
 			return
 		}
+	}()
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
 	}
+	go t.acceptStreams(peer)
 
 	fmt.Println("Entering read loop..." + peer.RemoteAddr().String())
 	// Once authenticated, read messages in read loop
-	msg := Message{}
 	for {
-		// Decode message from conn to msg
-		err := t.Codec.Decode(conn, &msg)
+		// Decode message from the control stream to msg
+		msg := Message{}
+		err := peer.codec.Decode(peer, &msg)
 		//  TODO: Handle abrupt peer disconnect during onPeer func, since it comes to read loop at that point
 		if err != nil {
 			if err == io.EOF {
@@ -144,23 +249,53 @@ func (t *TCPTransport) handleConn(conn net.Conn, isOutbound bool) {
 			return
 		}
 
-		// Set the sender address and forward the message
+		// Replies go straight to the Call waiting for them
 		msg.From = peer.RemoteAddr()
-
-		// Helper to check if it is a STORE Control Message
-		isStoreControlMessage := msg.Type == ControlMessageType && msg.Payload.(ControlPayload).Command == MESSAGE_STORE_CONTROL_COMMAND
-		if isStoreControlMessage {
-			peer.Wg.Add(1)
+		if replyTo, isReply := msg.Arg(ReplyToArg); isReply {
+			if !t.calls.deliver(replyTo, peer, msg) {
+				fmt.Printf("Dropping late %s reply to request %s from %s\n", msg.Command(), replyTo, peer.RemoteAddr().String())
+			}
+			continue
 		}
 
+		// Forward the message. While the message channel is full, nothing more is read from the
+		// control stream, which in turn makes the peer wait for room on it rather than any message being dropped.
 		select {
 		case t.messageChan <- msg:
 			// Message forwarded successfully
-			// After forwarding, wait on file write to finish
-			peer.Wg.Wait()
-		default:
-			fmt.Printf("Warning: Message channel full, dropping message from %s\n",
-				peer.RemoteAddr().String())
+		case <-peer.session.closedCh:
+			return
+		}
+	}
+}
+
+// acceptStreams reads the message that opens each stream the peer opens, and forwards it along with the stream,
+// so that the bytes that follow are read in parallel with the control stream and every other stream
+func (t *TCPTransport) acceptStreams(peer *TCPPeer) {
+	for {
+		stream, err := peer.session.Accept()
+		if err != nil {
+			return
 		}
+		go t.handleStream(peer, stream)
+	}
+}
+
+// handleStream forwards the message that opens stream, or resets the stream if it can't be handled
+func (t *TCPTransport) handleStream(peer *TCPPeer, stream *Stream) {
+	msg := Message{}
+	if err := peer.codec.Decode(stream, &msg); err != nil {
+		fmt.Printf("Error decoding stream message from %s: %v\n", peer.RemoteAddr().String(), err)
+		_ = stream.Reset()
+		return
+	}
+	msg.From = peer.RemoteAddr()
+	msg.Stream = stream
+
+	// The sender waits on the stream anyway, so rather than dropping the message, wait for room in the message channel
+	select {
+	case t.messageChan <- msg:
+	case <-peer.session.closedCh:
+		_ = stream.Reset()
 	}
 }
@@ -1,16 +1,20 @@
 package p2p
 
 import (
+	"bytes"
 	"file-store/internal/util"
 	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTCPTransport(t *testing.T) {
 	tcpOpts := TCPTransportOpts{
 		ListenAddress: ":5000",
 		HandshakeFunc: NOHANDSHAKE,
-		Decoder:       DefaultDecoder{},
+		Codec:         &DefaultCodec{},
 	}
 	tTransport := NewTCPTransport(tcpOpts, util.MessageChanBufferSize)
 
@@ -19,3 +23,149 @@ func TestTCPTransport(t *testing.T) {
 	assert.Nil(t, tTransport.ListenAndAccept())
 
 }
+
+func TestTCPTransportDoesNotDropMessages(t *testing.T) {
+	var (
+		codec  = &DefaultCodec{}
+		peerCh = make(chan Peer, 1)
+	)
+	receiver := NewTCPTransport(TCPTransportOpts{ListenAddress: ":5011", HandshakeFunc: NOHANDSHAKE, Codec: codec}, 1)
+	sender := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOHANDSHAKE,
+		Codec:         codec,
+		SendQueue:     SendQueueOpts{Capacity: 8},
+		OnPeer: func(peer Peer) error {
+			peerCh <- peer
+			return nil
+		},
+	}, 1)
+	assert.Nil(t, receiver.ListenAndAccept())
+	defer receiver.Close()
+	assert.Nil(t, sender.Dial(":5011"))
+	peer := <-peerCh
+	defer peer.Close()
+
+	// Far more messages than the message channel holds are sent, while it is consumed slowly
+	const numMessages = 200
+	go func() {
+		for i := 0; i < numMessages; i++ {
+			msg := ConstructUploadOffsetMessage("upload", "key", int64(i), numMessages)
+			var frame bytes.Buffer
+			assert.Nil(t, codec.Encode(&frame, &msg))
+			assert.Nil(t, peer.Send(frame.Bytes(), ControlPriority))
+		}
+	}()
+	for i := 0; i < numMessages; i++ {
+		if i%50 == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		msg := <-receiver.Consume()
+		assert.Equal(t, strconv.Itoa(i), msg.Payload.(ControlPayload).Args["offset"])
+	}
+}
+
+// unknownCodec is a codec that no peer knows of
+type unknownCodec struct {
+	DefaultCodec
+}
+
+func (c *unknownCodec) Name() string {
+	return "unknown"
+}
+
+func TestTCPTransportNegotiatesCodec(t *testing.T) {
+	receiver := NewTCPTransport(TCPTransportOpts{ListenAddress: ":5013", HandshakeFunc: NOHANDSHAKE, Codec: &DefaultCodec{}}, 1)
+	assert.Nil(t, receiver.ListenAndAccept())
+	defer receiver.Close()
+
+	// The receiver takes the codec the sender proposes if it knows it, and answers with its own otherwise
+	for proposed, agreed := range map[Codec]string{&ProtobufCodec{}: ProtobufCodecName, &unknownCodec{}: GobCodecName} {
+		peerCh := make(chan Peer, 1)
+		sender := NewTCPTransport(TCPTransportOpts{
+			HandshakeFunc: NOHANDSHAKE,
+			Codec:         proposed,
+			OnPeer: func(peer Peer) error {
+				peerCh <- peer
+				return nil
+			},
+		}, 1)
+		assert.Nil(t, sender.Dial(":5013"))
+		peer := <-peerCh
+		assert.Equal(t, agreed, peer.Codec().Name())
+
+		msg := ConstructUploadOffsetMessage("upload", "key", 1, 2)
+		var frame bytes.Buffer
+		assert.Nil(t, peer.Codec().Encode(&frame, &msg))
+		assert.Nil(t, peer.Send(frame.Bytes(), ControlPriority))
+		assert.Equal(t, msg.Payload, (<-receiver.Consume()).Payload)
+		_ = peer.Close()
+	}
+}
+
+func TestTCPTransportSharedSecretHandshake(t *testing.T) {
+	receiver := NewTCPTransport(TCPTransportOpts{ListenAddress: ":5015", HandshakeFunc: SharedSecretHandshake([]byte("secret")), Codec: &DefaultCodec{}}, 1)
+	assert.Nil(t, receiver.ListenAndAccept())
+	defer receiver.Close()
+
+	// Only the peers that know the cluster secret get in
+	for secret, allowed := range map[string]bool{"secret": true, "guess": false} {
+		sender := NewTCPTransport(TCPTransportOpts{HandshakeFunc: SharedSecretHandshake([]byte(secret)), Codec: &DefaultCodec{}}, 1)
+		err := sender.Dial(":5015")
+		if allowed {
+			assert.Nil(t, err)
+		} else {
+			assert.ErrorIs(t, err, ErrInvalidHandshake)
+		}
+		_ = sender.Close()
+	}
+}
+
+func TestTCPTransportDropsPeersThatDontHandshake(t *testing.T) {
+	accepted := make(chan Peer, 1)
+	receiver := NewTCPTransport(TCPTransportOpts{
+		ListenAddress: ":5016",
+		HandshakeFunc: SharedSecretHandshake([]byte("secret")),
+		Codec:         &DefaultCodec{},
+		OnPeer: func(peer Peer) error {
+			accepted <- peer
+			return nil
+		},
+	}, 1)
+	assert.Nil(t, receiver.ListenAndAccept())
+	defer receiver.Close()
+
+	// A node without the cluster secret doesn't handshake at all, so whatever it sends is taken for a proof that doesn't check
+	// out, and the connection is dropped without any message of it getting through. The nonce of the receiver may not make sense
+	// to the sender either, which may drop the connection before it gets to send anything.
+	dialed, dropped := make(chan Peer, 1), make(chan Peer, 1)
+	sender := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOHANDSHAKE,
+		Codec:         &DefaultCodec{},
+		OnPeer: func(peer Peer) error {
+			dialed <- peer
+			return nil
+		},
+		OnPeerDisconnect: func(peer Peer) {
+			dropped <- peer
+		},
+	}, 1)
+	defer sender.Close()
+	assert.Nil(t, sender.Dial(":5016"))
+	peer := <-dialed
+	msg := Message{Type: ControlMessageType, Payload: ControlPayload{Command: MESSAGE_LIST_CONTROL_COMMAND, Args: map[string]string{"key": strings.Repeat("k", 128)}}}
+	var frame bytes.Buffer
+	assert.Nil(t, peer.Codec().Encode(&frame, &msg))
+	_ = peer.Send(frame.Bytes(), ControlPriority)
+
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection of a peer that didn't handshake wasn't dropped")
+	}
+	assert.Empty(t, accepted)
+	select {
+	case received := <-receiver.Consume():
+		t.Fatalf("message of a peer that didn't handshake got through: %v", received)
+	default:
+	}
+}
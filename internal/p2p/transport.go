@@ -1,16 +1,23 @@
 package p2p
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 type Peer interface {
 	net.Conn
-	Send([]byte) error
+	Send([]byte, SendPriority) error
 	String() string
+	Stats() *PeerStats
+	OpenStream() (*Stream, error)
+	Codec() Codec
 }
 
 type Transport interface {
 	Dial(string) error
 	ListenAndAccept() error
 	Consume() <-chan Message
+	Call(context.Context, Peer, Message) (Message, error)
 	Close() error
 }
@@ -0,0 +1,269 @@
+package peers
+
+import (
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dialer opens a connection to the node listening on addr
+type Dialer func(addr string) error
+
+type ManagerOpts struct {
+	// BaseBackoff is the delay before the first retry of a failed dial, doubled on every further failure
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between retries
+	MaxBackoff time.Duration
+	// KnownPeerTTL is how long a peer we were once connected to is reused at startup
+	KnownPeerTTL time.Duration
+	// OnConnected is called whenever a dial by the Manager succeeds
+	OnConnected func(addr string)
+	// HasConnection reports whether there already is a connection to addr that the Manager didn't dial, such as an inbound one.
+	// It is checked before every dial, so that two peers wanting each other don't end up connected twice.
+	HasConnection func(addr string) bool
+}
+
+// target is a peer the Manager keeps a connection to
+type target struct {
+	connected bool
+	attempts  int
+	// wake is signalled when the connection drops, and stop when the target is forgotten
+	wake chan struct{}
+	stop chan struct{}
+}
+
+// Manager keeps connections to the peers it is told to want alive. Failed dials are retried with exponential backoff and
+// jitter, dropped connections are redialed, and every peer connected to is persisted so that it can be dialed on the next start.
+type Manager struct {
+	ManagerOpts
+	dial    Dialer
+	lock    sync.Mutex
+	targets map[string]*target
+	ddb     *db.DDB
+}
+
+func NewManager(opts ManagerOpts, dial Dialer) *Manager {
+	return &Manager{
+		ManagerOpts: opts,
+		dial:        dial,
+		targets:     make(map[string]*target),
+	}
+}
+
+// AttachDB makes the Manager persist the peers it connects to in ddb, and starts wanting the ones persisted by earlier runs
+func (m *Manager) AttachDB(ddb *db.DDB) error {
+	m.lock.Lock()
+	m.ddb = ddb
+	m.lock.Unlock()
+
+	known, err := m.KnownPeers()
+	if err != nil {
+		return err
+	}
+	for _, addr := range known {
+		m.Want(addr)
+	}
+	return nil
+}
+
+// KnownPeers returns the peers connected to within KnownPeerTTL, most recent first, and forgets the older ones
+func (m *Manager) KnownPeers() ([]string, error) {
+	m.lock.Lock()
+	ddb := m.ddb
+	m.lock.Unlock()
+	if ddb == nil {
+		return nil, nil
+	}
+
+	lastSeen := make(map[string]time.Time)
+	var expired []string
+	err := ddb.ForEach(util.KnownPeersBucketName, func(addr string, value []byte) error {
+		seen, err := time.Parse(time.RFC3339, string(value))
+		if err != nil || time.Since(seen) > m.KnownPeerTTL {
+			expired = append(expired, addr)
+			return nil
+		}
+		lastSeen[addr] = seen
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range expired {
+		if err := ddb.Delete(util.KnownPeersBucketName, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	known := make([]string, 0, len(lastSeen))
+	for addr := range lastSeen {
+		known = append(known, addr)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return lastSeen[known[i]].After(lastSeen[known[j]])
+	})
+	return known, nil
+}
+
+// Want makes the Manager keep a connection to the peer listening on addr, dialing it right away if it isn't known yet
+func (m *Manager) Want(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.targets[addr]; exists {
+		return
+	}
+	t := &target{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	m.targets[addr] = t
+	go m.maintain(addr, t)
+}
+
+// Forget stops the Manager from keeping a connection to the peer listening on addr
+func (m *Manager) Forget(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if t, exists := m.targets[addr]; exists {
+		close(t.stop)
+		delete(m.targets, addr)
+	}
+}
+
+// Connected records that there is a connection to the peer listening on addr that the Manager didn't dial, such as an inbound one
+func (m *Manager) Connected(addr string) {
+	m.lock.Lock()
+	t, exists := m.targets[addr]
+	if exists {
+		t.connected = true
+		t.attempts = 0
+	}
+	m.lock.Unlock()
+
+	if exists {
+		m.persist(addr)
+	}
+}
+
+// Disconnected records that the connection to the peer listening on addr dropped, so that it gets redialed
+func (m *Manager) Disconnected(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, exists := m.targets[addr]
+	if !exists {
+		return
+	}
+	t.connected = false
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// IsConnected reports whether the Manager believes there is a connection to the peer listening on addr
+func (m *Manager) IsConnected(addr string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, exists := m.targets[addr]
+	return exists && t.connected
+}
+
+// Close forgets every peer
+func (m *Manager) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for addr, t := range m.targets {
+		close(t.stop)
+		delete(m.targets, addr)
+	}
+}
+
+// maintain dials the peer listening on addr whenever it isn't connected, until it is forgotten
+func (m *Manager) maintain(addr string, t *target) {
+	for {
+		if !m.isConnected(t) && m.HasConnection != nil && m.HasConnection(addr) {
+			m.Connected(addr)
+		}
+		if !m.isConnected(t) {
+			if err := m.dial(addr); err != nil {
+				attempts := m.recordFailure(t)
+				delay := Backoff(attempts, m.BaseBackoff, m.MaxBackoff)
+				log.Printf("Couldn't connect to peer %s (attempt %d), retrying in %s: %v", addr, attempts, delay, err)
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-t.wake:
+					timer.Stop()
+				case <-t.stop:
+					timer.Stop()
+					return
+				}
+				continue
+			}
+			m.lock.Lock()
+			t.connected = true
+			t.attempts = 0
+			m.lock.Unlock()
+			m.persist(addr)
+			if m.OnConnected != nil {
+				m.OnConnected(addr)
+			}
+		}
+
+		select {
+		case <-t.wake:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (m *Manager) isConnected(t *target) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return t.connected
+}
+
+// recordFailure counts a failed dial of t, returning the number of consecutive failures
+func (m *Manager) recordFailure(t *target) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t.attempts++
+	return t.attempts
+}
+
+// persist records that the peer listening on addr was just connected to
+func (m *Manager) persist(addr string) {
+	m.lock.Lock()
+	ddb := m.ddb
+	m.lock.Unlock()
+	if ddb == nil {
+		return
+	}
+	if err := ddb.Put(util.KnownPeersBucketName, addr, []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+		log.Printf("Couldn't persist known peer %s: %v", addr, err)
+	}
+}
+
+// Backoff returns the delay before retrying after the given number of consecutive failures. The delay doubles with every failure
+// up to max, and is then jittered to somewhere between its half and itself, so that nodes restarted together don't retry in lockstep.
+func Backoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	delay := max
+	if attempts < 1 {
+		attempts = 1
+	}
+	if shift := attempts - 1; shift < 32 && base<<shift < max && base<<shift > 0 {
+		delay = base << shift
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -0,0 +1,132 @@
+package peers
+
+import (
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDialer fails the first failures dials of every address, and records all of them
+type flakyDialer struct {
+	lock     sync.Mutex
+	failures int
+	dials    map[string]int
+}
+
+func (d *flakyDialer) dial(addr string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dials[addr]++
+	if d.dials[addr] <= d.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (d *flakyDialer) count(addr string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dials[addr]
+}
+
+// setupManager quickly sets up a Manager with short backoffs over a flakyDialer
+func setupManager(failures int) (*Manager, *flakyDialer) {
+	dialer := &flakyDialer{failures: failures, dials: make(map[string]int)}
+	opts := ManagerOpts{
+		BaseBackoff:  time.Millisecond,
+		MaxBackoff:   5 * time.Millisecond,
+		KnownPeerTTL: time.Hour,
+	}
+	return NewManager(opts, dialer.dial), dialer
+}
+
+func setupDB(t *testing.T) *db.DDB {
+	ddb, err := db.InitDB(filepath.Join(t.TempDir(), "metadata.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	return &ddb
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	for attempts, want := range map[int]time.Duration{1: base, 2: 2 * base, 3: 4 * base, 5: max, 100: max} {
+		for i := 0; i < 20; i++ {
+			delay := Backoff(attempts, base, max)
+			assert.GreaterOrEqual(t, delay, want/2, "attempts %d", attempts)
+			assert.LessOrEqual(t, delay, want, "attempts %d", attempts)
+		}
+	}
+}
+
+func TestWantRetriesUntilConnected(t *testing.T) {
+	manager, dialer := setupManager(3)
+	defer manager.Close()
+
+	manager.Want(util.DefaultListenAddress)
+	assert.Eventually(t, func() bool {
+		return manager.IsConnected(util.DefaultListenAddress)
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 4, dialer.count(util.DefaultListenAddress))
+}
+
+func TestDisconnectedPeerIsRedialed(t *testing.T) {
+	manager, dialer := setupManager(0)
+	defer manager.Close()
+
+	connected := make(chan string, 2)
+	manager.OnConnected = func(addr string) {
+		connected <- addr
+	}
+	manager.Want(util.DefaultListenAddress)
+	assert.Equal(t, util.DefaultListenAddress, <-connected)
+
+	manager.Disconnected(util.DefaultListenAddress)
+	assert.Equal(t, util.DefaultListenAddress, <-connected)
+	assert.Equal(t, 2, dialer.count(util.DefaultListenAddress))
+
+	// A forgotten peer is left alone
+	manager.Forget(util.DefaultListenAddress)
+	manager.Disconnected(util.DefaultListenAddress)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 2, dialer.count(util.DefaultListenAddress))
+	assert.False(t, manager.IsConnected(util.DefaultListenAddress))
+}
+
+func TestKnownPeersAreReusedOnRestart(t *testing.T) {
+	ddb := setupDB(t)
+	manager, _ := setupManager(0)
+	assert.Nil(t, manager.AttachDB(ddb))
+
+	manager.Want(util.DefaultListenAddress)
+	assert.Eventually(t, func() bool {
+		return manager.IsConnected(util.DefaultListenAddress)
+	}, time.Second, time.Millisecond)
+	// An inbound connection from a wanted peer is as good as a dialed one
+	manager.Want("127.0.0.1:5001")
+	manager.Connected("127.0.0.1:5001")
+	manager.Close()
+
+	// Peers not seen within KnownPeerTTL are dropped
+	assert.Nil(t, ddb.Put(util.KnownPeersBucketName, "127.0.0.1:5002", []byte(time.Now().Add(-2*time.Hour).Format(time.RFC3339))))
+
+	restarted, dialer := setupManager(0)
+	defer restarted.Close()
+	assert.Nil(t, restarted.AttachDB(ddb))
+	for _, addr := range []string{util.DefaultListenAddress, "127.0.0.1:5001"} {
+		assert.Eventually(t, func() bool {
+			return restarted.IsConnected(addr)
+		}, time.Second, time.Millisecond)
+	}
+	assert.Zero(t, dialer.count("127.0.0.1:5002"))
+
+	known, err := restarted.KnownPeers()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{util.DefaultListenAddress, "127.0.0.1:5001"}, known)
+}
@@ -0,0 +1,849 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned when a Node that isn't the leader is asked to propose a command or serve a read
+	ErrNotLeader = errors.New("not the raft leader")
+	// ErrShutdown is returned once the Node is stopped
+	ErrShutdown = errors.New("raft node is shut down")
+	// ErrLeadershipLost is returned when the Node stopped being leader before it could tell a proposal or read went through
+	ErrLeadershipLost = errors.New("raft leadership lost")
+)
+
+const (
+	defaultMaxEntriesPerAppend = 256
+	defaultSnapshotChunkSize   = 1024 * 1024
+)
+
+// State is the role a Node plays in its current term
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	return [...]string{"follower", "candidate", "leader"}[s]
+}
+
+type Opts struct {
+	// ElectionTimeout is how long a follower waits to hear from a leader before it stands for election. The actual
+	// timeout is picked at random between it and twice it, so that candidates rarely split the vote.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader reaches out to every follower, even with nothing to replicate
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many applied entries the log may hold before it is compacted into a snapshot
+	SnapshotThreshold uint64
+	// MaxEntriesPerAppend is how many entries a single AppendEntries carries at most
+	MaxEntriesPerAppend int
+	// SnapshotChunkSize is how many bytes of the snapshot a single InstallSnapshot carries at most
+	SnapshotChunkSize int
+}
+
+// Entry is a command in the replicated log. Entries without a command are the no-ops a new leader appends.
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// StateMachine is what the committed commands of the log are applied to, in log order, on every node
+type StateMachine interface {
+	// Apply applies cmd and returns the result of it to hand to whoever proposed it
+	Apply(cmd []byte) []byte
+	// Snapshot returns the state of the machine, for the log to be compacted
+	Snapshot() ([]byte, error)
+	// Restore replaces the state of the machine with a snapshot of it, or with the empty state when it is nil
+	Restore(snapshot []byte) error
+}
+
+// Status reports the state of a Node
+type Status struct {
+	ID            string   `json:"id"`
+	State         string   `json:"state"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader"`
+	Peers         []string `json:"peers"`
+	LastIndex     uint64   `json:"last_index"`
+	CommitIndex   uint64   `json:"commit_index"`
+	LastApplied   uint64   `json:"last_applied"`
+	SnapshotIndex uint64   `json:"snapshot_index"`
+}
+
+type proposal struct {
+	term   uint64
+	result chan proposalResult
+}
+
+type proposalResult struct {
+	value []byte
+	err   error
+}
+
+// Node is a member of a Raft cluster with a fixed set of peers. It elects a leader among them, replicates the commands
+// proposed to the leader to a majority before applying them to its StateMachine, and compacts its log into snapshots.
+type Node struct {
+	Opts
+	id        string
+	peers     []string
+	transport Transport
+	storage   *Storage
+	fsm       StateMachine
+
+	lock     sync.Mutex
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	// entries holds the log, starting with a sentinel for the index and term of the latest snapshot
+	entries     []Entry
+	snapshot    []byte
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	proposals   map[uint64]proposal
+	deadline    time.Time
+	// changed is closed and replaced whenever the state, commit index or last applied index change
+	changed chan struct{}
+	// leaderStop is closed once the Node stops leading the term it was elected for
+	leaderStop chan struct{}
+	// pending holds the chunks received so far of a snapshot being installed
+	pending []byte
+
+	// applyLock is held while entries are applied to the StateMachine, or it is restored from a snapshot
+	applyLock sync.Mutex
+	peerLocks map[string]*sync.Mutex
+	// replicate wakes up the replication to a peer when there are new entries for it
+	replicate map[string]chan struct{}
+	applyCh   chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewNode returns the Node id of a cluster made of it and its peers, loading whatever storage persisted of it before
+func NewNode(opts Opts, id string, peers []string, transport Transport, storage *Storage, fsm StateMachine) (*Node, error) {
+	n := &Node{
+		Opts:      opts,
+		id:        id,
+		transport: transport,
+		storage:   storage,
+		fsm:       fsm,
+		entries:   []Entry{{}},
+		proposals: make(map[uint64]proposal),
+		changed:   make(chan struct{}),
+		peerLocks: make(map[string]*sync.Mutex),
+		replicate: make(map[string]chan struct{}),
+		applyCh:   make(chan struct{}, 1),
+	}
+	if n.MaxEntriesPerAppend <= 0 {
+		n.MaxEntriesPerAppend = defaultMaxEntriesPerAppend
+	}
+	if n.SnapshotChunkSize <= 0 {
+		n.SnapshotChunkSize = defaultSnapshotChunkSize
+	}
+	for _, peer := range peers {
+		if peer != id {
+			n.peers = append(n.peers, peer)
+			n.peerLocks[peer] = &sync.Mutex{}
+			n.replicate[peer] = make(chan struct{}, 1)
+		}
+	}
+
+	var err error
+	if n.term, n.votedFor, err = storage.LoadState(); err != nil {
+		return nil, fmt.Errorf("failed to load raft state: %w", err)
+	}
+	snapshot, err := storage.LoadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft snapshot: %w", err)
+	}
+	if snapshot != nil {
+		n.entries[0] = Entry{Index: snapshot.Index, Term: snapshot.Term}
+		n.snapshot = snapshot.Data
+	}
+	entries, err := storage.LoadEntries(n.entries[0].Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft log: %w", err)
+	}
+	n.entries = append(n.entries, entries...)
+	n.commitIndex = n.entries[0].Index
+	n.lastApplied = n.entries[0].Index
+	return n, nil
+}
+
+// Start restores the StateMachine from the latest snapshot and starts taking part in elections
+func (n *Node) Start() error {
+	if err := n.fsm.Restore(n.snapshot); err != nil {
+		return fmt.Errorf("failed to restore raft snapshot: %w", err)
+	}
+	n.lock.Lock()
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.resetDeadline()
+	n.lock.Unlock()
+	n.wg.Add(2)
+	go n.runElectionTimer()
+	go n.runApplier()
+	return nil
+}
+
+// Stop stops the Node, failing the proposals still waiting to be applied with ErrShutdown
+func (n *Node) Stop() {
+	n.lock.Lock()
+	if n.cancel == nil {
+		n.lock.Unlock()
+		return
+	}
+	n.cancel()
+	n.stepDown(n.term)
+	for index, waiting := range n.proposals {
+		waiting.result <- proposalResult{err: ErrShutdown}
+		delete(n.proposals, index)
+	}
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+// Leader returns the id of the current leader, or "" when none is known
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leader
+}
+
+// Status returns the Status of the Node
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return Status{
+		ID:            n.id,
+		State:         n.state.String(),
+		Term:          n.term,
+		Leader:        n.leader,
+		Peers:         append([]string(nil), n.peers...),
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.entries[0].Index,
+	}
+}
+
+// Propose appends cmd to the log, and once it is committed and applied returns the result the StateMachine gave.
+// ErrNotLeader is returned right away when the Node isn't the leader.
+func (n *Node) Propose(ctx context.Context, cmd []byte) ([]byte, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("raft command is empty")
+	}
+	n.lock.Lock()
+	if n.state != Leader {
+		n.lock.Unlock()
+		return nil, ErrNotLeader
+	}
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: cmd}
+	if err := n.append(entry); err != nil {
+		n.lock.Unlock()
+		return nil, err
+	}
+	waiting := proposal{term: n.term, result: make(chan proposalResult, 1)}
+	n.proposals[entry.Index] = waiting
+	n.lock.Unlock()
+
+	select {
+	case result := <-waiting.result:
+		return result.value, result.err
+	case <-ctx.Done():
+		n.lock.Lock()
+		delete(n.proposals, entry.Index)
+		n.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// ReadIndex returns once the StateMachine of the leader reflects every command committed before it was called, so that
+// a read served from it right after is linearizable. ErrNotLeader is returned right away when the Node isn't the leader.
+func (n *Node) ReadIndex(ctx context.Context) error {
+	// A new leader only knows what was committed before it once an entry of its own term is
+	n.lock.Lock()
+	for {
+		if n.state != Leader {
+			n.lock.Unlock()
+			return ErrNotLeader
+		}
+		if n.termAt(n.commitIndex) == n.term {
+			break
+		}
+		if err := n.waitChange(ctx); err != nil {
+			return err
+		}
+	}
+	readIndex, term := n.commitIndex, n.term
+	n.lock.Unlock()
+
+	// And it only is still the leader if a majority still hears from it
+	acks := make(chan bool, len(n.peers))
+	for _, peer := range n.peers {
+		go func(peer string) {
+			acks <- n.replicateTo(peer, term)
+		}(peer)
+	}
+	votes := 1
+	for responses := 0; votes < n.majority() && responses < len(n.peers); responses++ {
+		if <-acks {
+			votes++
+		}
+	}
+	if votes < n.majority() {
+		return ErrLeadershipLost
+	}
+
+	n.lock.Lock()
+	for n.lastApplied < readIndex {
+		if err := n.waitChange(ctx); err != nil {
+			return err
+		}
+	}
+	n.lock.Unlock()
+	return nil
+}
+
+// waitChange releases the lock until something changes or ctx is done, and takes it back only if it returns nil
+func (n *Node) waitChange(ctx context.Context) error {
+	changed := n.changed
+	n.lock.Unlock()
+	select {
+	case <-changed:
+		n.lock.Lock()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.ctx.Done():
+		return ErrShutdown
+	}
+}
+
+// notify wakes up everyone waiting for a change
+func (n *Node) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.entries[len(n.entries)-1].Index
+}
+
+// termAt returns the term of the entry at index, which must be in the log or be the index of the snapshot
+func (n *Node) termAt(index uint64) uint64 {
+	return n.entries[index-n.entries[0].Index].Term
+}
+
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(n.ElectionTimeout + time.Duration(rand.Int63n(int64(n.ElectionTimeout))))
+}
+
+func (n *Node) setTerm(term uint64, votedFor string) error {
+	n.term, n.votedFor = term, votedFor
+	return n.storage.SaveState(term, votedFor)
+}
+
+// append appends entries to the log and persists them
+func (n *Node) append(entries ...Entry) error {
+	if err := n.storage.AppendEntries(entries, n.lastIndex()+1, n.lastIndex()); err != nil {
+		return err
+	}
+	n.entries = append(n.entries, entries...)
+	n.signal()
+	return nil
+}
+
+// signal wakes up the replication of the leader, or commits right away when there is no one to replicate to
+func (n *Node) signal() {
+	if n.state != Leader {
+		return
+	}
+	if len(n.peers) == 0 {
+		n.advanceCommit()
+	}
+	for _, wake := range n.replicate {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stepDown makes the Node a follower in term, forgetting its vote if the term is a new one
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		if err := n.setTerm(term, ""); err != nil {
+			log.Printf("Failed to persist raft term %d: %v\n", term, err)
+		}
+		n.leader = ""
+	}
+	if n.state == Leader {
+		close(n.leaderStop)
+		n.leader = ""
+	}
+	if n.state != Follower {
+		n.state = Follower
+		n.notify()
+	}
+}
+
+func (n *Node) runElectionTimer() {
+	defer n.wg.Done()
+	for {
+		n.lock.Lock()
+		wait := time.Until(n.deadline)
+		if n.state == Leader {
+			wait = n.ElectionTimeout
+		}
+		n.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-n.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		n.lock.Lock()
+		if n.state != Leader && !time.Now().Before(n.deadline) {
+			n.startElection()
+		}
+		n.lock.Unlock()
+	}
+}
+
+// startElection stands for election in a new term, asking every peer for its vote
+func (n *Node) startElection() {
+	if err := n.setTerm(n.term+1, n.id); err != nil {
+		log.Printf("Failed to persist raft term %d: %v\n", n.term, err)
+		return
+	}
+	n.state = Candidate
+	n.leader = ""
+	n.resetDeadline()
+	n.notify()
+	if len(n.peers) == 0 {
+		n.becomeLeader()
+		return
+	}
+
+	req := RequestVoteRequest{Term: n.term, CandidateID: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.termAt(n.lastIndex())}
+	votes := 1
+	for _, peer := range n.peers {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(n.ctx, n.ElectionTimeout)
+			defer cancel()
+			resp, err := n.transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if n.ctx.Err() != nil {
+				return
+			}
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.state != Candidate || n.term != req.Term || !resp.VoteGranted {
+				return
+			}
+			if votes++; votes >= n.majority() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader makes the Node the leader of its term and starts replicating its log to every peer
+func (n *Node) becomeLeader() {
+	log.Printf("Raft node %s is the leader of term %d\n", n.id, n.term)
+	n.state = Leader
+	n.leader = n.id
+	n.leaderStop = make(chan struct{})
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.wg.Add(1)
+		go n.runReplicator(peer, n.term, n.leaderStop)
+	}
+	n.notify()
+	// The entries of past terms can only be committed along with one of this term
+	if err := n.append(Entry{Index: n.lastIndex() + 1, Term: n.term}); err != nil {
+		log.Printf("Failed to append the raft entry of term %d: %v\n", n.term, err)
+	}
+}
+
+// runReplicator keeps peer up to date with the log for as long as the Node leads term
+func (n *Node) runReplicator(peer string, term uint64, stop chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		n.replicateTo(peer, term)
+		select {
+		case <-stop:
+			return
+		case <-n.ctx.Done():
+			return
+		case <-n.replicate[peer]:
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicateTo sends peer what it misses of the log, or a heartbeat, until it is up to date or something fails.
+// It returns whether peer acknowledged the Node as the leader of term.
+func (n *Node) replicateTo(peer string, term uint64) bool {
+	n.peerLocks[peer].Lock()
+	defer n.peerLocks[peer].Unlock()
+	acked := false
+	for {
+		n.lock.Lock()
+		if n.state != Leader || n.term != term {
+			n.lock.Unlock()
+			return false
+		}
+		next := n.nextIndex[peer]
+		if next <= n.entries[0].Index {
+			snapshot := InstallSnapshotRequest{Term: term, LeaderID: n.id, LastIncludedIndex: n.entries[0].Index, LastIncludedTerm: n.entries[0].Term}
+			data := n.snapshot
+			n.lock.Unlock()
+			if !n.sendSnapshot(peer, snapshot, data) {
+				return acked
+			}
+			acked = true
+			continue
+		}
+		req := AppendEntriesRequest{Term: term, LeaderID: n.id, PrevLogIndex: next - 1, PrevLogTerm: n.termAt(next - 1), LeaderCommit: n.commitIndex}
+		last := min(n.lastIndex(), next-1+uint64(n.MaxEntriesPerAppend))
+		req.Entries = append(req.Entries, n.entries[next-n.entries[0].Index:last-n.entries[0].Index+1]...)
+		n.lock.Unlock()
+
+		ctx, cancel := context.WithTimeout(n.ctx, n.ElectionTimeout)
+		resp, err := n.transport.AppendEntries(ctx, peer, req)
+		cancel()
+		if err != nil {
+			return acked
+		}
+
+		n.lock.Lock()
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+			n.lock.Unlock()
+			return false
+		}
+		if n.state != Leader || n.term != term {
+			n.lock.Unlock()
+			return false
+		}
+		acked = true
+		if !resp.Success {
+			n.nextIndex[peer] = max(1, min(resp.ConflictIndex, next-1))
+			n.lock.Unlock()
+			continue
+		}
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+		upToDate := match >= n.lastIndex() && req.LeaderCommit >= n.commitIndex
+		n.lock.Unlock()
+		if upToDate {
+			return true
+		}
+	}
+}
+
+// sendSnapshot sends the snapshot of the log to peer, chunk by chunk, and returns whether it was installed
+func (n *Node) sendSnapshot(peer string, req InstallSnapshotRequest, data []byte) bool {
+	for {
+		end := min(uint64(len(data)), req.Offset+uint64(n.SnapshotChunkSize))
+		req.Data = data[req.Offset:end]
+		req.Done = end == uint64(len(data))
+
+		ctx, cancel := context.WithTimeout(n.ctx, n.ElectionTimeout)
+		resp, err := n.transport.InstallSnapshot(ctx, peer, req)
+		cancel()
+		if err != nil {
+			return false
+		}
+		n.lock.Lock()
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+		}
+		if n.state != Leader || n.term != req.Term {
+			n.lock.Unlock()
+			return false
+		}
+		if req.Done {
+			n.matchIndex[peer] = max(n.matchIndex[peer], req.LastIncludedIndex)
+			n.nextIndex[peer] = req.LastIncludedIndex + 1
+			n.lock.Unlock()
+			return true
+		}
+		n.lock.Unlock()
+		req.Offset = end
+	}
+}
+
+// advanceCommit commits the latest entry of the current term that a majority holds, along with every one before it
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		holders := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				holders++
+			}
+		}
+		if holders >= n.majority() {
+			n.commit(index)
+			return
+		}
+	}
+}
+
+func (n *Node) commit(index uint64) {
+	n.commitIndex = index
+	n.notify()
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// runApplier applies the committed entries to the StateMachine, hands the results to their proposals, and takes a
+// snapshot whenever the log grows past SnapshotThreshold
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.applyCh:
+		}
+		n.applyCommitted()
+	}
+}
+
+func (n *Node) applyCommitted() {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	n.lock.Lock()
+	first := n.entries[0].Index
+	entries := append([]Entry(nil), n.entries[n.lastApplied-first+1:n.commitIndex-first+1]...)
+	n.lock.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	results := make([][]byte, len(entries))
+	for i, entry := range entries {
+		if entry.Command != nil {
+			results[i] = n.fsm.Apply(entry.Command)
+		}
+	}
+
+	n.lock.Lock()
+	for i, entry := range entries {
+		if waiting, ok := n.proposals[entry.Index]; ok {
+			if waiting.term == entry.Term {
+				waiting.result <- proposalResult{value: results[i]}
+			} else {
+				waiting.result <- proposalResult{err: ErrLeadershipLost}
+			}
+			delete(n.proposals, entry.Index)
+		}
+	}
+	n.lastApplied = entries[len(entries)-1].Index
+	n.notify()
+	compact := n.lastApplied-n.entries[0].Index >= n.SnapshotThreshold
+	n.lock.Unlock()
+
+	if compact {
+		if err := n.takeSnapshot(); err != nil {
+			log.Printf("Failed to take a raft snapshot: %v\n", err)
+		}
+	}
+}
+
+// takeSnapshot compacts the applied entries of the log into a snapshot of the StateMachine. The applyLock must be held.
+func (n *Node) takeSnapshot() error {
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	first := n.entries[0].Index
+	snapshot := Snapshot{Index: n.lastApplied, Term: n.termAt(n.lastApplied), Data: data}
+	if err := n.storage.SaveSnapshot(snapshot, first+1, snapshot.Index); err != nil {
+		return err
+	}
+	n.entries = append([]Entry{{Index: snapshot.Index, Term: snapshot.Term}}, n.entries[snapshot.Index-first+1:]...)
+	n.snapshot = data
+	return nil
+}
+
+// HandleRequestVote grants the vote of the Node to a candidate whose log is at least as up to date as its own, unless
+// it already voted for someone else in the term
+func (n *Node) HandleRequestVote(req RequestVoteRequest) (RequestVoteResponse, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	resp := RequestVoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.CandidateID) {
+		return resp, nil
+	}
+	lastTerm := n.termAt(n.lastIndex())
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.lastIndex()) {
+		return resp, nil
+	}
+	if err := n.setTerm(n.term, req.CandidateID); err != nil {
+		return resp, err
+	}
+	n.resetDeadline()
+	resp.VoteGranted = true
+	return resp, nil
+}
+
+// HandleAppendEntries appends the entries the leader sent to the log, once the log matches the leader's up to them
+func (n *Node) HandleAppendEntries(req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.followLeader(req.Term, req.LeaderID) {
+		return AppendEntriesResponse{Term: n.term}, nil
+	}
+	resp := AppendEntriesResponse{Term: n.term}
+
+	// The entries up to the snapshot are committed, so they match the leader's anyway
+	first := n.entries[0].Index
+	if req.PrevLogIndex < first {
+		skip := min(uint64(len(req.Entries)), first-req.PrevLogIndex)
+		req.Entries = req.Entries[skip:]
+		req.PrevLogIndex, req.PrevLogTerm = first, n.entries[0].Term
+	}
+	if req.PrevLogIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term := n.termAt(req.PrevLogIndex); term != req.PrevLogTerm {
+		// Skip back over the whole term that conflicts rather than one entry at a time
+		resp.ConflictIndex = req.PrevLogIndex
+		for resp.ConflictIndex > first+1 && n.termAt(resp.ConflictIndex-1) == term {
+			resp.ConflictIndex--
+		}
+		return resp, nil
+	}
+
+	for i, entry := range req.Entries {
+		if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+			continue
+		}
+		if err := n.storage.AppendEntries(req.Entries[i:], entry.Index, n.lastIndex()); err != nil {
+			return resp, err
+		}
+		n.entries = append(n.entries[:entry.Index-first], req.Entries[i:]...)
+		break
+	}
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commit(min(req.LeaderCommit, last))
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// HandleInstallSnapshot receives a chunk of the leader's snapshot, and once it has all of them replaces the state of the
+// StateMachine with it, along with the part of the log it covers
+func (n *Node) HandleInstallSnapshot(req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.followLeader(req.Term, req.LeaderID) {
+		return InstallSnapshotResponse{Term: n.term}, nil
+	}
+	resp := InstallSnapshotResponse{Term: n.term}
+	if req.Offset == 0 {
+		n.pending = nil
+	}
+	if req.Offset != uint64(len(n.pending)) {
+		return resp, fmt.Errorf("raft snapshot chunk at %d doesn't follow the %d bytes received", req.Offset, len(n.pending))
+	}
+	n.pending = append(n.pending, req.Data...)
+	if !req.Done {
+		return resp, nil
+	}
+	data := n.pending
+	n.pending = nil
+	if req.LastIncludedIndex <= n.lastApplied {
+		return resp, nil
+	}
+
+	// The entries past the snapshot are kept if the log agrees with it, otherwise the whole log goes
+	first, last := n.entries[0].Index, n.lastIndex()
+	snapshot := Snapshot{Index: req.LastIncludedIndex, Term: req.LastIncludedTerm, Data: data}
+	kept := []Entry{{Index: snapshot.Index, Term: snapshot.Term}}
+	compactTo := last
+	if snapshot.Index < last && n.termAt(snapshot.Index) == snapshot.Term {
+		kept = append(kept, n.entries[snapshot.Index-first+1:]...)
+		compactTo = snapshot.Index
+	}
+	if err := n.fsm.Restore(data); err != nil {
+		return resp, err
+	}
+	if err := n.storage.SaveSnapshot(snapshot, first+1, compactTo); err != nil {
+		return resp, err
+	}
+	n.entries = kept
+	n.snapshot = data
+	for index, waiting := range n.proposals {
+		if index <= snapshot.Index {
+			waiting.result <- proposalResult{err: ErrLeadershipLost}
+			delete(n.proposals, index)
+		}
+	}
+	n.lastApplied = snapshot.Index
+	n.commitIndex = max(n.commitIndex, snapshot.Index)
+	n.notify()
+	return resp, nil
+}
+
+// followLeader returns whether a request of leader in term is to be followed, and if so makes the Node its follower
+func (n *Node) followLeader(term uint64, leader string) bool {
+	if term < n.term {
+		return false
+	}
+	n.stepDown(term)
+	if n.leader != leader {
+		n.leader = leader
+		n.notify()
+	}
+	n.resetDeadline()
+	return true
+}
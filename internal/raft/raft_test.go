@@ -0,0 +1,310 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// memoryTransport delivers the RPCs between the nodes of a test cluster in memory, unless either end is cut off
+type memoryTransport struct {
+	lock  sync.Mutex
+	nodes map[string]*Node
+	cut   map[string]bool
+}
+
+func (t *memoryTransport) node(from string, to string) (*Node, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.cut[from] || t.cut[to] || t.nodes[to] == nil {
+		return nil, errUnreachable
+	}
+	return t.nodes[to], nil
+}
+
+// from returns the Transport that the node id sends its RPCs through
+func (t *memoryTransport) from(id string) Transport {
+	return &memoryEndpoint{network: t, id: id}
+}
+
+type memoryEndpoint struct {
+	network *memoryTransport
+	id      string
+}
+
+func (e *memoryEndpoint) RequestVote(_ context.Context, peer string, req RequestVoteRequest) (RequestVoteResponse, error) {
+	node, err := e.network.node(e.id, peer)
+	if err != nil {
+		return RequestVoteResponse{}, err
+	}
+	return node.HandleRequestVote(req)
+}
+
+func (e *memoryEndpoint) AppendEntries(_ context.Context, peer string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	node, err := e.network.node(e.id, peer)
+	if err != nil {
+		return AppendEntriesResponse{}, err
+	}
+	return node.HandleAppendEntries(req)
+}
+
+func (e *memoryEndpoint) InstallSnapshot(_ context.Context, peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	node, err := e.network.node(e.id, peer)
+	if err != nil {
+		return InstallSnapshotResponse{}, err
+	}
+	return node.HandleInstallSnapshot(req)
+}
+
+// listMachine appends every command applied to a list, and returns the length of the list as the result
+type listMachine struct {
+	lock    sync.Mutex
+	applied []string
+}
+
+func (m *listMachine) Apply(cmd []byte) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.applied = append(m.applied, string(cmd))
+	return []byte(fmt.Sprint(len(m.applied)))
+}
+
+func (m *listMachine) Snapshot() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return json.Marshal(m.applied)
+}
+
+func (m *listMachine) Restore(snapshot []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.applied = nil
+	if snapshot == nil {
+		return nil
+	}
+	return json.Unmarshal(snapshot, &m.applied)
+}
+
+func (m *listMachine) list() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.applied...)
+}
+
+type testCluster struct {
+	t        *testing.T
+	network  *memoryTransport
+	ids      []string
+	dirs     map[string]string
+	nodes    map[string]*Node
+	machines map[string]*listMachine
+	ddbs     map[string]*db.DDB
+	opts     Opts
+}
+
+func newTestCluster(t *testing.T, size int, opts Opts) *testCluster {
+	c := &testCluster{
+		t:        t,
+		network:  &memoryTransport{nodes: make(map[string]*Node), cut: make(map[string]bool)},
+		dirs:     make(map[string]string),
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*listMachine),
+		ddbs:     make(map[string]*db.DDB),
+		opts:     opts,
+	}
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		c.ids = append(c.ids, id)
+		c.dirs[id] = t.TempDir()
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.ids {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts the node id on whatever it persisted before
+func (c *testCluster) start(id string) {
+	ddb, err := db.InitDB(filepath.Join(c.dirs[id], "metadata.db"))
+	assert.Nil(c.t, err)
+	machine := &listMachine{}
+	node, err := NewNode(c.opts, id, c.ids, c.network.from(id), NewStorage(&ddb), machine)
+	assert.Nil(c.t, err)
+	c.network.lock.Lock()
+	c.network.nodes[id] = node
+	c.network.lock.Unlock()
+	c.nodes[id] = node
+	c.machines[id] = machine
+	c.ddbs[id] = &ddb
+	assert.Nil(c.t, node.Start())
+}
+
+// stop stops the node id, if it is running
+func (c *testCluster) stop(id string) {
+	if c.ddbs[id] == nil {
+		return
+	}
+	c.network.lock.Lock()
+	delete(c.network.nodes, id)
+	c.network.lock.Unlock()
+	c.nodes[id].Stop()
+	assert.Nil(c.t, c.ddbs[id].Close())
+	delete(c.ddbs, id)
+}
+
+func (c *testCluster) setCut(id string, cut bool) {
+	c.network.lock.Lock()
+	defer c.network.lock.Unlock()
+	c.network.cut[id] = cut
+}
+
+// waitLeader waits until one of the nodes that aren't cut off leads, and returns its id
+func (c *testCluster) waitLeader() string {
+	var leader string
+	assert.Eventually(c.t, func() bool {
+		for _, id := range c.ids {
+			c.network.lock.Lock()
+			reachable := !c.network.cut[id] && c.network.nodes[id] != nil
+			c.network.lock.Unlock()
+			if reachable && c.nodes[id].Status().State == Leader.String() {
+				leader = id
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (c *testCluster) propose(id string, cmd string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return c.nodes[id].Propose(ctx, []byte(cmd))
+}
+
+// waitApplied waits until every node in ids applied exactly the commands in want
+func (c *testCluster) waitApplied(want []string, ids ...string) {
+	for _, id := range ids {
+		assert.Eventually(c.t, func() bool {
+			return assert.ObjectsAreEqual(want, c.machines[id].list())
+		}, 5*time.Second, 10*time.Millisecond, "node %s applied %v", id, c.machines[id].list())
+	}
+}
+
+var testOpts = Opts{
+	ElectionTimeout:   100 * time.Millisecond,
+	HeartbeatInterval: 20 * time.Millisecond,
+	SnapshotThreshold: 1000,
+}
+
+func TestElectAndReplicate(t *testing.T) {
+	cluster := newTestCluster(t, 3, testOpts)
+	leader := cluster.waitLeader()
+	for _, id := range cluster.ids {
+		if id != leader {
+			_, err := cluster.propose(id, "refused")
+			assert.ErrorIs(t, err, ErrNotLeader)
+		}
+	}
+
+	for i, cmd := range []string{"a", "b", "c"} {
+		result, err := cluster.propose(leader, cmd)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint(i+1), string(result))
+	}
+	cluster.waitApplied([]string{"a", "b", "c"}, cluster.ids...)
+	assert.Nil(t, cluster.nodes[leader].ReadIndex(context.Background()))
+	for _, id := range cluster.ids {
+		assert.Equal(t, leader, cluster.nodes[id].Leader())
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	cluster := newTestCluster(t, 3, testOpts)
+	leader := cluster.waitLeader()
+	_, err := cluster.propose(leader, "before")
+	assert.Nil(t, err)
+
+	// A leader cut off from the others can't commit nor serve reads, and they elect another one
+	cluster.setCut(leader, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = cluster.nodes[leader].Propose(ctx, []byte("lost"))
+	assert.NotNil(t, err)
+	assert.NotNil(t, cluster.nodes[leader].ReadIndex(ctx))
+	newLeader := cluster.waitLeader()
+	assert.NotEqual(t, leader, newLeader)
+	_, err = cluster.propose(newLeader, "after")
+	assert.Nil(t, err)
+
+	// Once back, the old leader drops what it couldn't commit and catches up with the others
+	cluster.setCut(leader, false)
+	cluster.waitApplied([]string{"before", "after"}, cluster.ids...)
+}
+
+func TestLaggingFollowerCatchesUpFromSnapshot(t *testing.T) {
+	opts := testOpts
+	opts.SnapshotThreshold = 5
+	opts.SnapshotChunkSize = 16
+	cluster := newTestCluster(t, 3, opts)
+	leader := cluster.waitLeader()
+	var lagging string
+	for _, id := range cluster.ids {
+		if id != leader {
+			lagging = id
+		}
+	}
+
+	cluster.setCut(lagging, true)
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprint("cmd-", i))
+		_, err := cluster.propose(leader, want[i])
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, cluster.nodes[leader].Status().SnapshotIndex, uint64(0))
+
+	cluster.setCut(lagging, false)
+	cluster.waitApplied(want, cluster.ids...)
+	assert.Greater(t, cluster.nodes[lagging].Status().SnapshotIndex, uint64(0))
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	opts := testOpts
+	opts.SnapshotThreshold = 4
+	cluster := newTestCluster(t, 3, opts)
+	leader := cluster.waitLeader()
+	var want []string
+	for i := 0; i < 6; i++ {
+		want = append(want, fmt.Sprint("cmd-", i))
+		_, err := cluster.propose(leader, want[i])
+		assert.Nil(t, err)
+	}
+	cluster.waitApplied(want, cluster.ids...)
+
+	// Every node restarts on the term, log and snapshot it persisted
+	for _, id := range cluster.ids {
+		cluster.stop(id)
+	}
+	for _, id := range cluster.ids {
+		cluster.start(id)
+	}
+	leader = cluster.waitLeader()
+	_, err := cluster.propose(leader, "after restart")
+	assert.Nil(t, err)
+	cluster.waitApplied(append(want, "after restart"), cluster.ids...)
+}
@@ -0,0 +1,55 @@
+package raft
+
+import "context"
+
+// RequestVoteRequest is sent by a candidate to ask for the vote of a peer
+type RequestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RequestVoteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+// AppendEntriesRequest is sent by the leader to replicate its log, and with no entries as a heartbeat
+type AppendEntriesRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should retry from when the follower's log doesn't match PrevLogIndex
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+// InstallSnapshotRequest carries one chunk of the leader's snapshot to a follower that lags behind its log
+type InstallSnapshotRequest struct {
+	Term              uint64 `json:"term"`
+	LeaderID          string `json:"leader_id"`
+	LastIncludedIndex uint64 `json:"last_included_index"`
+	LastIncludedTerm  uint64 `json:"last_included_term"`
+	Offset            uint64 `json:"offset"`
+	Data              []byte `json:"data"`
+	Done              bool   `json:"done"`
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport sends the RPCs of a Node to its peers, which are identified by their ids
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, req RequestVoteRequest) (RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, req AppendEntriesRequest) (AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error)
+}
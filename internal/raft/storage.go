@@ -0,0 +1,129 @@
+package raft
+
+import (
+	"encoding/json"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"fmt"
+	"strconv"
+)
+
+const (
+	stateKey    = "state"
+	snapshotKey = "snapshot"
+)
+
+// Snapshot is the state of the StateMachine once every entry up to Index was applied
+type Snapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// Storage persists the term, vote, log and snapshot of a Node in the metadata DB
+type Storage struct {
+	ddb *db.DDB
+}
+
+func NewStorage(ddb *db.DDB) *Storage {
+	return &Storage{ddb: ddb}
+}
+
+// entryKey returns the key the entry at index is saved under, zero padded so that the log is kept in order
+func entryKey(index uint64) string {
+	return fmt.Sprintf("%020d", index)
+}
+
+// LoadState returns the current term and the vote cast in it, if any
+func (s *Storage) LoadState() (uint64, string, error) {
+	encoded, err := s.ddb.Get(util.RaftStateBucketName, stateKey)
+	if err != nil || encoded == nil {
+		return 0, "", err
+	}
+	var state persistentState
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		return 0, "", err
+	}
+	return state.Term, state.VotedFor, nil
+}
+
+// SaveState saves the current term and the vote cast in it
+func (s *Storage) SaveState(term uint64, votedFor string) error {
+	encoded, err := json.Marshal(persistentState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return s.ddb.Put(util.RaftStateBucketName, stateKey, encoded)
+}
+
+// LoadSnapshot returns the latest snapshot saved, or nil if there is none
+func (s *Storage) LoadSnapshot() (*Snapshot, error) {
+	encoded, err := s.ddb.Get(util.RaftStateBucketName, snapshotKey)
+	if err != nil || encoded == nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(encoded, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// SaveSnapshot saves snapshot, then removes the log entries from..to that it replaces
+func (s *Storage) SaveSnapshot(snapshot Snapshot, from uint64, to uint64) error {
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := s.ddb.Put(util.RaftStateBucketName, snapshotKey, encoded); err != nil {
+		return err
+	}
+	var deletes []string
+	for index := from; index <= to; index++ {
+		deletes = append(deletes, entryKey(index))
+	}
+	return s.ddb.Batch(util.RaftLogBucketName, nil, deletes)
+}
+
+// LoadEntries returns the entries of the log that come after index, in order
+func (s *Storage) LoadEntries(after uint64) ([]Entry, error) {
+	var entries []Entry
+	err := s.ddb.ForEach(util.RaftLogBucketName, func(key string, value []byte) error {
+		index, err := strconv.ParseUint(key, 10, 64)
+		if err != nil || index <= after {
+			return nil
+		}
+		var entry Entry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		if entry.Index != after+uint64(len(entries))+1 {
+			return fmt.Errorf("raft log has a gap before entry %d", entry.Index)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// AppendEntries removes the entries of the log from truncateFrom to lastIndex, then appends entries, in one transaction
+func (s *Storage) AppendEntries(entries []Entry, truncateFrom uint64, lastIndex uint64) error {
+	var deletes []string
+	for index := truncateFrom; index <= lastIndex; index++ {
+		deletes = append(deletes, entryKey(index))
+	}
+	puts := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		puts[entryKey(entry.Index)] = encoded
+	}
+	return s.ddb.Batch(util.RaftLogBucketName, puts, deletes)
+}
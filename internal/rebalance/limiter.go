@@ -0,0 +1,73 @@
+package rebalance
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter paces the bytes sent by a rebalance to a rate, so that it doesn't starve the traffic of clients.
+// A nil Limiter doesn't limit anything.
+type Limiter struct {
+	bytesPerSecond int64
+	lock           sync.Mutex
+	next           time.Time
+}
+
+// NewLimiter returns a Limiter letting bytesPerSecond bytes through every second, or nil if bytesPerSecond <= 0
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{bytesPerSecond: bytesPerSecond}
+}
+
+// WaitN waits until n more bytes may be sent, or until ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns a reader of r whose reads are paced by the Limiter
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, limiter: l, r: r}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	limiter *Limiter
+	r       io.Reader
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
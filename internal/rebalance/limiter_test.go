@@ -0,0 +1,53 @@
+package rebalance
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimiterPacesReads(t *testing.T) {
+	limiter := NewLimiter(10 * 1024)
+	data := bytes.Repeat([]byte("x"), 3*1024)
+
+	start := time.Now()
+	read, err := io.ReadAll(limiter.Reader(context.Background(), bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+	// The first read goes through right away, and the rest wait for their turn
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, limiter.WaitN(ctx, 10*1024), context.Canceled)
+}
+
+func TestNilLimiterDoesntLimit(t *testing.T) {
+	var limiter *Limiter = NewLimiter(0)
+	assert.Nil(t, limiter)
+	assert.Nil(t, limiter.WaitN(context.Background(), 1<<30))
+	r := bytes.NewReader(nil)
+	assert.Equal(t, io.Reader(r), limiter.Reader(context.Background(), r))
+}
+
+func TestTrackerReportsProgress(t *testing.T) {
+	var tracker Tracker
+	transfers := []Transfer{{Key: "a", To: "node", Size: 10}, {Key: "b", To: "node", Size: 20}}
+	tracker.Start(transfers)
+	tracker.Done(transfers[0], nil)
+	tracker.Done(transfers[1], io.ErrUnexpectedEOF)
+
+	progress := tracker.Progress()
+	assert.True(t, progress.Running)
+	assert.Equal(t, 2, progress.Planned)
+	assert.Equal(t, 1, progress.Transferred)
+	assert.Equal(t, 1, progress.Failed)
+	assert.Equal(t, int64(30), progress.BytesPlanned)
+	assert.Equal(t, int64(10), progress.BytesTransferred)
+
+	tracker.Finish()
+	assert.False(t, tracker.Progress().Running)
+}
@@ -0,0 +1,76 @@
+package rebalance
+
+import (
+	"file-store/internal/dht"
+	"sort"
+)
+
+// Owners returns the n nodes, by listen address, that own key, nearest to it first. The owners of a key are the nodes whose
+// NodeID is nearest to its KeyID by XOR distance, like the DHT measures it. If n <= 0, or there are no more than n nodes, every
+// node owns every key.
+func Owners(key string, nodes []string, n int) []string {
+	keyID := dht.KeyID(key)
+	distances := make(map[string]dht.NodeID, len(nodes))
+	owners := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		distances[node] = dht.NewNodeID(node).Distance(keyID)
+		owners = append(owners, node)
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return distances[owners[i]].Less(distances[owners[j]])
+	})
+	if n > 0 && n < len(owners) {
+		owners = owners[:n]
+	}
+	return owners
+}
+
+// Transfer is a file that has to be sent to a node which now owns it
+type Transfer struct {
+	Key string
+	// To is the listen address of the node the file is sent to
+	To   string
+	Size int64
+}
+
+// Plan computes the transfers self has to make of the files it holds, which map keys to their sizes, as the nodes of the cluster
+// change from oldNodes to newNodes with n owners per key. Every node that now owns a key, but didn't before, is sent it by the
+// nearest previous owner still in the cluster, so that only one node sends it. If every previous owner is gone, every node left
+// holding the key sends it.
+func Plan(self string, held map[string]int64, oldNodes []string, newNodes []string, n int) []Transfer {
+	present := make(map[string]bool, len(newNodes))
+	for _, node := range newNodes {
+		present[node] = true
+	}
+
+	var transfers []Transfer
+	for key, size := range held {
+		var survivors []string
+		for _, owner := range Owners(key, oldNodes, n) {
+			if present[owner] {
+				survivors = append(survivors, owner)
+			}
+		}
+		if len(survivors) > 0 && survivors[0] != self {
+			continue
+		}
+		hadIt := make(map[string]bool, len(survivors)+1)
+		for _, owner := range survivors {
+			hadIt[owner] = true
+		}
+		hadIt[self] = true
+		for _, owner := range Owners(key, newNodes, n) {
+			if !hadIt[owner] {
+				transfers = append(transfers, Transfer{Key: key, To: owner, Size: size})
+			}
+		}
+	}
+	// Send the files in a stable order, so that progress reads the same on every run
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].Key != transfers[j].Key {
+			return transfers[i].Key < transfers[j].Key
+		}
+		return transfers[i].To < transfers[j].To
+	})
+	return transfers
+}
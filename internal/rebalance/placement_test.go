@@ -0,0 +1,85 @@
+package rebalance
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func nodeAddrs(n int) []string {
+	var nodes []string
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, fmt.Sprintf("127.0.0.1:%d", 7001+i))
+	}
+	return nodes
+}
+
+func TestOwnersArePickedByDistance(t *testing.T) {
+	nodes := nodeAddrs(5)
+	owners := Owners("key", nodes, 2)
+	assert.Len(t, owners, 2)
+	// Every node agrees on the owners, whatever order it knows the nodes in
+	reversed := []string{nodes[4], nodes[3], nodes[2], nodes[1], nodes[0]}
+	assert.Equal(t, owners, Owners("key", reversed, 2))
+	// The owners of a key only change if one of them goes, or a nearer node comes
+	for _, owner := range Owners("key", append(nodes, "127.0.0.1:9999"), 2) {
+		assert.Contains(t, append(owners, "127.0.0.1:9999"), owner)
+	}
+
+	assert.ElementsMatch(t, nodes, Owners("key", nodes, 0))
+	assert.ElementsMatch(t, nodes[:2], Owners("key", nodes[:2], 3))
+}
+
+func TestPlanSendsEachNewOwnerTheKeyOnce(t *testing.T) {
+	oldNodes := nodeAddrs(3)
+	newNodes := nodeAddrs(4)
+	held := make(map[string]int64)
+	for i := 0; i < 50; i++ {
+		held[fmt.Sprintf("key-%d", i)] = int64(i)
+	}
+
+	// Every node holds every key, so each transfer is planned by exactly one of them
+	received := make(map[Transfer]int)
+	for _, self := range oldNodes {
+		for _, transfer := range Plan(self, held, oldNodes, newNodes, 2) {
+			received[transfer]++
+		}
+	}
+	for key, size := range held {
+		before, after := Owners(key, oldNodes, 2), Owners(key, newNodes, 2)
+		for _, owner := range after {
+			expected := 1
+			if owner == before[0] || owner == before[1] {
+				expected = 0
+			}
+			assert.Equal(t, expected, received[Transfer{Key: key, To: owner, Size: size}], "%s to %s", key, owner)
+		}
+	}
+}
+
+func TestPlanReplicatesKeysOfGoneNodes(t *testing.T) {
+	oldNodes := nodeAddrs(4)
+	newNodes := oldNodes[:3]
+	held := map[string]int64{}
+	for i := 0; len(held) < 10; i++ {
+		// Only keys the gone node owned lose a replica
+		if key := fmt.Sprintf("key-%d", i); Owners(key, oldNodes, 2)[0] == oldNodes[3] {
+			held[key] = 1
+		}
+	}
+
+	for key := range held {
+		survivor := Owners(key, oldNodes, 2)[1]
+		transfers := Plan(survivor, map[string]int64{key: 1}, oldNodes, newNodes, 2)
+		assert.Len(t, transfers, 1)
+		assert.NotEqual(t, survivor, transfers[0].To)
+		assert.Contains(t, Owners(key, newNodes, 2), transfers[0].To)
+	}
+
+	// Once every owner is gone, whoever is left holding the key sends it
+	transfers := Plan(newNodes[0], map[string]int64{"key": 1}, []string{"gone-1", "gone-2"}, newNodes, 2)
+	for _, transfer := range transfers {
+		assert.NotEqual(t, newNodes[0], transfer.To)
+	}
+	assert.NotEmpty(t, transfers)
+}
@@ -0,0 +1,61 @@
+package rebalance
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress reports how far the latest rebalance got
+type Progress struct {
+	Running          bool      `json:"running"`
+	StartedAt        time.Time `json:"started_at"`
+	FinishedAt       time.Time `json:"finished_at,omitempty"`
+	Planned          int       `json:"planned"`
+	Transferred      int       `json:"transferred"`
+	Failed           int       `json:"failed"`
+	BytesPlanned     int64     `json:"bytes_planned"`
+	BytesTransferred int64     `json:"bytes_transferred"`
+}
+
+// Tracker keeps the Progress of the latest rebalance, and is safe for concurrent use
+type Tracker struct {
+	lock     sync.Mutex
+	progress Progress
+}
+
+// Start records that a rebalance making the given transfers started
+func (t *Tracker) Start(transfers []Transfer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progress = Progress{Running: true, StartedAt: time.Now(), Planned: len(transfers)}
+	for _, transfer := range transfers {
+		t.progress.BytesPlanned += transfer.Size
+	}
+}
+
+// Done records that transfer is over, having failed with err if it isn't nil
+func (t *Tracker) Done(transfer Transfer, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		t.progress.Failed++
+		return
+	}
+	t.progress.Transferred++
+	t.progress.BytesTransferred += transfer.Size
+}
+
+// Finish records that the rebalance is over
+func (t *Tracker) Finish() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progress.Running = false
+	t.progress.FinishedAt = time.Now()
+}
+
+// Progress returns the Progress of the latest rebalance
+func (t *Tracker) Progress() Progress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.progress
+}
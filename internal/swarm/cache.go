@@ -0,0 +1,49 @@
+package swarm
+
+import "sync"
+
+// ManifestCache keeps the manifests of the files served lately, so that a file isn't hashed again for every page of its
+// Manifest, nor for every swarm fetch of it. Every Manifest is kept along with the version of the file it was built from, and is
+// only served for that version.
+type ManifestCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]cachedManifest
+	// order holds the keys cached, oldest first, which are evicted in that order once the cache is full
+	order []string
+}
+
+// cachedManifest is a Manifest along with the version of the file it was built from
+type cachedManifest struct {
+	version  string
+	manifest *Manifest
+}
+
+func NewManifestCache(capacity int) *ManifestCache {
+	return &ManifestCache{capacity: max(1, capacity), entries: make(map[string]cachedManifest)}
+}
+
+// Get returns the Manifest cached for the given version of the file of key, if any
+func (c *ManifestCache) Get(key string, version string) (*Manifest, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, exists := c.entries[key]
+	if !exists || cached.version != version {
+		return nil, false
+	}
+	return cached.manifest, true
+}
+
+// Put caches the Manifest of the given version of the file of key, in place of the one of any other version
+func (c *ManifestCache) Put(key string, version string, manifest *Manifest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.entries[key]; !exists {
+		if len(c.order) >= c.capacity {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = cachedManifest{version: version, manifest: manifest}
+}
@@ -0,0 +1,148 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrNoPeers = errors.New("no peers to download from")
+
+// ChunkFetcher fetches the chunk at index of the file from the peer with the given address
+type ChunkFetcher func(ctx context.Context, peerAddr string, index int) ([]byte, error)
+
+// DownloaderOpts configures how a Downloader spreads chunk requests over peers
+type DownloaderOpts struct {
+	// ParallelChunksPerPeer is the max number of chunk requests in flight to a single peer
+	ParallelChunksPerPeer int
+	// MaxChunkRetries is the number of times a chunk is retried on another peer before the download fails
+	MaxChunkRetries int
+}
+
+// Downloader fetches the chunks of a file from several peers in parallel, and reassembles them in order
+type Downloader struct {
+	DownloaderOpts
+	Manifest *Manifest
+	Peers    []string
+	Fetch    ChunkFetcher
+}
+
+// chunkResult is the outcome of fetching a single chunk from a single peer
+type chunkResult struct {
+	index    int
+	peerAddr string
+	data     []byte
+	err      error
+}
+
+func NewDownloader(opts DownloaderOpts, manifest *Manifest, peers []string, fetch ChunkFetcher) *Downloader {
+	if opts.ParallelChunksPerPeer <= 0 {
+		opts.ParallelChunksPerPeer = 1
+	}
+	return &Downloader{
+		DownloaderOpts: opts,
+		Manifest:       manifest,
+		Peers:          peers,
+		Fetch:          fetch,
+	}
+}
+
+// Download fetches every chunk of the file and returns the reassembled content.
+// Each chunk is verified against the Manifest, and a chunk that fails on one peer is retried on another.
+func (d *Downloader) Download(ctx context.Context) ([]byte, error) {
+	if len(d.Peers) == 0 {
+		return nil, ErrNoPeers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		content  = make([]byte, d.Manifest.Size)
+		pending  = make([]int, 0, d.Manifest.NumChunks())
+		attempts = make(map[int]int)
+		// failedOn tracks the peers each chunk has failed on, so that its retry goes elsewhere
+		failedOn  = make(map[int]map[string]bool)
+		inFlight  = make(map[string]int)
+		remaining = d.Manifest.NumChunks()
+		results   = make(chan chunkResult)
+	)
+	for i := 0; i < d.Manifest.NumChunks(); i++ {
+		pending = append(pending, i)
+		failedOn[i] = make(map[string]bool)
+	}
+
+	// assign hands out pending chunks to peers with free slots, skipping peers a chunk already failed on
+	var assign = func() error {
+		var unassigned []int
+		for _, index := range pending {
+			peerAddr, ok := d.pickPeer(inFlight, failedOn[index])
+			if !ok {
+				if len(failedOn[index]) >= len(d.Peers) {
+					return fmt.Errorf("chunk %d failed on every peer", index)
+				}
+				unassigned = append(unassigned, index)
+				continue
+			}
+			inFlight[peerAddr]++
+			go func(index int, peerAddr string) {
+				data, err := d.Fetch(ctx, peerAddr, index)
+				select {
+				case results <- chunkResult{index: index, peerAddr: peerAddr, data: data, err: err}:
+				case <-ctx.Done():
+				}
+			}(index, peerAddr)
+		}
+		pending = unassigned
+		return nil
+	}
+
+	for remaining > 0 {
+		if err := assign(); err != nil {
+			return nil, err
+		}
+		var result chunkResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		inFlight[result.peerAddr]--
+
+		if result.err == nil && !d.Manifest.VerifyChunk(result.index, result.data) {
+			result.err = fmt.Errorf("chunk %d from %s failed verification", result.index, result.peerAddr)
+		}
+		if result.err != nil {
+			log.Printf("Swarm: %v", result.err)
+			attempts[result.index]++
+			if attempts[result.index] > d.MaxChunkRetries {
+				return nil, fmt.Errorf("chunk %d failed after %d attempts: %w", result.index, attempts[result.index], result.err)
+			}
+			failedOn[result.index][result.peerAddr] = true
+			pending = append(pending, result.index)
+			continue
+		}
+
+		offset, _ := d.Manifest.ChunkRange(result.index)
+		copy(content[offset:], result.data)
+		remaining--
+	}
+	return content, nil
+}
+
+// pickPeer returns the least loaded peer with a free slot that isn't in exclude
+func (d *Downloader) pickPeer(inFlight map[string]int, exclude map[string]bool) (string, bool) {
+	var (
+		picked string
+		found  bool
+	)
+	for _, peerAddr := range d.Peers {
+		if exclude[peerAddr] || inFlight[peerAddr] >= d.ParallelChunksPerPeer {
+			continue
+		}
+		if !found || inFlight[peerAddr] < inFlight[picked] {
+			picked, found = peerAddr, true
+		}
+	}
+	return picked, found
+}
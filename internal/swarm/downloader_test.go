@@ -0,0 +1,79 @@
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// setupDownload builds the manifest of the large test content, and a fetcher serving it through serve
+func setupDownload(t *testing.T, serve func(peerAddr string, data []byte) ([]byte, error)) ([]byte, *Manifest, ChunkFetcher) {
+	data := []byte(util.DefaultLargeFileContent)
+	manifest, err := BuildManifest(bytes.NewReader(data), 64)
+	assert.Nil(t, err)
+
+	fetch := func(ctx context.Context, peerAddr string, index int) ([]byte, error) {
+		offset, length := manifest.ChunkRange(index)
+		return serve(peerAddr, data[offset:offset+length])
+	}
+	return data, manifest, fetch
+}
+
+func TestDownloadSpreadsChunksOverPeers(t *testing.T) {
+	var (
+		servedLock sync.Mutex
+		served     = make(map[string]int)
+	)
+	data, manifest, fetch := setupDownload(t, func(peerAddr string, data []byte) ([]byte, error) {
+		servedLock.Lock()
+		served[peerAddr]++
+		servedLock.Unlock()
+		return data, nil
+	})
+
+	downloader := NewDownloader(DownloaderOpts{ParallelChunksPerPeer: 2, MaxChunkRetries: 1}, manifest, []string{"a", "b", "c"}, fetch)
+	content, err := downloader.Download(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+
+	assert.Len(t, served, 3)
+	total := 0
+	for _, count := range served {
+		total += count
+	}
+	assert.Equal(t, manifest.NumChunks(), total)
+}
+
+func TestDownloadRetriesBadChunksOnAnotherPeer(t *testing.T) {
+	data, manifest, fetch := setupDownload(t, func(peerAddr string, data []byte) ([]byte, error) {
+		switch peerAddr {
+		case "corrupt":
+			return append([]byte("x"), data[1:]...), nil
+		case "down":
+			return nil, errors.New("connection refused")
+		}
+		return data, nil
+	})
+
+	downloader := NewDownloader(DownloaderOpts{ParallelChunksPerPeer: 4, MaxChunkRetries: 2}, manifest, []string{"corrupt", "down", "good"}, fetch)
+	content, err := downloader.Download(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+}
+
+func TestDownloadFailsWhenEveryPeerFails(t *testing.T) {
+	_, manifest, fetch := setupDownload(t, func(peerAddr string, data []byte) ([]byte, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	downloader := NewDownloader(DownloaderOpts{MaxChunkRetries: 5}, manifest, []string{"a", "b"}, fetch)
+	_, err := downloader.Download(context.Background())
+	assert.NotNil(t, err)
+
+	_, err = NewDownloader(DownloaderOpts{}, manifest, nil, fetch).Download(context.Background())
+	assert.ErrorIs(t, err, ErrNoPeers)
+}
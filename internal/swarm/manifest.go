@@ -0,0 +1,223 @@
+package swarm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Manifest describes how a file is split into fixed size chunks, along with the hash of every chunk
+type Manifest struct {
+	Size        int64
+	ChunkSize   int64
+	ChunkHashes []string
+	// root is the Root of the Manifest, kept once it is built so that it isn't hashed again for every page sent
+	root string
+}
+
+// BuildManifest reads r till EOF and builds the Manifest of its content for the given chunkSize
+func BuildManifest(r io.Reader, chunkSize int64) (*Manifest, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	manifest := &Manifest{ChunkSize: chunkSize}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			manifest.Size += int64(n)
+			manifest.ChunkHashes = append(manifest.ChunkHashes, hashChunk(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			manifest.root = manifest.Root()
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Limits bound the Manifests accepted from peers, which are checked before anything is allocated for the file they describe
+type Limits struct {
+	// MaxChunkSize is the largest chunk accepted
+	MaxChunkSize int64
+	// MaxSize is the largest file accepted
+	MaxSize int64
+}
+
+// check returns an error unless a file of size bytes, in chunks of chunkSize bytes, is within l
+func (l Limits) check(size int64, chunkSize int64) error {
+	if size < 0 || size > l.MaxSize {
+		return fmt.Errorf("manifest size %d is beyond the max of %d", size, l.MaxSize)
+	}
+	if chunkSize <= 0 || chunkSize > l.MaxChunkSize {
+		return fmt.Errorf("manifest chunk size %d is beyond the max of %d", chunkSize, l.MaxChunkSize)
+	}
+	return nil
+}
+
+// Validate returns an error unless m is within limits, and its chunks add up to its size
+func (m *Manifest) Validate(limits Limits) error {
+	if err := limits.check(m.Size, m.ChunkSize); err != nil {
+		return err
+	}
+	chunks := int64(m.NumChunks())
+	if m.Size > chunks*m.ChunkSize || (chunks > 0 && m.Size <= (chunks-1)*m.ChunkSize) {
+		return fmt.Errorf("manifest of %d chunks of %d bytes doesn't add up to %d bytes", chunks, m.ChunkSize, m.Size)
+	}
+	return nil
+}
+
+// NumChunks returns the number of chunks the file is split into
+func (m *Manifest) NumChunks() int {
+	return len(m.ChunkHashes)
+}
+
+// ChunkRange returns the offset and length of the chunk at index within the file
+func (m *Manifest) ChunkRange(index int) (int64, int64) {
+	offset := int64(index) * m.ChunkSize
+	length := m.ChunkSize
+	if offset+length > m.Size {
+		length = m.Size - offset
+	}
+	return offset, length
+}
+
+// VerifyChunk reports whether data is the content of the chunk at index
+func (m *Manifest) VerifyChunk(index int, data []byte) bool {
+	if index < 0 || index >= m.NumChunks() {
+		return false
+	}
+	_, length := m.ChunkRange(index)
+	return int64(len(data)) == length && hashChunk(data) == m.ChunkHashes[index]
+}
+
+// Equal reports whether both manifests describe the same content
+func (m *Manifest) Equal(other *Manifest) bool {
+	if m.Size != other.Size || m.ChunkSize != other.ChunkSize || len(m.ChunkHashes) != len(other.ChunkHashes) {
+		return false
+	}
+	for i := range m.ChunkHashes {
+		if m.ChunkHashes[i] != other.ChunkHashes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Root returns the hash that the whole Manifest is checked against, once its pages are put back together
+func (m *Manifest) Root() string {
+	if m.root != "" {
+		return m.root
+	}
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%d/%d/", m.Size, m.ChunkSize)
+	_, _ = io.WriteString(hash, strings.Join(m.ChunkHashes, ","))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// NumPages returns how many pages of pageSize chunk hashes the Manifest is sent in, which is at least one
+func (m *Manifest) NumPages(pageSize int) int {
+	return max(1, (m.NumChunks()+pageSize-1)/pageSize)
+}
+
+// ToArgs encodes the given page of the Manifest into control message args. Every page holds pageSize of the chunk hashes, the last
+// one aside, along with the size, chunk size and Root of the whole Manifest, so that a Manifest of any size is sent in messages
+// of a bounded size.
+func (m *Manifest) ToArgs(page int, pageSize int) map[string]string {
+	from := min(page*pageSize, m.NumChunks())
+	to := min(from+pageSize, m.NumChunks())
+	return map[string]string{
+		"size":         strconv.FormatInt(m.Size, 10),
+		"chunk_size":   strconv.FormatInt(m.ChunkSize, 10),
+		"root":         m.Root(),
+		"page":         strconv.Itoa(page),
+		"chunk_hashes": strings.Join(m.ChunkHashes[from:to], ","),
+	}
+}
+
+// ManifestPage is a page of the chunk hashes of a Manifest, as encoded by ToArgs
+type ManifestPage struct {
+	Size        int64
+	ChunkSize   int64
+	Root        string
+	Page        int
+	ChunkHashes []string
+}
+
+// NumChunks returns the number of chunks of the whole Manifest that p is a page of
+func (p *ManifestPage) NumChunks() int {
+	return int((p.Size + p.ChunkSize - 1) / p.ChunkSize)
+}
+
+// PageFromArgs decodes a ManifestPage from control message args, as encoded by ToArgs
+func PageFromArgs(args map[string]string) (*ManifestPage, error) {
+	size, err := strconv.ParseInt(args["size"], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid manifest size %q", args["size"])
+	}
+	chunkSize, err := strconv.ParseInt(args["chunk_size"], 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid manifest chunk size %q", args["chunk_size"])
+	}
+	page, err := strconv.Atoi(args["page"])
+	if err != nil || page < 0 {
+		return nil, fmt.Errorf("invalid manifest page %q", args["page"])
+	}
+	p := &ManifestPage{Size: size, ChunkSize: chunkSize, Root: args["root"], Page: page}
+	if hashes := args["chunk_hashes"]; hashes != "" {
+		p.ChunkHashes = strings.Split(hashes, ",")
+	}
+	if p.Root == "" {
+		return nil, errors.New("manifest has no root")
+	}
+	return p, nil
+}
+
+// PageFetcher fetches the given page of a Manifest
+type PageFetcher func(page int) (*ManifestPage, error)
+
+// AssembleManifest puts the Manifest that first is the first page of back together, fetching the pages after it with fetch, and
+// checks it against the Root of first. A Manifest beyond limits is rejected before its pages are fetched.
+func AssembleManifest(first *ManifestPage, limits Limits, fetch PageFetcher) (*Manifest, error) {
+	if first.Page != 0 {
+		return nil, fmt.Errorf("manifest starts at page %d", first.Page)
+	}
+	if err := limits.check(first.Size, first.ChunkSize); err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{Size: first.Size, ChunkSize: first.ChunkSize, ChunkHashes: first.ChunkHashes}
+	expected := first.NumChunks()
+	for page := 1; manifest.NumChunks() < expected; page++ {
+		next, err := fetch(page)
+		if err != nil {
+			return nil, fmt.Errorf("manifest page %d: %w", page, err)
+		}
+		if next.Page != page || next.Root != first.Root || len(next.ChunkHashes) == 0 {
+			return nil, fmt.Errorf("manifest page %d doesn't follow page %d", next.Page, page-1)
+		}
+		manifest.ChunkHashes = append(manifest.ChunkHashes, next.ChunkHashes...)
+	}
+	if manifest.NumChunks() != expected {
+		return nil, fmt.Errorf("manifest has %d chunk hashes, expected %d", manifest.NumChunks(), expected)
+	}
+	if err := manifest.Validate(limits); err != nil {
+		return nil, err
+	}
+	if manifest.Root() != first.Root {
+		return nil, errors.New("manifest doesn't match its root")
+	}
+	manifest.root = first.Root
+	return manifest, nil
+}
+
+// hashChunk returns the hex encoded sha256 hash of data
+func hashChunk(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
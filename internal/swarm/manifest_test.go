@@ -0,0 +1,144 @@
+package swarm
+
+import (
+	"bytes"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBuildManifest(t *testing.T) {
+	data := []byte(util.DefaultLargeFileContent)
+	manifest, err := BuildManifest(bytes.NewReader(data), 100)
+	assert.Nil(t, err)
+
+	assert.Equal(t, int64(len(data)), manifest.Size)
+	assert.Equal(t, (len(data)+99)/100, manifest.NumChunks())
+
+	// The last chunk only holds what is left over
+	offset, length := manifest.ChunkRange(manifest.NumChunks() - 1)
+	assert.Equal(t, int64(len(data)), offset+length)
+	assert.True(t, manifest.VerifyChunk(manifest.NumChunks()-1, data[offset:]))
+	assert.False(t, manifest.VerifyChunk(0, data[1:101]))
+}
+
+var (
+	// testLimits are the Limits of the manifests of the tests, which have chunks of 100 bytes
+	testLimits = Limits{MaxChunkSize: 100, MaxSize: 1 << 20}
+	// defaultLimits are the Limits that manifests fetched in swarm mode are checked against
+	defaultLimits = Limits{MaxChunkSize: util.DefaultSwarmChunkSize, MaxSize: util.SwarmMaxFileSize}
+)
+
+// pagesOf returns a PageFetcher serving the pages of manifest
+func pagesOf(manifest *Manifest, pageSize int) PageFetcher {
+	return func(page int) (*ManifestPage, error) {
+		return PageFromArgs(manifest.ToArgs(page, pageSize))
+	}
+}
+
+func TestManifestArgsRoundTrip(t *testing.T) {
+	manifest, err := BuildManifest(bytes.NewReader([]byte(util.DefaultLargeFileContent)), 100)
+	assert.Nil(t, err)
+	assert.Greater(t, manifest.NumPages(2), 1)
+
+	first, err := PageFromArgs(manifest.ToArgs(0, 2))
+	assert.Nil(t, err)
+	decoded, err := AssembleManifest(first, testLimits, pagesOf(manifest, 2))
+	assert.Nil(t, err)
+	assert.True(t, manifest.Equal(decoded))
+
+	// Pages of another manifest, or a first page that lies about the size, don't add up to the root
+	other, err := BuildManifest(bytes.NewReader([]byte(util.DefaultLargeFileContent+"!")), 100)
+	assert.Nil(t, err)
+	_, err = AssembleManifest(first, testLimits, pagesOf(other, 2))
+	assert.NotNil(t, err)
+	args := manifest.ToArgs(0, 2)
+	args["size"] = "150"
+	first, err = PageFromArgs(args)
+	assert.Nil(t, err)
+	_, err = AssembleManifest(first, testLimits, pagesOf(manifest, 2))
+	assert.NotNil(t, err)
+}
+
+func TestManifestsBeyondTheLimitsAreRejected(t *testing.T) {
+	manifest, err := BuildManifest(bytes.NewReader([]byte(util.DefaultLargeFileContent)), 100)
+	assert.Nil(t, err)
+	assert.Nil(t, manifest.Validate(testLimits))
+
+	// Manifests whose root checks out, but that describe a file too large, or of a size its chunks don't add up to, are
+	// rejected, the ones beyond the limits before any of their pages are fetched
+	for name, tampered := range map[string]*Manifest{
+		"huge":     {Size: 1 << 60, ChunkSize: 1 << 60, ChunkHashes: manifest.ChunkHashes[:1]},
+		"negative": {Size: -1, ChunkSize: 100},
+		"chunks":   {Size: 50, ChunkSize: 100, ChunkHashes: manifest.ChunkHashes[:2]},
+		"short":    {Size: manifest.Size + 100, ChunkSize: 100, ChunkHashes: manifest.ChunkHashes},
+	} {
+		tampered.root = tampered.Root()
+		assert.NotNil(t, tampered.Validate(testLimits), name)
+		first, err := PageFromArgs(tampered.ToArgs(0, 2))
+		if err != nil {
+			continue
+		}
+		fetched := false
+		_, err = AssembleManifest(first, testLimits, func(page int) (*ManifestPage, error) {
+			fetched = true
+			return PageFromArgs(tampered.ToArgs(page, 2))
+		})
+		assert.NotNil(t, err, name)
+		if name == "huge" {
+			assert.False(t, fetched, name)
+		}
+	}
+}
+
+func TestManifestPagesStayBoundedForLargeFiles(t *testing.T) {
+	// A 1 GiB file in chunks of the default size, whose manifest alone would be over 4 MiB if it were sent whole
+	manifest := &Manifest{Size: 1 << 30, ChunkSize: util.DefaultSwarmChunkSize}
+	for i := 0; i < int(manifest.Size/manifest.ChunkSize); i++ {
+		manifest.ChunkHashes = append(manifest.ChunkHashes, hashChunk([]byte{byte(i), byte(i >> 8)}))
+	}
+	manifest.root = manifest.Root()
+	for page := 0; page < manifest.NumPages(util.SwarmManifestPageSize); page++ {
+		size := 0
+		for name, value := range manifest.ToArgs(page, util.SwarmManifestPageSize) {
+			size += len(name) + len(value)
+		}
+		assert.Less(t, size, 32*1024)
+	}
+	first, err := PageFromArgs(manifest.ToArgs(0, util.SwarmManifestPageSize))
+	assert.Nil(t, err)
+	decoded, err := AssembleManifest(first, defaultLimits, pagesOf(manifest, util.SwarmManifestPageSize))
+	assert.Nil(t, err)
+	assert.True(t, manifest.Equal(decoded))
+}
+
+func TestEmptyManifest(t *testing.T) {
+	manifest, err := BuildManifest(bytes.NewReader(nil), 100)
+	assert.Nil(t, err)
+	assert.Zero(t, manifest.NumChunks())
+
+	first, err := PageFromArgs(manifest.ToArgs(0, 2))
+	assert.Nil(t, err)
+	decoded, err := AssembleManifest(first, testLimits, pagesOf(manifest, 2))
+	assert.Nil(t, err)
+	assert.True(t, manifest.Equal(decoded))
+}
+
+func TestManifestCacheServesTheVersionCached(t *testing.T) {
+	cache := NewManifestCache(2)
+	manifest := &Manifest{Size: 1, ChunkSize: 1, ChunkHashes: []string{hashChunk([]byte("a"))}}
+	cache.Put("a", "v1", manifest)
+	cached, found := cache.Get("a", "v1")
+	assert.True(t, found)
+	assert.Same(t, manifest, cached)
+	_, found = cache.Get("a", "v2")
+	assert.False(t, found)
+
+	// The oldest key is evicted once the cache is full
+	cache.Put("b", "v1", manifest)
+	cache.Put("c", "v1", manifest)
+	_, found = cache.Get("a", "v1")
+	assert.False(t, found)
+	_, found = cache.Get("c", "v1")
+	assert.True(t, found)
+}
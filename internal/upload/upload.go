@@ -0,0 +1,254 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/file"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("upload session not found")
+	ErrSessionLocked   = errors.New("upload session is locked by another writer")
+	ErrOffsetMismatch  = errors.New("upload offset does not match the committed offset")
+	ErrInvalidID       = errors.New("invalid upload session id")
+)
+
+// Session tracks the progress of a single resumable upload
+type Session struct {
+	ID     string `json:"id"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+	// Origin is the listen address of the peer streaming this upload, and is empty for client uploads
+	Origin    string    `json:"origin,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version holds the args describing the version of the file being uploaded, which it is stored as once complete
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// IsComplete reports whether every byte of the upload has been committed
+func (s *Session) IsComplete() bool {
+	return s.Offset >= s.Size
+}
+
+type ManagerOpts struct {
+	// MaxAge is how long a session may go without any bytes written to it before it is abandoned
+	MaxAge time.Duration
+}
+
+// Manager persists upload sessions in the metadata DB and stages their bytes on disk until they are complete
+type Manager struct {
+	ManagerOpts
+	ddb         *db.DDB
+	stagingPath string
+	activeLock  sync.Mutex
+	active      map[string]bool
+}
+
+func NewManager(ddb *db.DDB, stagingPath string, opts ManagerOpts) *Manager {
+	return &Manager{
+		ManagerOpts: opts,
+		ddb:         ddb,
+		stagingPath: stagingPath,
+		active:      make(map[string]bool),
+	}
+}
+
+// NewSessionID generates a random upload session ID
+func NewSessionID() string {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		// crypto/rand never fails on supported platforms, fall back to a timestamp just in case
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(idBytes)
+}
+
+// Create starts a new upload session with the given id for size bytes of key, the given version of it
+func (m *Manager) Create(id string, key string, size int64, origin string, version map[string]string) (*Session, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+	// The bytes of the session are staged in a file named after its id, which peers pick, so it may not name any other path
+	if !filepath.IsLocal(id) || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	now := time.Now()
+	session := &Session{
+		ID:        id,
+		Key:       key,
+		Size:      size,
+		Origin:    origin,
+		Version:   version,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// Start from an empty staging file, in case a previous session with this id left one behind
+	if err := os.Remove(m.stagingFilePath(id)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := m.save(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Get returns the session with the given id
+func (m *Manager) Get(id string) (*Session, error) {
+	value, err := m.ddb.Get(util.UploadSessionsBucketName, id)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, ErrSessionNotFound
+	}
+	var session Session
+	if err := json.Unmarshal(value, &session); err != nil {
+		return nil, fmt.Errorf("corrupt upload session %s: %w", id, err)
+	}
+	return &session, nil
+}
+
+// List returns all the sessions that are currently tracked
+func (m *Manager) List() ([]*Session, error) {
+	var sessions []*Session
+	err := m.ddb.ForEach(util.UploadSessionsBucketName, func(key string, value []byte) error {
+		var session Session
+		if err := json.Unmarshal(value, &session); err != nil {
+			return fmt.Errorf("corrupt upload session %s: %w", key, err)
+		}
+		sessions = append(sessions, &session)
+		return nil
+	})
+	return sessions, err
+}
+
+// Patch writes the bytes from r into the session with the given id starting at offset, which must match the committed offset.
+// Whatever was written is committed even if r fails midway, so that the upload can be resumed from the last committed byte.
+func (m *Manager) Patch(id string, offset int64, r io.Reader) (*Session, error) {
+	if !m.lock(id) {
+		return nil, ErrSessionLocked
+	}
+	defer m.unlock(id)
+
+	session, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != session.Offset {
+		return session, ErrOffsetMismatch
+	}
+
+	f := file.File{
+		KeyPath:  id,
+		BasePath: m.stagingPath,
+		FileMode: util.Default,
+	}
+	n, writeErr := f.WriteStreamAt(io.LimitReader(r, session.Size-offset), offset)
+
+	session.Offset += n
+	session.UpdatedAt = time.Now()
+	if err := m.save(session); err != nil {
+		return nil, err
+	}
+	return session, writeErr
+}
+
+// Open opens the staged bytes of the session with the given id for reading
+func (m *Manager) Open(id string) (*os.File, error) {
+	return os.Open(m.stagingFilePath(id))
+}
+
+// Remove deletes the session with the given id along with its staged bytes
+func (m *Manager) Remove(id string) error {
+	if err := os.Remove(m.stagingFilePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return m.ddb.Delete(util.UploadSessionsBucketName, id)
+}
+
+// Expire abandons the sessions that no bytes were written to for longer than MaxAge, along with the staged files that no session
+// is left for, and returns how many sessions there were. Sessions being written to are left alone.
+func (m *Manager) Expire() (int, error) {
+	sessions, err := m.List()
+	if err != nil {
+		return 0, err
+	}
+	tracked := make(map[string]bool, len(sessions))
+	expired := 0
+	for _, session := range sessions {
+		tracked[session.ID] = true
+		if time.Since(session.UpdatedAt) <= m.MaxAge || !m.lock(session.ID) {
+			continue
+		}
+		err := m.Remove(session.ID)
+		m.unlock(session.ID)
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	entries, err := os.ReadDir(m.stagingPath)
+	if os.IsNotExist(err) {
+		return expired, nil
+	}
+	if err != nil {
+		return expired, err
+	}
+	for _, entry := range entries {
+		// A session may be created after it was listed, so only files staged for longer than MaxAge are removed
+		info, err := entry.Info()
+		if tracked[entry.Name()] || err != nil || time.Since(info.ModTime()) <= m.MaxAge {
+			continue
+		}
+		if err := os.Remove(m.stagingFilePath(entry.Name())); err != nil && !os.IsNotExist(err) {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// save persists the given session in the metadata DB
+func (m *Manager) save(session *Session) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return m.ddb.Put(util.UploadSessionsBucketName, session.ID, value)
+}
+
+// stagingFilePath returns the path where the bytes of the session with the given id are staged
+func (m *Manager) stagingFilePath(id string) string {
+	return filepath.Join(m.stagingPath, id)
+}
+
+// lock marks the session with the given id as being written to, and returns false if it already is
+func (m *Manager) lock(id string) bool {
+	m.activeLock.Lock()
+	defer m.activeLock.Unlock()
+	if m.active[id] {
+		return false
+	}
+	m.active[id] = true
+	return true
+}
+
+// unlock releases the session with the given id for other writers
+func (m *Manager) unlock(id string) {
+	m.activeLock.Lock()
+	defer m.activeLock.Unlock()
+	delete(m.active, id)
+}
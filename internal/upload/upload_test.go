@@ -0,0 +1,128 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// setupManager quickly sets up a Manager backed by a fresh DDB in a temp dir and returns it
+func setupManager(t *testing.T) *Manager {
+	dir := t.TempDir()
+	ddb, err := db.InitDB(filepath.Join(dir, "metadata.db"))
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		assert.Nil(t, ddb.Close())
+	})
+	return NewManager(&ddb, filepath.Join(dir, "uploads"), ManagerOpts{MaxAge: time.Hour})
+}
+
+func TestCreateAndGetSession(t *testing.T) {
+	manager := setupManager(t)
+	id := NewSessionID()
+
+	session, err := manager.Create(id, util.CommonFileKey, 14, "", nil)
+	assert.Nil(t, err)
+	assert.Zero(t, session.Offset)
+	assert.False(t, session.IsComplete())
+
+	fetched, err := manager.Get(id)
+	assert.Nil(t, err)
+	assert.Equal(t, util.CommonFileKey, fetched.Key)
+	assert.Equal(t, int64(14), fetched.Size)
+
+	_, err = manager.Get(NewSessionID())
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func TestPatchResumesFromCommittedOffset(t *testing.T) {
+	manager := setupManager(t)
+	id := NewSessionID()
+	data := []byte(util.CommonStringContent)
+	_, err := manager.Create(id, util.CommonFileKey, int64(len(data)), "", nil)
+	assert.Nil(t, err)
+
+	// Break the stream after the first 5 bytes
+	errBroken := errors.New("connection reset")
+	session, err := manager.Patch(id, 0, io.MultiReader(bytes.NewReader(data[:5]), iotest.ErrReader(errBroken)))
+	assert.ErrorIs(t, err, errBroken)
+	assert.Equal(t, int64(5), session.Offset)
+
+	// Resuming from anywhere but the committed offset is rejected
+	session, err = manager.Patch(id, 0, bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrOffsetMismatch)
+	assert.Equal(t, int64(5), session.Offset)
+
+	session, err = manager.Patch(id, 5, bytes.NewReader(data[5:]))
+	assert.Nil(t, err)
+	assert.True(t, session.IsComplete())
+
+	staged, err := manager.Open(id)
+	assert.Nil(t, err)
+	content, err := io.ReadAll(staged)
+	assert.Nil(t, err)
+	assert.Nil(t, staged.Close())
+	assert.Equal(t, data, content)
+}
+
+func TestRemoveSession(t *testing.T) {
+	manager := setupManager(t)
+	id := NewSessionID()
+	_, err := manager.Create(id, util.CommonFileKey, 4, "", nil)
+	assert.Nil(t, err)
+	_, err = manager.Patch(id, 0, bytes.NewReader([]byte("some")))
+	assert.Nil(t, err)
+
+	assert.Nil(t, manager.Remove(id))
+	_, err = manager.Get(id)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = manager.Open(id)
+	assert.NotNil(t, err)
+
+	sessions, err := manager.List()
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestExpireAbandonsStalledSessions(t *testing.T) {
+	manager := setupManager(t)
+	manager.MaxAge = 50 * time.Millisecond
+	stalled := NewSessionID()
+	_, err := manager.Create(stalled, util.CommonFileKey, 8, "", nil)
+	assert.Nil(t, err)
+	_, err = manager.Patch(stalled, 0, bytes.NewReader([]byte("some")))
+	assert.Nil(t, err)
+	// A staged file whose session is gone, e.g, as its DB entry was lost
+	orphan := filepath.Join(manager.stagingPath, NewSessionID())
+	assert.Nil(t, os.WriteFile(orphan, []byte("some"), 0644))
+
+	time.Sleep(100 * time.Millisecond)
+	active := NewSessionID()
+	_, err = manager.Create(active, util.CommonFileKey, 8, "", nil)
+	assert.Nil(t, err)
+	_, err = manager.Patch(active, 0, bytes.NewReader([]byte("some")))
+	assert.Nil(t, err)
+
+	expired, err := manager.Expire()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, expired)
+	_, err = manager.Get(stalled)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = manager.Open(stalled)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(orphan)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	session, err := manager.Get(active)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), session.Offset)
+}
@@ -3,31 +3,108 @@ package util
 import (
 	"flag"
 	"fmt"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type CommandLineArgs struct {
 	ListenAddress       string
+	HTTPListenAddress   string
 	BootstrapNodes      []string
 	MetadataDBPath      string
 	FileStorageBasePath string
 	TestStorage         bool
+	SwarmFetch          bool
+	HeartbeatInterval   time.Duration
+	HeartbeatTimeout    time.Duration
+	AntiEntropyInterval time.Duration
+	ReplicationFactor   int
+	RebalanceRate       int64
+	ErasureDataShards   int
+	ErasureParityShards int
+	ShardRepairInterval time.Duration
+	RaftPeers           []string
+	HintsMaxBytes       int64
+	HintMaxAge          time.Duration
+	CapacityBytes       int64
+	MinFreeDiskBytes    int64
+	ShutdownTimeout     time.Duration
+	Drain               bool
+	SendQueueCapacity   int
+	SendQueueDrop       bool
+	MessageWorkers      int
+	Codec               string
+	AdminToken          string
+	ClusterSecret       string
+	AuditMaxFileBytes   int64
+	AuditMaxFiles       int
 }
 
 func ParseCommandLineArgs() CommandLineArgs {
 	var (
 		listenAddress       string
+		httpListenAddress   string
 		bootstrapNodes      string
 		dbPath              string
 		fileStorageBasePath string
 		testStorage         bool
+		swarmFetch          bool
+		heartbeatInterval   time.Duration
+		heartbeatTimeout    time.Duration
+		antiEntropyInterval time.Duration
+		replicationFactor   int
+		rebalanceRate       int64
+		erasureDataShards   int
+		erasureParityShards int
+		shardRepairInterval time.Duration
+		raftPeers           string
+		hintsMaxBytes       int64
+		hintMaxAge          time.Duration
+		capacityBytes       int64
+		minFreeDiskBytes    int64
+		shutdownTimeout     time.Duration
+		drain               bool
+		sendQueueCapacity   int
+		sendQueueDrop       bool
+		messageWorkers      int
+		codec               string
+		adminToken          string
+		clusterSecret       string
+		auditMaxFileBytes   int64
+		auditMaxFiles       int
 	)
 
 	flag.StringVar(&listenAddress, "listen", DefaultListenAddress, "The address the hyperstore server should listen on, in <address:port> notation")
+	flag.StringVar(&httpListenAddress, "http", DefaultHTTPListenAddress, "The address the client facing HTTP API should listen on, in <address:port> notation. Disabled when empty")
 	flag.StringVar(&bootstrapNodes, "bootstrap", "", "List of bootstrapped nodes in comma separated <address:port> notation")
 	flag.StringVar(&dbPath, "db", DbPath, "Path that the metadata DB will be stored in")
 	flag.StringVar(&fileStorageBasePath, "file-storage-path", DefaultBaseStorageLocation, "Base path that the files will be stored in")
 	flag.BoolVar(&testStorage, "test-storage", false, "Setting this to true will test the store by storing a sample file")
+	flag.BoolVar(&swarmFetch, "swarm-fetch", false, "Setting this to true will fetch files from every peer holding them in parallel, a chunk at a time")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", DefaultHeartbeatInterval, "How often every connected peer is sent a HEARTBEAT")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", DefaultHeartbeatTimeout, "How long a peer may stay silent before its connection is evicted")
+	flag.DurationVar(&antiEntropyInterval, "anti-entropy-interval", DefaultAntiEntropyInterval, "How often the files held are compared with those of a random peer, to repair the replicas either is missing")
+	flag.IntVar(&replicationFactor, "replication-factor", DefaultReplicationFactor, "How many nodes every file is stored on. Every node stores every file when it is 0")
+	flag.Int64Var(&rebalanceRate, "rebalance-rate", DefaultRebalanceRate, "How many bytes per second may be sent to the nodes that take over files when the cluster changes. Unlimited when 0")
+	flag.IntVar(&erasureDataShards, "erasure-data-shards", 0, "How many data shards every file is split into when it is erasure coded, rather than replicated. Disabled when 0")
+	flag.IntVar(&erasureParityShards, "erasure-parity-shards", 0, "How many parity shards are computed for every erasure coded file, which is how many of its shards may be lost")
+	flag.DurationVar(&shardRepairInterval, "shard-repair-interval", DefaultShardRepairInterval, "How often the shards of erasure coded files that were lost are rebuilt")
+	flag.StringVar(&raftPeers, "raft-peers", "", "List of the nodes that replicate key metadata with Raft, this one included, in comma separated <address:port> notation. Disabled when empty")
+	flag.Int64Var(&hintsMaxBytes, "hints-max-bytes", DefaultHintsMaxBytes, "How many bytes the writes held for members that are down may take up in total")
+	flag.DurationVar(&hintMaxAge, "hint-max-age", DefaultHintMaxAge, "How long a write is held for a member that is down before it is given up on")
+	flag.Int64Var(&capacityBytes, "capacity", 0, "How many bytes the files stored on this node may take up in total, without a limit if it is 0")
+	flag.Int64Var(&minFreeDiskBytes, "min-free-disk", DefaultMinFreeDiskBytes, "How many bytes of the disk to leave free, rejecting the writes that would take up more")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "How long a shutdown may wait for transfers in flight before closing connections anyway")
+	flag.BoolVar(&drain, "drain", false, "Setting this to true will hand every file this node holds off to other nodes when shutting down")
+	flag.IntVar(&sendQueueCapacity, "send-queue-capacity", DefaultSendQueueCapacity, "How many messages of each priority may wait to be sent to a peer")
+	flag.BoolVar(&sendQueueDrop, "send-queue-drop", false, "Setting this to true will drop messages to a peer whose send queue is full, rather than waiting for room")
+	flag.IntVar(&messageWorkers, "message-workers", DefaultMessageWorkers, "How many messages from peers may be handled at once")
+	flag.StringVar(&codec, "codec", DefaultCodec, "The codec proposed to the peers this node dials, either gob or protobuf. Peers proposing either are answered in kind")
+	flag.StringVar(&adminToken, "admin-token", "", "The token that may do anything through the HTTP API, including managing principals and their tokens. Every request has to be made with a token once it is set, and peers have to know the -cluster-secret")
+	flag.StringVar(&clusterSecret, "cluster-secret", "", "The secret that every node of the cluster is started with, which peers have to prove they know to connect. Any peer may connect when it is empty")
+	flag.Int64Var(&auditMaxFileBytes, "audit-max-file-bytes", DefaultAuditMaxFileBytes, "How many bytes an audit log file may hold before a new one is started")
+	flag.IntVar(&auditMaxFiles, "audit-max-files", DefaultAuditMaxFiles, "How many audit log files are kept, the oldest ones being deleted first. Every file is kept when it is 0")
 
 	flag.Parse()
 
@@ -35,6 +112,10 @@ func ParseCommandLineArgs() CommandLineArgs {
 		// TODO: Validate if addresses are valid
 		return listenAddress
 	}
+	var parseHTTPListenAddress = func() string {
+		// TODO: Validate if addresses are valid
+		return httpListenAddress
+	}
 	var parseBootstrapNodes = func() []string {
 		// TODO: Validate if addresses are valid
 		if bootstrapNodes == "" {
@@ -44,6 +125,12 @@ func ParseCommandLineArgs() CommandLineArgs {
 	}
 	var parseDBPath = func() string {
 		// TODO: Validate if path exists
+		if dbPath == DbPath {
+			// Keep a separate DB per node, since BoltDB locks the file for a single process
+			basePathPrefix, _ := SafeStringToAddr(listenAddress)
+			defaultDBFileName := fmt.Sprintf("node-%s-%s", basePathPrefix, filepath.Base(DbPath))
+			return filepath.Join(filepath.Dir(DbPath), defaultDBFileName)
+		}
 		return dbPath
 	}
 	var parseFileStorageBasePath = func() string {
@@ -59,13 +146,164 @@ func ParseCommandLineArgs() CommandLineArgs {
 		// TODO: Validate if path exists
 		return testStorage
 	}
+	var parseSwarmFetch = func() bool {
+		return swarmFetch
+	}
+	var parseHeartbeatInterval = func() time.Duration {
+		if heartbeatInterval <= 0 {
+			return DefaultHeartbeatInterval
+		}
+		return heartbeatInterval
+	}
+	var parseHeartbeatTimeout = func() time.Duration {
+		// A peer must get a few chances to answer before being evicted
+		if heartbeatTimeout < 2*parseHeartbeatInterval() {
+			return 2 * parseHeartbeatInterval()
+		}
+		return heartbeatTimeout
+	}
+	var parseAntiEntropyInterval = func() time.Duration {
+		if antiEntropyInterval <= 0 {
+			return DefaultAntiEntropyInterval
+		}
+		return antiEntropyInterval
+	}
+	var parseReplicationFactor = func() int {
+		if replicationFactor < 0 {
+			return DefaultReplicationFactor
+		}
+		return replicationFactor
+	}
+	var parseRebalanceRate = func() int64 {
+		if rebalanceRate < 0 {
+			return DefaultRebalanceRate
+		}
+		return rebalanceRate
+	}
+	var parseErasureCoding = func() (int, int) {
+		if erasureDataShards <= 0 {
+			return 0, 0
+		}
+		return erasureDataShards, max(erasureParityShards, 0)
+	}
+	var parseShardRepairInterval = func() time.Duration {
+		if shardRepairInterval <= 0 {
+			return DefaultShardRepairInterval
+		}
+		return shardRepairInterval
+	}
+	var parseRaftPeers = func() []string {
+		if raftPeers == "" {
+			return nil
+		}
+		return strings.Split(raftPeers, ",")
+	}
+	var parseHintsMaxBytes = func() int64 {
+		if hintsMaxBytes < 0 {
+			return DefaultHintsMaxBytes
+		}
+		return hintsMaxBytes
+	}
+	var parseHintMaxAge = func() time.Duration {
+		if hintMaxAge <= 0 {
+			return DefaultHintMaxAge
+		}
+		return hintMaxAge
+	}
+	var parseCapacityBytes = func() int64 {
+		if capacityBytes < 0 {
+			return 0
+		}
+		return capacityBytes
+	}
+	var parseMinFreeDiskBytes = func() int64 {
+		if minFreeDiskBytes < 0 {
+			return DefaultMinFreeDiskBytes
+		}
+		return minFreeDiskBytes
+	}
+	var parseShutdownTimeout = func() time.Duration {
+		if shutdownTimeout <= 0 {
+			return DefaultShutdownTimeout
+		}
+		return shutdownTimeout
+	}
+	var parseDrain = func() bool {
+		return drain
+	}
+	var parseSendQueueCapacity = func() int {
+		if sendQueueCapacity <= 0 {
+			return DefaultSendQueueCapacity
+		}
+		return sendQueueCapacity
+	}
+	var parseSendQueueDrop = func() bool {
+		return sendQueueDrop
+	}
+	var parseMessageWorkers = func() int {
+		if messageWorkers <= 0 {
+			return DefaultMessageWorkers
+		}
+		return messageWorkers
+	}
+	var parseCodec = func() string {
+		if codec == "" {
+			return DefaultCodec
+		}
+		return strings.ToLower(codec)
+	}
+
+	var parseAdminToken = func() string {
+		return adminToken
+	}
+	var parseClusterSecret = func() string {
+		return clusterSecret
+	}
+	var parseAuditMaxFileBytes = func() int64 {
+		if auditMaxFileBytes <= 0 {
+			return DefaultAuditMaxFileBytes
+		}
+		return auditMaxFileBytes
+	}
+	var parseAuditMaxFiles = func() int {
+		if auditMaxFiles < 0 {
+			return DefaultAuditMaxFiles
+		}
+		return auditMaxFiles
+	}
 
 	flag.Parse()
+	dataShards, parityShards := parseErasureCoding()
 	return CommandLineArgs{
 		ListenAddress:       parseListenAddress(),
+		HTTPListenAddress:   parseHTTPListenAddress(),
 		BootstrapNodes:      parseBootstrapNodes(),
 		MetadataDBPath:      parseDBPath(),
 		FileStorageBasePath: parseFileStorageBasePath(),
 		TestStorage:         parseTestStorage(),
+		SwarmFetch:          parseSwarmFetch(),
+		HeartbeatInterval:   parseHeartbeatInterval(),
+		HeartbeatTimeout:    parseHeartbeatTimeout(),
+		AntiEntropyInterval: parseAntiEntropyInterval(),
+		ReplicationFactor:   parseReplicationFactor(),
+		RebalanceRate:       parseRebalanceRate(),
+		ErasureDataShards:   dataShards,
+		ErasureParityShards: parityShards,
+		ShardRepairInterval: parseShardRepairInterval(),
+		RaftPeers:           parseRaftPeers(),
+		HintsMaxBytes:       parseHintsMaxBytes(),
+		HintMaxAge:          parseHintMaxAge(),
+		CapacityBytes:       parseCapacityBytes(),
+		MinFreeDiskBytes:    parseMinFreeDiskBytes(),
+		ShutdownTimeout:     parseShutdownTimeout(),
+		Drain:               parseDrain(),
+		SendQueueCapacity:   parseSendQueueCapacity(),
+		SendQueueDrop:       parseSendQueueDrop(),
+		MessageWorkers:      parseMessageWorkers(),
+		Codec:               parseCodec(),
+		AdminToken:          parseAdminToken(),
+		ClusterSecret:       parseClusterSecret(),
+		AuditMaxFileBytes:   parseAuditMaxFileBytes(),
+		AuditMaxFiles:       parseAuditMaxFiles(),
 	}
 }
@@ -37,21 +37,132 @@ const (
 const (
 	DefaultBaseStorageLocation string = "storage"
 	DefaultListenAddress       string = ":5000"
+	DefaultHTTPListenAddress   string = ""
+)
+
+// Resumable upload opts
+const (
+	UploadStagingDirName = ".uploads"
+	TusResumableVersion  = "1.0.0"
+	DefaultUploadMaxAge  = 24 * time.Hour
+	UploadExpiryInterval = 10 * time.Minute
+)
+
+// Hinted handoff opts
+const (
+	HintsDirName         = ".hints"
+	DefaultHintsMaxBytes = 256 * 1024 * 1024
+	DefaultHintMaxAge    = 3 * time.Hour
+	HintReplayTimeout    = 5 * time.Minute
+)
+
+// Audit log opts
+const (
+	AuditDirName             = ".audit"
+	DefaultAuditMaxFileBytes = 64 * 1024 * 1024
+	DefaultAuditMaxFiles     = 16
+	DefaultAuditQueryLimit   = 1000
+)
+
+// Erasure coding opts
+const (
+	ShardsDirName              = ".shards"
+	ShardFetchChunkSize        = 32 * 1024
+	ShardLocateTimeout         = 3 * time.Second
+	ShardConnectTimeout        = 3 * time.Second
+	ShardFetchTimeout          = 30 * time.Second
+	ShardPlaceTimeout          = 30 * time.Second
+	DefaultShardRepairInterval = 1 * time.Minute
+)
+
+// Versioning opts
+const (
+	SiblingsDirName = ".siblings"
+	// VersionLockStripes is how many locks the writes of versions are spread over by key, so that writes of the same key are serialized
+	VersionLockStripes = 64
+)
+
+// Bucket opts
+const (
+	BucketsDirName        = ".buckets"
+	BucketExpiryInterval  = 1 * time.Minute
+	BucketExchangeTimeout = 5 * time.Second
+)
+
+// Storage capacity opts
+const (
+	DefaultMinFreeDiskBytes = 64 * 1024 * 1024
+	CapacityScanInterval    = 30 * time.Second
+)
+
+// Raft metadata opts
+const (
+	RaftElectionTimeout     = 1 * time.Second
+	RaftHeartbeatInterval   = 150 * time.Millisecond
+	RaftSnapshotThreshold   = 1024
+	RaftMaxEntriesPerAppend = 128
+	// RaftSnapshotFrameOverhead is the room kept in a frame for whatever an INSTALL_SNAPSHOT carries besides its chunk
+	RaftSnapshotFrameOverhead = 16 * 1024
+	RaftProposeTimeout        = 10 * time.Second
+	RaftRetryInterval         = 50 * time.Millisecond
 )
 
 const (
 	FetchMessageResponseTimeout = 15 * time.Second
 )
 
+// Swarm fetch opts
+const (
+	DefaultSwarmChunkSize      = 16 * 1024
+	SwarmManifestTimeout       = 3 * time.Second
+	SwarmChunkTimeout          = 10 * time.Second
+	SwarmDownloadTimeout       = 5 * time.Minute
+	SwarmParallelChunksPerPeer = 4
+	SwarmMaxChunkRetries       = 3
+	// SwarmManifestPageSize is how many chunk hashes a reply to a swarm FETCH holds, which keeps it well within a frame
+	SwarmManifestPageSize  = 256
+	SwarmManifestCacheSize = 64
+	// SwarmMaxFileSize is the largest file fetched in swarm mode, which is held in memory as a whole
+	SwarmMaxFileSize = 1 << 30
+)
+
 // --------------------------------------------------------------  END OF STORAGE CONSTANTS --------------------------------------------------------------
 
 // --------------------------------------------------------------  DB CONSTANTS --------------------------------------------------------------
 
 const (
-	DbPath             = "./data/metadata.db"
-	MetadataBucketName = "fileMetadata"
+	DbPath                   = "./data/metadata.db"
+	MetadataBucketName       = "fileMetadata"
+	UploadSessionsBucketName = "uploadSessions"
+	KnownPeersBucketName     = "knownPeers"
+	HintsBucketName          = "hints"
+	RaftStateBucketName      = "raftState"
+	RaftLogBucketName        = "raftLog"
+	NamespaceBucketName      = "namespace"
+	BucketsBucketName        = "buckets"
+	PrincipalsBucketName     = "principals"
+	APITokensBucketName      = "apiTokens"
+	AuditBucketName          = "audit"
+	// BucketMetadataBucketPrefix prefixes the name of the bucket of the metadata DB that the metadata of the files of every bucket
+	// of keys is recorded in, rather than in MetadataBucketName along with the files of the default bucket
+	BucketMetadataBucketPrefix = "fileMetadata/"
 )
 
+// RequiredBucketNames lists the buckets that are created when the metadata DB is initialized
+var RequiredBucketNames = []string{
+	MetadataBucketName,
+	UploadSessionsBucketName,
+	KnownPeersBucketName,
+	HintsBucketName,
+	RaftStateBucketName,
+	RaftLogBucketName,
+	NamespaceBucketName,
+	BucketsBucketName,
+	PrincipalsBucketName,
+	APITokensBucketName,
+	AuditBucketName,
+}
+
 // --------------------------------------------------------------  END OF DB CONSTANTS --------------------------------------------------------------
 
 // --------------------------------------------------------------  P2P CONSTANTS --------------------------------------------------------------
@@ -62,4 +173,75 @@ const (
 	MaxAllowedDataPayloadSize       = 1024
 )
 
+// DHT opts
+const (
+	DHTBucketSize    = 20
+	DHTAlpha         = 3
+	DHTProviderTTL   = 24 * time.Hour
+	DHTRPCTimeout    = 5 * time.Second
+	DHTLookupTimeout = 15 * time.Second
+	// DHTReprovideInterval is how often the provider records of the files held are renewed, well before they expire
+	DHTReprovideInterval = DHTProviderTTL / 2
+)
+
+// Peer manager opts
+const (
+	PeerReconnectBaseBackoff = 500 * time.Millisecond
+	PeerReconnectMaxBackoff  = 30 * time.Second
+	KnownPeerTTL             = 7 * 24 * time.Hour
+	// PeerAliasVerifyTimeout bounds dialing back the listen address a peer claims, and asking the node there to vouch for it
+	PeerAliasVerifyTimeout = 5 * time.Second
+)
+
+// Message worker opts
+const (
+	DefaultMessageWorkers  = 8
+	MessageWorkerQueueSize = 32
+)
+
+// DefaultCodec is the name of the codec proposed to the peers dialed, unless another one is picked with -codec
+const DefaultCodec = "gob"
+
+// Send queue opts
+const (
+	DefaultSendQueueCapacity = 256
+)
+
+// Lifecycle opts
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// Heartbeat opts
+const (
+	DefaultHeartbeatInterval = 2 * time.Second
+	DefaultHeartbeatTimeout  = 10 * time.Second
+)
+
+// Membership opts
+const (
+	MembershipProbeInterval    = 1 * time.Second
+	MembershipProbeTimeout     = 500 * time.Millisecond
+	MembershipIndirectChecks   = 3
+	MembershipSuspicionTimeout = 5 * time.Second
+	MembershipRetransmitMult   = 4
+	MembershipJoinTimeout      = 5 * time.Second
+)
+
+// Placement and rebalancing opts
+const (
+	DefaultReplicationFactor = 3
+	DefaultRebalanceRate     = 8 * 1024 * 1024
+	RebalanceSettleDelay     = 1 * time.Second
+	RebalanceConnectTimeout  = 5 * time.Second
+)
+
+// Anti-entropy opts
+const (
+	DefaultAntiEntropyInterval = 30 * time.Second
+	AntiEntropySyncTimeout     = 2 * time.Minute
+	AntiEntropyNodesPerCall    = 256
+	AntiEntropyKeysPerCall     = 128
+)
+
 // --------------------------------------------------------------  END OF P2P CONSTANTS --------------------------------------------------------------
@@ -0,0 +1,111 @@
+package vclock
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ordering is how two versions of the same key relate to each other, as told by their Clocks
+type Ordering int
+
+const (
+	// Equal versions saw the same writes
+	Equal Ordering = iota
+	// Before is a version that the other one saw, and replaces
+	Before
+	// After is a version that saw the other one, and replaces it
+	After
+	// Concurrent versions were written without either seeing the other, so neither may replace the other
+	Concurrent
+)
+
+func (o Ordering) String() string {
+	return [...]string{"EQUAL", "BEFORE", "AFTER", "CONCURRENT"}[o]
+}
+
+// Clock is a version vector, which counts the writes every node made to a key, by the listen address of the node.
+// Missing nodes made no writes, and a nil Clock is the version of a key before any write.
+type Clock map[string]uint64
+
+// Compare returns how the version c is ordered relative to other
+func (c Clock) Compare(other Clock) Ordering {
+	var ahead, behind bool
+	for node, count := range c {
+		if count > other[node] {
+			ahead = true
+		} else if count < other[node] {
+			behind = true
+		}
+	}
+	for node, count := range other {
+		if _, exists := c[node]; !exists && count > 0 {
+			behind = true
+		}
+	}
+	switch {
+	case ahead && behind:
+		return Concurrent
+	case ahead:
+		return After
+	case behind:
+		return Before
+	}
+	return Equal
+}
+
+// Descends reports whether the version c saw every write other did, which is when other doesn't need to be kept alongside c
+func (c Clock) Descends(other Clock) bool {
+	ordering := c.Compare(other)
+	return ordering == After || ordering == Equal
+}
+
+// Increment returns a copy of c with one more write by node
+func (c Clock) Increment(node string) Clock {
+	incremented := c.Merge()
+	incremented[node]++
+	return incremented
+}
+
+// Merge returns a Clock that saw every write that c or any of others saw, which is the highest count of every node
+func (c Clock) Merge(others ...Clock) Clock {
+	merged := make(Clock, len(c))
+	for _, clock := range append([]Clock{c}, others...) {
+		for node, count := range clock {
+			merged[node] = max(merged[node], count)
+		}
+	}
+	return merged
+}
+
+// String encodes c as comma separated node=count pairs, ordered by node, which Parse decodes
+func (c Clock) String() string {
+	nodes := make([]string, 0, len(c))
+	for node := range c {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	pairs := make([]string, len(nodes))
+	for i, node := range nodes {
+		pairs[i] = node + "=" + strconv.FormatUint(c[node], 10)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Parse decodes a Clock encoded by String
+func Parse(encoded string) (Clock, error) {
+	clock := make(Clock)
+	if encoded == "" {
+		return clock, nil
+	}
+	for _, pair := range strings.Split(encoded, ",") {
+		node, countStr, found := strings.Cut(pair, "=")
+		count, err := strconv.ParseUint(countStr, 10, 64)
+		if !found || node == "" || err != nil {
+			return nil, fmt.Errorf("invalid clock entry %q", pair)
+		}
+		clock[node] = count
+	}
+	return clock, nil
+}
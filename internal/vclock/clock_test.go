@@ -0,0 +1,49 @@
+package vclock
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	base := Clock{"a": 1}
+	assert.Equal(t, Equal, base.Compare(Clock{"a": 1}))
+	assert.Equal(t, Equal, Clock(nil).Compare(Clock{}))
+	assert.Equal(t, After, base.Compare(nil))
+	assert.Equal(t, Before, Clock(nil).Compare(base))
+
+	// A write on top of base replaces it
+	next := base.Increment("b")
+	assert.Equal(t, After, next.Compare(base))
+	assert.Equal(t, Before, base.Compare(next))
+	assert.True(t, next.Descends(base))
+	assert.False(t, base.Descends(next))
+	assert.Equal(t, Clock{"a": 1}, base, "Increment must leave the clock it was called on untouched")
+
+	// Writes on top of base on different nodes conflict, until a write sees both
+	other := base.Increment("c")
+	assert.Equal(t, Concurrent, next.Compare(other))
+	assert.Equal(t, Concurrent, other.Compare(next))
+	assert.False(t, next.Descends(other))
+	merged := next.Merge(other)
+	assert.Equal(t, Clock{"a": 1, "b": 1, "c": 1}, merged)
+	assert.True(t, merged.Descends(next))
+	assert.True(t, merged.Descends(other))
+	assert.Equal(t, After, merged.Increment("a").Compare(merged))
+}
+
+func TestStringAndParse(t *testing.T) {
+	clock := Clock{"127.0.0.1:7002": 3, "127.0.0.1:7001": 12}
+	assert.Equal(t, "127.0.0.1:7001=12,127.0.0.1:7002=3", clock.String())
+	parsed, err := Parse(clock.String())
+	assert.Nil(t, err)
+	assert.Equal(t, clock, parsed)
+
+	parsed, err = Parse("")
+	assert.Nil(t, err)
+	assert.Empty(t, parsed)
+	for _, invalid := range []string{"a", "a=", "=1", "a=-1", "a=1,,b=2"} {
+		_, err = Parse(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
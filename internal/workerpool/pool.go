@@ -0,0 +1,90 @@
+package workerpool
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+type PoolOpts struct {
+	// Workers is the number of tasks that may run at once
+	Workers int
+	// QueueSize is the number of tasks that may wait for each worker, after which Submit waits for room
+	QueueSize int
+}
+
+// Pool runs tasks on a fixed number of workers. Tasks submitted under the same key run one at a time, in the order they were
+// submitted, while tasks under different keys, or under no key at all, run concurrently.
+type Pool struct {
+	PoolOpts
+	// keyed holds the tasks waiting for each worker, a key always being handled by the same worker
+	keyed []chan func()
+	// unkeyed holds the tasks any worker may run
+	unkeyed   chan func()
+	closeOnce sync.Once
+	closedCh  chan struct{}
+}
+
+func NewPool(opts PoolOpts) *Pool {
+	opts.Workers = max(opts.Workers, 1)
+	p := &Pool{
+		PoolOpts: opts,
+		keyed:    make([]chan func(), opts.Workers),
+		unkeyed:  make(chan func(), opts.QueueSize),
+		closedCh: make(chan struct{}),
+	}
+	for i := range p.keyed {
+		p.keyed[i] = make(chan func(), opts.QueueSize)
+		go p.work(p.keyed[i])
+	}
+	return p
+}
+
+// Submit queues task to run under key, and waits for room if the queue is full, which pushes back on whoever submits tasks.
+// An empty key puts no constraint on the order the task runs in. It returns false if the pool was closed instead.
+func (p *Pool) Submit(key string, task func()) bool {
+	queue := p.unkeyed
+	if key != "" {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(key))
+		queue = p.keyed[hash.Sum32()%uint32(len(p.keyed))]
+	}
+
+	select {
+	case <-p.closedCh:
+		return false
+	default:
+	}
+	select {
+	case queue <- task:
+		return true
+	case <-p.closedCh:
+		return false
+	}
+}
+
+// Close stops the workers once the tasks they are running are over, dropping the tasks still queued
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closedCh)
+	})
+}
+
+// work runs the tasks of keyed, and of the unkeyed queue whenever keyed is empty
+func (p *Pool) work(keyed chan func()) {
+	for {
+		select {
+		case <-p.closedCh:
+			return
+		default:
+		}
+
+		select {
+		case task := <-keyed:
+			task()
+		case task := <-p.unkeyed:
+			task()
+		case <-p.closedCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package workerpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTasksUnderTheSameKeyRunInOrder(t *testing.T) {
+	pool := NewPool(PoolOpts{Workers: 4, QueueSize: 8})
+	defer pool.Close()
+
+	var (
+		lock  sync.Mutex
+		order = make(map[string][]int)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			assert.True(t, pool.Submit(key, func() {
+				defer wg.Done()
+				lock.Lock()
+				order[key] = append(order[key], i)
+				lock.Unlock()
+			}))
+		}
+	}
+	wg.Wait()
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Len(t, order[key], 100)
+		for i, n := range order[key] {
+			assert.Equal(t, i, n)
+		}
+	}
+}
+
+func TestUnkeyedTasksRunConcurrently(t *testing.T) {
+	pool := NewPool(PoolOpts{Workers: 4, QueueSize: 8})
+	defer pool.Close()
+
+	// Every task waits for all of them to be running, which only works out if they run at once
+	var (
+		running atomic.Int32
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		pool.Submit("", func() {
+			defer wg.Done()
+			running.Add(1)
+			assert.Eventually(t, func() bool {
+				return running.Load() == 4
+			}, time.Second, time.Millisecond)
+		})
+	}
+	wg.Wait()
+}
+
+func TestSubmitWaitsForRoom(t *testing.T) {
+	pool := NewPool(PoolOpts{Workers: 1, QueueSize: 1})
+	release := make(chan struct{})
+	pool.Submit("key", func() { <-release })
+	pool.Submit("key", func() {})
+
+	// The worker is busy and its queue is full, so the next task has to wait
+	submitted := make(chan bool)
+	go func() {
+		submitted <- pool.Submit("key", func() {})
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submit to a full queue returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.True(t, <-submitted)
+
+	pool.Close()
+	assert.False(t, pool.Submit("key", func() {}))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"file-store/internal/bucket"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("store is shutting down")
+
+// beginTransfer records that a transfer started, and returns the func to call once it is over
+func (s *Store) beginTransfer() func() {
+	s.activeTransfers.Add(1)
+	return func() {
+		s.activeTransfers.Add(-1)
+	}
+}
+
+// waitForTransfers waits until no transfer is in flight, or until ctx is done
+func (s *Store) waitForTransfers(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := s.activeTransfers.Load()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d transfers still in flight: %w", active, ctx.Err())
+		}
+	}
+}
+
+// isShuttingDown reports whether shutdown has begun, after which the Store takes no new work
+func (s *Store) isShuttingDown() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops the Store gracefully, leaving the data on disk intact. It stops taking new work, optionally drains the replicas
+// of this node to other nodes, leaves the cluster, waits for in-flight transfers until ctx is done, says EXIT to every peer,
+// and closes every connection, the listeners and the metadata DB.
+func (s *Store) shutdown(ctx context.Context, drain bool) error {
+	alreadyShuttingDown := true
+	s.shutdownOnce.Do(func() {
+		alreadyShuttingDown = false
+		close(s.shutdownCh)
+	})
+	if alreadyShuttingDown {
+		return ErrShuttingDown
+	}
+	log.Println("Shutting down...")
+
+	var errs []error
+	// Stop accepting clients and peers, while the connections we have keep working
+	if httpServer := s.httpServer.Load(); httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down HTTP API: %w", err))
+		}
+	}
+	if err := s.Transport.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing listener: %w", err))
+	}
+
+	if drain {
+		if err := s.drain(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("draining: %w", err))
+		}
+	}
+
+	// Leaving announces our departure, so that the cluster doesn't have to detect it as a failure
+	s.Members.Leave(ctx)
+	s.Peers.Close()
+	if err := s.waitForTransfers(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if s.Raft != nil {
+		s.Raft.Stop()
+	}
+
+	exitMsg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_EXIT_CONTROL_COMMAND,
+			Args:    map[string]string{"sender_addr": s.normalizedListenAddress()},
+		},
+	}
+	if err := s.broadcastMessage(exitMsg).Err(); err != nil {
+		log.Println("Error while broadcasting EXIT:", err)
+	}
+	s.PeerLock.Lock()
+	for _, peer := range s.PeerMap {
+		_ = peer.Close()
+	}
+	s.PeerLock.Unlock()
+
+	if err := s.Audit.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing audit log: %w", err))
+	}
+	if s.MetadataDB != nil {
+		if err := s.MetadataDB.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing metadata DB: %w", err))
+		}
+	}
+	close(s.closedCh)
+	log.Println("Shut down")
+	return errors.Join(errs...)
+}
+
+// drain hands every file this node holds off to a member that doesn't hold it yet, so that leaving doesn't cost it a replica
+func (s *Store) drain(ctx context.Context) error {
+	keys, err := s.listLocalKeys()
+	if err != nil {
+		return err
+	}
+	log.Printf("Draining %d files", len(keys))
+
+	failed := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		peer, err := s.pickHandoffPeer(ctx, key)
+		if err != nil {
+			log.Printf("Couldn't hand %s off: %v", key, err)
+			failed++
+			continue
+		}
+		if err := s.streamVersionsToPeer(key, peer); err != nil {
+			log.Printf("Couldn't hand %s off to %s: %v", key, peer, err)
+			failed++
+			continue
+		}
+		log.Printf("Handed %s off to %s", key, peer)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files couldn't be handed off", failed, len(keys))
+	}
+	return nil
+}
+
+// pickHandoffPeer returns the nearest member that isn't already known to hold key
+func (s *Store) pickHandoffPeer(ctx context.Context, key string) (p2p.Peer, error) {
+	holders := make(map[string]bool)
+	providers, err := s.DHT.FindProviders(ctx, key)
+	if err != nil {
+		log.Printf("Error while looking up providers of %s in DHT: %v", key, err)
+	}
+	for _, provider := range providers {
+		holders[provider.Addr] = true
+	}
+
+	var candidates []string
+	for _, member := range s.Members.Members() {
+		if !holders[member.Addr] {
+			candidates = append(candidates, member.Addr)
+		}
+	}
+	s.sortByRTT(candidates)
+	for _, addr := range candidates {
+		if peer, err := s.connectToPeer(ctx, addr); err == nil {
+			return peer, nil
+		}
+	}
+	return nil, fmt.Errorf("no reachable member without a replica among %d candidates", len(candidates))
+}
+
+// listLocalKeys returns the keys of every file in storage, by matching each file against the path its key would be stored at
+func (s *Store) listLocalKeys() ([]string, error) {
+	base := s.StoreOpts.BaseStorageLocation
+	stagingPath := filepath.Join(base, util.UploadStagingDirName)
+	hintsPath := filepath.Join(base, util.HintsDirName)
+	shardsPath := filepath.Join(base, util.ShardsDirName)
+	siblingsPath := filepath.Join(base, util.SiblingsDirName)
+	bucketsPath := filepath.Join(base, util.BucketsDirName)
+	auditPath := filepath.Join(base, util.AuditDirName)
+
+	var keys []string
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if p == stagingPath || p == hintsPath || p == shardsPath || p == siblingsPath || p == auditPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		// The files of a bucket are stored under a directory of its own, and known by their qualified keys
+		name := ""
+		if strings.HasPrefix(p, bucketsPath+string(filepath.Separator)) && len(parts) > 2 {
+			name, parts = parts[1], parts[2:]
+		}
+		for i := range parts {
+			key := bucket.Qualify(name, strings.Join(parts[i:], "/"))
+			if s.filePath(key) == path.Clean(filepath.ToSlash(p)) {
+				keys = append(keys, key)
+				break
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"file-store/internal/db"
+	"file-store/internal/util"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupRunningStore starts a Store listening on listenAddress, with its own storage and metadata DB in a temp dir
+func setupRunningStore(t *testing.T, listenAddress string, bootstrapNodes []string) *Store {
+	dir := t.TempDir()
+	store := createStoreWithDefaultOptions(listenAddress, bootstrapNodes, filepath.Join(dir, "storage"))
+	ddb, err := db.InitDB(filepath.Join(dir, "metadata.db"))
+	assert.Nil(t, err)
+	store.attachMetadataDB(&ddb)
+	go store.setupHyperStoreServer()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = store.shutdown(ctx, false)
+	})
+	return store
+}
+
+func TestListLocalKeys(t *testing.T) {
+	store := createStoreWithDefaultOptions(":5103", nil, t.TempDir())
+	for _, key := range []string{util.CommonFileKey, "otherkey"} {
+		_, err := store.handleFileWrite(key, bytes.NewReader([]byte(util.CommonStringContent)))
+		assert.Nil(t, err)
+	}
+
+	keys, err := store.listLocalKeys()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{util.CommonFileKey, "otherkey"}, keys)
+}
+
+func TestShutdownDrainsAndLeavesDataIntact(t *testing.T) {
+	leaving := setupRunningStore(t, ":5104", nil)
+	staying := setupRunningStore(t, ":5105", []string{":5104"})
+	assert.Eventually(t, func() bool {
+		return len(leaving.Members.Members()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := leaving.handleFileWrite(util.CommonFileKey, bytes.NewReader([]byte(util.CommonStringContent)))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, leaving.shutdown(ctx, true))
+
+	// The file was handed off, and kept on disk
+	assert.Eventually(t, func() bool {
+		return staying.existsInStorage(util.CommonFileKey)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, leaving.existsInStorage(util.CommonFileKey))
+
+	// The node is gone for good, and nobody tries to reconnect to it
+	_, err = net.DialTimeout("tcp", "127.0.0.1:5104", time.Second)
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, leaving.shutdown(ctx, false), ErrShuttingDown)
+	_, err = leaving.MetadataDB.Get(util.UploadSessionsBucketName, "any")
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		_, connected := staying.peerForAddr("127.0.0.1:5104")
+		return !connected && !staying.Peers.IsConnected("127.0.0.1:5104")
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -2,20 +2,65 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"file-store/internal/capacity"
 	"file-store/internal/db"
+	"file-store/internal/p2p"
 	"file-store/internal/util"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func initApp() {
-	util.RegisterGobTypes()
+	p2p.RegisterGobTypes()
 }
 
-func initStore(commandLineArgs util.CommandLineArgs) {
+func initStore(commandLineArgs util.CommandLineArgs, ddb *db.DDB) {
+	if err := checkPeerAuth(commandLineArgs); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
 	globalStore = getStoreInstance(commandLineArgs.ListenAddress, commandLineArgs.BootstrapNodes, commandLineArgs.FileStorageBasePath)
+	// The Raft node is created along with the metadata DB it persists in
+	globalStore.StoreOpts.RaftPeers = commandLineArgs.RaftPeers
+	globalStore.attachMetadataDB(ddb)
+	globalStore.StoreOpts.SwarmFetch = commandLineArgs.SwarmFetch
+	globalStore.StoreOpts.HeartbeatInterval = commandLineArgs.HeartbeatInterval
+	globalStore.StoreOpts.HeartbeatTimeout = commandLineArgs.HeartbeatTimeout
+	globalStore.StoreOpts.AntiEntropyInterval = commandLineArgs.AntiEntropyInterval
+	globalStore.StoreOpts.ReplicationFactor = commandLineArgs.ReplicationFactor
+	globalStore.StoreOpts.RebalanceRate = commandLineArgs.RebalanceRate
+	globalStore.StoreOpts.ErasureDataShards = commandLineArgs.ErasureDataShards
+	globalStore.StoreOpts.ErasureParityShards = commandLineArgs.ErasureParityShards
+	globalStore.StoreOpts.ShardRepairInterval = commandLineArgs.ShardRepairInterval
+	globalStore.Hints.MaxBytes = commandLineArgs.HintsMaxBytes
+	globalStore.Hints.MaxAge = commandLineArgs.HintMaxAge
+	globalStore.Audit.MaxFileBytes = commandLineArgs.AuditMaxFileBytes
+	globalStore.Audit.MaxFiles = commandLineArgs.AuditMaxFiles
+	globalStore.Capacity.SetOpts(capacity.Opts{MaxBytes: commandLineArgs.CapacityBytes, MinFreeDiskBytes: commandLineArgs.MinFreeDiskBytes})
+	globalStore.StoreOpts.MessageWorkers = commandLineArgs.MessageWorkers
+	sendQueueOpts := p2p.SendQueueOpts{Capacity: commandLineArgs.SendQueueCapacity, Policy: p2p.BlockWhenFull}
+	if commandLineArgs.SendQueueDrop {
+		sendQueueOpts.Policy = p2p.DropWhenFull
+	}
+	globalStore.Transport.(*p2p.TCPTransport).SendQueue = sendQueueOpts
+	codec, err := p2p.NewCodec(commandLineArgs.Codec)
+	if err != nil {
+		log.Fatalf("Invalid -codec: %v", err)
+	}
+	globalStore.Transport.(*p2p.TCPTransport).Codec = codec
+	if commandLineArgs.ClusterSecret != "" {
+		globalStore.Transport.(*p2p.TCPTransport).HandshakeFunc = p2p.SharedSecretHandshake([]byte(commandLineArgs.ClusterSecret))
+	}
+	globalStore.StoreOpts.AdminToken = commandLineArgs.AdminToken
 	go globalStore.setupHyperStoreServer()
+	if commandLineArgs.HTTPListenAddress != "" {
+		go globalStore.setupHTTPServer(commandLineArgs.HTTPListenAddress)
+	}
 
 	// Helper funcs for testing storage
 	// timeout sleeps for given seconds
@@ -63,8 +108,8 @@ func initStore(commandLineArgs util.CommandLineArgs) {
 
 }
 
-func initDDB() {
-	ddbInstance, err := db.InitDB(util.DbPath)
+func initDDB(dbPath string) *db.DDB {
+	ddbInstance, err := db.InitDB(dbPath)
 	if err != nil {
 		log.Fatalf("error occurred while setting up ddb: %+v\n", err)
 	}
@@ -75,25 +120,49 @@ func initDDB() {
 	if ddbInstance.IsReady {
 		fmt.Println("ddb instance is ready for tx")
 	}
+	return &ddbInstance
 }
 
-func keepAlive() {
-	for {
-
+// waitForShutdown blocks until SIGINT or SIGTERM, and then shuts the Store down gracefully.
+// A second signal exits right away, for when the graceful shutdown is stuck.
+func waitForShutdown(commandLineArgs util.CommandLineArgs) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down gracefully. Send it again to exit right away.", sig)
+	go func() {
+		<-signals
+		log.Fatalln("Exiting without a graceful shutdown")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandLineArgs.ShutdownTimeout)
+	defer cancel()
+	if err := globalStore.shutdown(ctx, commandLineArgs.Drain); err != nil {
+		log.Fatalln("Error while shutting down:", err)
 	}
 }
 
 func main() {
 	initApp()
 
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		// Only the decoded messages are printed, not the logs of decoding them
+		log.SetOutput(io.Discard)
+		if err := runDecodeCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while decoding:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	commandLineArgs := util.ParseCommandLineArgs()
 
 	util.ColorPrint(util.ColorBlue, util.HyperstoreArt)
 	log.Println("Starting file-store...")
 
-	initStore(commandLineArgs)
+	ddb := initDDB(commandLineArgs.MetadataDBPath)
 
-	// initDDB()
+	initStore(commandLineArgs, ddb)
 
-	keepAlive()
+	waitForShutdown(commandLineArgs)
 }
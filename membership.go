@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"file-store/internal/dht"
+	"file-store/internal/membership"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"log"
+)
+
+// storeMembershipTransport implements membership.Transport over the control messages of the Store's Transport
+type storeMembershipTransport struct {
+	store *Store
+}
+
+func (tr *storeMembershipTransport) Ping(ctx context.Context, addr string, updates []membership.Update) ([]membership.Update, error) {
+	resp, err := tr.store.callPeer(ctx, addr, p2p.MESSAGE_PING_CONTROL_COMMAND, map[string]string{"updates": membership.EncodeUpdates(updates)})
+	if err != nil {
+		return nil, err
+	}
+	return membership.DecodeUpdates(resp["updates"])
+}
+
+func (tr *storeMembershipTransport) PingReq(ctx context.Context, via string, target string, updates []membership.Update) ([]membership.Update, error) {
+	args := map[string]string{
+		"target":  target,
+		"updates": membership.EncodeUpdates(updates),
+	}
+	// via replies with an ERROR if target didn't ack
+	resp, err := tr.store.callPeer(ctx, via, p2p.MESSAGE_PING_REQ_CONTROL_COMMAND, args)
+	if err != nil {
+		return nil, err
+	}
+	return membership.DecodeUpdates(resp["updates"])
+}
+
+// newStoreMemberlist creates the Memberlist of the Store, identified by the address it listens on
+func newStoreMemberlist(s *Store) *membership.Memberlist {
+	opts := membership.MemberlistOpts{
+		ProbeInterval:    util.MembershipProbeInterval,
+		ProbeTimeout:     util.MembershipProbeTimeout,
+		IndirectChecks:   util.MembershipIndirectChecks,
+		SuspicionTimeout: util.MembershipSuspicionTimeout,
+		RetransmitMult:   util.MembershipRetransmitMult,
+		OnEvent:          s.onMembershipEvent,
+	}
+	return membership.NewMemberlist(opts, s.normalizedListenAddress(), &storeMembershipTransport{store: s})
+}
+
+// joinCluster joins the membership of the cluster through the peers listening on seeds
+func (s *Store) joinCluster(seeds []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), util.MembershipJoinTimeout)
+	defer cancel()
+	joined := s.Members.Join(ctx, seeds)
+	log.Printf("Joined cluster through %d of %d seeds, with %d members known", joined, len(seeds), len(s.Members.Members()))
+}
+
+// onMembershipEvent keeps the connections and the DHT of the Store in line with the member list
+func (s *Store) onMembershipEvent(event membership.Event) {
+	addr := event.Member.Addr
+	switch event.Type {
+	case membership.EventJoin:
+		// Keep a connection to every member, not only to the ones we were bootstrapped with, and hand off the writes it missed
+		s.Peers.Want(addr)
+		go s.replayHints(addr)
+	case membership.EventLeave:
+		s.Peers.Forget(addr)
+		// A member that left on purpose isn't coming back for the writes held for it
+		if s.Hints != nil {
+			if err := s.Hints.RemoveOwner(addr); err != nil {
+				log.Printf("Error while removing the hints for %s: %v", addr, err)
+			}
+		}
+		s.DHT.Table.Remove(dht.NewNodeID(addr))
+		s.dropPeer(addr)
+	case membership.EventFail:
+		// The peer manager keeps redialing a failed member with backoff, in case it only dropped off for a while
+		s.DHT.Table.Remove(dht.NewNodeID(addr))
+		s.dropPeer(addr)
+	}
+	// The keys owned by the member moved to other nodes, or to it if it joined
+	s.scheduleRebalance()
+}
+
+// dropPeer closes the connection to the peer listening on addr. OnPeerDisconnect takes care of forgetting it.
+func (s *Store) dropPeer(addr string) {
+	peer, exists := s.peerForAddr(addr)
+	if !exists {
+		return
+	}
+	if err := peer.Close(); err != nil {
+		log.Printf("Error while closing connection to %s: %v", addr, err)
+	}
+}
+
+// handlePing answers a PING from fromPeer with an ACK carrying the updates to piggyback
+func (s *Store) handlePing(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	senderAddr, senderAddrExists := payload.Args["sender_addr"]
+	if !senderAddrExists {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing sender_addr for PING Control Message %s", fromPeer.String())
+	}
+	updates, err := membership.DecodeUpdates(payload.Args["updates"])
+	if err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid updates for PING Control Message %s: %v", fromPeer.String(), err)
+	}
+	s.addPeerAlias(senderAddr, fromPeer)
+
+	respUpdates := s.Members.HandlePing(senderAddr, updates)
+	return s.sendAck(payload, respUpdates, fromPeer)
+}
+
+// handlePingReq probes the target of a PING_REQ on behalf of fromPeer, and ACKs if the target answered, or replies with an
+// ERROR if it didn't. The probe waits for the reply of the target, so it runs in the background rather than hold up a worker.
+func (s *Store) handlePingReq(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	var (
+		senderAddr, senderAddrExists = payload.Args["sender_addr"]
+		target, targetExists         = payload.Args["target"]
+	)
+	if !senderAddrExists || !targetExists {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing sender_addr/target for PING_REQ Control Message %s", fromPeer.String())
+	}
+	updates, err := membership.DecodeUpdates(payload.Args["updates"])
+	if err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid updates for PING_REQ Control Message %s: %v", fromPeer.String(), err)
+	}
+	s.addPeerAlias(senderAddr, fromPeer)
+
+	go func() {
+		respUpdates, err := s.Members.HandlePingReq(context.Background(), senderAddr, target, updates)
+		if err != nil {
+			log.Printf("PING_REQ from %s: %s didn't ack: %v", senderAddr, target, err)
+			err = p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "%s didn't ack: %v", target, err)
+			err = s.replyToPeer(payload, p2p.ConstructErrorMessage(err), fromPeer)
+		} else {
+			err = s.sendAck(payload, respUpdates, fromPeer)
+		}
+		if err != nil {
+			log.Printf("Couldn't reply to PING_REQ from %s: %v", senderAddr, err)
+		}
+	}()
+	return nil
+}
+
+// sendAck answers the PING or PING_REQ with the given payload with an ACK carrying updates
+func (s *Store) sendAck(request *p2p.ControlPayload, updates []membership.Update, toPeer p2p.Peer) error {
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_ACK_CONTROL_COMMAND,
+			Args:    map[string]string{"updates": membership.EncodeUpdates(updates)},
+		},
+	}
+	return s.replyToPeer(request, msg, toPeer)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"file-store/internal/bucket"
+	"file-store/internal/util"
+	"file-store/internal/vclock"
+	"strings"
+	"time"
+)
+
+// FileMetadata is what the metadata DB records about every file in storage
+type FileMetadata struct {
+	// Checksum is the hex encoded sha256 hash of the content of the file
+	Checksum   string    `json:"checksum"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	// Clock is the version vector of the file, which tells whether another version of it replaces it or conflicts with it.
+	// Files written before versioning have none.
+	Clock vclock.Clock `json:"clock,omitempty"`
+	// Siblings are the versions of the file that conflict with this one, and are kept alongside it until they are resolved
+	Siblings []FileMetadata `json:"siblings,omitempty"`
+	// DeletedAt is set once the file is deleted. Its metadata is kept as a tombstone, so that the replicas that still hold the
+	// file delete it too, rather than push it back.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// deleted reports whether m is a tombstone
+func (m FileMetadata) deleted() bool {
+	return m.DeletedAt != nil
+}
+
+// newerThan reports whether the file m describes should be pushed to a node holding the one other describes, if any. If both
+// are versioned, it should be unless other or one of its siblings saw m. Otherwise the last write wins, see lastWriteAfter.
+func (m FileMetadata) newerThan(other *FileMetadata) bool {
+	if other == nil {
+		return true
+	}
+	if m.Clock != nil && other.Clock != nil {
+		for _, version := range other.versions() {
+			if version.Clock.Descends(m.Clock) {
+				return false
+			}
+		}
+		return true
+	}
+	return m.lastWriteAfter(*other)
+}
+
+// supersedes reports whether m replaces every version that other holds, which is the case if none of them should be pushed to a
+// node holding m
+func (m FileMetadata) supersedes(other FileMetadata) bool {
+	for _, version := range other.versions() {
+		if version.newerThan(&m) {
+			return false
+		}
+	}
+	return true
+}
+
+// lastWriteAfter reports whether the file m describes was written after the one other describes. Writes at the same time are
+// ordered by checksum, so that every node picks the same one.
+func (m FileMetadata) lastWriteAfter(other FileMetadata) bool {
+	if m.Checksum == other.Checksum {
+		return false
+	}
+	if !m.ModifiedAt.Equal(other.ModifiedAt) {
+		return m.ModifiedAt.After(other.ModifiedAt)
+	}
+	return m.Checksum > other.Checksum
+}
+
+// versions returns the version m describes followed by its siblings, none of which have siblings of their own
+func (m FileMetadata) versions() []FileMetadata {
+	current := m
+	current.Siblings = nil
+	return append([]FileMetadata{current}, m.Siblings...)
+}
+
+// seen returns the Clock that saw every version m holds, which a write on top of all of them descends from
+func (m FileMetadata) seen() vclock.Clock {
+	seen := vclock.Clock{}
+	for _, version := range m.versions() {
+		seen = seen.Merge(version.Clock)
+	}
+	return seen
+}
+
+// metadataBucket returns the metadata DB bucket that the metadata of the file of key is recorded in, along with the key it is
+// recorded against. Every bucket of files has a metadata DB bucket of its own, so that it can be dropped at once.
+func metadataBucket(key string) (string, string) {
+	name, localKey := bucket.Split(key)
+	if name == "" {
+		return util.MetadataBucketName, key
+	}
+	return util.BucketMetadataBucketPrefix + name, localKey
+}
+
+// recordFileMetadata records the metadata of the file of key, if the Store has a metadata DB
+func (s *Store) recordFileMetadata(key string, metadata FileMetadata) error {
+	if s.MetadataDB == nil {
+		return nil
+	}
+	value, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	boltBucket, localKey := metadataBucket(key)
+	return s.MetadataDB.Put(boltBucket, localKey, value)
+}
+
+// getFileMetadata returns the recorded metadata of the file of key, or nil if there is none
+func (s *Store) getFileMetadata(key string) (*FileMetadata, error) {
+	if s.MetadataDB == nil {
+		return nil, nil
+	}
+	boltBucket, localKey := metadataBucket(key)
+	value, err := s.MetadataDB.Get(boltBucket, localKey)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var metadata FileMetadata
+	if err := json.Unmarshal(value, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// getLiveFileMetadata returns the recorded metadata of the file of key, or nil if there is none or the file was deleted
+func (s *Store) getLiveFileMetadata(key string) (*FileMetadata, error) {
+	metadata, err := s.getFileMetadata(key)
+	if err != nil || metadata == nil || metadata.deleted() {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// forgetFileMetadata removes the metadata of the file of key, if the Store has a metadata DB
+func (s *Store) forgetFileMetadata(key string) error {
+	if s.MetadataDB == nil {
+		return nil
+	}
+	boltBucket, localKey := metadataBucket(key)
+	return s.MetadataDB.Delete(boltBucket, localKey)
+}
+
+// listFileMetadata returns the metadata of every file recorded in the metadata DB, by key
+func (s *Store) listFileMetadata() (map[string]FileMetadata, error) {
+	files := make(map[string]FileMetadata)
+	if s.MetadataDB == nil {
+		return files, nil
+	}
+	boltBuckets, err := s.MetadataDB.BucketNames(util.BucketMetadataBucketPrefix)
+	if err != nil {
+		return files, err
+	}
+	for _, boltBucket := range append([]string{util.MetadataBucketName}, boltBuckets...) {
+		name := strings.TrimPrefix(boltBucket, util.BucketMetadataBucketPrefix)
+		if boltBucket == util.MetadataBucketName {
+			name = ""
+		}
+		err := s.MetadataDB.ForEach(boltBucket, func(key string, value []byte) error {
+			var metadata FileMetadata
+			if err := json.Unmarshal(value, &metadata); err != nil {
+				return err
+			}
+			files[bucket.Qualify(name, key)] = metadata
+			return nil
+		})
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
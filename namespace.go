@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/p2p"
+	"file-store/internal/raft"
+	"file-store/internal/util"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNamespaceDisabled is returned by namespace operations on a Store without Raft
+	ErrNamespaceDisabled = errors.New("the namespace needs Raft peers")
+	// ErrKeyNotFound is returned when a key isn't in the namespace
+	ErrKeyNotFound = errors.New("key not found in the namespace")
+	// ErrVersionConflict is returned when a conditional namespace operation finds the key at another version than expected
+	ErrVersionConflict = errors.New("key is at another version")
+)
+
+// KeyRecord is the version pointer of a key in the namespace, which tells which content the key currently stands for
+type KeyRecord struct {
+	Key string `json:"key"`
+	// Version starts at 1 when the key is created, and goes up by one with every write of it
+	Version    uint64    `json:"version"`
+	Checksum   string    `json:"checksum"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+type namespaceOp string
+
+const (
+	namespacePut    namespaceOp = "put"
+	namespaceDelete namespaceOp = "delete"
+)
+
+// namespaceCommand is a change of the namespace, as committed to the Raft log
+type namespaceCommand struct {
+	Op         namespaceOp `json:"op"`
+	Key        string      `json:"key"`
+	Checksum   string      `json:"checksum,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+	ModifiedAt time.Time   `json:"modified_at,omitempty"`
+	// ExpectedVersion makes the command conditional on the key being at that version, where 0 means it doesn't exist
+	ExpectedVersion *uint64 `json:"expected_version,omitempty"`
+}
+
+// namespaceResult is what applying a namespaceCommand gives back: the record it left, or the reason it was refused
+type namespaceResult struct {
+	Record *KeyRecord `json:"record,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+const (
+	namespaceConflict = "conflict"
+	namespaceNotFound = "not_found"
+)
+
+func (r namespaceResult) err() error {
+	switch r.Error {
+	case "":
+		return nil
+	case namespaceConflict:
+		return ErrVersionConflict
+	case namespaceNotFound:
+		return ErrKeyNotFound
+	default:
+		return errors.New(r.Error)
+	}
+}
+
+// namespaceMachine is the raft.StateMachine that keeps the namespace in the metadata DB
+type namespaceMachine struct {
+	ddb *db.DDB
+}
+
+func (m *namespaceMachine) Apply(cmd []byte) []byte {
+	encoded, _ := json.Marshal(m.apply(cmd))
+	return encoded
+}
+
+func (m *namespaceMachine) apply(cmd []byte) namespaceResult {
+	var command namespaceCommand
+	if err := json.Unmarshal(cmd, &command); err != nil {
+		return namespaceResult{Error: fmt.Sprintf("invalid namespace command: %v", err)}
+	}
+	current, err := getKeyRecord(m.ddb, command.Key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return namespaceResult{Error: err.Error()}
+	}
+	var version uint64
+	if current != nil {
+		version = current.Version
+	}
+	if command.ExpectedVersion != nil && *command.ExpectedVersion != version {
+		return namespaceResult{Record: current, Error: namespaceConflict}
+	}
+
+	switch command.Op {
+	case namespacePut:
+		record := &KeyRecord{Key: command.Key, Version: version + 1, Checksum: command.Checksum, Size: command.Size, ModifiedAt: command.ModifiedAt}
+		encoded, err := json.Marshal(record)
+		if err == nil {
+			err = m.ddb.Put(util.NamespaceBucketName, command.Key, encoded)
+		}
+		if err != nil {
+			return namespaceResult{Error: err.Error()}
+		}
+		return namespaceResult{Record: record}
+	case namespaceDelete:
+		if current == nil {
+			return namespaceResult{Error: namespaceNotFound}
+		}
+		if err := m.ddb.Delete(util.NamespaceBucketName, command.Key); err != nil {
+			return namespaceResult{Error: err.Error()}
+		}
+		return namespaceResult{Record: current}
+	}
+	return namespaceResult{Error: fmt.Sprintf("unknown namespace op %q", command.Op)}
+}
+
+func (m *namespaceMachine) Snapshot() ([]byte, error) {
+	entries := make(map[string]json.RawMessage)
+	err := m.ddb.ForEach(util.NamespaceBucketName, func(key string, value []byte) error {
+		entries[key] = append(json.RawMessage(nil), value...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(entries)
+}
+
+func (m *namespaceMachine) Restore(snapshot []byte) error {
+	var entries map[string]json.RawMessage
+	if snapshot != nil {
+		if err := json.Unmarshal(snapshot, &entries); err != nil {
+			return err
+		}
+	}
+	values := make(map[string][]byte, len(entries))
+	for key, value := range entries {
+		values[key] = value
+	}
+	return m.ddb.Replace(util.NamespaceBucketName, values)
+}
+
+// getKeyRecord returns the KeyRecord of key kept in ddb
+func getKeyRecord(ddb *db.DDB, key string) (*KeyRecord, error) {
+	encoded, err := ddb.Get(util.NamespaceBucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	if encoded == nil {
+		return nil, ErrKeyNotFound
+	}
+	var record KeyRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// withRaftLeader calls fn with the listen address of the Raft leader, until fn gets through or ctx is done. fn is only called
+// again when it certainly had no effect, because the node it reached wasn't the leader or it couldn't reach it at all.
+func (s *Store) withRaftLeader(ctx context.Context, fn func(leader string) error) error {
+	if s.Raft == nil {
+		return ErrNamespaceDisabled
+	}
+	ticker := time.NewTicker(util.RaftRetryInterval)
+	defer ticker.Stop()
+	err := raft.ErrNotLeader
+	for {
+		if leader := s.Raft.Leader(); leader != "" {
+			if err = s.reachRaftLeader(ctx, leader); err == nil {
+				err = fn(leader)
+			}
+			if !errors.Is(err, raft.ErrNotLeader) && !errors.Is(err, p2p.ErrUnavailable) && !errors.Is(err, errRaftLeaderUnreachable) {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// errRaftLeaderUnreachable is returned when the node believed to be the Raft leader can't be connected to
+var errRaftLeaderUnreachable = errors.New("raft leader is unreachable")
+
+// reachRaftLeader connects to leader, unless it is this node
+func (s *Store) reachRaftLeader(ctx context.Context, leader string) error {
+	if leader == s.normalizedListenAddress() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, util.RaftElectionTimeout)
+	defer cancel()
+	if _, err := s.connectToPeer(ctx, leader); err != nil {
+		return fmt.Errorf("%w: %v", errRaftLeaderUnreachable, err)
+	}
+	return nil
+}
+
+// proposeNamespace commits command to the namespace through the Raft leader, and returns the KeyRecord it left
+func (s *Store) proposeNamespace(ctx context.Context, command namespaceCommand) (*KeyRecord, error) {
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	var result namespaceResult
+	err = s.withRaftLeader(ctx, func(leader string) error {
+		if leader == s.normalizedListenAddress() {
+			raw, err := s.Raft.Propose(ctx, encoded)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(raw, &result)
+		}
+		reply, err := s.callPeer(ctx, leader, p2p.MESSAGE_RAFT_PROPOSE_CONTROL_COMMAND, map[string]string{"request": string(encoded)})
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(reply["response"]), &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Record, result.err()
+}
+
+// putKeyVersion points key at the content with the given checksum and size, as its next version. If expected isn't nil, the
+// key must be at that version, where 0 means it must not exist yet, or ErrVersionConflict is returned.
+func (s *Store) putKeyVersion(ctx context.Context, key string, checksum string, size int64, expected *uint64) (*KeyRecord, error) {
+	return s.proposeNamespace(ctx, namespaceCommand{
+		Op:              namespacePut,
+		Key:             key,
+		Checksum:        checksum,
+		Size:            size,
+		ModifiedAt:      time.Now(),
+		ExpectedVersion: expected,
+	})
+}
+
+// deleteKey removes key from the namespace, and returns the last KeyRecord of it. If expected isn't nil, the key must be at that
+// version, or ErrVersionConflict is returned.
+func (s *Store) deleteKey(ctx context.Context, key string, expected *uint64) (*KeyRecord, error) {
+	return s.proposeNamespace(ctx, namespaceCommand{Op: namespaceDelete, Key: key, ExpectedVersion: expected})
+}
+
+// lookupKey returns the KeyRecord of key as of the latest namespace operation committed, as the Raft leader knows it
+func (s *Store) lookupKey(ctx context.Context, key string) (*KeyRecord, error) {
+	var record *KeyRecord
+	err := s.withRaftLeader(ctx, func(leader string) error {
+		var err error
+		if leader == s.normalizedListenAddress() {
+			record, err = s.readKeyRecord(ctx, key)
+			return err
+		}
+		reply, err := s.callPeer(ctx, leader, p2p.MESSAGE_RAFT_READ_CONTROL_COMMAND, map[string]string{"request": key})
+		if errors.Is(err, p2p.ErrNotFound) {
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(reply["response"]), &record)
+	})
+	return record, err
+}
+
+// readKeyRecord returns the KeyRecord of key once this node, as the Raft leader, applied every namespace operation committed so far
+func (s *Store) readKeyRecord(ctx context.Context, key string) (*KeyRecord, error) {
+	if err := s.Raft.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return getKeyRecord(s.MetadataDB, key)
+}
+
+// digestReader hashes and counts the bytes read through it, for the KeyRecord of a file to describe them
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	return &digestReader{r: r, hash: sha256.New()}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func (d *digestReader) checksum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// parseExpectedVersion returns the version a namespace request is conditional on, from its version query parameter, if any
+func parseExpectedVersion(r *http.Request) (*uint64, error) {
+	param := r.URL.Query().Get("version")
+	if param == "" {
+		return nil, nil
+	}
+	version, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version %q", param)
+	}
+	return &version, nil
+}
+
+// writeNamespaceResult writes record as the response to a namespace request, or the status that err stands for
+func writeNamespaceResult(w http.ResponseWriter, record *KeyRecord, err error) {
+	switch {
+	case errors.Is(err, ErrNamespaceDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrVersionConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(record); err != nil {
+			log.Println("Error while writing key record:", err)
+		}
+	}
+}
+
+// handleGetKeyRecord serves the current KeyRecord of a key
+func (s *Store) handleGetKeyRecord(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), util.RaftProposeTimeout)
+	defer cancel()
+	record, err := s.lookupKey(ctx, requestKey(r))
+	writeNamespaceResult(w, record, err)
+}
+
+// handlePutKeyRecord points a key at the content whose checksum and size the body holds, as its next version. With a version
+// query parameter, the key must be at that version, where 0 creates the key only if it doesn't exist yet.
+func (s *Store) handlePutKeyRecord(w http.ResponseWriter, r *http.Request) {
+	expected, err := parseExpectedVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Checksum string `json:"checksum"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid key record: %v", err), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), util.RaftProposeTimeout)
+	defer cancel()
+	record, err := s.putKeyVersion(ctx, requestKey(r), body.Checksum, body.Size, expected)
+	writeNamespaceResult(w, record, err)
+}
+
+// handleDeleteKeyRecord removes a key from the namespace, and then deletes its file on every owner of it, whether or not a copy
+// is held here. With a version query parameter, the key must be at that version.
+func (s *Store) handleDeleteKeyRecord(w http.ResponseWriter, r *http.Request) {
+	expected, err := parseExpectedVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), util.RaftProposeTimeout)
+	defer cancel()
+	key := requestKey(r)
+	record, err := s.deleteKey(ctx, key, expected)
+	if err == nil {
+		if err := s.deleteAudited(key, s.requestActor(r), s.handleDeleteFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error while deleting %s: %v", key, err)
+		}
+	}
+	writeNamespaceResult(w, record, err)
+}
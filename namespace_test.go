@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"file-store/internal/p2p"
+	"file-store/internal/raft"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newRaftCluster starts n nodes that replicate the namespace with Raft among themselves, and waits until they agree on a leader
+func newRaftCluster(t *testing.T, n int) *testCluster {
+	var peers []string
+	for i := 0; i < n; i++ {
+		peers = append(peers, clusterNodeAddr(i))
+	}
+	cluster := startTestCluster(&testCluster{t: t, configure: func(opts *StoreOpts) {
+		opts.RaftPeers = peers
+	}}, n)
+	cluster.waitRaftLeader()
+	return cluster
+}
+
+// waitRaftLeader waits until every node that isn't isolated follows the same Raft leader, and returns the index of the leader
+func (c *testCluster) waitRaftLeader(isolated ...int) int {
+	c.t.Helper()
+	leader := -1
+	assert.Eventually(c.t, func() bool {
+		leaders := make(map[string]bool)
+		for i, store := range c.Nodes {
+			if !slices.Contains(isolated, i) {
+				leaders[store.Raft.Leader()] = true
+			}
+		}
+		for i := range c.Nodes {
+			if len(leaders) == 1 && leaders[clusterNodeAddr(i)] && !slices.Contains(isolated, i) {
+				leader = i
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func TestNamespaceOperationsAreLinearizable(t *testing.T) {
+	cluster := newRaftCluster(t, 3)
+	leader := cluster.waitRaftLeader()
+	follower, other := (leader+1)%3, (leader+2)%3
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Creating a key from a follower goes through the leader, and only one create of the same key wins
+	created := uint64(0)
+	record, err := cluster.Nodes[follower].putKeyVersion(ctx, "doc", "checksum", 8, &created)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), record.Version)
+	_, err = cluster.Nodes[other].putKeyVersion(ctx, "doc", "other checksum", 8, &created)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	record, err = cluster.Nodes[other].lookupKey(ctx, "doc")
+	assert.Nil(t, err)
+	assert.Equal(t, "checksum", record.Checksum)
+
+	// Storing the file moves the key to a new version that describes its content
+	data := []byte("the content of the doc")
+	cluster.Store(follower, "doc", data)
+	sum := sha256.Sum256(data)
+	record, err = cluster.Nodes[leader].lookupKey(ctx, "doc")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), record.Version)
+	assert.Equal(t, hex.EncodeToString(sum[:]), record.Checksum)
+	assert.Equal(t, int64(len(data)), record.Size)
+
+	// A delete of a stale version is refused, and once the key is deleted every node agrees it is gone
+	stale := uint64(1)
+	_, err = cluster.Nodes[other].deleteKey(ctx, "doc", &stale)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	current := uint64(2)
+	_, err = cluster.Nodes[other].deleteKey(ctx, "doc", &current)
+	assert.Nil(t, err)
+	for _, store := range cluster.Nodes {
+		_, err = store.lookupKey(ctx, "doc")
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+}
+
+func TestNamespaceSurvivesLeaderLoss(t *testing.T) {
+	cluster := newRaftCluster(t, 3)
+	leader := cluster.waitRaftLeader()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := cluster.Nodes[leader].putKeyVersion(ctx, "doc", "first", 1, nil)
+	assert.Nil(t, err)
+
+	// The others elect a leader of their own, which knows of every committed write
+	cluster.Isolate(leader)
+	newLeader := cluster.waitRaftLeader(leader)
+	assert.NotEqual(t, leader, newLeader)
+	record, err := cluster.Nodes[newLeader].putKeyVersion(ctx, "doc", "second", 2, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), record.Version)
+
+	// And the namespace can be read over the HTTP API of the node left
+	w := httptest.NewRecorder()
+	cluster.Nodes[3-leader-newLeader].newHTTPHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/namespace/doc", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var read KeyRecord
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &read))
+	assert.Equal(t, "second", read.Checksum)
+}
+
+func TestNamespaceDeletesRemoveTheFileFromEveryOwner(t *testing.T) {
+	cluster := newRaftCluster(t, 3)
+	cluster.Store(0, "doc", []byte("the content of the doc"))
+	cluster.WaitStored("doc", 1, 2)
+
+	// The key is deleted through a node holding no copy of the file, and every copy goes, never to be synced back
+	assert.Nil(t, cluster.Nodes[1].handleFileDelete("doc"))
+	w := httptest.NewRecorder()
+	cluster.Nodes[1].newHTTPHandler().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/namespace/doc", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	cluster.WaitDeleted("doc", 0, 2)
+	cluster.syncNodes(0, 1)
+	cluster.syncNodes(1, 2)
+	for i := range cluster.Nodes {
+		_, err := cluster.Nodes[i].handleGetFile("doc", true)
+		assert.ErrorIs(t, err, os.ErrNotExist, "node %d", i)
+	}
+}
+
+func TestRaftSnapshotChunksFitInAFrame(t *testing.T) {
+	// A full chunk, sent the way callRaft sends it, fits in a frame of either codec
+	encoded, err := json.Marshal(raft.InstallSnapshotRequest{
+		Term:              1 << 40,
+		LeaderID:          "255.255.255.255:65535",
+		LastIncludedIndex: 1 << 40,
+		LastIncludedTerm:  1 << 40,
+		Offset:            1 << 40,
+		Data:              bytes.Repeat([]byte{0xff}, raftSnapshotChunkSize),
+	})
+	assert.Nil(t, err)
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_RAFT_INSTALL_SNAPSHOT_CONTROL_COMMAND,
+			Args: map[string]string{
+				"request":        string(encoded),
+				"sender_addr":    "255.255.255.255:65535",
+				p2p.RequestIDArg: "ffffffffffffffffffffffffffffffff",
+			},
+		},
+	}
+	for _, codec := range []p2p.Codec{&p2p.DefaultCodec{}, &p2p.ProtobufCodec{}} {
+		var frame bytes.Buffer
+		assert.Nil(t, codec.Encode(&frame, &msg), codec.Name())
+		var decoded p2p.Message
+		assert.Nil(t, codec.Decode(&frame, &decoded), codec.Name())
+		assert.Equal(t, msg.Payload, decoded.Payload, codec.Name())
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"file-store/internal/dht"
+	"file-store/internal/peers"
+	"file-store/internal/util"
+)
+
+// newStorePeerManager creates the peer manager of the Store, which dials through the Store's Transport
+func newStorePeerManager(s *Store) *peers.Manager {
+	opts := peers.ManagerOpts{
+		BaseBackoff:  util.PeerReconnectBaseBackoff,
+		MaxBackoff:   util.PeerReconnectMaxBackoff,
+		KnownPeerTTL: util.KnownPeerTTL,
+		OnConnected:  s.onPeerConnected,
+		HasConnection: func(addr string) bool {
+			_, exists := s.peerForAddr(addr)
+			return exists
+		},
+	}
+	return peers.NewManager(opts, s.dialPeer)
+}
+
+// onPeerConnected joins the cluster and the DHT through a peer the peer manager just (re)connected to. Joining again after a
+// reconnect is cheap, and merges back whatever either side missed while the connection was down.
+func (s *Store) onPeerConnected(addr string) {
+	go func() {
+		s.joinCluster([]string{addr})
+		if s.DHT.Table.Len() == 0 {
+			s.bootstrapDHT([]string{addr})
+		} else {
+			s.DHT.Observe(dht.NewContact(addr))
+		}
+	}()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"file-store/internal/db"
+	"file-store/internal/p2p"
+	"file-store/internal/raft"
+	"file-store/internal/util"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// raftSnapshotChunkSize is how many bytes of the snapshot an INSTALL_SNAPSHOT carries at most. The chunk is base64 encoded in the
+// JSON of the request, which grows it by a third, and has to fit in a single frame along with the rest of the message.
+const raftSnapshotChunkSize = (p2p.MAX_DECODER_BUFFER_SIZE - util.RaftSnapshotFrameOverhead) * 3 / 4
+
+// newStoreRaftNode returns the Raft node of s, that replicates the namespace over its peers in the Raft cluster and persists in ddb
+func newStoreRaftNode(s *Store, ddb *db.DDB) (*raft.Node, error) {
+	var peers []string
+	for _, peer := range s.StoreOpts.RaftPeers {
+		addr, err := util.SafeStringToAddr(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Raft peer %s: %w", peer, err)
+		}
+		peers = append(peers, addr.String())
+	}
+	opts := raft.Opts{
+		ElectionTimeout:     util.RaftElectionTimeout,
+		HeartbeatInterval:   util.RaftHeartbeatInterval,
+		SnapshotThreshold:   util.RaftSnapshotThreshold,
+		MaxEntriesPerAppend: util.RaftMaxEntriesPerAppend,
+		SnapshotChunkSize:   raftSnapshotChunkSize,
+	}
+	return raft.NewNode(opts, s.normalizedListenAddress(), peers, storeRaftTransport{store: s}, raft.NewStorage(ddb), &namespaceMachine{ddb: ddb})
+}
+
+// storeRaftTransport sends the RPCs of the Raft node to its peers as Control Messages, over the Transport of the Store
+type storeRaftTransport struct {
+	store *Store
+}
+
+func (t storeRaftTransport) RequestVote(ctx context.Context, peer string, req raft.RequestVoteRequest) (raft.RequestVoteResponse, error) {
+	var resp raft.RequestVoteResponse
+	err := t.store.callRaft(ctx, peer, p2p.MESSAGE_RAFT_REQUEST_VOTE_CONTROL_COMMAND, req, &resp)
+	return resp, err
+}
+
+func (t storeRaftTransport) AppendEntries(ctx context.Context, peer string, req raft.AppendEntriesRequest) (raft.AppendEntriesResponse, error) {
+	var resp raft.AppendEntriesResponse
+	err := t.store.callRaft(ctx, peer, p2p.MESSAGE_RAFT_APPEND_ENTRIES_CONTROL_COMMAND, req, &resp)
+	return resp, err
+}
+
+func (t storeRaftTransport) InstallSnapshot(ctx context.Context, peer string, req raft.InstallSnapshotRequest) (raft.InstallSnapshotResponse, error) {
+	var resp raft.InstallSnapshotResponse
+	err := t.store.callRaft(ctx, peer, p2p.MESSAGE_RAFT_INSTALL_SNAPSHOT_CONTROL_COMMAND, req, &resp)
+	return resp, err
+}
+
+// callRaft sends req as a Raft RPC to the node listening on addr, and decodes its RAFT_RESPONSE into resp
+func (s *Store) callRaft(ctx context.Context, addr string, command p2p.ControlMessage, req any, resp any) error {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	reply, err := s.callPeer(ctx, addr, command, map[string]string{"request": string(encoded)})
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(reply["response"]), resp); err != nil {
+		return fmt.Errorf("invalid RAFT_RESPONSE to %s from %s: %w", command, addr, err)
+	}
+	return nil
+}
+
+// handleRaftRequest answers a Raft RPC from fromPeer, or a proposal or read forwarded to this node as the leader, with a RAFT_RESPONSE
+func (s *Store) handleRaftRequest(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	if s.Raft == nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "no Raft on %s", s.StoreOpts.ListenAddress)
+	}
+	var (
+		request = []byte(payload.Args["request"])
+		resp    any
+		err     error
+	)
+	decode := func(req any) error {
+		if err := json.Unmarshal(request, req); err != nil {
+			return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid %s Control Message %s: %v", payload.Command, fromPeer.String(), err)
+		}
+		return nil
+	}
+	switch payload.Command {
+	case p2p.MESSAGE_RAFT_REQUEST_VOTE_CONTROL_COMMAND:
+		var req raft.RequestVoteRequest
+		if err = decode(&req); err == nil {
+			resp, err = s.Raft.HandleRequestVote(req)
+		}
+	case p2p.MESSAGE_RAFT_APPEND_ENTRIES_CONTROL_COMMAND:
+		var req raft.AppendEntriesRequest
+		if err = decode(&req); err == nil {
+			resp, err = s.Raft.HandleAppendEntries(req)
+		}
+	case p2p.MESSAGE_RAFT_INSTALL_SNAPSHOT_CONTROL_COMMAND:
+		var req raft.InstallSnapshotRequest
+		if err = decode(&req); err == nil {
+			resp, err = s.Raft.HandleInstallSnapshot(req)
+		}
+	case p2p.MESSAGE_RAFT_PROPOSE_CONTROL_COMMAND:
+		ctx, cancel := context.WithTimeout(context.Background(), util.RaftProposeTimeout)
+		defer cancel()
+		var result []byte
+		if result, err = s.Raft.Propose(ctx, request); err == nil {
+			resp = json.RawMessage(result)
+		}
+	case p2p.MESSAGE_RAFT_READ_CONTROL_COMMAND:
+		ctx, cancel := context.WithTimeout(context.Background(), util.RaftProposeTimeout)
+		defer cancel()
+		if resp, err = s.readKeyRecord(ctx, string(request)); errors.Is(err, ErrKeyNotFound) {
+			return p2p.NewRemoteError(p2p.ErrorCodeNotFound, "%s not found in the namespace", request)
+		}
+	}
+	// A node that isn't the leader is only unavailable until the next leader is known
+	if errors.Is(err, raft.ErrNotLeader) {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "%s on %s: %v", payload.Command, s.StoreOpts.ListenAddress, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.replyToPeer(payload, constructRaftResponse(map[string]string{"response": string(encoded)}), fromPeer)
+}
+
+// constructRaftResponse constructs and returns a MESSAGE_RAFT_RESPONSE_CONTROL_COMMAND message with the given args
+func constructRaftResponse(args map[string]string) p2p.Message {
+	return p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_RAFT_RESPONSE_CONTROL_COMMAND,
+			Args:    args,
+		},
+	}
+}
+
+// handleGetRaft serves the status of the Raft node of this node
+func (s *Store) handleGetRaft(w http.ResponseWriter, r *http.Request) {
+	if s.Raft == nil {
+		http.Error(w, "Raft is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Raft.Status()); err != nil {
+		log.Println("Error while writing Raft status:", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"file-store/internal/p2p"
+	"file-store/internal/rebalance"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// placementNodes returns the listen addresses of the nodes files are placed on: this Store and every live member, along with the
+// failed ones if withFailed is set
+func (s *Store) placementNodes(withFailed bool) []string {
+	nodes := []string{s.normalizedListenAddress()}
+	members := s.Members.Members()
+	if withFailed {
+		members = append(members, s.Members.Failed()...)
+	}
+	for _, member := range members {
+		nodes = append(nodes, member.Addr)
+	}
+	return nodes
+}
+
+// ownsAll reports whether every one of nodes owns every key replicated replicationFactor times, which is the case while there
+// are no more of them than the replication factor
+func ownsAll(nodes []string, replicationFactor int) bool {
+	return replicationFactor <= 0 || len(nodes) <= replicationFactor
+}
+
+// isOwnedBy reports whether the file of key is owned by every one of addrs, out of nodes
+func (s *Store) isOwnedBy(key string, nodes []string, addrs ...string) bool {
+	replicationFactor := s.replicationFactor(key)
+	if ownsAll(nodes, replicationFactor) {
+		return true
+	}
+	owners := make(map[string]bool, replicationFactor)
+	for _, owner := range rebalance.Owners(key, nodes, replicationFactor) {
+		owners[owner] = true
+	}
+	for _, addr := range addrs {
+		if !owners[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// replicaPeers returns the connected peers the file of key, of size bytes, is replicated to, keyed like PeerMap. Those are the
+// other owners of it, except for the ones that advertised no room for it, which the next nearest nodes with room stand in for.
+// Owners that aren't connected still count, since the write is held for them as a hint.
+func (s *Store) replicaPeers(key string, size int64) map[string]p2p.Peer {
+	peers, _ := s.placeReplicas(key, size)
+	return peers
+}
+
+// placeReplicas returns the peers that replicaPeers does, along with how many of the replicas of the file of key, of size bytes,
+// no node with room for it was found for
+func (s *Store) placeReplicas(key string, size int64) (map[string]p2p.Peer, int) {
+	nodes := s.placementNodes(false)
+	replicationFactor := s.replicationFactor(key)
+	peers := make(map[string]p2p.Peer)
+	missing := 0
+	if ownsAll(nodes, replicationFactor) {
+		for id, peer := range s.connectedPeers() {
+			if peerHasRoom(peer, size) {
+				peers[id] = peer
+			} else {
+				missing++
+			}
+		}
+		return peers, missing
+	}
+	self := s.normalizedListenAddress()
+	replicas := 0
+	for i, node := range rebalance.Owners(key, nodes, len(nodes)) {
+		if replicas == replicationFactor {
+			break
+		}
+		if node == self {
+			replicas++
+			continue
+		}
+		peer, connected := s.peerForAddr(node)
+		if !connected {
+			if i < replicationFactor {
+				replicas++
+			}
+			continue
+		}
+		if !peerHasRoom(peer, size) {
+			log.Printf("Skipping %s for %s, which has no room for it", node, key)
+			continue
+		}
+		peers[peer.String()] = peer
+		replicas++
+	}
+	return peers, max(replicationFactor-replicas, 0)
+}
+
+// scheduleRebalance has the rebalancer run once the membership settles, unless a rebalance is already pending
+func (s *Store) scheduleRebalance() {
+	select {
+	case s.rebalanceCh <- struct{}{}:
+	default:
+	}
+}
+
+// runRebalancer rebalances the files held every time the membership changes. Changes that come in within RebalanceSettleDelay
+// of each other, e.g, a node joining along with the members it knows of, are rebalanced at once.
+func (s *Store) runRebalancer() {
+	for {
+		select {
+		case <-s.rebalanceCh:
+		case <-s.shutdownCh:
+			return
+		}
+		select {
+		case <-time.After(util.RebalanceSettleDelay):
+		case <-s.shutdownCh:
+			return
+		}
+		s.rebalance()
+	}
+}
+
+// rebalance sends the files held to the nodes that own them as of the current membership, but didn't as of the previous one.
+// The files that this Store no longer owns are kept until the new owners it sends them to confirmed they stored them, so that
+// reads of them don't miss until then, and dropped afterwards. The ones that couldn't be handed off are left over, and sent to
+// every owner of them on the next rebalance. A Store that just started has no previous view to compare with, so the first
+// membership it sees is taken as is, and the owners that miss files until then are repaired by anti-entropy with the others.
+func (s *Store) rebalance() {
+	newNodes := s.placementNodes(false)
+	s.placementLock.Lock()
+	oldNodes := s.placementView
+	s.placementView = newNodes
+	s.placementLock.Unlock()
+	if oldNodes == nil || s.MetadataDB == nil {
+		return
+	}
+
+	files, err := s.listFileMetadata()
+	if err != nil {
+		log.Println("Error while listing file metadata:", err)
+		return
+	}
+	// The files of buckets with a replication factor of their own are planned apart from the others
+	held := make(map[int]map[string]int64)
+	for key, metadata := range files {
+		// Tombstones reach the new owners through anti-entropy
+		if metadata.deleted() {
+			continue
+		}
+		replicationFactor := s.replicationFactor(key)
+		if held[replicationFactor] == nil {
+			held[replicationFactor] = make(map[string]int64)
+		}
+		held[replicationFactor][key] = metadata.Size
+	}
+	replicationFactors := make([]int, 0, len(held))
+	for replicationFactor := range held {
+		replicationFactors = append(replicationFactors, replicationFactor)
+	}
+	sort.Ints(replicationFactors)
+	self := s.normalizedListenAddress()
+	var transfers []rebalance.Transfer
+	for _, replicationFactor := range replicationFactors {
+		transfers = append(transfers, rebalance.Plan(self, held[replicationFactor], oldNodes, newNodes, replicationFactor)...)
+		transfers = append(transfers, s.leftoverTransfers(held[replicationFactor], oldNodes, newNodes, replicationFactor)...)
+	}
+
+	// pending counts the transfers of each key that weren't confirmed yet
+	pending := make(map[string]int)
+	for _, transfer := range transfers {
+		pending[transfer.Key]++
+	}
+	if len(transfers) > 0 {
+		s.Rebalance.Start(transfers)
+		log.Printf("Rebalancing %d files across %d nodes", len(transfers), len(newNodes))
+		limiter := rebalance.NewLimiter(s.StoreOpts.RebalanceRate)
+		for _, transfer := range transfers {
+			if s.isShuttingDown() {
+				break
+			}
+			err := s.transferFile(transfer, limiter)
+			if err != nil {
+				log.Printf("Couldn't send %s to %s, its new owner: %v", transfer.Key, transfer.To, err)
+			} else {
+				pending[transfer.Key]--
+			}
+			s.Rebalance.Done(transfer, err)
+		}
+		s.Rebalance.Finish()
+		progress := s.Rebalance.Progress()
+		log.Printf("Rebalanced %d of %d files (%d bytes), %d failed", progress.Transferred, progress.Planned, progress.BytesTransferred, progress.Failed)
+	}
+
+	for key, metadata := range files {
+		if metadata.deleted() || pending[key] > 0 || s.isOwnedBy(key, newNodes, self) {
+			continue
+		}
+		if err := s.dropUnownedFile(key, metadata); err != nil {
+			log.Printf("Error while dropping %s, which is no longer owned here: %v", key, err)
+		}
+	}
+}
+
+// leftoverTransfers returns the transfers of the files of held, which map keys to their sizes, that this Store owned neither
+// as of oldNodes nor as of newNodes, to every owner of them. Those are left over from an earlier rebalance that couldn't hand
+// them off, or were written here without being owned here.
+func (s *Store) leftoverTransfers(held map[string]int64, oldNodes []string, newNodes []string, replicationFactor int) []rebalance.Transfer {
+	self := s.normalizedListenAddress()
+	var transfers []rebalance.Transfer
+	for key, size := range held {
+		if s.isOwnedBy(key, oldNodes, self) || s.isOwnedBy(key, newNodes, self) {
+			continue
+		}
+		for _, owner := range rebalance.Owners(key, newNodes, replicationFactor) {
+			transfers = append(transfers, rebalance.Transfer{Key: key, To: owner, Size: size})
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].Key != transfers[j].Key {
+			return transfers[i].Key < transfers[j].Key
+		}
+		return transfers[i].To < transfers[j].To
+	})
+	return transfers
+}
+
+// dropUnownedFile drops the local copy of the file of key, which this Store no longer owns, without leaving a tombstone. It is
+// only dropped if listed, the versions of it that were handed off, supersedes every version held, rather than one written since.
+func (s *Store) dropUnownedFile(key string, listed FileMetadata) error {
+	defer s.lockVersions(key)()
+	current, err := s.getLiveFileMetadata(key)
+	if err != nil || current == nil || !listed.supersedes(*current) {
+		return err
+	}
+	log.Printf("Dropping %s, which the new owners of it hold", key)
+	return s.handleFileDelete(key)
+}
+
+// transferFile sends the stored file of transfer to its new owner, at the pace limiter allows
+func (s *Store) transferFile(transfer rebalance.Transfer, limiter *rebalance.Limiter) error {
+	defer s.beginTransfer()()
+	ctx, cancel := context.WithTimeout(context.Background(), util.RebalanceConnectTimeout)
+	defer cancel()
+	peer, err := s.connectToPeer(ctx, transfer.To)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.getLiveFileMetadata(transfer.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return os.ErrNotExist
+	}
+	// Siblings are sent along with the current version, since the local copy of every version is dropped once they are
+	for _, version := range current.versions() {
+		if err := s.transferVersion(transfer.Key, version, peer, limiter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferVersion sends the given version of the stored file of key to toPeer at the pace limiter allows, and returns once
+// toPeer stored it
+func (s *Store) transferVersion(key string, version FileMetadata, toPeer p2p.Peer, limiter *rebalance.Limiter) error {
+	fd, version, err := s.openVersion(key, version.Checksum)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if version.Size > util.MaxAllowedDataPayloadSize {
+		return s.streamToPeer(key, fd, versionArgs(version), upload.NewSessionID(), 0, toPeer, limiter)
+	}
+	if err := limiter.WaitN(context.Background(), int(version.Size)); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), util.RebalanceConnectTimeout)
+	defer cancel()
+	return s.storeOnPeer(ctx, withVersionArgs(p2p.ConstructDataMessage(key, data), version), toPeer)
+}
+
+// handleGetRebalance reports the progress of the latest rebalance
+func (s *Store) handleGetRebalance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Rebalance.Progress()); err != nil {
+		log.Println("Error while writing rebalance progress:", err)
+	}
+}
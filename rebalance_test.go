@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"file-store/internal/rebalance"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// waitPlaced waits until every node knows every other one as a live member, and placed files across all of them
+func (c *testCluster) waitPlaced() {
+	c.t.Helper()
+	assert.Eventually(c.t, func() bool {
+		for _, store := range c.Nodes {
+			store.placementLock.Lock()
+			placed := len(store.placementView)
+			store.placementLock.Unlock()
+			if len(store.Members.Members()) != len(c.Nodes)-1 || placed != len(c.Nodes) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// waitOwnersHold waits until every one of the given keys is held by each of its owners among the given nodes
+func (c *testCluster) waitOwnersHold(keys []string, nodes ...int) {
+	c.t.Helper()
+	var addrs []string
+	for _, i := range nodes {
+		addrs = append(addrs, clusterNodeAddr(i))
+	}
+	assert.Eventually(c.t, func() bool {
+		for _, key := range keys {
+			for _, owner := range rebalance.Owners(key, addrs, c.replicationFactor) {
+				for _, i := range nodes {
+					if clusterNodeAddr(i) == owner && !c.Nodes[i].existsInStorage(key) {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// waitOnlyOwnersHold waits until every one of the given keys is held by its owners among the given nodes, and by no other node
+func (c *testCluster) waitOnlyOwnersHold(keys []string, nodes ...int) {
+	c.t.Helper()
+	var addrs []string
+	for _, i := range nodes {
+		addrs = append(addrs, clusterNodeAddr(i))
+	}
+	assert.Eventually(c.t, func() bool {
+		for _, key := range keys {
+			owners := make(map[string]bool)
+			for _, owner := range rebalance.Owners(key, addrs, c.replicationFactor) {
+				owners[owner] = true
+			}
+			for _, i := range nodes {
+				if owners[clusterNodeAddr(i)] != c.Nodes[i].existsInStorage(key) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestFilesAreReplicatedToTheirOwners(t *testing.T) {
+	cluster := newTestClusterWithReplication(t, 4, 2)
+	cluster.waitPlaced()
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		cluster.Store(0, key, []byte("content of "+key))
+	}
+	cluster.waitOwnersHold(keys, 0, 1, 2, 3)
+
+	// Nodes other than the writer only hold the files they own
+	addrs := []string{clusterNodeAddr(0), clusterNodeAddr(1), clusterNodeAddr(2), clusterNodeAddr(3)}
+	for _, key := range keys {
+		owners := rebalance.Owners(key, addrs, 2)
+		for i := 1; i < 4; i++ {
+			assert.Equal(t, owners[0] == clusterNodeAddr(i) || owners[1] == clusterNodeAddr(i), cluster.Nodes[i].existsInStorage(key), "%s on node %d", key, i)
+		}
+	}
+}
+
+func TestRebalanceOnJoinAndLeave(t *testing.T) {
+	cluster := newTestClusterWithReplication(t, 3, 2)
+	cluster.waitPlaced()
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		cluster.Store(i%3, key, []byte("content of "+key))
+	}
+	cluster.waitOwnersHold(keys, 0, 1, 2)
+
+	// A node that joins is sent the files it now owns, which the nodes that no longer own them drop once it stored them. So do
+	// the nodes the files were written on without owning them.
+	cluster.AddNode()
+	cluster.waitPlaced()
+	cluster.waitOnlyOwnersHold(keys, 0, 1, 2, 3)
+	for _, key := range keys {
+		if cluster.Nodes[3].existsInStorage(key) {
+			data, err := cluster.Nodes[3].handleFileRead(key)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("content of "+key), data)
+		}
+	}
+
+	// The files a node that leaves owned are replicated to their new owners, so that they keep two replicas
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, cluster.Nodes[1].shutdown(ctx, false))
+	cluster.waitOwnersHold(keys, 0, 2, 3)
+
+	// Every rebalance is reported done, without failures
+	assert.Eventually(t, func() bool {
+		for _, i := range []int{0, 2, 3} {
+			if cluster.Nodes[i].Rebalance.Progress().Running {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	var transferred int
+	for _, i := range []int{0, 2, 3} {
+		progress := cluster.Nodes[i].Rebalance.Progress()
+		assert.Zero(t, progress.Failed)
+		transferred += progress.Transferred
+	}
+	assert.Positive(t, transferred)
+}
@@ -2,33 +2,87 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"file-store/internal/acl"
+	"file-store/internal/audit"
+	"file-store/internal/bucket"
+	"file-store/internal/capacity"
+	"file-store/internal/db"
+	"file-store/internal/dht"
+	"file-store/internal/erasure"
 	"file-store/internal/file"
+	"file-store/internal/hints"
+	"file-store/internal/membership"
 	"file-store/internal/p2p"
+	"file-store/internal/peers"
+	"file-store/internal/raft"
+	"file-store/internal/rebalance"
+	"file-store/internal/swarm"
+	"file-store/internal/upload"
 	"file-store/internal/util"
+	"file-store/internal/vclock"
+	"file-store/internal/workerpool"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 func (s *Store) OnPeer(p p2p.Peer) error {
+	// A connection dialed back to verify an alias is handed to the verification, rather than added to PeerMap
+	if probe, probing := s.aliasProbes.LoadAndDelete(p.RemoteAddr().String()); probing {
+		s.probePeers.Store(p, struct{}{})
+		probe.(chan p2p.Peer) <- p
+		return nil
+	}
+
 	s.PeerLock.Lock()
 	defer s.PeerLock.Unlock()
 
 	log.Printf("Adding peer %s to PeerMap\n", p.RemoteAddr())
 	s.PeerMap[p.RemoteAddr().String()] = p
 
+	// Ask the peer to continue any uploads it was streaming to us before the connection dropped, and hand the writes it missed off
+	go s.requestUploadResumption(p, p.RemoteAddr().String())
+	go s.replayHints(p.RemoteAddr().String())
+
 	return nil
 }
 
+// OnPeerDisconnect forgets a peer whose connection ended, and has the peer manager redial it if it is still wanted
+func (s *Store) OnPeerDisconnect(p p2p.Peer) {
+	if _, probe := s.probePeers.LoadAndDelete(p); probe {
+		return
+	}
+	s.PeerLock.Lock()
+	peerKey := p.RemoteAddr().String()
+	listenAddr := peerKey
+	if current, exists := s.PeerMap[peerKey]; exists && current == p {
+		log.Printf("Removing peer %s from PeerMap\n", peerKey)
+		delete(s.PeerMap, peerKey)
+	}
+	for alias, aliasedKey := range s.PeerAliases {
+		if aliasedKey == peerKey {
+			listenAddr = alias
+			delete(s.PeerAliases, alias)
+		}
+	}
+	s.PeerLock.Unlock()
+
+	s.Peers.Disconnected(listenAddr)
+}
+
 func onPeerFailure(peer p2p.Peer) error {
 	return fmt.Errorf("error occuring")
 }
@@ -63,28 +117,106 @@ type StoreOpts struct {
 	MessageFormat       p2p.MessageFormat
 	BaseStorageLocation string
 	BootstrapNodes      []string
+	// SwarmFetch makes handleGetFile fetch chunks from every peer holding the file in parallel
+	SwarmFetch bool
+	// HeartbeatInterval is how often every connected peer is sent a HEARTBEAT
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long a peer may stay silent before its connection is evicted
+	HeartbeatTimeout time.Duration
+	// ReplicationFactor is how many nodes own every file, which is every node if it is 0
+	ReplicationFactor int
+	// RebalanceRate is how many bytes per second a rebalance may send, without a limit if it is 0
+	RebalanceRate int64
+	// ErasureDataShards and ErasureParityShards are how many data and parity shards files are erasure coded into, rather than
+	// replicated, if ErasureDataShards isn't 0
+	ErasureDataShards   int
+	ErasureParityShards int
+	// ShardRepairInterval is how often the lost shards of erasure coded files are rebuilt
+	ShardRepairInterval time.Duration
+	// RaftPeers holds the listen addresses of the nodes that replicate key metadata with Raft, this one included. Key metadata
+	// is only kept locally if it is empty.
+	RaftPeers []string
+	// ConflictResolver resolves the conflicting versions of a file when their resolution is requested without content of its own,
+	// and is LastWriterWins if it is nil
+	ConflictResolver ConflictResolver
+	// AntiEntropyInterval is how often the files held are compared with those of a random peer
+	AntiEntropyInterval time.Duration
+	// MessageWorkers is how many messages from peers may be handled at once
+	MessageWorkers int
+	// FetchTimeout is how long fetching a file from peers may take
+	FetchTimeout time.Duration
+	// AdminToken is the token that authenticates as acl.Root. Every request to the HTTP API has to be made with a token, which
+	// the ACL authorizes, if it is set, and none has to otherwise.
+	AdminToken string
 }
 
 type Store struct {
-	StoreOpts              StoreOpts
-	Transport              p2p.Transport
-	PeerLock               sync.Mutex
-	PeerMap                map[string]p2p.Peer
-	FetchResponseChans     map[string]chan p2p.FetchResult
-	FetchResponseChansLock sync.RWMutex
+	StoreOpts StoreOpts
+	Transport p2p.Transport
+	PeerLock  sync.Mutex
+	PeerMap   map[string]p2p.Peer
+	// MetadataDB and the features depending on it are nil until attachMetadataDB is called
+	MetadataDB *db.DDB
+	Uploads    *upload.Manager
+	Hints      *hints.Manager
+	DHT        *dht.DHT
+	Members    *membership.Memberlist
+	Peers      *peers.Manager
+	Rebalance  *rebalance.Tracker
+	Shards     *erasure.ShardStore
+	// Capacity tracks how much room for files this Store has
+	Capacity *capacity.Tracker
+	// Buckets holds the isolated key spaces that files may be stored in, besides the default one
+	Buckets *bucket.Registry
+	// ACL holds the principals that requests to the HTTP API are made as, and their tokens
+	ACL *acl.Registry
+	// Audit is the log of the data operations made on this Store, by clients and peers alike
+	Audit *audit.Log
+	// Raft is the node that replicates key metadata, if StoreOpts.RaftPeers is set
+	Raft *raft.Node
+	// PeerAliases maps the listen addresses of peers connected to us to their key in PeerMap
+	PeerAliases map[string]string
+	dialLocks   sync.Map
+	// aliasClaims maps the aliases claimed by peers that are being verified to a channel closed once they are
+	aliasClaims sync.Map
+	// aliasProbes maps the listen addresses dialed back to verify an alias to the channel their connection is handed to
+	aliasProbes sync.Map
+	// probePeers holds the connections dialed back to verify aliases, which are never taken for the peer they connect to
+	probePeers sync.Map
+	// heartbeatsInFlight holds the peers a HEARTBEAT is currently being sent to
+	heartbeatsInFlight sync.Map
+	// hintReplays holds the owners that hints are currently being handed off to
+	hintReplays sync.Map
+	// reproviding is set while the files held are being announced in the DHT again, see reprovideKeys
+	reproviding atomic.Bool
+	// swarmManifests holds the manifests of the files served to swarm fetches lately
+	swarmManifests *swarm.ManifestCache
+	// versionLocks serialize the writes of the versions of every key, see lockVersions
+	versionLocks [util.VersionLockStripes]sync.Mutex
+	// placementView holds the nodes that owned the files as of the last rebalance, which rebalanceCh triggers the next one of
+	placementLock sync.Mutex
+	placementView []string
+	rebalanceCh   chan struct{}
+	// shutdownCh is closed once shutdown begins, and closedCh once it is over
+	shutdownCh      chan struct{}
+	closedCh        chan struct{}
+	shutdownOnce    sync.Once
+	activeTransfers atomic.Int64
+	httpServer      atomic.Pointer[http.Server]
 }
 
 var globalStore *Store
 
 // createStoreWithDefaultOptions initializes a Store with default options using a content-addressable path transform function.
 func createStoreWithDefaultOptions(listenAddress string, bootstrapNodes []string, fileStorageBasePath string) *Store {
-	// Prepare Transport with opts
-	tcpOpts := p2p.TCPTransportOpts{
-		ListenAddress: listenAddress,
-		HandshakeFunc: p2p.NOHANDSHAKE,
-		Codec:         &p2p.DefaultCodec{},
-	}
-	tTransport := p2p.NewTCPTransport(tcpOpts, util.MessageChanBufferSize)
+	return createStoreOnTransport(listenAddress, bootstrapNodes, fileStorageBasePath, func(opts p2p.TCPTransportOpts) p2p.Transport {
+		return p2p.NewTCPTransport(opts, util.MessageChanBufferSize)
+	})
+}
+
+// createStoreOnTransport initializes a Store with default options like createStoreWithDefaultOptions, on the Transport that
+// newTransport creates from the default transport opts, e.g, a p2p.MemoryTransport.
+func createStoreOnTransport(listenAddress string, bootstrapNodes []string, fileStorageBasePath string, newTransport func(p2p.TCPTransportOpts) p2p.Transport) *Store {
 	// Prepare Store with opts
 	opts := StoreOpts{
 		ListenAddress:       listenAddress,
@@ -92,17 +224,42 @@ func createStoreWithDefaultOptions(listenAddress string, bootstrapNodes []string
 		MessageFormat:       p2p.JSONFormat{},
 		BaseStorageLocation: fileStorageBasePath,
 		BootstrapNodes:      bootstrapNodes,
+		HeartbeatInterval:   util.DefaultHeartbeatInterval,
+		HeartbeatTimeout:    util.DefaultHeartbeatTimeout,
+		ReplicationFactor:   util.DefaultReplicationFactor,
+		RebalanceRate:       util.DefaultRebalanceRate,
+		ShardRepairInterval: util.DefaultShardRepairInterval,
+		AntiEntropyInterval: util.DefaultAntiEntropyInterval,
+		MessageWorkers:      util.DefaultMessageWorkers,
+		FetchTimeout:        util.FetchMessageResponseTimeout,
 	}
 	store := Store{
-		StoreOpts:              opts,
-		Transport:              tTransport,
-		PeerLock:               sync.Mutex{},
-		PeerMap:                make(map[string]p2p.Peer),
-		FetchResponseChans:     make(map[string]chan p2p.FetchResult),
-		FetchResponseChansLock: sync.RWMutex{},
-	}
-	// Set onPeer on Transport to use Store's onPeer method
-	tTransport.OnPeer = store.OnPeer
+		StoreOpts:   opts,
+		PeerLock:    sync.Mutex{},
+		PeerMap:     make(map[string]p2p.Peer),
+		PeerAliases: make(map[string]string),
+		Rebalance:   &rebalance.Tracker{},
+		Shards:      erasure.NewShardStore(path.Join(fileStorageBasePath, util.ShardsDirName)),
+		Capacity:    capacity.NewTracker(fileStorageBasePath, capacity.Opts{MinFreeDiskBytes: util.DefaultMinFreeDiskBytes}),
+		Audit:       audit.NewLog(path.Join(fileStorageBasePath, util.AuditDirName), util.DefaultAuditMaxFileBytes, util.DefaultAuditMaxFiles),
+		shutdownCh:  make(chan struct{}),
+		closedCh:    make(chan struct{}),
+		rebalanceCh: make(chan struct{}, 1),
+	}
+	// Prepare Transport with opts, using Store's onPeer method
+	tcpOpts := p2p.TCPTransportOpts{
+		ListenAddress:    listenAddress,
+		HandshakeFunc:    p2p.NOHANDSHAKE,
+		Codec:            &p2p.DefaultCodec{},
+		SendQueue:        p2p.SendQueueOpts{Capacity: util.DefaultSendQueueCapacity, Policy: p2p.BlockWhenFull},
+		OnPeer:           store.OnPeer,
+		OnPeerDisconnect: store.OnPeerDisconnect,
+	}
+	store.Transport = newTransport(tcpOpts)
+	store.DHT = newStoreDHT(&store)
+	store.Members = newStoreMemberlist(&store)
+	store.Peers = newStorePeerManager(&store)
+	store.swarmManifests = swarm.NewManifestCache(util.SwarmManifestCacheSize)
 	return &store
 }
 
@@ -116,26 +273,22 @@ func getStoreInstance(listenAddress string, bootstrapNodes []string, fileStorage
 	return globalStore
 }
 
-// bootstrapNetwork with improved error handling and synchronization
+// bootstrapNetwork has the peer manager keep connections to the bootstrap nodes, retrying the ones that aren't up yet.
+// Once a connection is up, the cluster and the DHT are joined through it, so nodes can be started in any order.
 func (s *Store) bootstrapNetwork() error {
-	var wg sync.WaitGroup
 	var errors []error
-	var errorsMux sync.Mutex
-
 	for _, nodeAddr := range s.StoreOpts.BootstrapNodes {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-			if err := s.Transport.Dial(addr); err != nil {
-				errorsMux.Lock()
-				errors = append(errors, fmt.Errorf("failed to dial %s: %w", addr, err))
-				errorsMux.Unlock()
-			}
-		}(nodeAddr)
+		addr, err := util.SafeStringToAddr(nodeAddr)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid bootstrap node %s: %w", nodeAddr, err))
+			continue
+		}
+		if addr.String() == s.normalizedListenAddress() {
+			continue
+		}
+		s.Peers.Want(addr.String())
 	}
 
-	wg.Wait()
-
 	if len(errors) > 0 {
 		// Return first error or combine them as needed
 		return fmt.Errorf("bootstrap errors: %v", errors)
@@ -164,6 +317,20 @@ func (s *Store) setupHyperStoreServer() {
 			log.Println("Error while bootstrapping network:", err)
 		}
 	}
+	s.Members.Start()
+	go s.runHeartbeats()
+	go s.runAntiEntropy()
+	go s.runRebalancer()
+	go s.runShardRepair()
+	go s.runCapacityScans()
+	go s.runBucketExpiry()
+	go s.runUploadExpiry()
+	go s.runReprovider()
+	if s.Raft != nil {
+		if err := s.Raft.Start(); err != nil {
+			log.Println("Error while starting Raft:", err)
+		}
+	}
 
 	wg.Add(1)
 	// Start read loop
@@ -176,6 +343,11 @@ func (s *Store) setupHyperStoreServer() {
 func (s *Store) teardownHyperStoreServer() {
 	log.Println("Hyperstore stopped due to user STOP action")
 	// Terminate all connections
+	ctx, cancel := context.WithTimeout(context.Background(), util.DefaultShutdownTimeout)
+	defer cancel()
+	if err := s.shutdown(ctx, false); err != nil {
+		log.Println("Error while shutting down:", err)
+	}
 
 	// Remove the base path entirely
 	err := os.RemoveAll(s.StoreOpts.BaseStorageLocation)
@@ -187,90 +359,150 @@ func (s *Store) teardownHyperStoreServer() {
 // handlePeerRead causes the peer goes into a read loop where it reads from the msg channel
 func (s *Store) handlePeerRead(wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer func() {
-		log.Println("Shutting down peer read due to peer QUIT")
-		time.Sleep(time.Second * 3)
+	defer log.Println("Shutting down peer read due to Store shutdown")
 
-		s.Transport.Close()
-	}()
+	// Messages are handled by a pool of workers. While all of them are busy, no more messages are consumed from the Transport,
+	// which pushes back on the peers sending them.
+	workers := workerpool.NewPool(workerpool.PoolOpts{Workers: s.StoreOpts.MessageWorkers, QueueSize: util.MessageWorkerQueueSize})
+	defer workers.Close()
 
 	var msgCount uint32 = 0
 	var toRead = true
-	// TODO: Set value of toRead to false somewhere in loop based on EXIT Control Message
 	for toRead {
-		msg := <-s.Transport.Consume()
+		var msg p2p.Message
+		select {
+		case msg = <-s.Transport.Consume():
+		case <-s.closedCh:
+			toRead = false
+			continue
+		}
 		parsedMsg := p2p.ParseMessage(msg)
+		if parsedMsg == nil {
+			continue
+		}
 		senderAddr := parsedMsg.From.String()
 
 		// Validate if peer exists
+		s.PeerLock.Lock()
 		sender, senderExists := s.PeerMap[senderAddr]
+		s.PeerLock.Unlock()
 		if !senderExists {
-			log.Printf("Error: Sender %s does not exist in peerMap", sender)
+			// The connection may have dropped before its last messages were handled
+			log.Printf("Error: Sender %s does not exist in peerMap, dropping message", senderAddr)
+			continue
 		}
 
-		// Call appropriate handler
-		var err error = nil
-		switch parsedMsg.Type {
-		case p2p.DataMessageType:
-			payload := parsedMsg.Payload.(p2p.DataPayload)
-			log.Printf("Parsed %s", payload.String())
-			err = s.handleReadDataMessage(&payload, sender)
-		case p2p.ControlMessageType:
-			payload := parsedMsg.Payload.(p2p.ControlPayload)
-			log.Printf("Parsed %s", payload.String())
-			err = s.handleReadControlMessage(&payload, sender)
-		}
-		if err != nil {
-			log.Printf("Error while reading message from peer %s: %v", senderAddr, err)
+		// Messages that open a stream are handled in parallel, so that a transfer doesn't hold up the messages behind it
+		if parsedMsg.Stream != nil {
+			go func(payload p2p.ControlPayload, stream *p2p.Stream) {
+				if err := s.handleReadStreamMessage(&payload, stream, sender); err != nil {
+					log.Printf("Error while reading stream %d from peer %s: %v", stream.ID(), senderAddr, err)
+				}
+			}(parsedMsg.Payload.(p2p.ControlPayload), parsedMsg.Stream)
+			msgCount++
+			continue
 		}
 
+		if !workers.Submit(messageOrderingKey(parsedMsg), func() {
+			s.handleMessage(parsedMsg, sender)
+		}) {
+			toRead = false
+			continue
+		}
 		msgCount++
 	}
 	log.Printf("Read %d messages in total in peer: %s\n", msgCount, s.StoreOpts.ListenAddress)
 }
 
-func (s *Store) handleReadDataMessage(payload *p2p.DataPayload, fromPeer p2p.Peer) error {
-	// If we receive a DataPayload that has fetch_id in metadata, then we are parsing a response to FETCH call
-	if payload.Metadata != nil {
-		fetchID, hasFetchID := payload.Metadata["fetch_id"]
-		if hasFetchID {
-			// So, if it is present, we push this into the corresponding fetchResponseChan
-			fetchResponseChan := s.safeOperationToFetchResponseChans(util.MAP_GET_ELEMENT, fetchID, nil)
-			if fetchResponseChan != nil {
-				select {
-				case fetchResponseChan <- p2p.FetchResult{
-					FileExists: true,
-					Data:       payload.Data,
-					PeerAddr:   fromPeer.String(),
-				}:
-					log.Printf("Sent file data to waiting channel for fetch ID: %s", fetchID)
-				default:
-					log.Printf("Warning: Unable to send file data, channel might be full or closed for ID: %s", fetchID)
-				}
-				return nil
+// messageOrderingKey returns the key under which msg is handled in the order it was sent in, relative to the other messages
+// of its sender. Requests made through Call don't depend on each other, and may be handled in any order.
+func messageOrderingKey(msg *p2p.Message) string {
+	if payload, isControl := msg.Payload.(p2p.ControlPayload); isControl {
+		switch payload.Command {
+		case p2p.MESSAGE_PING_CONTROL_COMMAND, p2p.MESSAGE_PING_REQ_CONTROL_COMMAND, p2p.MESSAGE_HEARTBEAT_CONTROL_COMMAND,
+			p2p.MESSAGE_FIND_NODE_CONTROL_COMMAND, p2p.MESSAGE_FIND_VALUE_CONTROL_COMMAND, p2p.MESSAGE_STORE_PROVIDER_CONTROL_COMMAND,
+			p2p.MESSAGE_FETCH_CONTROL_COMMAND, p2p.MESSAGE_FETCH_CHUNK_CONTROL_COMMAND,
+			p2p.MESSAGE_SYNC_TREE_CONTROL_COMMAND, p2p.MESSAGE_SYNC_KEYS_CONTROL_COMMAND, p2p.MESSAGE_FETCH_SHARD_CONTROL_COMMAND,
+			p2p.MESSAGE_RAFT_REQUEST_VOTE_CONTROL_COMMAND, p2p.MESSAGE_RAFT_APPEND_ENTRIES_CONTROL_COMMAND,
+			p2p.MESSAGE_RAFT_INSTALL_SNAPSHOT_CONTROL_COMMAND, p2p.MESSAGE_RAFT_PROPOSE_CONTROL_COMMAND, p2p.MESSAGE_RAFT_READ_CONTROL_COMMAND,
+			p2p.MESSAGE_BUCKETS_CONTROL_COMMAND, p2p.MESSAGE_IDENTIFY_CONTROL_COMMAND:
+			return ""
+		}
+	}
+	return msg.From.String()
+}
+
+// handleMessage calls the appropriate handler for msg from sender
+func (s *Store) handleMessage(msg *p2p.Message, sender p2p.Peer) {
+	var err error = nil
+	switch msg.Type {
+	case p2p.DataMessageType:
+		payload := msg.Payload.(p2p.DataPayload)
+		log.Printf("Parsed %s", payload.String())
+		err = s.handleReadDataMessage(&payload, sender)
+		// A write made through Call is acknowledged once it was stored, or told why it wasn't
+		if requestID, isRequest := payload.Metadata[p2p.RequestIDArg]; isRequest {
+			reply := p2p.Message{
+				Type:    p2p.ControlMessageType,
+				Payload: p2p.ControlPayload{Command: p2p.MESSAGE_ACK_CONTROL_COMMAND, Args: map[string]string{}},
+			}
+			if err != nil {
+				reply = p2p.ConstructErrorMessage(err)
+			}
+			if replyErr := s.sendMessageToPeer(reply.WithArg(p2p.ReplyToArg, requestID), sender); replyErr != nil {
+				log.Printf("Couldn't send %s to peer %s: %v", reply.Command(), msg.From, replyErr)
 			}
 		}
+	case p2p.ControlMessageType:
+		payload := msg.Payload.(p2p.ControlPayload)
+		log.Printf("Parsed %s", payload.String())
+		err = s.handleReadControlMessage(&payload, sender)
+		// A request made through Call is told why it failed, rather than left waiting until it times out
+		if _, isRequest := payload.Args[p2p.RequestIDArg]; err != nil && isRequest {
+			if replyErr := s.replyToPeer(&payload, p2p.ConstructErrorMessage(err), sender); replyErr != nil {
+				log.Printf("Couldn't send ERROR to peer %s: %v", msg.From, replyErr)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error while reading message from peer %s: %v", msg.From, err)
 	}
+}
 
-	// If we receive a normal DataPayload, then we need to call file write for current instance
-	data := bytes.NewReader(payload.Data)
-	if _, err := s.handleFileWrite(payload.Key, data); err != nil {
+func (s *Store) handleReadDataMessage(payload *p2p.DataPayload, fromPeer p2p.Peer) error {
+	// Replies to FETCH and FETCH_CHUNK never get here, since the Transport hands them to the Call waiting for them.
+	// If we receive a normal DataPayload, then we need to call file write for current instance, unless it was corrupted on the way
+	if err := payload.Verify(); err != nil {
 		return err
 	}
-	return nil
+	if err := bucket.ValidateKey(payload.Key); err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "%v in DataPayload from %s", err, fromPeer.String())
+	}
+	if err := s.checkReplicaRoom(payload.Key, int64(len(payload.Data))); err != nil {
+		return err
+	}
+	data := bytes.NewReader(payload.Data)
+	err := s.handleReplicaWrite(payload.Key, data, payload.Metadata)
+	s.auditPeer(audit.Store, payload.Key, fromPeer, int64(len(payload.Data)), err)
+	return err
 }
 
-func (s *Store) handleReadControlMessage(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
-	/*  If we receive a ControlPayload, then we need to
-	1. If Command=EXIT, then we need to remove that peer from peerMap
-	2. If Command=STORE, then we need to stream a file from the sender
-	*/
-
-	log.Printf("In handleReadControlMessage with %v as COMMAND", payload.Command)
+// handleReadStreamMessage handles a ControlPayload that opened a stream from fromPeer, and consumes the stream.
+// If Command=STORE, then the file the sender streams is stored.
+func (s *Store) handleReadStreamMessage(payload *p2p.ControlPayload, stream *p2p.Stream, fromPeer p2p.Peer) (err error) {
+	// A stream that couldn't be consumed is reset, which tells the sender it failed. Otherwise whatever wasn't consumed is
+	// discarded, so that the sender isn't left waiting for room on the stream, and the sender sees it closed once it was handled.
+	defer func() {
+		if err != nil {
+			_ = stream.Reset()
+			return
+		}
+		_, _ = io.Copy(io.Discard, stream)
+		_ = stream.Close()
+	}()
+	log.Printf("In handleReadStreamMessage with %v as COMMAND", payload.Command)
 
 	switch payload.Command {
-	case p2p.MESSAGE_EXIT_CONTROL_COMMAND:
-		delete(s.PeerMap, fromPeer.String())
 	case p2p.MESSAGE_STORE_CONTROL_COMMAND:
 		var (
 			key, keyExists          = payload.Args["key"]
@@ -279,73 +511,169 @@ func (s *Store) handleReadControlMessage(payload *p2p.ControlPayload, fromPeer p
 		if !keyExists || !fileExists {
 			return fmt.Errorf("missing key/size for STORE Control Message %s", fromPeer.String())
 		}
+		// Resumable streams are checked here too, since they are stored under the same key once complete
+		if err := validatePeerKey(key, payload.Command, fromPeer); err != nil {
+			return err
+		}
 
-		// Store the file
 		fileSize, _ := strconv.ParseInt(fileSizeStr, 10, 64)
-		log.Printf("Reading streamed file of size %v", fileSize)
-		_, err := s.handleFileWrite(key, io.LimitReader(fromPeer, fileSize))
-		if err != nil {
+		if err := s.checkReplicaRoom(key, fileSize); err != nil {
 			return err
 		}
-		// Sync wg to allow tcp read loop to continue
-		fromPeer.(*p2p.TCPPeer).Wg.Done()
+		// Only the bytes that arrived are recorded, since a resumable stream may carry a part of the file, or end early
+		body := &countingReadCloser{ReadCloser: io.NopCloser(io.LimitReader(stream, fileSize))}
+		var err error
+		// Resumable streams carry an upload_id, and are staged until every byte has arrived
+		if _, isResumable := payload.Args["upload_id"]; isResumable {
+			err = s.handleResumableStoreStream(payload.Args, body, fileSize, fromPeer)
+		} else {
+			// Store the file
+			log.Printf("Reading streamed file of size %v", fileSize)
+			err = s.handleReplicaWrite(key, body, payload.Args)
+		}
+		s.auditPeer(audit.Store, key, fromPeer, body.read, err)
+		return err
+	case p2p.MESSAGE_STORE_SHARD_CONTROL_COMMAND:
+		body := &countingReadCloser{ReadCloser: io.NopCloser(stream)}
+		err := s.handleStoreShardStream(payload.Args, body, fromPeer)
+		s.auditPeer(audit.Store, payload.Args["key"], fromPeer, body.read, err)
+		return err
+	default:
+		return fmt.Errorf("unexpected %s Control Message opening a stream from %s", payload.Command, fromPeer.String())
+	}
+}
 
-	case p2p.MESSAGE_LIST_CONTROL_COMMAND:
-		log.Printf("Received LIST Control Message from %s", fromPeer)
+func (s *Store) handleReadControlMessage(payload *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	/*  If we receive a ControlPayload, then we need to
+	1. If Command=EXIT, then we need to remove that peer from peerMap
+	*/
+
+	log.Printf("In handleReadControlMessage with %v as COMMAND", payload.Command)
 
-	case p2p.MESSAGE_FETCH_RESPONSE_CONTROL_COMMAND:
-		log.Printf("Received FETCH_RESPONSE Control Message from %s", fromPeer)
+	switch payload.Command {
+	case p2p.MESSAGE_EXIT_CONTROL_COMMAND:
+		log.Printf("Received EXIT Control Message from %s", fromPeer)
+		// The peer left on purpose, so don't redial it. OnPeerDisconnect forgets it once the connection is closed. Only the
+		// address the connection is known by is forgotten, so that a connection can't make us forget another peer.
+		s.Peers.Forget(s.peerListenAddr(fromPeer))
+		return fromPeer.Close()
+	case p2p.MESSAGE_UPLOAD_OFFSET_CONTROL_COMMAND:
+		log.Printf("Received UPLOAD_OFFSET Control Message from %s", fromPeer)
 		var (
-			fileFoundResp, fileFoundRespExists = payload.Args["file_exists"]
+			uploadID, uploadIDExists = payload.Args["upload_id"]
+			key, keyExists           = payload.Args["key"]
+			offsetStr, offsetExists  = payload.Args["offset"]
 		)
-		if !fileFoundRespExists {
-			return fmt.Errorf("missing file_exists for FETCH_RESPONSE Control Message %s", fromPeer.String())
+		if !uploadIDExists || !keyExists || !offsetExists {
+			return fmt.Errorf("missing upload_id/key/offset for UPLOAD_OFFSET Control Message %s", fromPeer.String())
+		}
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset for UPLOAD_OFFSET Control Message %s: %w", fromPeer.String(), err)
 		}
-		log.Printf("File was found on peer %s: YES/NO: %v", fromPeer.String(), fileFoundResp)
+		if err := validatePeerKey(key, payload.Command, fromPeer); err != nil {
+			return err
+		}
+		total, _ := strconv.ParseInt(payload.Args["total"], 10, 64)
+
+		// Stream in the background, so that the read loop isn't held up for the duration of the upload
+		go func() {
+			if err := s.resumeStoreToPeer(key, uploadID, offset, total, fromPeer); err != nil {
+				log.Printf("Error while resuming upload %s to peer %s: %v", uploadID, fromPeer.String(), err)
+			}
+		}()
+
+	case p2p.MESSAGE_LIST_CONTROL_COMMAND:
+		log.Printf("Received LIST Control Message from %s", fromPeer)
+		s.auditPeer(audit.List, "", fromPeer, 0, nil)
 
 	case p2p.MESSAGE_FETCH_CONTROL_COMMAND:
 		log.Printf("Received FETCH Control Message from %s", fromPeer)
-		var (
-			key, keyExists         = payload.Args["key"]
-			fetchID, fetchIDExists = payload.Args["fetch_id"]
-		)
-		if !keyExists || !fetchIDExists {
-			return fmt.Errorf("missing key/fetchID for FETCH Control Message %s", fromPeer.String())
+		key, keyExists := payload.Args["key"]
+		if !keyExists {
+			return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing key for FETCH Control Message %s", fromPeer.String())
+		}
+		if err := validatePeerKey(key, payload.Command, fromPeer); err != nil {
+			s.auditPeer(audit.Get, key, fromPeer, 0, err)
+			return err
+		}
+		// In swarm mode, only the manifest is sent back and the chunks are requested separately
+		if payload.Args["swarm"] == "true" {
+			// The chunks are recorded as they are fetched, so a page of the manifest doesn't count for any bytes
+			err := s.handleSwarmFetch(payload, key, fromPeer)
+			s.auditPeer(audit.Get, key, fromPeer, 0, err)
+			return err
 		}
 
 		// Check if file is there in this peer
-		if bytesRead, err := s.handleGetFile(key, false); err != nil || bytesRead == nil {
-			// Generate negative ACK and send to source
-			log.Printf("File not found on this machine, sending negative ACK")
-			msg := p2p.ConstructFetchResponseMessage(false)
-			if err := s.broadcastMessage(msg); err != nil {
-				return err
-			}
-		} else {
-			// Generate positive ACK and send to source
-			log.Printf("File found on this machine, sending ACK")
-			msg := p2p.ConstructFetchResponseMessage(true)
-			if err := s.sendMessageToPeer(msg, fromPeer); err != nil {
-				return err
-			}
-			log.Printf("Sent ACK to peer %s", fromPeer.String())
-			// Generate DataMessage with read file bytes and send to source
-			msg = p2p.Message{
-				Type: p2p.DataMessageType,
-				From: nil,
-				Payload: p2p.DataPayload{
-					Key:  key,
-					Data: bytesRead,
-					Metadata: map[string]string{
-						"fetch_id": fetchID,
-					},
-				},
-			}
-			log.Printf("Prepared msg: %s", msg)
-			if err := s.sendMessageToPeer(msg, fromPeer); err != nil {
-				return err
-			}
+		bytesRead, err := s.getStoredFile(key, false)
+		if err != nil || bytesRead == nil {
+			log.Printf("File not found on this machine, sending ERROR")
+			err = p2p.NewRemoteError(p2p.ErrorCodeNotFound, "%s not found on %s", key, s.StoreOpts.ListenAddress)
+			s.auditPeer(audit.Get, key, fromPeer, 0, err)
+			return err
 		}
+		s.auditPeer(audit.Get, key, fromPeer, int64(len(bytesRead)), nil)
+		// Reply with a DataMessage holding the read file bytes
+		log.Printf("File found on this machine, sending it")
+		msg := p2p.ConstructDataMessage(key, bytesRead)
+		log.Printf("Prepared msg: %s", msg.String())
+		return s.replyToPeer(payload, msg, fromPeer)
+
+	case p2p.MESSAGE_FETCH_CHUNK_CONTROL_COMMAND:
+		log.Printf("Received FETCH_CHUNK Control Message from %s", fromPeer)
+		err := s.handleFetchChunk(payload, fromPeer)
+		s.auditPeer(audit.Get, payload.Args["key"], fromPeer, requestedLength(payload), err)
+		return err
+
+	case p2p.MESSAGE_FIND_NODE_CONTROL_COMMAND, p2p.MESSAGE_FIND_VALUE_CONTROL_COMMAND, p2p.MESSAGE_STORE_PROVIDER_CONTROL_COMMAND:
+		return s.handleDHTRequest(payload, fromPeer)
+
+	case p2p.MESSAGE_PING_CONTROL_COMMAND:
+		return s.handlePing(payload, fromPeer)
+
+	case p2p.MESSAGE_PING_REQ_CONTROL_COMMAND:
+		return s.handlePingReq(payload, fromPeer)
+
+	case p2p.MESSAGE_HEARTBEAT_CONTROL_COMMAND:
+		return s.handleHeartbeat(payload, fromPeer)
+
+	case p2p.MESSAGE_SYNC_TREE_CONTROL_COMMAND:
+		return s.handleSyncTree(payload, fromPeer)
+
+	case p2p.MESSAGE_SYNC_KEYS_CONTROL_COMMAND:
+		err := s.handleSyncKeys(payload, fromPeer)
+		s.auditPeer(audit.List, "", fromPeer, 0, err)
+		return err
+
+	case p2p.MESSAGE_FETCH_SHARD_CONTROL_COMMAND:
+		err := s.handleFetchShard(payload, fromPeer)
+		s.auditPeer(audit.Get, payload.Args["key"], fromPeer, requestedLength(payload), err)
+		return err
+
+	case p2p.MESSAGE_RAFT_REQUEST_VOTE_CONTROL_COMMAND, p2p.MESSAGE_RAFT_APPEND_ENTRIES_CONTROL_COMMAND,
+		p2p.MESSAGE_RAFT_INSTALL_SNAPSHOT_CONTROL_COMMAND, p2p.MESSAGE_RAFT_PROPOSE_CONTROL_COMMAND, p2p.MESSAGE_RAFT_READ_CONTROL_COMMAND:
+		return s.handleRaftRequest(payload, fromPeer)
+
+	case p2p.MESSAGE_BUCKETS_CONTROL_COMMAND:
+		return s.handleBucketsRequest(payload, fromPeer)
+
+	case p2p.MESSAGE_IDENTIFY_CONTROL_COMMAND:
+		return s.handleIdentify(payload, fromPeer)
+
+	case p2p.MESSAGE_DELETE_CONTROL_COMMAND:
+		log.Printf("Received DELETE Control Message from %s", fromPeer)
+		key, keyExists := payload.Args["key"]
+		if !keyExists {
+			return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing key for DELETE Control Message %s", fromPeer.String())
+		}
+		if err := validatePeerKey(key, payload.Command, fromPeer); err != nil {
+			return err
+		}
+		err := s.handleReplicaDelete(key, payload.Args)
+		s.auditPeer(audit.Delete, key, fromPeer, 0, err)
+		return err
+
 	default:
 		log.Printf("Received unknown control message from %s: Command=%s", fromPeer, payload.Command)
 	}
@@ -353,24 +681,91 @@ func (s *Store) handleReadControlMessage(payload *p2p.ControlPayload, fromPeer p
 	return nil
 }
 
-// broadcastMessage broadcasts the given msg across all the peers
-func (s *Store) broadcastMessage(msg p2p.Message) error {
-	fromAddr, err := util.SafeStringToAddr(s.StoreOpts.ListenAddress)
-	if err != nil {
-		log.Fatalf("Conv error: %+v", err)
+// validatePeerKey returns an ErrorCodeInvalidRequest RemoteError for fromPeer unless key, which the command it sent names, is
+// a valid key
+func validatePeerKey(key string, command p2p.ControlMessage, fromPeer p2p.Peer) error {
+	if err := bucket.ValidateKey(key); err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "%v in %s Control Message %s", err, command, fromPeer.String())
 	}
-	msg.From = fromAddr
-	log.Printf("Broadcasting message: %+v", msg.String())
-	for _, peer := range s.PeerMap {
-		if err := s.Transport.(*p2p.TCPTransport).Codec.Encode(peer.(*p2p.TCPPeer).Conn, &msg); err != nil {
-			return err
+	return nil
+}
+
+// BroadcastResults maps the address of every peer a message was broadcast to, to the error sending it to that peer, if any
+type BroadcastResults map[string]error
+
+// Err returns the errors of the sends that failed joined together, or nil if every send succeeded
+func (r BroadcastResults) Err() error {
+	var errs []error
+	for addr, err := range r {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sending to %s: %w", addr, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-// sendMessageToPeer sends the given message msg to the peer toPeer
+// broadcastMessage broadcasts the given msg across all the peers. Every peer is sent msg in parallel,
+// so that a slow peer doesn't hold up the others, and the result of each send is returned.
+func (s *Store) broadcastMessage(msg p2p.Message) BroadcastResults {
+	log.Printf("Broadcasting message: %+v", msg.String())
+	return s.multicastMessage(msg, s.connectedPeers())
+}
+
+// multicastMessage sends the given msg to each of peers in parallel, and returns the result of each send
+func (s *Store) multicastMessage(msg p2p.Message, peers map[string]p2p.Peer) BroadcastResults {
+	results := make(BroadcastResults, len(peers))
+
+	var (
+		resultsLock sync.Mutex
+		wg          sync.WaitGroup
+	)
+	for addr, peer := range peers {
+		wg.Add(1)
+		go func(addr string, peer p2p.Peer) {
+			defer wg.Done()
+			err := s.sendMessageToPeer(msg, peer)
+			resultsLock.Lock()
+			results[addr] = err
+			resultsLock.Unlock()
+		}(addr, peer)
+	}
+	wg.Wait()
+	return results
+}
+
+// connectedPeers returns a copy of PeerMap, so that the peers can be used without holding PeerLock
+func (s *Store) connectedPeers() map[string]p2p.Peer {
+	s.PeerLock.Lock()
+	defer s.PeerLock.Unlock()
+	peers := make(map[string]p2p.Peer, len(s.PeerMap))
+	for addr, peer := range s.PeerMap {
+		peers[addr] = peer
+	}
+	return peers
+}
+
+// sendMessageToPeer sends the given message msg to the peer toPeer through its send queue, and waits until it was sent
 func (s *Store) sendMessageToPeer(msg p2p.Message, toPeer p2p.Peer) error {
+	var frame bytes.Buffer
+	if err := s.encodeMessage(msg, toPeer, &frame); err != nil {
+		return err
+	}
+	return toPeer.Send(frame.Bytes(), msg.Priority())
+}
+
+// storeOnPeer sends the DataMessage msg to toPeer, and waits until toPeer acknowledges that it stored the data, or until ctx is done
+func (s *Store) storeOnPeer(ctx context.Context, msg p2p.Message, toPeer p2p.Peer) error {
+	_, err := s.Transport.Call(ctx, toPeer, msg)
+	return err
+}
+
+// replyToPeer sends reply to the request with the given payload, which came from toPeer
+func (s *Store) replyToPeer(request *p2p.ControlPayload, reply p2p.Message, toPeer p2p.Peer) error {
+	return s.sendMessageToPeer(p2p.ConstructReplyMessage(request, reply), toPeer)
+}
+
+// encodeMessage writes the given message msg for toPeer to w, which is either a buffer or a stream to toPeer
+func (s *Store) encodeMessage(msg p2p.Message, toPeer p2p.Peer, w io.Writer) error {
 	fromAddr, err := util.SafeStringToAddr(s.StoreOpts.ListenAddress)
 	if err != nil {
 		log.Fatalf("Conv error: %+v", err)
@@ -394,70 +789,115 @@ func (s *Store) sendMessageToPeer(msg p2p.Message, toPeer p2p.Peer) error {
 	}
 	debug()
 
-	log.Printf("Directly sending message (%s->%s): %+v", msg.From, toPeer, msg.String())
-	if err := s.Transport.(*p2p.TCPTransport).Codec.Encode(toPeer.(*p2p.TCPPeer).Conn, &msg); err != nil {
+	log.Printf("Sending message (%s->%s): %+v", msg.From, toPeer, msg.String())
+	if err := toPeer.Codec().Encode(w, &msg); err != nil {
 		return err
 	}
 	return nil
 }
 
-// handleStoreFile handles writes a file with given key and broadcast it to all peers for replication
+// handleStoreFile handles writes a file with given key and replicates it to the other owners of it. With Raft, the key is then
+// pointed at the new content in the namespace, as its next version.
 func (s *Store) handleStoreFile(key string, r io.Reader) error {
+	return s.storeFile(key, r, nil)
+}
+
+// storeFile writes a file with given key like handleStoreFile does, as a version on top of the versions that seen saw, or on top
+// of every version held if seen is nil
+func (s *Store) storeFile(key string, r io.Reader, seen vclock.Clock) error {
+	b, err := s.bucketOf(key)
+	if err != nil {
+		return err
+	}
+	// The size is told before the content is compressed, which hides it, so that the room for the file can be checked
+	size := readerSize(r)
+	if compresses(b) {
+		content := compressContent(r)
+		defer content.Close()
+		r = content
+	}
+	if s.Raft == nil {
+		return s.storeAndReplicate(key, r, size, seen)
+	}
+	// The version pointer only moves once the bytes it points at are stored
+	digest := newDigestReader(r)
+	if err := s.storeAndReplicate(key, digest, size, seen); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), util.RaftProposeTimeout)
+	defer cancel()
+	_, err = s.putKeyVersion(ctx, key, digest.checksum(), digest.size, nil)
+	return err
+}
+
+// storeAndReplicate writes a file with given key and replicates it to the other owners of it, along with its version. The file
+// is size bytes long, or of an unknown size if size is 0.
+func (s *Store) storeAndReplicate(key string, r io.Reader, size int64, seen vclock.Clock) error {
+	if s.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	defer s.beginTransfer()()
+	// A write this Store has no room for is rejected before anything is written, rather than failing once the disk is full
+	if err := s.Capacity.Check(size); err != nil {
+		return err
+	}
+	if s.StoreOpts.ErasureDataShards > 0 {
+		return s.handleStoreErasureCoded(key, r)
+	}
+	// So is a write that the nodes it would be replicated to have no room for
+	if err := s.checkReplicasRoom(key, size); err != nil {
+		return err
+	}
+
 	// Copy Reader buffer
 	buf := new(bytes.Buffer)
 	rCopy := io.TeeReader(r, buf)
 
 	// Store the file
-	fileSize, err := s.handleFileWrite(key, rCopy)
+	written, err := s.writeLocalVersion(key, rCopy, seen)
 	if err != nil {
 		return err
 	}
+	// Members that are down miss the replication below, so the write is held for them until they are back
+	s.hintUnreachableOwners(key, written.Checksum)
 
 	// Now, we need to decide whether to stream	this data or to use directly send via DataPayload
 	var message p2p.Message
 	// If file size is beyond MaxAllowedDataPayloadSize, then decoder's buffer will overflow
-	if fileSize > util.MaxAllowedDataPayloadSize {
-		// Thus, we need to send a STORE control message with the necessary information to allow peers to stream
-		message.Type = p2p.ControlMessageType
-		message.Payload = p2p.ControlPayload{
-			Command: p2p.MESSAGE_STORE_CONTROL_COMMAND,
-			Args: map[string]string{
-				"key":  key,
-				"size": strconv.FormatInt(fileSize, 10),
-			},
-		}
-		// Broadcast the ControlMessage
-		if err := s.broadcastMessage(message); err != nil {
-			return err
-		}
-		// And we need to stream the file contents to all peers
-		for _, peer := range s.PeerMap {
-			if n, err := io.Copy(peer, buf); err != nil {
+	if written.Size > util.MaxAllowedDataPayloadSize {
+		// Thus, we need to stream the stored file to every owner, each in a resumable STORE session of its own
+		for _, peer := range s.replicaPeers(key, written.Size) {
+			if err := s.streamVersionToPeer(key, written.Checksum, upload.NewSessionID(), 0, peer); err != nil {
 				log.Printf("Streaming error: %+v", err)
 				return err
-			} else if n != fileSize {
-				log.Printf("Streaming issue: Number of bytes streamed=%d and Number of bytes written=%d do not match", n, fileSize)
 			}
 		}
-		log.Println("Streamed file contents to all peers successfully")
+		log.Println("Streamed file contents to all owners successfully")
 	} else {
 		// Else, we can directly send a DataPayload message with the file data and key to use while replicating
-		message.Type = p2p.DataMessageType
-		message.Payload = p2p.DataPayload{
-			Key:  key,
-			Data: buf.Bytes(),
-		}
-		// Broadcast the ControlMessage
-		if err := s.broadcastMessage(message); err != nil {
+		message = withVersionArgs(p2p.ConstructDataMessage(key, buf.Bytes()), written)
+		// Send it to the other owners of the file
+		log.Printf("Replicating message: %+v", message.String())
+		if err := s.multicastMessage(message, s.replicaPeers(key, written.Size)).Err(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// handleGetFile handles a file fetch with given key. If found in same store, it directly returns.
-// Else broadcasts a FETCH control message to check if any peer has it.
+// handleGetFile handles a file fetch with given key, like getStoredFile does, and returns its content as it was stored, undoing
+// the compression of its bucket
 func (s *Store) handleGetFile(key string, toBroadcast bool) ([]byte, error) {
+	data, err := s.getStoredFile(key, toBroadcast)
+	if err != nil || data == nil {
+		return data, err
+	}
+	return s.decodeContent(key, data)
+}
+
+// getStoredFile handles a file fetch with given key. If found in same store, it directly returns.
+// Else broadcasts a FETCH control message to check if any peer has it.
+func (s *Store) getStoredFile(key string, toBroadcast bool) ([]byte, error) {
 	// TODO: Try to read and check for existence at once
 	if s.existsInStorage(key) {
 		bytesRead, err := s.handleFileRead(key)
@@ -473,70 +913,84 @@ func (s *Store) handleGetFile(key string, toBroadcast bool) ([]byte, error) {
 	}
 	log.Printf("File %s does not exist in current storage, checking peers...", key)
 
+	// Erasure coded files are held as shards only, which the file is reconstructed from
+	if toBroadcast && s.mayBeErasureCoded(key) {
+		if data, err := s.handleGetErasureCoded(key); !errors.Is(err, os.ErrNotExist) {
+			return data, err
+		}
+	}
+
+	if toBroadcast && s.StoreOpts.SwarmFetch {
+		return s.handleSwarmGetFile(key)
+	}
+
 	if toBroadcast {
 		// If file is not found, need to fetch from peers
-		// Using fetchID to track the FETCH request
-		fetchID := s.generateFetchID(key)
-		// Create a response channel to collect peer responses
-		fetchResponseChan := make(chan p2p.FetchResult, len(s.PeerMap))
-		// Add to map safely to track
-		s.safeOperationToFetchResponseChans(util.MAP_UPSERT_ELEMENT, fetchID, fetchResponseChan)
-		defer s.safeOperationToFetchResponseChans(util.MAP_DELETE_ELEMENT, fetchID, nil)
-		// Prepare FETCH control msg and broadcast
-		msg := p2p.Message{
-			Type: p2p.ControlMessageType,
-			From: nil,
-			Payload: p2p.ControlPayload{
-				Command: p2p.MESSAGE_FETCH_CONTROL_COMMAND,
-				Args: map[string]string{
-					"key":      key,
-					"fetch_id": fetchID,
-				},
+		return s.fetchFromPeers(key)
+	}
+
+	return nil, nil
+}
+
+// fetchFromPeers sends a FETCH for key to every candidate found by fetchCandidates at once, and returns the data of the first
+// of them to reply with it. If every candidate replies that it doesn't hold key, os.ErrNotExist is returned.
+func (s *Store) fetchFromPeers(key string) ([]byte, error) {
+	candidates := s.fetchCandidates(key)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no peer to fetch %s from", key)
+	}
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		From: nil,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_FETCH_CONTROL_COMMAND,
+			Args: map[string]string{
+				"key": key,
 			},
-		}
-		if err := s.broadcastMessage(msg); err != nil {
-			return nil, err
-		}
+		},
+	}
 
-		// Wait for responses with a timeout
-		timer := time.NewTimer(util.FetchMessageResponseTimeout)
-		defer timer.Stop()
-		// Enter read loop
-		for {
-			select {
-			case result := <-fetchResponseChan:
-				if result.Error != nil {
-					log.Printf("Error from peer %s: %v", result.PeerAddr, result.Error)
-					continue
+	ctx, cancel := context.WithTimeout(context.Background(), s.StoreOpts.FetchTimeout)
+	defer cancel()
+	fetchResponseChan := make(chan p2p.FetchResult, len(candidates))
+	for _, peer := range candidates {
+		go func(peer p2p.Peer) {
+			result := p2p.FetchResult{PeerAddr: peer.String()}
+			reply, err := s.Transport.Call(ctx, peer, msg)
+			if payload, isData := reply.Payload.(p2p.DataPayload); err == nil && isData {
+				if result.Error = payload.Verify(); result.Error == nil {
+					result.FileExists = true
+					result.Data = payload.Data
 				}
-				if result.FileExists {
-					if result.Data != nil {
-						return result.Data, nil
-					}
-				}
-			case <-timer.C:
-				// Timeout reached
-				return nil, fmt.Errorf("timed out waiting for fetch response")
+			} else if err == nil {
+				result.Error = fmt.Errorf("unexpected %s reply to FETCH", reply.Type)
+			} else {
+				result.Error = err
 			}
-		}
+			fetchResponseChan <- result
+		}(peer)
 	}
 
-	return nil, nil
-}
-
-// safeOperationToFetchResponseChans thread-safely performs the action op on the s.FetchResponsesChans map based on key and value
-func (s *Store) safeOperationToFetchResponseChans(op util.MAP_ACTION, key string, value chan p2p.FetchResult) chan p2p.FetchResult {
-	s.FetchResponseChansLock.Lock()
-	defer s.FetchResponseChansLock.Unlock()
-	switch op {
-	case util.MAP_GET_ELEMENT:
-		return s.FetchResponseChans[key]
-	case util.MAP_UPSERT_ELEMENT:
-		s.FetchResponseChans[key] = value
-	case util.MAP_DELETE_ELEMENT:
-		delete(s.FetchResponseChans, key)
+	var (
+		errs     []error
+		notFound = 0
+	)
+	for range candidates {
+		result := <-fetchResponseChan
+		if result.FileExists {
+			return result.Data, nil
+		}
+		if errors.Is(result.Error, p2p.ErrNotFound) {
+			notFound++
+			continue
+		}
+		log.Printf("Error from peer %s: %v", result.PeerAddr, result.Error)
+		errs = append(errs, fmt.Errorf("%s: %w", result.PeerAddr, result.Error))
 	}
-	return nil
+	if notFound == len(candidates) {
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("fetching %s: %w", key, errors.Join(errs...))
 }
 
 // --------------------------------------------------------------  END OF CONTROL PLANE --------------------------------------------------------------
@@ -545,62 +999,82 @@ func (s *Store) safeOperationToFetchResponseChans(op util.MAP_ACTION, key string
 
 // generatePath generates and returns a path to store a file with given key
 func (s *Store) generatePath(key string) string {
+	name, key := bucket.Split(key)
 	hashPath := s.StoreOpts.PathTransformFunc(key, s.StoreOpts.BaseStorageLocation)
-	return path.Join(s.StoreOpts.BaseStorageLocation, hashPath)
+	if name == "" {
+		return path.Join(s.StoreOpts.BaseStorageLocation, hashPath)
+	}
+	// Every bucket has a directory of its own, so the same key in two buckets never maps to the same file
+	return path.Join(s.bucketPath(name), hashPath)
 }
 
-// generatePath generates a fetchID that can used to broadcast and keep track of a FETCH request
-func (s *Store) generateFetchID(key string) string {
-	fetchHash := sha1.Sum([]byte(key + "-" + s.StoreOpts.ListenAddress))
-	return hex.EncodeToString(fetchHash[:])
+// localFile returns the File that the file of key is stored in, which is named after its key within its bucket
+func (s *Store) localFile(key string) file.File {
+	_, name := bucket.Split(key)
+	return file.File{
+		KeyPath:  name,
+		BasePath: s.generatePath(key),
+	}
 }
 
 // handleFileWrite writes the content from the given io.Reader to a file specified by the key within the storage system.
+// It is written as a new version of the file, which replaces every version held.
 func (s *Store) handleFileWrite(key string, r io.Reader) (int64, error) {
-	//if rc, ok := r.(io.ReadCloser); ok {
-	//	defer rc.Close()
-	//}
+	written, err := s.writeLocalVersion(key, r, nil)
+	return written.Size, err
+}
 
-	pathname := s.generatePath(key)
-	f := file.File{
-		KeyPath:  key,
-		BasePath: pathname,
-		FileMode: util.Default,
-	}
-	if err := f.WriteStream(r); err != nil {
+// writeFile writes the content from the given io.Reader to the file of key as the given version, and records the metadata of it.
+// The caller holds the version lock of key.
+func (s *Store) writeFile(key string, r io.Reader, version FileMetadata) (FileMetadata, error) {
+	f := s.localFile(key)
+	f.FileMode = util.Default
+	checksum := sha256.New()
+	if err := f.WriteStream(io.TeeReader(r, checksum)); err != nil {
 		fmt.Println("Store Error: Error occurred while writing file to storage", err)
-		return 0, err
+		return version, err
+	}
+	s.Capacity.Add(f.FileSize)
+	// The file is stored either way, but anti-entropy can't tell which replicas hold it without its metadata
+	version.Checksum, version.Size = hex.EncodeToString(checksum.Sum(nil)), f.FileSize
+	if err := s.recordFileMetadata(key, version); err != nil {
+		log.Printf("Error while recording metadata of %s: %v", key, err)
 	}
-	return f.FileSize, nil
+	s.announceKey(key)
+	return version, nil
 }
 
 // handleFileRead reads the file identified by the given key and returns its content as a byte slice.
 func (s *Store) handleFileRead(key string) ([]byte, error) {
-	pathname := s.generatePath(key)
-	f := file.File{
-		KeyPath:  key,
-		BasePath: pathname,
-	}
+	f := s.localFile(key)
 	return f.ReadFile()
 }
 
+// handleFileOpen opens the file identified by the given key for reading, so that it can be streamed.
+func (s *Store) handleFileOpen(key string) (*os.File, error) {
+	f := s.localFile(key)
+	return f.OpenFile()
+}
+
 // handleFileDelete deletes the file identified by the given key within the storage system.
 func (s *Store) handleFileDelete(key string) error {
-	pathname := s.generatePath(key)
-	f := file.File{
-		KeyPath:  key,
-		BasePath: pathname,
+	f := s.localFile(key)
+	if err := f.DeleteFile(); err != nil {
+		return err
+	}
+	if err := s.forgetFileMetadata(key); err != nil {
+		log.Printf("Error while forgetting metadata of %s: %v", key, err)
 	}
-	return f.DeleteFile()
+	if err := os.RemoveAll(s.siblingsPath(key)); err != nil {
+		log.Printf("Error while deleting siblings of %s: %v", key, err)
+	}
+	s.DHT.Providers.Remove(dht.KeyID(key), s.DHT.Self.ID)
+	return nil
 }
 
 // existsInStorage checks if a file identified by the given key exists in the storage system.
 func (s *Store) existsInStorage(key string) bool {
-	pathname := s.generatePath(key)
-	f := file.File{
-		KeyPath:  key,
-		BasePath: pathname,
-	}
+	f := s.localFile(key)
 	return f.Exists()
 }
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"file-store/internal/p2p"
 	"file-store/internal/util"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -71,3 +72,37 @@ func TestDeleteFile(t *testing.T) {
 	}
 	assert.Nil(t, err)
 }
+
+func TestBroadcastReturnsPerPeerResults(t *testing.T) {
+	store := createStoreWithDefaultOptions(":5002", nil, t.TempDir())
+	_, healthyRemote := addPipePeer(t, store, "127.0.0.1:6001")
+	closed, _ := addPipePeer(t, store, "127.0.0.1:6002")
+	remoteSession := p2p.NewSession(healthyRemote, false)
+	assert.Nil(t, closed.Close())
+
+	results := store.broadcastMessage(p2p.ConstructFetchResponseMessage(true))
+	assert.Len(t, results, 2)
+	assert.Nil(t, results["127.0.0.1:6001"])
+	assert.NotNil(t, results["127.0.0.1:6002"])
+	assert.ErrorContains(t, results.Err(), "127.0.0.1:6002")
+
+	var msg p2p.Message
+	assert.Nil(t, (&p2p.DefaultCodec{}).Decode(remoteSession.Control(), &msg))
+	assert.Equal(t, p2p.ConstructFetchResponseMessage(true).Payload, msg.Payload)
+}
+
+func TestMessageOrderingKey(t *testing.T) {
+	from, err := util.SafeStringToAddr("127.0.0.1:6001")
+	assert.Nil(t, err)
+
+	// Replicas and their control messages are handled in the order they were sent in, correlated RPCs in any order
+	replica := &p2p.Message{Type: p2p.DataMessageType, From: from, Payload: p2p.DataPayload{Key: util.CommonFileKey}}
+	assert.Equal(t, "127.0.0.1:6001", messageOrderingKey(replica))
+	uploadOffset := p2p.ConstructUploadOffsetMessage("upload", util.CommonFileKey, 0, 1)
+	uploadOffset.From = from
+	assert.Equal(t, "127.0.0.1:6001", messageOrderingKey(&uploadOffset))
+	ping := &p2p.Message{Type: p2p.ControlMessageType, From: from, Payload: p2p.ControlPayload{Command: p2p.MESSAGE_PING_CONTROL_COMMAND}}
+	assert.Empty(t, messageOrderingKey(ping))
+	fetch := &p2p.Message{Type: p2p.ControlMessageType, From: from, Payload: p2p.ControlPayload{Command: p2p.MESSAGE_FETCH_CONTROL_COMMAND}}
+	assert.Empty(t, messageOrderingKey(fetch))
+}
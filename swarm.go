@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"file-store/internal/p2p"
+	"file-store/internal/swarm"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// handleSwarmGetFile fetches the file with given key from every peer holding it in parallel, a chunk at a time.
+// Holders are found by sending every peer a swarm FETCH, to which each of them replies with the Manifest of its copy.
+func (s *Store) handleSwarmGetFile(key string) ([]byte, error) {
+	peers := s.connectedPeers()
+	fetchResponseChan := make(chan p2p.FetchResult, len(peers))
+
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		From: nil,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_FETCH_CONTROL_COMMAND,
+			Args: map[string]string{
+				"key":   key,
+				"swarm": "true",
+			},
+		},
+	}
+	manifestCtx, cancelManifests := context.WithTimeout(context.Background(), util.SwarmManifestTimeout)
+	defer cancelManifests()
+	for addr, peer := range peers {
+		go func(addr string, peer p2p.Peer) {
+			result := p2p.FetchResult{PeerAddr: addr}
+			reply, err := s.Transport.Call(manifestCtx, peer, msg)
+			if payload, isControl := reply.Payload.(p2p.ControlPayload); err == nil && isControl {
+				result.FileExists = true
+				result.Metadata = payload.Args
+			} else {
+				result.Error = err
+			}
+			fetchResponseChan <- result
+		}(addr, peer)
+	}
+
+	first, holders := collectSwarmManifests(fetchResponseChan, len(peers))
+	if len(holders) == 0 {
+		return nil, fmt.Errorf("no peer holds %s", key)
+	}
+	// The rest of the Manifest is paged in from the holders, any of which has the same one
+	limits := swarm.Limits{MaxChunkSize: util.DefaultSwarmChunkSize, MaxSize: util.SwarmMaxFileSize}
+	manifest, err := swarm.AssembleManifest(first, limits, func(page int) (*swarm.ManifestPage, error) {
+		var errs []error
+		for _, holder := range holders {
+			p, err := s.fetchManifestPage(key, holder, page)
+			if err == nil {
+				return p, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("manifest of %s: %w", key, err)
+	}
+	log.Printf("Swarm fetching %d chunks of %s from %d peers", manifest.NumChunks(), key, len(holders))
+	// Among equally loaded holders, the Downloader picks the first, so order them nearest first
+	s.sortByRTT(holders)
+
+	opts := swarm.DownloaderOpts{
+		ParallelChunksPerPeer: util.SwarmParallelChunksPerPeer,
+		MaxChunkRetries:       util.SwarmMaxChunkRetries,
+	}
+	downloader := swarm.NewDownloader(opts, manifest, holders, func(ctx context.Context, peerAddr string, index int) ([]byte, error) {
+		return s.fetchChunkFromPeer(ctx, key, manifest, peerAddr, index)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), util.SwarmDownloadTimeout)
+	defer cancel()
+	return downloader.Download(ctx)
+}
+
+// collectSwarmManifests waits for expected responses to a swarm FETCH, or until util.SwarmManifestTimeout, which hold the first
+// page of the Manifest of every holder. Holders may disagree on the content of a key, so the Manifest held by the most peers wins.
+func collectSwarmManifests(fetchResponseChan chan p2p.FetchResult, expected int) (*swarm.ManifestPage, []string) {
+	var (
+		manifests = make(map[string]*swarm.ManifestPage)
+		holders   = make(map[string][]string)
+		timer     = time.NewTimer(util.SwarmManifestTimeout)
+	)
+	defer timer.Stop()
+
+collect:
+	for responses := 0; responses < expected; responses++ {
+		var result p2p.FetchResult
+		select {
+		case result = <-fetchResponseChan:
+		case <-timer.C:
+			break collect
+		}
+		if !result.FileExists {
+			if result.Error != nil && !errors.Is(result.Error, p2p.ErrNotFound) {
+				log.Printf("No manifest from peer %s: %v", result.PeerAddr, result.Error)
+			}
+			continue
+		}
+		page, err := swarm.PageFromArgs(result.Metadata)
+		if err != nil || page.Page != 0 {
+			log.Printf("Invalid manifest from peer %s: %v", result.PeerAddr, err)
+			continue
+		}
+		// The root covers the size and chunk size too, so manifests are told apart by it alone
+		manifestID := page.Root
+		manifests[manifestID] = page
+		holders[manifestID] = append(holders[manifestID], result.PeerAddr)
+	}
+
+	var picked string
+	for manifestID := range manifests {
+		if len(holders[manifestID]) > len(holders[picked]) {
+			picked = manifestID
+		}
+	}
+	return manifests[picked], holders[picked]
+}
+
+// fetchManifestPage requests the given page of the Manifest of key from the peer with the given address, and waits for it
+func (s *Store) fetchManifestPage(key string, peerAddr string, page int) (*swarm.ManifestPage, error) {
+	s.PeerLock.Lock()
+	peer, peerExists := s.PeerMap[peerAddr]
+	s.PeerLock.Unlock()
+	if !peerExists {
+		return nil, fmt.Errorf("peer %s is gone", peerAddr)
+	}
+
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		From: nil,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_FETCH_CONTROL_COMMAND,
+			Args: map[string]string{
+				"key":   key,
+				"swarm": "true",
+				"page":  strconv.Itoa(page),
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), util.SwarmManifestTimeout)
+	defer cancel()
+	reply, err := s.Transport.Call(ctx, peer, msg)
+	if err != nil {
+		return nil, fmt.Errorf("page %d from %s: %w", page, peerAddr, err)
+	}
+	payload, isControl := reply.Payload.(p2p.ControlPayload)
+	if !isControl {
+		return nil, fmt.Errorf("unexpected %s reply to swarm FETCH from %s", reply.Type, peerAddr)
+	}
+	return swarm.PageFromArgs(payload.Args)
+}
+
+// fetchChunkFromPeer requests the chunk at index of key from the peer with the given address, and waits for it
+func (s *Store) fetchChunkFromPeer(ctx context.Context, key string, manifest *swarm.Manifest, peerAddr string, index int) ([]byte, error) {
+	s.PeerLock.Lock()
+	peer, peerExists := s.PeerMap[peerAddr]
+	s.PeerLock.Unlock()
+	if !peerExists {
+		return nil, fmt.Errorf("peer %s is gone", peerAddr)
+	}
+
+	offset, length := manifest.ChunkRange(index)
+	msg := p2p.Message{
+		Type: p2p.ControlMessageType,
+		From: nil,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_FETCH_CHUNK_CONTROL_COMMAND,
+			Args: map[string]string{
+				"key":    key,
+				"offset": strconv.FormatInt(offset, 10),
+				"length": strconv.FormatInt(length, 10),
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(ctx, util.SwarmChunkTimeout)
+	defer cancel()
+	reply, err := s.Transport.Call(ctx, peer, msg)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d from %s: %w", index, peerAddr, err)
+	}
+	payload, isData := reply.Payload.(p2p.DataPayload)
+	if !isData {
+		return nil, fmt.Errorf("unexpected %s reply to FETCH_CHUNK from %s", reply.Type, peerAddr)
+	}
+	return payload.Data, nil
+}
+
+// handleSwarmFetch replies to a swarm FETCH with the requested page of the Manifest of the file with given key, the first one
+// unless the request names another, if this peer holds it
+func (s *Store) handleSwarmFetch(request *p2p.ControlPayload, key string, fromPeer p2p.Peer) error {
+	page := 0
+	if pageStr, pageExists := request.Args["page"]; pageExists {
+		var err error
+		if page, err = strconv.Atoi(pageStr); err != nil || page < 0 {
+			return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid page for swarm FETCH Control Message %s", fromPeer.String())
+		}
+	}
+	manifest, err := s.swarmManifest(key)
+	if err != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeNotFound, "%s not found on %s", key, s.StoreOpts.ListenAddress)
+	}
+	if page >= manifest.NumPages(util.SwarmManifestPageSize) {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "%s has no manifest page %d", key, page)
+	}
+	msg := p2p.ConstructFetchResponseMessage(true)
+	args := msg.Payload.(p2p.ControlPayload).Args
+	for k, v := range manifest.ToArgs(page, util.SwarmManifestPageSize) {
+		args[k] = v
+	}
+	log.Printf("File found on this machine, sending page %d of the manifest of %d chunks", page, manifest.NumChunks())
+	return s.replyToPeer(request, msg, fromPeer)
+}
+
+// swarmManifest returns the Manifest of the file with given key, which is only built again once the file changes
+func (s *Store) swarmManifest(key string) (*swarm.Manifest, error) {
+	fd, err := s.handleFileOpen(key)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	version := fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano())
+	if manifest, cached := s.swarmManifests.Get(key, version); cached {
+		return manifest, nil
+	}
+	manifest, err := swarm.BuildManifest(fd, util.DefaultSwarmChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	s.swarmManifests.Put(key, version, manifest)
+	return manifest, nil
+}
+
+// handleFetchChunk replies to a FETCH_CHUNK with a DataMessage holding the requested range of the file
+func (s *Store) handleFetchChunk(request *p2p.ControlPayload, fromPeer p2p.Peer) error {
+	var (
+		key, keyExists    = request.Args["key"]
+		offset, offsetErr = strconv.ParseInt(request.Args["offset"], 10, 64)
+		length, lengthErr = strconv.ParseInt(request.Args["length"], 10, 64)
+	)
+	if !keyExists || offsetErr != nil || lengthErr != nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "missing key/offset/length for FETCH_CHUNK Control Message %s", fromPeer.String())
+	}
+	if err := validatePeerKey(key, request.Command, fromPeer); err != nil {
+		return err
+	}
+	if length < 0 || length > util.DefaultSwarmChunkSize {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid length %d for FETCH_CHUNK Control Message %s", length, fromPeer.String())
+	}
+
+	data := make([]byte, length)
+	fd, err := s.handleFileOpen(key)
+	if err == nil {
+		var n int
+		n, err = fd.ReadAt(data, offset)
+		data = data[:n]
+		_ = fd.Close()
+	}
+	if err != nil && err != io.EOF {
+		return p2p.NewRemoteError(p2p.ErrorCodeNotFound, "chunk of %s at offset %d is unavailable: %v", key, offset, err)
+	}
+
+	msg := p2p.Message{
+		Type: p2p.DataMessageType,
+		From: nil,
+		Payload: p2p.DataPayload{
+			Key:  key,
+			Data: data,
+		},
+	}
+	return s.replyToPeer(request, msg, fromPeer)
+}
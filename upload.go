@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"file-store/internal/acl"
+	"file-store/internal/bucket"
+	"file-store/internal/db"
+	"file-store/internal/hints"
+	"file-store/internal/p2p"
+	"file-store/internal/rebalance"
+	"file-store/internal/upload"
+	"file-store/internal/util"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// attachMetadataDB makes the Store persist its metadata in ddb, and enables the features that depend on it
+func (s *Store) attachMetadataDB(ddb *db.DDB) {
+	s.MetadataDB = ddb
+	s.Uploads = upload.NewManager(ddb, path.Join(s.StoreOpts.BaseStorageLocation, util.UploadStagingDirName), upload.ManagerOpts{
+		MaxAge: util.DefaultUploadMaxAge,
+	})
+	s.Hints = hints.NewManager(ddb, path.Join(s.StoreOpts.BaseStorageLocation, util.HintsDirName), hints.ManagerOpts{
+		MaxBytes: util.DefaultHintsMaxBytes,
+		MaxAge:   util.DefaultHintMaxAge,
+	})
+	if err := s.Peers.AttachDB(ddb); err != nil {
+		log.Println("Error while loading known peers:", err)
+	}
+	if err := s.Audit.AttachDB(ddb); err != nil {
+		log.Println("Error while loading the head of the audit log:", err)
+	}
+	registry, err := bucket.NewRegistry(ddb)
+	if err != nil {
+		log.Println("Error while loading buckets:", err)
+	} else {
+		s.Buckets = registry
+	}
+	principals, err := acl.NewRegistry(ddb)
+	if err != nil {
+		log.Println("Error while loading principals:", err)
+	} else {
+		s.ACL = principals
+	}
+	if len(s.StoreOpts.RaftPeers) > 0 {
+		node, err := newStoreRaftNode(s, ddb)
+		if err != nil {
+			log.Println("Error while loading Raft state:", err)
+			return
+		}
+		s.Raft = node
+	}
+}
+
+// finalizeUpload moves the staged bytes of a complete upload session into storage, replicating them to peers if toReplicate is set
+func (s *Store) finalizeUpload(session *upload.Session, toReplicate bool) error {
+	staged, err := s.Uploads.Open(session.ID)
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+
+	if toReplicate {
+		err = s.handleStoreFile(session.Key, staged)
+	} else {
+		err = s.handleReplicaWrite(session.Key, staged, session.Version)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Upload %s of %s is complete", session.ID, session.Key)
+	return s.Uploads.Remove(session.ID)
+}
+
+// handleResumableStoreStream consumes a resumable STORE stream of size bytes from fromPeer into its upload session.
+// If the stream doesn't start at the committed offset or ends early, the sender is told where to continue from. A session
+// is only continued by the node that started it, and with the same key.
+func (s *Store) handleResumableStoreStream(args map[string]string, stream io.Reader, size int64, fromPeer p2p.Peer) error {
+	var (
+		key               = args["key"]
+		uploadID          = args["upload_id"]
+		offset, offsetErr = strconv.ParseInt(args["offset"], 10, 64)
+		total, totalErr   = strconv.ParseInt(args["total"], 10, 64)
+	)
+	defer s.beginTransfer()()
+
+	if offsetErr != nil || totalErr != nil {
+		return fmt.Errorf("invalid offset/total for resumable STORE Control Message %s", fromPeer.String())
+	}
+	if s.Uploads == nil {
+		// Without a metadata DB, only a stream that carries the whole file can be accepted
+		if offset != 0 || size != total {
+			return fmt.Errorf("cannot resume upload %s without a metadata DB", uploadID)
+		}
+		return s.handleReplicaWrite(key, stream, args)
+	}
+
+	session, err := s.Uploads.Get(uploadID)
+	if errors.Is(err, upload.ErrSessionNotFound) {
+		session, err = s.Uploads.Create(uploadID, key, total, args["origin"], versionArgsIn(args))
+	} else if err == nil && (session.Key != key || session.Origin == "" || session.Origin != args["origin"] || !s.isPeerAt(fromPeer, session.Origin)) {
+		return p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "upload %s isn't an upload of %s by %s", uploadID, key, fromPeer.String())
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reading resumable stream of upload %s at offset %d of %d", uploadID, offset, total)
+	session, err = s.Uploads.Patch(uploadID, offset, stream)
+	if errors.Is(err, upload.ErrOffsetMismatch) {
+		log.Printf("Upload %s is at offset %d, but the stream started at %d", uploadID, session.Offset, offset)
+		return s.sendMessageToPeer(p2p.ConstructUploadOffsetMessage(uploadID, key, session.Offset, session.Size), fromPeer)
+	}
+	if err != nil {
+		if session != nil {
+			log.Printf("Upload %s was interrupted at offset %d", uploadID, session.Offset)
+		}
+		return err
+	}
+	if !session.IsComplete() {
+		// The stream ended early, so ask for the rest
+		return s.sendMessageToPeer(p2p.ConstructUploadOffsetMessage(uploadID, key, session.Offset, session.Size), fromPeer)
+	}
+	return s.finalizeUpload(session, false)
+}
+
+// streamFileToPeer sends a resumable STORE control message to toPeer, and streams the stored file of key from offset onwards
+func (s *Store) streamFileToPeer(key string, uploadID string, offset int64, toPeer p2p.Peer) error {
+	return s.streamVersionToPeer(key, "", uploadID, offset, toPeer)
+}
+
+// streamVersionToPeer streams the version of the stored file of key with the given checksum to toPeer, like streamFileToPeer
+// does with the current version
+func (s *Store) streamVersionToPeer(key string, checksum string, uploadID string, offset int64, toPeer p2p.Peer) error {
+	fd, version, err := s.openVersion(key, checksum)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return s.streamToPeer(key, fd, versionArgs(version), uploadID, offset, toPeer, nil)
+}
+
+// streamVersionsToPeer streams every version of the stored file of key to toPeer, the current one first and then its siblings
+func (s *Store) streamVersionsToPeer(key string, toPeer p2p.Peer) error {
+	if err := s.streamFileToPeer(key, upload.NewSessionID(), 0, toPeer); err != nil {
+		return err
+	}
+	metadata, err := s.getLiveFileMetadata(key)
+	if err != nil || metadata == nil {
+		return err
+	}
+	for _, sibling := range metadata.Siblings {
+		if err := s.streamVersionToPeer(key, sibling.Checksum, upload.NewSessionID(), 0, toPeer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamToPeer streams the content of fd to toPeer as the version of the file of key that the version args describe, like
+// streamFileToPeer does with the stored file. The stream is paced by limiter, unless it is nil.
+func (s *Store) streamToPeer(key string, fd *os.File, version map[string]string, uploadID string, offset int64, toPeer p2p.Peer, limiter *rebalance.Limiter) error {
+	defer s.beginTransfer()()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	total := info.Size()
+	if offset > total {
+		return fmt.Errorf("offset %d is beyond the size %d of %s", offset, total, key)
+	}
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Every transfer gets a stream of its own, so that it runs alongside the messages and the other transfers to toPeer
+	stream, err := toPeer.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// Open it with a STORE control message with the necessary information to allow the peer to read the stream
+	args := map[string]string{
+		"key":       key,
+		"size":      strconv.FormatInt(total-offset, 10),
+		"upload_id": uploadID,
+		"offset":    strconv.FormatInt(offset, 10),
+		"total":     strconv.FormatInt(total, 10),
+		"origin":    s.normalizedListenAddress(),
+	}
+	for name, value := range version {
+		args[name] = value
+	}
+	message := p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_STORE_CONTROL_COMMAND,
+			Args:    args,
+		},
+	}
+	if err := s.encodeMessage(message, toPeer, stream); err != nil {
+		return err
+	}
+
+	// And stream the file contents right after it
+	if n, err := io.Copy(stream, limiter.Reader(context.Background(), fd)); err != nil {
+		return err
+	} else if n != total-offset {
+		log.Printf("Streaming issue: Number of bytes streamed=%d and Number of bytes to stream=%d do not match", n, total-offset)
+	}
+
+	// The peer closes its end once it handled the stream, or resets it if that failed, so wait for that before the transfer
+	// counts as over
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, stream)
+	return err
+}
+
+// resumeStoreToPeer continues streaming upload uploadID of key to toPeer from offset.
+// If the stored file no longer has the size the upload was started with, a fresh upload is started instead.
+func (s *Store) resumeStoreToPeer(key string, uploadID string, offset int64, total int64, toPeer p2p.Peer) error {
+	fd, err := s.handleFileOpen(key)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	_ = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != total {
+		log.Printf("File %s changed since upload %s started, restarting upload to %s", key, uploadID, toPeer.String())
+		return s.streamFileToPeer(key, upload.NewSessionID(), 0, toPeer)
+	}
+	if offset >= total {
+		log.Printf("Upload %s of %s to %s is already complete", uploadID, key, toPeer.String())
+		return nil
+	}
+	log.Printf("Resuming upload %s of %s to %s from offset %d", uploadID, key, toPeer.String(), offset)
+	return s.streamFileToPeer(key, uploadID, offset, toPeer)
+}
+
+// requestUploadResumption tells peer, which listens on listenAddr, the committed offsets of the incomplete uploads it was streaming
+// to us, so that it continues them. Uploads are matched to peer by the listen address they originate from, which is the remote
+// address of the connections we dial, and is learned from the first PING of the peers that dial us.
+func (s *Store) requestUploadResumption(peer p2p.Peer, listenAddr string) {
+	if s.Uploads == nil {
+		return
+	}
+	sessions, err := s.Uploads.List()
+	if err != nil {
+		log.Printf("Error while listing upload sessions: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		if session.Origin == "" || session.Origin != listenAddr || session.IsComplete() {
+			continue
+		}
+		msg := p2p.ConstructUploadOffsetMessage(session.ID, session.Key, session.Offset, session.Size)
+		if err := s.sendMessageToPeer(msg, peer); err != nil {
+			log.Printf("Error while requesting resumption of upload %s from %s: %v", session.ID, peer.String(), err)
+		}
+	}
+}
+
+// runUploadExpiry abandons the upload sessions that stalled for longer than their max age, every UploadExpiryInterval
+func (s *Store) runUploadExpiry() {
+	if s.Uploads == nil {
+		return
+	}
+	ticker := time.NewTicker(util.UploadExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := s.Uploads.Expire()
+			if err != nil {
+				log.Println("Error while expiring upload sessions:", err)
+			}
+			if expired > 0 {
+				log.Printf("Expired %d stalled upload sessions", expired)
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
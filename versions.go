@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-store/internal/p2p"
+	"file-store/internal/util"
+	"file-store/internal/vclock"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// The args of the STORE and DATA messages replicating a file that describe the version of it they carry
+const (
+	clockArg      = "clock"
+	modifiedAtArg = "modified_at"
+)
+
+// Version is a version of a file along with its content, as handed to a ConflictResolver
+type Version struct {
+	FileMetadata
+	Data []byte
+}
+
+// ConflictResolver picks the content that the conflicting versions of a file are resolved to
+type ConflictResolver interface {
+	Resolve(key string, versions []Version) ([]byte, error)
+}
+
+// LastWriterWins resolves conflicting versions to the one written last, which is the version every replica serves until then
+type LastWriterWins struct{}
+
+func (LastWriterWins) Resolve(key string, versions []Version) ([]byte, error) {
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no versions of %s to resolve", key)
+	}
+	latest := versions[0]
+	for _, version := range versions[1:] {
+		if version.lastWriteAfter(latest.FileMetadata) {
+			latest = version
+		}
+	}
+	return latest.Data, nil
+}
+
+// MergeFunc adapts a function merging the conflicting versions of a file into one into a ConflictResolver
+type MergeFunc func(key string, versions []Version) ([]byte, error)
+
+func (f MergeFunc) Resolve(key string, versions []Version) ([]byte, error) {
+	return f(key, versions)
+}
+
+// versionArgs returns the args that the given version of a file is replicated with, or nil if it isn't versioned
+func versionArgs(version FileMetadata) map[string]string {
+	if version.Clock == nil {
+		return nil
+	}
+	return map[string]string{
+		clockArg:      version.Clock.String(),
+		modifiedAtArg: version.ModifiedAt.Format(time.RFC3339Nano),
+	}
+}
+
+// versionArgsIn returns the args among args that describe the version of a file, as set by versionArgs
+func versionArgsIn(args map[string]string) map[string]string {
+	if _, versioned := args[clockArg]; !versioned {
+		return nil
+	}
+	return map[string]string{clockArg: args[clockArg], modifiedAtArg: args[modifiedAtArg]}
+}
+
+// withVersionArgs returns a copy of msg carrying the version args of the given version of a file
+func withVersionArgs(msg p2p.Message, version FileMetadata) p2p.Message {
+	for name, value := range versionArgs(version) {
+		msg = msg.WithArg(name, value)
+	}
+	return msg
+}
+
+// parseVersion returns the version described by the version args among args, or nil if there are none
+func parseVersion(args map[string]string) (*FileMetadata, error) {
+	encoded, versioned := args[clockArg]
+	if !versioned {
+		return nil, nil
+	}
+	clock, err := vclock.Parse(encoded)
+	if err != nil {
+		return nil, p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid %s: %v", clockArg, err)
+	}
+	modifiedAt, err := time.Parse(time.RFC3339Nano, args[modifiedAtArg])
+	if err != nil {
+		return nil, p2p.NewRemoteError(p2p.ErrorCodeInvalidRequest, "invalid %s: %v", modifiedAtArg, err)
+	}
+	return &FileMetadata{Clock: clock, ModifiedAt: modifiedAt}, nil
+}
+
+// lockVersions locks the versions of the file of key, so that they are read and replaced by one write at a time, and returns
+// the function unlocking them
+func (s *Store) lockVersions(key string) func() {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	lock := &s.versionLocks[hash.Sum32()%uint32(len(s.versionLocks))]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// siblingsPath returns the directory that the content of the siblings of the file of key is stored in, by checksum
+func (s *Store) siblingsPath(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.StoreOpts.BaseStorageLocation, util.SiblingsDirName, hex.EncodeToString(hash[:]))
+}
+
+// siblingPath returns the path that the content of the sibling of the file of key with the given checksum is stored at
+func (s *Store) siblingPath(key string, checksum string) string {
+	return filepath.Join(s.siblingsPath(key), checksum)
+}
+
+// filePath returns the path that the content of the current version of the file of key is stored at
+func (s *Store) filePath(key string) string {
+	f := s.localFile(key)
+	return path.Join(f.BasePath, f.KeyPath)
+}
+
+// writeLocalVersion writes the content read from r as a new version of the file of key, made by this node on top of the versions
+// that seen saw, or on top of every version held if seen is nil. The versions held that seen didn't see are kept as siblings.
+// The version written is returned, which is the current one unless a sibling kept was written after it.
+func (s *Store) writeLocalVersion(key string, r io.Reader, seen vclock.Clock) (FileMetadata, error) {
+	defer s.lockVersions(key)()
+	current, err := s.getFileMetadata(key)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	version := FileMetadata{ModifiedAt: time.Now()}
+	// Without a metadata DB, the clock of the file couldn't be kept, so its versions are told apart by when they were written
+	if s.MetadataDB != nil {
+		if seen == nil && current != nil {
+			seen = current.seen()
+		}
+		version.Clock = seen.Increment(s.normalizedListenAddress())
+	}
+	return s.writeVersion(key, r, version, current)
+}
+
+// handleReplicaWrite writes the content read from r as the version of the file of key that args describe, which a peer replicated
+// to us. Versions that a version held saw are discarded, and the ones conflicting with the versions held are kept as siblings.
+// Files replicated without a version are written as a new version of our own, like handleFileWrite does.
+func (s *Store) handleReplicaWrite(key string, r io.Reader, args map[string]string) error {
+	version, err := parseVersion(args)
+	if err != nil {
+		return err
+	}
+	if err := s.checkReplicaBucket(key, version); errors.Is(err, errReplicaExpired) {
+		log.Printf("Dropping a replica of %s, which expired already", key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if version == nil || s.MetadataDB == nil {
+		_, err := s.handleFileWrite(key, r)
+		return err
+	}
+
+	defer s.lockVersions(key)()
+	current, err := s.getFileMetadata(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.writeVersion(key, r, *version, current)
+	return err
+}
+
+// writeVersion writes the content read from r as the given version of the file of key, where current holds the versions held.
+// The caller holds the version lock of key.
+func (s *Store) writeVersion(key string, r io.Reader, version FileMetadata, current *FileMetadata) (FileMetadata, error) {
+	// A version that the delete of the file saw stays deleted, while one written after it, or concurrently with it, brings it back
+	if current != nil && current.deleted() {
+		if !version.newerThan(current) {
+			log.Printf("Discarding a version of %s, which was deleted since", key)
+			_, err := io.Copy(io.Discard, r)
+			return version, err
+		}
+		current = nil
+	}
+	// A version that saw every version held replaces them all, which is the case for every write that doesn't conflict
+	if current == nil || version.Clock.Descends(current.seen()) {
+		written, err := s.writeFile(key, r, version)
+		if err == nil && current != nil {
+			s.removeSiblingFiles(key, current.Siblings)
+		}
+		return written, err
+	}
+	return s.mergeVersion(key, r, version, *current)
+}
+
+// deleteFile deletes the file of key held here, and keeps a tombstone of it in place of its metadata. Anti-entropy replicates the
+// tombstone to the other owners of key, so that they delete their replicas too rather than push the file back. Without a metadata
+// DB, the file is only deleted here. os.ErrNotExist is returned if no file of key is held.
+func (s *Store) deleteFile(key string) error {
+	if s.MetadataDB == nil {
+		return s.handleFileDelete(key)
+	}
+	defer s.lockVersions(key)()
+	current, err := s.getFileMetadata(key)
+	if err != nil {
+		return err
+	}
+	var seen vclock.Clock
+	switch {
+	case current == nil && !s.existsInStorage(key), current != nil && current.deleted():
+		return os.ErrNotExist
+	case current != nil:
+		seen = current.seen()
+	}
+	deletedAt := time.Now()
+	return s.writeTombstone(key, FileMetadata{ModifiedAt: deletedAt, Clock: seen.Increment(s.normalizedListenAddress()), DeletedAt: &deletedAt})
+}
+
+// handleDeleteFile deletes the file of key like deleteFile does, and sends the tombstone to the other owners of it, so that they
+// delete their replicas right away rather than on the next round of anti-entropy. The owners that miss it, because they are down
+// or the message is lost, get the tombstone from anti-entropy. Without a file of key held here, the owners are still asked to
+// delete theirs, which they do on top of the versions they hold.
+func (s *Store) handleDeleteFile(key string) error {
+	deleteErr := s.deleteFile(key)
+	if deleteErr != nil && !errors.Is(deleteErr, os.ErrNotExist) {
+		return deleteErr
+	}
+	msg := constructDeleteMessage(key, FileMetadata{})
+	tombstone, err := s.getFileMetadata(key)
+	if err != nil {
+		return err
+	}
+	if tombstone != nil && tombstone.deleted() {
+		msg = constructDeleteMessage(key, *tombstone)
+	}
+	if err := s.multicastMessage(msg, s.replicaPeers(key, 0)).Err(); err != nil {
+		log.Printf("Couldn't send the DELETE of %s to every owner: %v", key, err)
+	}
+	return deleteErr
+}
+
+// handleReplicaDelete applies the tombstone of the file of key that args describe, which a peer replicated to us. The versions it
+// saw are deleted, while a version written concurrently with the delete is kept, and replaces the tombstone on the peer in turn.
+// Concurrent tombstones are merged into one. A DELETE without a version deletes the versions held, like deleteFile does.
+func (s *Store) handleReplicaDelete(key string, args map[string]string) error {
+	tombstone, err := parseVersion(args)
+	if err != nil {
+		return err
+	}
+	if tombstone == nil {
+		if err := s.deleteFile(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if s.MetadataDB == nil {
+		return p2p.NewRemoteError(p2p.ErrorCodeUnavailable, "no metadata DB on %s", s.StoreOpts.ListenAddress)
+	}
+	if err := s.checkReplicaBucket(key, tombstone); errors.Is(err, errReplicaExpired) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	deletedAt := tombstone.ModifiedAt
+	tombstone.DeletedAt = &deletedAt
+
+	defer s.lockVersions(key)()
+	current, err := s.getFileMetadata(key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current == nil || tombstone.supersedes(*current):
+		return s.writeTombstone(key, *tombstone)
+	case current.deleted():
+		merged := *current
+		merged.Clock = merged.Clock.Merge(tombstone.Clock)
+		if tombstone.ModifiedAt.After(merged.ModifiedAt) {
+			merged.ModifiedAt, merged.DeletedAt = tombstone.ModifiedAt, tombstone.DeletedAt
+		}
+		return s.recordFileMetadata(key, merged)
+	default:
+		log.Printf("Keeping %s, which was written concurrently with its delete", key)
+		return nil
+	}
+}
+
+// writeTombstone deletes the file of key held here, if any, along with its siblings, and records tombstone in place of its
+// metadata. The caller holds the version lock of key.
+func (s *Store) writeTombstone(key string, tombstone FileMetadata) error {
+	if err := s.handleFileDelete(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.RemoveAll(s.siblingsPath(key)); err != nil {
+		log.Printf("Error while deleting siblings of %s: %v", key, err)
+	}
+	return s.recordFileMetadata(key, tombstone)
+}
+
+// constructDeleteMessage constructs and returns a MESSAGE_DELETE_CONTROL_COMMAND message replicating the given tombstone of the
+// file of key
+func constructDeleteMessage(key string, tombstone FileMetadata) p2p.Message {
+	args := map[string]string{"key": key}
+	for name, value := range versionArgs(tombstone) {
+		args[name] = value
+	}
+	return p2p.Message{
+		Type: p2p.ControlMessageType,
+		Payload: p2p.ControlPayload{
+			Command: p2p.MESSAGE_DELETE_CONTROL_COMMAND,
+			Args:    args,
+		},
+	}
+}
+
+// mergeVersion adds the given version of the file of key, read from r, to the versions current holds. The content is staged first,
+// since whether it is kept, and where, depends on its checksum. The versions it saw are dropped, and among the versions left, the
+// one written last is the current one, which is served, while the others are kept as its siblings.
+func (s *Store) mergeVersion(key string, r io.Reader, version FileMetadata, current FileMetadata) (FileMetadata, error) {
+	if err := os.MkdirAll(s.siblingsPath(key), util.Default); err != nil {
+		return version, err
+	}
+	staged, err := os.CreateTemp(s.siblingsPath(key), ".staged-*")
+	if err != nil {
+		return version, err
+	}
+	// Once the staged content is moved into place, removing it is a no-op
+	defer os.Remove(staged.Name())
+	checksum := sha256.New()
+	version.Size, err = io.Copy(io.MultiWriter(staged, checksum), r)
+	if err == nil {
+		err = staged.Sync()
+	}
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return version, err
+	}
+	s.Capacity.Add(version.Size)
+	version.Checksum = hex.EncodeToString(checksum.Sum(nil))
+
+	held := current.versions()
+	for _, other := range held {
+		if other.Clock.Descends(version.Clock) {
+			log.Printf("Discarding a version of %s, which the versions held already saw", key)
+			_ = os.Remove(staged.Name())
+			s.removeSiblingFiles(key, nil)
+			return version, nil
+		}
+	}
+	// The same content written concurrently on different nodes isn't a conflict, so those versions become one
+	for _, other := range held {
+		if other.Checksum == version.Checksum {
+			version.Clock = version.Clock.Merge(other.Clock)
+			if other.ModifiedAt.After(version.ModifiedAt) {
+				version.ModifiedAt = other.ModifiedAt
+			}
+		}
+	}
+	var (
+		kept   []FileMetadata
+		winner = version
+	)
+	for _, other := range held {
+		if version.Clock.Descends(other.Clock) {
+			continue
+		}
+		kept = append(kept, other)
+		if other.lastWriteAfter(winner) {
+			winner = other
+		}
+	}
+
+	// Move the content of every version into place, which is the path of the file for the winner, and the siblings path for the rest
+	var dropped []FileMetadata
+	for _, sibling := range current.Siblings {
+		if !containsVersion(kept, sibling.Checksum) {
+			dropped = append(dropped, sibling)
+		}
+	}
+	s.removeSiblingFiles(key, dropped)
+	filePath := s.filePath(key)
+	// The current version is linked rather than moved to the siblings path, so that the file is never missing for readers
+	if winner.Checksum != current.Checksum && containsVersion(kept, current.Checksum) {
+		if err := os.Link(filePath, s.siblingPath(key, current.Checksum)); err != nil {
+			return version, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), util.Default); err != nil {
+		return version, err
+	}
+	if winner.Checksum != version.Checksum && winner.Checksum != current.Checksum {
+		if err := os.Rename(s.siblingPath(key, winner.Checksum), filePath); err != nil {
+			return version, err
+		}
+	}
+	target := s.siblingPath(key, version.Checksum)
+	if winner.Checksum == version.Checksum {
+		target = filePath
+	}
+	if err := os.Rename(staged.Name(), target); err != nil {
+		return version, err
+	}
+
+	merged := winner
+	merged.Siblings = nil
+	for _, other := range append(kept, version) {
+		if other.Checksum != winner.Checksum {
+			merged.Siblings = append(merged.Siblings, other)
+		}
+	}
+	if len(merged.Siblings) > 0 {
+		log.Printf("Keeping %d conflicting versions of %s as siblings", len(merged.Siblings), key)
+	}
+	if err := s.recordFileMetadata(key, merged); err != nil {
+		return version, err
+	}
+	s.announceKey(key)
+	return version, nil
+}
+
+// containsVersion reports whether one of versions has the given checksum
+func containsVersion(versions []FileMetadata, checksum string) bool {
+	for _, version := range versions {
+		if version.Checksum == checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSiblingFiles removes the content of the given siblings of the file of key, and the siblings path of key once it is empty
+func (s *Store) removeSiblingFiles(key string, siblings []FileMetadata) {
+	for _, sibling := range siblings {
+		if err := os.Remove(s.siblingPath(key, sibling.Checksum)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error while removing a sibling of %s: %v", key, err)
+		}
+	}
+	_ = os.Remove(s.siblingsPath(key))
+}
+
+// openVersion opens the content of the version of the file of key with the given checksum, which is either the current version or
+// one of its siblings, or the current version if checksum is empty. The version is returned along with it.
+func (s *Store) openVersion(key string, checksum string) (*os.File, FileMetadata, error) {
+	defer s.lockVersions(key)()
+	current, err := s.getLiveFileMetadata(key)
+	if err != nil {
+		return nil, FileMetadata{}, err
+	}
+	if current == nil {
+		// Files stored without a metadata DB have a single unversioned version
+		fd, err := s.handleFileOpen(key)
+		return fd, FileMetadata{}, err
+	}
+	for i, version := range current.versions() {
+		if checksum != "" && version.Checksum != checksum {
+			continue
+		}
+		if i == 0 {
+			fd, err := s.handleFileOpen(key)
+			return fd, version, err
+		}
+		fd, err := os.Open(s.siblingPath(key, version.Checksum))
+		return fd, version, err
+	}
+	return nil, FileMetadata{}, os.ErrNotExist
+}
+
+// readVersions reads the content of every version of the file of key, current first
+func (s *Store) readVersions(key string) ([]Version, error) {
+	current, err := s.getLiveFileMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, os.ErrNotExist
+	}
+	var versions []Version
+	for _, metadata := range current.versions() {
+		fd, version, err := s.openVersion(key, metadata.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(fd)
+		_ = fd.Close()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = s.decodeContent(key, data); err != nil {
+			return nil, err
+		}
+		versions = append(versions, Version{FileMetadata: version, Data: data})
+	}
+	return versions, nil
+}
+
+// resolveConflict resolves the versions of the file of key held to the content read from r, or to the content picked by the
+// ConflictResolver if r is nil. It is stored and replicated as a version that saw every one of them, so that it replaces them
+// on every replica, while the versions that arrive meanwhile are kept as its siblings.
+func (s *Store) resolveConflict(key string, r io.Reader) error {
+	current, err := s.getLiveFileMetadata(key)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return os.ErrNotExist
+	}
+	if r == nil {
+		versions, err := s.readVersions(key)
+		if err != nil {
+			return err
+		}
+		resolver := s.StoreOpts.ConflictResolver
+		if resolver == nil {
+			resolver = LastWriterWins{}
+		}
+		data, err := resolver.Resolve(key, versions)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	return s.storeFile(key, r, current.seen())
+}
+
+// handleGetSiblings serves the versions held of a file, current first
+func (s *Store) handleGetSiblings(w http.ResponseWriter, r *http.Request) {
+	current, err := s.getLiveFileMetadata(requestKey(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if current == nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(current.versions()); err != nil {
+		log.Println("Error while writing versions:", err)
+	}
+}
+
+// handleGetSibling serves the content of the version of a file with the given checksum
+func (s *Store) handleGetSibling(w http.ResponseWriter, r *http.Request) {
+	key := requestKey(r)
+	fd, _, err := s.openVersion(key, r.PathValue("checksum"))
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+	content, err := s.decodeReader(key, fd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, content); err != nil {
+		log.Println("Error while writing version:", err)
+	}
+}
+
+// handleResolveSiblings resolves the versions held of a file to the content of the body, or to the content picked by the
+// ConflictResolver if the body is empty, and serves the versions left
+func (s *Store) handleResolveSiblings(w http.ResponseWriter, r *http.Request) {
+	key := requestKey(r)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var resolution io.Reader
+	if len(body) > 0 {
+		resolution = bytes.NewReader(body)
+	}
+	err = s.resolveConflict(key, resolution)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+	s.handleGetSiblings(w, r)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"file-store/internal/vclock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitVersions waits until node i holds the given number of versions of key, and returns them, current first
+func (c *testCluster) waitVersions(i int, key string, count int) []FileMetadata {
+	c.t.Helper()
+	var versions []FileMetadata
+	assert.Eventually(c.t, func() bool {
+		metadata, err := c.Nodes[i].getFileMetadata(key)
+		if err != nil || metadata == nil {
+			return false
+		}
+		versions = metadata.versions()
+		return len(versions) == count
+	}, 5*time.Second, 10*time.Millisecond)
+	return versions
+}
+
+func TestVersionsOrderWritesAndDiscardStaleOnes(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster.Store(0, "doc", []byte("first"))
+	first := cluster.waitVersions(1, "doc", 1)[0]
+	assert.Equal(t, vclock.Clock{clusterNodeAddr(0): 1}, first.Clock)
+
+	// A write on top of the replicated one replaces it on both nodes, wherever it is made
+	cluster.Store(1, "doc", []byte("second"))
+	assert.Eventually(t, func() bool {
+		data, err := cluster.Nodes[0].handleFileRead("doc")
+		return err == nil && string(data) == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+	second := cluster.waitVersions(0, "doc", 1)[0]
+	assert.Equal(t, vclock.After, second.Clock.Compare(first.Clock))
+
+	// And the first version arriving late, e.g, from a hint, is discarded rather than overwriting it
+	assert.Nil(t, cluster.Nodes[0].handleReplicaWrite("doc", strings.NewReader("first"), versionArgs(first)))
+	data, err := cluster.Nodes[0].handleFileRead("doc")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(data))
+	assert.Len(t, cluster.waitVersions(0, "doc", 1), 1)
+}
+
+func TestConcurrentWritesAreKeptAsSiblingsUntilResolved(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+
+	// Both nodes write the file while they can't reach each other, and learn of the other write once they can again
+	cluster.Isolate(1)
+	cluster.Store(0, "doc", []byte("written on 0"))
+	cluster.Store(1, "doc", []byte("written on 1"))
+	cluster.Rejoin(1)
+	versions := cluster.waitVersions(0, "doc", 2)
+	assert.Equal(t, versions, cluster.waitVersions(1, "doc", 2))
+	assert.Equal(t, vclock.Concurrent, versions[0].Clock.Compare(versions[1].Clock))
+
+	// Until they are resolved, both nodes serve the same version, and every version can be read over the HTTP API
+	current, err := cluster.Nodes[0].handleFileRead("doc")
+	assert.Nil(t, err)
+	other, err := cluster.Nodes[1].handleFileRead("doc")
+	assert.Nil(t, err)
+	assert.Equal(t, current, other)
+	handler := cluster.Nodes[1].newHTTPHandler()
+	var contents []string
+	for _, version := range versions {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/siblings/doc/"+version.Checksum, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		contents = append(contents, w.Body.String())
+	}
+	sort.Strings(contents)
+	assert.Equal(t, []string{"written on 0", "written on 1"}, contents)
+
+	// Resolving them on one node replaces both on every node
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/siblings/doc/resolve", strings.NewReader("merged")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resolved []FileMetadata
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resolved))
+	assert.Len(t, resolved, 1)
+	for i := range cluster.Nodes {
+		assert.Eventually(t, func() bool {
+			data, err := cluster.Nodes[i].handleFileRead("doc")
+			return err == nil && string(data) == "merged"
+		}, 5*time.Second, 10*time.Millisecond)
+		version := cluster.waitVersions(i, "doc", 1)[0]
+		assert.True(t, version.Clock.Descends(versions[0].Clock))
+		assert.True(t, version.Clock.Descends(versions[1].Clock))
+	}
+}
+
+func TestConflictResolverMergesSiblings(t *testing.T) {
+	cluster := startTestCluster(&testCluster{t: t, configure: func(opts *StoreOpts) {
+		opts.ConflictResolver = MergeFunc(func(key string, versions []Version) ([]byte, error) {
+			var lines []string
+			for _, version := range versions {
+				lines = append(lines, string(version.Data))
+			}
+			sort.Strings(lines)
+			return []byte(strings.Join(lines, "\n")), nil
+		})
+	}}, 1)
+	store := cluster.Nodes[0]
+	cluster.Store(0, "doc", []byte("local"))
+
+	// A version written elsewhere without seeing the local one conflicts with it
+	remote := FileMetadata{Clock: vclock.Clock{"127.0.0.1:9999": 1}, ModifiedAt: time.Now().Add(-time.Hour)}
+	assert.Nil(t, store.handleReplicaWrite("doc", strings.NewReader("remote"), versionArgs(remote)))
+	versions := cluster.waitVersions(0, "doc", 2)
+	data, err := store.handleFileRead("doc")
+	assert.Nil(t, err)
+	assert.Equal(t, "local", string(data), "the version written last is served until the conflict is resolved")
+
+	// Resolving without content of its own merges them with the ConflictResolver
+	assert.Nil(t, store.resolveConflict("doc", nil))
+	data, err = store.handleFileRead("doc")
+	assert.Nil(t, err)
+	assert.Equal(t, "local\nremote", string(data))
+	merged := cluster.waitVersions(0, "doc", 1)[0]
+	assert.True(t, merged.Clock.Descends(versions[0].Clock.Merge(versions[1].Clock)))
+
+	// LastWriterWins picks the version written last
+	picked, err := LastWriterWins{}.Resolve("doc", []Version{
+		{FileMetadata: FileMetadata{Checksum: "a", ModifiedAt: time.Now()}, Data: []byte("newer")},
+		{FileMetadata: FileMetadata{Checksum: "b", ModifiedAt: time.Now().Add(-time.Minute)}, Data: []byte("older")},
+	})
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal([]byte("newer"), picked))
+}